@@ -0,0 +1,208 @@
+// Package backup collects consistent backups of the whole cluster.
+package backup
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"go-kvdb/config"
+	"go-kvdb/db"
+	"go-kvdb/web"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ManifestFile is the name of the manifest in every backup directory.
+const ManifestFile = "manifest.json"
+
+// Manifest describes a backup set: one backup per shard, all labelled
+// with the same label and taken with the same topology epoch.
+type Manifest struct {
+	Label   string        `json:"label"`
+	Epoch   int64         `json:"epoch"`
+	Created time.Time     `json:"created"`
+	Shards  []ShardBackup `json:"shards"`
+}
+
+// ShardBackup describes the backup of a single shard.
+type ShardBackup struct {
+	Name    string `json:"name"`
+	Idx     int    `json:"idx"`
+	Address string `json:"address"`
+	File    string `json:"file"`
+	Size    int64  `json:"size"`
+	SHA256  string `json:"sha256"`
+}
+
+// Label returns the label for a backup set taken at the time.
+func Label(t time.Time, epoch int64) string {
+	return fmt.Sprintf("%s-epoch%d", t.UTC().Format("20060102T150405Z"), epoch)
+}
+
+// Cluster downloads the backups of all shards in parallel into a new
+// directory named after the backup label inside dir, and writes the
+// manifest once every shard backup has been verified.
+func Cluster(ctx context.Context, c config.Config, dir string) (Manifest, error) {
+	client, err := config.NewClient(c.Node.TLS)
+	if err != nil {
+		return Manifest{}, err
+	}
+
+	now := time.Now()
+	m := Manifest{
+		Label:   Label(now, c.Epoch),
+		Epoch:   c.Epoch,
+		Created: now.UTC(),
+		Shards:  make([]ShardBackup, len(c.Shards)),
+	}
+
+	out := filepath.Join(dir, m.Label)
+	if err := os.MkdirAll(out, 0700); err != nil {
+		return Manifest{}, err
+	}
+
+	errs := make([]error, len(c.Shards))
+	var wg sync.WaitGroup
+	for i, s := range c.Shards {
+		wg.Add(1)
+		go func(i int, s config.Shard) {
+			defer wg.Done()
+			m.Shards[i], errs[i] = fetchShard(ctx, client, s, c.Epoch, out)
+		}(i, s)
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			os.RemoveAll(out)
+			return Manifest{}, fmt.Errorf("backing up shard %q: %w", c.Shards[i].Name, err)
+		}
+	}
+
+	if err := WriteManifest(out, m); err != nil {
+		os.RemoveAll(out)
+		return Manifest{}, err
+	}
+	return m, nil
+}
+
+func fetchShard(ctx context.Context, client *config.Client, s config.Shard, epoch int64, dir string) (ShardBackup, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, client.URL(s.Address, "/admin/backup"), nil)
+	if err != nil {
+		return ShardBackup{}, err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return ShardBackup{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return ShardBackup{}, fmt.Errorf("shard returned %s", resp.Status)
+	}
+
+	// Refuse backups from nodes that disagree with our view of the
+	// cluster: the set would not be consistent.
+	if idx := resp.Header.Get(web.ShardHeader); idx != strconv.Itoa(s.Idx) {
+		return ShardBackup{}, fmt.Errorf("node at %s is shard %q, want %d", s.Address, idx, s.Idx)
+	}
+	if e := resp.Header.Get(web.EpochHeader); e != strconv.FormatInt(epoch, 10) {
+		return ShardBackup{}, fmt.Errorf("node at %s has topology epoch %q, want %d", s.Address, e, epoch)
+	}
+
+	b := ShardBackup{
+		Name:    s.Name,
+		Idx:     s.Idx,
+		Address: s.Address,
+		File:    s.Name + ".db",
+	}
+	path := filepath.Join(dir, b.File)
+
+	f, err := os.Create(path)
+	if err != nil {
+		return ShardBackup{}, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if b.Size, err = io.Copy(io.MultiWriter(f, h), resp.Body); err != nil {
+		return ShardBackup{}, err
+	}
+	if err := f.Sync(); err != nil {
+		return ShardBackup{}, err
+	}
+	b.SHA256 = hex.EncodeToString(h.Sum(nil))
+
+	if err := db.VerifyBackup(path); err != nil {
+		return ShardBackup{}, err
+	}
+	return b, nil
+}
+
+// WriteManifest atomically writes the manifest into the backup directory.
+func WriteManifest(dir string, m Manifest) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(dir, ManifestFile)
+	if err := os.WriteFile(path+".tmp", data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// ReadManifest reads the manifest of the backup directory.
+func ReadManifest(dir string) (Manifest, error) {
+	var m Manifest
+
+	data, err := os.ReadFile(filepath.Join(dir, ManifestFile))
+	if err != nil {
+		return m, err
+	}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return m, fmt.Errorf("decoding manifest: %w", err)
+	}
+	return m, nil
+}
+
+// ShardFile returns the path of the named shard backup in the backup
+// directory after checking its checksum against the manifest.
+func ShardFile(dir string, shardName string) (string, error) {
+	m, err := ReadManifest(dir)
+	if err != nil {
+		return "", err
+	}
+
+	for _, s := range m.Shards {
+		if s.Name != shardName {
+			continue
+		}
+
+		path := filepath.Join(dir, s.File)
+		f, err := os.Open(path)
+		if err != nil {
+			return "", err
+		}
+		defer f.Close()
+
+		h := sha256.New()
+		if _, err := io.Copy(h, f); err != nil {
+			return "", err
+		}
+		if sum := hex.EncodeToString(h.Sum(nil)); sum != s.SHA256 {
+			return "", fmt.Errorf("%s: checksum mismatch: got %s, want %s", path, sum, s.SHA256)
+		}
+		return path, nil
+	}
+	return "", fmt.Errorf("shard %q is not in backup %s", shardName, m.Label)
+}
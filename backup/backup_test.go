@@ -0,0 +1,112 @@
+package backup_test
+
+import (
+	"context"
+	"go-kvdb/backup"
+	"go-kvdb/config"
+	"go-kvdb/db"
+	"go-kvdb/web"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func startShard(t *testing.T, idx int, epoch int64) (*db.Database, string) {
+	t.Helper()
+
+	d, closeFunc, err := db.NewDatabase(filepath.Join(t.TempDir(), "shard.db"))
+	if err != nil {
+		t.Fatalf("Could not create a new database: %v", err)
+	}
+	t.Cleanup(func() { closeFunc() })
+
+	srv := web.NewServer(d, &config.Shards{Count: 2, CurIdx: idx, Epoch: epoch})
+	ts := httptest.NewServer(http.HandlerFunc(srv.BackupHandler))
+	t.Cleanup(ts.Close)
+
+	return d, strings.TrimPrefix(ts.URL, "http://")
+}
+
+func TestClusterBackup(t *testing.T) {
+	db1, addr1 := startShard(t, 0, 3)
+	db2, addr2 := startShard(t, 1, 3)
+
+	if err := db1.SetKey("USA", "default", []byte("value-USA")); err != nil {
+		t.Fatalf("SetKey failed: %v", err)
+	}
+	if err := db2.SetKey("Soviet", "default", []byte("value-Soviet")); err != nil {
+		t.Fatalf("SetKey failed: %v", err)
+	}
+
+	c := config.Config{
+		Epoch: 3,
+		Shards: []config.Shard{
+			{Name: "sh-1", Idx: 0, Address: addr1},
+			{Name: "sh-2", Idx: 1, Address: addr2},
+		},
+	}
+
+	dir := t.TempDir()
+	m, err := backup.Cluster(context.Background(), c, dir)
+	if err != nil {
+		t.Fatalf("Could not back up the cluster: %v", err)
+	}
+
+	if !strings.HasSuffix(m.Label, "-epoch3") || len(m.Shards) != 2 {
+		t.Errorf("Unexpected manifest: %#v", m)
+	}
+
+	setDir := filepath.Join(dir, m.Label)
+	path, err := backup.ShardFile(setDir, "sh-2")
+	if err != nil {
+		t.Fatalf("Could not find the shard backup: %v", err)
+	}
+
+	restored := filepath.Join(t.TempDir(), "restored.db")
+	if err := db.Restore(path, restored); err != nil {
+		t.Fatalf("Could not restore the shard backup: %v", err)
+	}
+
+	d, closeFunc, err := db.NewDatabase(restored)
+	if err != nil {
+		t.Fatalf("Could not open the restored database: %v", err)
+	}
+	defer closeFunc()
+
+	if v, err := d.GetKey("Soviet", "default"); err != nil || string(v) != "value-Soviet" {
+		t.Errorf("Unexpected restored value: got %q, %v", v, err)
+	}
+
+	// A tampered backup must be rejected.
+	if err := os.WriteFile(path, []byte("tampered"), 0600); err != nil {
+		t.Fatalf("Could not overwrite the backup: %v", err)
+	}
+	if _, err := backup.ShardFile(setDir, "sh-2"); err == nil {
+		t.Errorf("Expected a checksum error for a tampered backup")
+	}
+}
+
+func TestClusterBackupEpochMismatch(t *testing.T) {
+	_, addr1 := startShard(t, 0, 3)
+	_, addr2 := startShard(t, 1, 2)
+
+	c := config.Config{
+		Epoch: 3,
+		Shards: []config.Shard{
+			{Name: "sh-1", Idx: 0, Address: addr1},
+			{Name: "sh-2", Idx: 1, Address: addr2},
+		},
+	}
+
+	dir := t.TempDir()
+	if _, err := backup.Cluster(context.Background(), c, dir); err == nil {
+		t.Fatalf("Expected error when a shard has a different topology epoch")
+	}
+
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("Incomplete backup set was not removed: %v", entries)
+	}
+}
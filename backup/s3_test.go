@@ -0,0 +1,101 @@
+package backup_test
+
+import (
+	"encoding/xml"
+	"go-kvdb/backup"
+	"go-kvdb/config"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeS3 is a minimal in-memory stand-in for an S3-compatible object store.
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=kvdb/") {
+		http.Error(w, "AccessDenied", http.StatusForbidden)
+		return
+	}
+
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if bucket != "backups" {
+		http.Error(w, "NoSuchBucket", http.StatusNotFound)
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch {
+	case r.Method == http.MethodGet && key == "":
+		if r.URL.Query().Get("list-type") != "2" {
+			http.Error(w, "NotImplemented", http.StatusNotImplemented)
+			return
+		}
+
+		type content struct{ Key string }
+		var res struct {
+			XMLName  xml.Name `xml:"ListBucketResult"`
+			Contents []content
+		}
+		for k := range f.objects {
+			if strings.HasPrefix(k, r.URL.Query().Get("prefix")) {
+				res.Contents = append(res.Contents, content{k})
+			}
+		}
+		sort.Slice(res.Contents, func(i, j int) bool { return res.Contents[i].Key < res.Contents[j].Key })
+		xml.NewEncoder(w).Encode(res)
+	case r.Method == http.MethodPut:
+		data, err := io.ReadAll(r.Body)
+		if err != nil || int64(len(data)) != r.ContentLength {
+			http.Error(w, "IncompleteBody", http.StatusBadRequest)
+			return
+		}
+		f.objects[key] = data
+	case r.Method == http.MethodGet:
+		data, ok := f.objects[key]
+		if !ok {
+			http.Error(w, "NoSuchKey", http.StatusNotFound)
+			return
+		}
+		w.Write(data)
+	case r.Method == http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "MethodNotAllowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func TestScheduledBackupsS3(t *testing.T) {
+	fake := &fakeS3{objects: make(map[string][]byte)}
+	ts := httptest.NewServer(fake)
+	defer ts.Close()
+
+	target, err := backup.NewTarget(config.Backup{S3: config.S3{
+		Endpoint:  ts.URL,
+		Bucket:    "backups",
+		Prefix:    "cluster-a",
+		AccessKey: "kvdb",
+		SecretKey: "secret",
+	}})
+	if err != nil {
+		t.Fatalf("Could not create the target: %v", err)
+	}
+
+	testScheduledBackups(t, target)
+
+	for k := range fake.objects {
+		if !strings.HasPrefix(k, "cluster-a/sh-1/") {
+			t.Errorf("Object stored outside of the prefix: %q", k)
+		}
+	}
+}
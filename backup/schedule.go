@@ -0,0 +1,451 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"go-kvdb/config"
+	"go-kvdb/db"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Kinds of scheduled backups.
+const (
+	KindFull        = "full"
+	KindIncremental = "incremental"
+)
+
+// Files of a scheduled backup.
+const (
+	fullFile    = "shard.db"
+	changesFile = "changes.ndjson"
+	digestFile  = "digest.json"
+)
+
+// NodeManifest describes a scheduled backup of a single shard.
+//
+// Backups are stored as <shard>/<id>/manifest.json next to the data file,
+// where the id starts with the creation time, so the backups of a shard
+// sort chronologically. Base is the id of the full backup that starts the
+// chain and Parent is the backup the changes were taken against. Digest
+// is the file with the digest of the database at the time of the backup,
+// which the next incremental backup is taken against.
+type NodeManifest struct {
+	ID      string    `json:"id"`
+	Shard   string    `json:"shard"`
+	Epoch   int64     `json:"epoch"`
+	Kind    string    `json:"kind"`
+	Base    string    `json:"base"`
+	Parent  string    `json:"parent,omitempty"`
+	Created time.Time `json:"created"`
+	File    string    `json:"file"`
+	Size    int64     `json:"size"`
+	SHA256  string    `json:"sha256"`
+	Changes int       `json:"changes,omitempty"`
+	Digest  string    `json:"digest,omitempty"`
+}
+
+func (m NodeManifest) dir() string {
+	return m.Shard + "/" + m.ID
+}
+
+// Scheduler periodically backs up the shard to the target and prunes
+// the old backups according to the retention policy.
+//
+// The changes are computed against the digest of the previous backup,
+// which is stored with it, so a restarted scheduler continues the chain
+// of the newest backup of the shard.
+type Scheduler struct {
+	store  db.IncrementalBackuper
+	target Target
+	shard  string
+	epoch  func() int64
+	cfg    config.Backup
+
+	mu      sync.Mutex
+	resumed bool
+	last    NodeManifest
+	digest  *db.Digest
+	count   int
+}
+
+// NewScheduler returns a scheduler for the shard. The epoch function
+// returns the current topology epoch recorded in the manifests.
+func NewScheduler(store db.IncrementalBackuper, target Target, shard string, epoch func() int64, cfg config.Backup) *Scheduler {
+	return &Scheduler{
+		store:  store,
+		target: target,
+		shard:  shard,
+		epoch:  epoch,
+		cfg:    cfg,
+	}
+}
+
+// Run takes a backup every interval until the context is cancelled.
+// Errors are logged and the backup is retried at the next tick.
+func (s *Scheduler) Run(ctx context.Context) {
+	t := time.NewTicker(time.Duration(s.cfg.Interval))
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+
+		m, err := s.RunOnce(ctx)
+		if err != nil {
+			log.Printf("Error taking scheduled backup: %v", err)
+			continue
+		}
+		log.Printf("Scheduled %s backup %s stored (%d bytes)", m.Kind, m.ID, m.Size)
+
+		if err := Prune(ctx, s.target, s.shard, s.cfg, time.Now()); err != nil {
+			log.Printf("Error pruning backups: %v", err)
+		}
+	}
+}
+
+// RunOnce takes a single backup: a full one if it is the first backup
+// or every FullEvery-th one, an incremental one otherwise.
+func (s *Scheduler) RunOnce(ctx context.Context) (NodeManifest, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.resumed {
+		if err := s.resume(ctx); err != nil {
+			return NodeManifest{}, fmt.Errorf("reading the previous backup: %w", err)
+		}
+		s.resumed = true
+	}
+
+	now := time.Now().UTC()
+	m := NodeManifest{
+		ID:      now.Format("20060102T150405.000000000Z"),
+		Shard:   s.shard,
+		Epoch:   s.epoch(),
+		Kind:    KindFull,
+		Created: now,
+		File:    fullFile,
+		Digest:  digestFile,
+	}
+	if s.digest != nil && s.count+1 < s.cfg.FullEvery {
+		m.Kind = KindIncremental
+		m.File = changesFile
+		m.Base = s.last.Base
+		m.Parent = s.last.ID
+	} else {
+		m.Base = m.ID
+	}
+
+	// Stage the backup locally: the size and checksum must be known
+	// before the upload and the full backup is also needed for the digest.
+	f, err := os.CreateTemp("", "kvdb-backup-*")
+	if err != nil {
+		return NodeManifest{}, err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	h := sha256.New()
+	w := io.MultiWriter(f, h)
+
+	var digest db.Digest
+	if m.Kind == KindFull {
+		if m.Size, err = s.store.Backup(w); err != nil {
+			return NodeManifest{}, err
+		}
+		if err := f.Sync(); err != nil {
+			return NodeManifest{}, err
+		}
+		if digest, err = db.FileDigest(f.Name()); err != nil {
+			return NodeManifest{}, err
+		}
+	} else {
+		if digest, m.Changes, err = s.store.Changes(w, *s.digest); err != nil {
+			return NodeManifest{}, err
+		}
+		if m.Size, err = f.Seek(0, io.SeekCurrent); err != nil {
+			return NodeManifest{}, err
+		}
+	}
+	m.SHA256 = hex.EncodeToString(h.Sum(nil))
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return NodeManifest{}, err
+	}
+	if err := s.target.Put(ctx, m.dir()+"/"+m.File, f, m.Size); err != nil {
+		return NodeManifest{}, fmt.Errorf("uploading %s: %w", m.File, err)
+	}
+
+	data, err := json.Marshal(digest)
+	if err != nil {
+		return NodeManifest{}, err
+	}
+	if err := s.target.Put(ctx, m.dir()+"/"+m.Digest, bytes.NewReader(data), int64(len(data))); err != nil {
+		return NodeManifest{}, fmt.Errorf("uploading digest: %w", err)
+	}
+
+	// The manifest goes last: a backup without one is incomplete.
+	data, err = json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return NodeManifest{}, err
+	}
+	if err := s.target.Put(ctx, m.dir()+"/"+ManifestFile, strings.NewReader(string(data)), int64(len(data))); err != nil {
+		return NodeManifest{}, fmt.Errorf("uploading manifest: %w", err)
+	}
+
+	if m.Kind == KindFull {
+		s.count = 0
+	} else {
+		s.count++
+	}
+	s.last = m
+	s.digest = &digest
+	return m, nil
+}
+
+// resume continues the chain of the newest backup of the shard, if it
+// has a digest.
+func (s *Scheduler) resume(ctx context.Context) error {
+	ms, err := List(ctx, s.target, s.shard)
+	if err != nil || len(ms) == 0 {
+		return err
+	}
+	last := ms[len(ms)-1]
+	if last.Digest == "" {
+		return nil
+	}
+
+	r, err := s.target.Get(ctx, last.dir()+"/"+last.Digest)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	var digest db.Digest
+	if err := json.NewDecoder(r).Decode(&digest); err != nil {
+		return fmt.Errorf("decoding digest of backup %s: %w", last.ID, err)
+	}
+
+	s.count = 0
+	for _, m := range ms {
+		if m.Base == last.Base && m.Kind == KindIncremental {
+			s.count++
+		}
+	}
+	s.last = last
+	s.digest = &digest
+	return nil
+}
+
+// List returns the complete scheduled backups of the shard, oldest first.
+func List(ctx context.Context, target Target, shard string) ([]NodeManifest, error) {
+	names, err := target.List(ctx, shard+"/")
+	if err != nil {
+		return nil, err
+	}
+
+	var ms []NodeManifest
+	for _, name := range names {
+		if path.Base(name) != ManifestFile {
+			continue
+		}
+
+		m, err := readNodeManifest(ctx, target, name)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		ms = append(ms, m)
+	}
+
+	sort.Slice(ms, func(i, j int) bool { return ms[i].ID < ms[j].ID })
+	return ms, nil
+}
+
+func readNodeManifest(ctx context.Context, target Target, name string) (NodeManifest, error) {
+	var m NodeManifest
+
+	r, err := target.Get(ctx, name)
+	if err != nil {
+		return m, err
+	}
+	defer r.Close()
+
+	if err := json.NewDecoder(r).Decode(&m); err != nil {
+		return m, fmt.Errorf("decoding manifest: %w", err)
+	}
+	return m, nil
+}
+
+// Prune removes the chains of backups that are outside the retention
+// policy. The newest chain is always kept.
+func Prune(ctx context.Context, target Target, shard string, cfg config.Backup, now time.Time) error {
+	ms, err := List(ctx, target, shard)
+	if err != nil {
+		return err
+	}
+
+	// Chains in the order of their full backups, oldest first.
+	var bases []string
+	chains := make(map[string][]NodeManifest)
+	for _, m := range ms {
+		if _, ok := chains[m.Base]; !ok {
+			bases = append(bases, m.Base)
+		}
+		chains[m.Base] = append(chains[m.Base], m)
+	}
+	sort.Strings(bases)
+
+	for i, base := range bases[:max(len(bases)-1, 0)] {
+		chain := chains[base]
+		newest := chain[len(chain)-1]
+
+		expired := cfg.Keep > 0 && len(bases)-i > cfg.Keep
+		expired = expired || (cfg.MaxAge > 0 && now.Sub(newest.Created) > time.Duration(cfg.MaxAge))
+		if !expired {
+			continue
+		}
+
+		// Newest first, so that a failure never leaves
+		// incremental backups without their base.
+		for j := len(chain) - 1; j >= 0; j-- {
+			if err := deleteBackup(ctx, target, chain[j]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func deleteBackup(ctx context.Context, target Target, m NodeManifest) error {
+	// The manifest goes first, so that a partly deleted backup is not listed.
+	if err := target.Delete(ctx, m.dir()+"/"+ManifestFile); err != nil {
+		return err
+	}
+	if m.Digest != "" {
+		if err := target.Delete(ctx, m.dir()+"/"+m.Digest); err != nil {
+			return err
+		}
+	}
+	return target.Delete(ctx, m.dir()+"/"+m.File)
+}
+
+// RestoreChain restores the shard database at dbPath to the state of the
+// backup with the id, or of the newest backup if the id is empty. The full
+// backup of its chain is downloaded and verified and the incremental
+// backups up to the requested one are applied to it.
+func RestoreChain(ctx context.Context, target Target, shard, id, dbPath string) (NodeManifest, error) {
+	ms, err := List(ctx, target, shard)
+	if err != nil {
+		return NodeManifest{}, err
+	}
+	if len(ms) == 0 {
+		return NodeManifest{}, fmt.Errorf("no backups of shard %q", shard)
+	}
+
+	want := ms[len(ms)-1]
+	if id != "" {
+		found := false
+		for _, m := range ms {
+			if m.ID == id {
+				want, found = m, true
+			}
+		}
+		if !found {
+			return NodeManifest{}, fmt.Errorf("backup %q of shard %q not found", id, shard)
+		}
+	}
+
+	byID := make(map[string]NodeManifest)
+	for _, m := range ms {
+		byID[m.ID] = m
+	}
+
+	// Follow the parents back to the full backup.
+	var chain []NodeManifest
+	for m := want; ; {
+		chain = append([]NodeManifest{m}, chain...)
+		if m.Kind == KindFull {
+			break
+		}
+
+		parent, ok := byID[m.Parent]
+		if !ok {
+			return NodeManifest{}, fmt.Errorf("backup %s: parent %q is missing", m.ID, m.Parent)
+		}
+		m = parent
+	}
+
+	tmp, err := os.MkdirTemp(filepath.Dir(dbPath), filepath.Base(dbPath)+".chain-*")
+	if err != nil {
+		return NodeManifest{}, err
+	}
+	defer os.RemoveAll(tmp)
+
+	dbFile := filepath.Join(tmp, fullFile)
+	for _, m := range chain {
+		file := filepath.Join(tmp, m.ID+"-"+m.File)
+		if err := download(ctx, target, m, file); err != nil {
+			return NodeManifest{}, err
+		}
+
+		if m.Kind == KindFull {
+			if err := os.Rename(file, dbFile); err != nil {
+				return NodeManifest{}, err
+			}
+			continue
+		}
+
+		f, err := os.Open(file)
+		if err != nil {
+			return NodeManifest{}, err
+		}
+		_, err = db.ApplyChanges(dbFile, f)
+		f.Close()
+		if err != nil {
+			return NodeManifest{}, fmt.Errorf("applying backup %s: %w", m.ID, err)
+		}
+	}
+
+	if err := db.Restore(dbFile, dbPath); err != nil {
+		return NodeManifest{}, err
+	}
+	return want, nil
+}
+
+// download copies the data file of the backup to dst and checks it against the manifest.
+func download(ctx context.Context, target Target, m NodeManifest, dst string) error {
+	r, err := target.Get(ctx, m.dir()+"/"+m.File)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	f, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(f, h), r); err != nil {
+		return err
+	}
+	if sum := hex.EncodeToString(h.Sum(nil)); sum != m.SHA256 {
+		return fmt.Errorf("backup %s: checksum mismatch: got %s, want %s", m.ID, sum, m.SHA256)
+	}
+	return f.Close()
+}
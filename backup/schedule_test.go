@@ -0,0 +1,162 @@
+package backup_test
+
+import (
+	"context"
+	"go-kvdb/backup"
+	"go-kvdb/config"
+	"go-kvdb/db"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newDatabase(t *testing.T) *db.Database {
+	t.Helper()
+
+	d, closeFunc, err := db.NewDatabase(filepath.Join(t.TempDir(), "shard.db"))
+	if err != nil {
+		t.Fatalf("Could not create a new database: %v", err)
+	}
+	t.Cleanup(func() { closeFunc() })
+	return d
+}
+
+func runOnce(t *testing.T, s *backup.Scheduler, kind string) backup.NodeManifest {
+	t.Helper()
+
+	m, err := s.RunOnce(context.Background())
+	if err != nil {
+		t.Fatalf("Could not take a backup: %v", err)
+	}
+	if m.Kind != kind {
+		t.Errorf("Unexpected backup kind: got %q, want %q", m.Kind, kind)
+	}
+	return m
+}
+
+func restoreValue(t *testing.T, target backup.Target, id, key string) string {
+	t.Helper()
+
+	dbPath := filepath.Join(t.TempDir(), "restored.db")
+	if _, err := backup.RestoreChain(context.Background(), target, "sh-1", id, dbPath); err != nil {
+		t.Fatalf("Could not restore backup %q: %v", id, err)
+	}
+
+	d, closeFunc, err := db.NewDatabase(dbPath)
+	if err != nil {
+		t.Fatalf("Could not open the restored database: %v", err)
+	}
+	defer closeFunc()
+
+	v, err := d.GetKey(key, "default")
+	if err != nil {
+		t.Fatalf("GetKey(%q) failed: %v", key, err)
+	}
+	return string(v)
+}
+
+// testScheduledBackups takes a chain of backups, restores them and prunes them.
+func testScheduledBackups(t *testing.T, target backup.Target) {
+	cfg := config.Backup{Interval: config.Duration(time.Hour), FullEvery: 3, Keep: 1}
+	d := newDatabase(t)
+	s := backup.NewScheduler(d, target, "sh-1", func() int64 { return 7 }, cfg)
+
+	set := func(key, value string) {
+		if err := d.SetKey(key, "default", []byte(value)); err != nil {
+			t.Fatalf("SetKey failed: %v", err)
+		}
+	}
+
+	set("party", "v1")
+	full := runOnce(t, s, backup.KindFull)
+	set("party", "v2")
+	inc := runOnce(t, s, backup.KindIncremental)
+	set("party", "v3")
+	last := runOnce(t, s, backup.KindIncremental)
+
+	if inc.Base != full.ID || inc.Parent != full.ID || last.Parent != inc.ID || inc.Changes != 1 || inc.Epoch != 7 {
+		t.Errorf("Unexpected incremental backup manifest: %#v", inc)
+	}
+
+	for _, tc := range []struct{ id, want string }{
+		{full.ID, "v1"},
+		{inc.ID, "v2"},
+		{"", "v3"},
+	} {
+		if got := restoreValue(t, target, tc.id, "party"); got != tc.want {
+			t.Errorf("Unexpected value restored from %q: got %q, want %q", tc.id, got, tc.want)
+		}
+	}
+
+	// The fourth backup starts a new chain, so the first one can be pruned.
+	set("party", "v4")
+	next := runOnce(t, s, backup.KindFull)
+
+	if err := backup.Prune(context.Background(), target, "sh-1", cfg, time.Now()); err != nil {
+		t.Fatalf("Could not prune backups: %v", err)
+	}
+
+	ms, err := backup.List(context.Background(), target, "sh-1")
+	if err != nil {
+		t.Fatalf("Could not list backups: %v", err)
+	}
+	if len(ms) != 1 || ms[0].ID != next.ID {
+		t.Errorf("Unexpected backups after pruning: %#v", ms)
+	}
+
+	if got := restoreValue(t, target, "", "party"); got != "v4" {
+		t.Errorf("Unexpected restored value: got %q, want %q", got, "v4")
+	}
+}
+
+func TestScheduledBackupsDir(t *testing.T) {
+	testScheduledBackups(t, backup.DirTarget(t.TempDir()))
+}
+
+func TestPruneMaxAge(t *testing.T) {
+	target := backup.DirTarget(t.TempDir())
+	cfg := config.Backup{Interval: config.Duration(time.Hour), MaxAge: config.Duration(time.Hour)}
+	d := newDatabase(t)
+	s := backup.NewScheduler(d, target, "sh-1", func() int64 { return 1 }, cfg)
+
+	runOnce(t, s, backup.KindFull)
+	runOnce(t, s, backup.KindFull)
+
+	if err := backup.Prune(context.Background(), target, "sh-1", cfg, time.Now().Add(2*time.Hour)); err != nil {
+		t.Fatalf("Could not prune backups: %v", err)
+	}
+
+	// The newest chain is kept even though it is too old.
+	if ms, _ := backup.List(context.Background(), target, "sh-1"); len(ms) != 1 {
+		t.Errorf("Unexpected number of backups after pruning: got %d, want 1", len(ms))
+	}
+}
+
+func TestSchedulerResume(t *testing.T) {
+	target := backup.DirTarget(t.TempDir())
+	cfg := config.Backup{Interval: config.Duration(time.Hour), FullEvery: 3}
+	d := newDatabase(t)
+	epoch := func() int64 { return 1 }
+
+	if err := d.SetKey("party", "default", []byte("v1")); err != nil {
+		t.Fatalf("SetKey failed: %v", err)
+	}
+	full := runOnce(t, backup.NewScheduler(d, target, "sh-1", epoch, cfg), backup.KindFull)
+
+	// A restarted node continues the chain of its newest backup.
+	if err := d.SetKey("party", "default", []byte("v2")); err != nil {
+		t.Fatalf("SetKey failed: %v", err)
+	}
+	s := backup.NewScheduler(d, target, "sh-1", epoch, cfg)
+	inc := runOnce(t, s, backup.KindIncremental)
+	if inc.Parent != full.ID || inc.Changes != 1 {
+		t.Errorf("Unexpected incremental backup manifest: %#v", inc)
+	}
+	if got := restoreValue(t, target, "", "party"); got != "v2" {
+		t.Errorf("Unexpected restored value: got %q, want %q", got, "v2")
+	}
+
+	// The backups of the chain taken before the restart count.
+	runOnce(t, backup.NewScheduler(d, target, "sh-1", epoch, cfg), backup.KindIncremental)
+	runOnce(t, backup.NewScheduler(d, target, "sh-1", epoch, cfg), backup.KindFull)
+}
@@ -0,0 +1,141 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go-kvdb/config"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Target is where scheduled backups are stored. Object names are
+// slash-separated paths relative to the root of the target.
+type Target interface {
+	// Put stores size bytes read from r under the name.
+	Put(ctx context.Context, name string, r io.Reader, size int64) error
+	// Get opens the named object.
+	Get(ctx context.Context, name string) (io.ReadCloser, error)
+	// List returns the sorted names of all objects starting with the prefix.
+	List(ctx context.Context, prefix string) ([]string, error)
+	// Delete removes the named object. Deleting a missing object is not an error.
+	Delete(ctx context.Context, name string) error
+}
+
+// NewTarget returns the target configured in the backup settings.
+func NewTarget(b config.Backup) (Target, error) {
+	switch {
+	case b.Dir != "":
+		return DirTarget(b.Dir), nil
+	case b.S3.Endpoint != "":
+		return NewS3Target(b.S3), nil
+	default:
+		return nil, fmt.Errorf("no backup target is configured")
+	}
+}
+
+// DirTarget stores the backups in a local directory.
+type DirTarget string
+
+func (d DirTarget) path(name string) (string, error) {
+	if !fs.ValidPath(name) {
+		return "", fmt.Errorf("invalid object name %q", name)
+	}
+	return filepath.Join(string(d), filepath.FromSlash(name)), nil
+}
+
+// Put atomically writes the file, so that readers never see a partial object.
+func (d DirTarget) Put(ctx context.Context, name string, r io.Reader, size int64) error {
+	p, err := d.path(name)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(p), filepath.Base(p)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	n, err := io.Copy(f, r)
+	if err == nil && n != size {
+		err = fmt.Errorf("wrote %d bytes, want %d", n, size)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), p)
+}
+
+// Get opens the file.
+func (d DirTarget) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	p, err := d.path(name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(p)
+}
+
+// List walks the directory. Temporary files of unfinished writes are skipped.
+func (d DirTarget) List(ctx context.Context, prefix string) ([]string, error) {
+	var names []string
+
+	err := filepath.WalkDir(string(d), func(p string, e fs.DirEntry, err error) error {
+		if errors.Is(err, fs.ErrNotExist) && p == string(d) {
+			return filepath.SkipDir
+		}
+		if err != nil || e.IsDir() {
+			return err
+		}
+
+		rel, err := filepath.Rel(string(d), p)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		if strings.HasPrefix(name, prefix) && !strings.Contains(path.Base(name), ".tmp-") {
+			names = append(names, name)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(names)
+	return names, nil
+}
+
+// Delete removes the file and the directories left empty.
+func (d DirTarget) Delete(ctx context.Context, name string) error {
+	p, err := d.path(name)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	// Fails for the directories that still have files in them.
+	for dir := filepath.Dir(p); dir != filepath.Clean(string(d)); dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+	return nil
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"go-kvdb/backup"
+	"go-kvdb/config"
+	"go-kvdb/db"
+	"io"
+	"time"
+)
+
+const backupUsage = `Usage:
+  go-kvdb backup cluster [-config-file=sharding.toml] [-config-format=toml|json|yaml] [-out=backups]
+  go-kvdb backup restore -db-location=PATH (-from=FILE | -backup-dir=DIR -shard=NAME)
+  go-kvdb backup list [-config-file=sharding.toml] [-config-format=toml|json|yaml] -shard=NAME
+  go-kvdb backup restore-scheduled [-config-file=sharding.toml] [-config-format=toml|json|yaml] -shard=NAME -db-location=PATH [-id=ID]
+  go-kvdb backup changelog -from=FILE [-after=SEQ]
+  go-kvdb backup recover -base=FILE -log=FILE -db-location=PATH [-until=TIME | -before-seq=SEQ]`
+
+// runBackupCommand implements the "go-kvdb backup" subcommands
+// and returns the process exit code.
+func runBackupCommand(args []string, stdout, stderr io.Writer) int {
+	if len(args) == 0 {
+		fmt.Fprintln(stderr, backupUsage)
+		return 2
+	}
+
+	switch args[0] {
+	case "cluster":
+		return runClusterBackup(args[1:], stdout, stderr)
+	case "restore":
+		return runRestore(args[1:], stdout, stderr)
+	case "list":
+		return runListScheduled(args[1:], stdout, stderr)
+	case "restore-scheduled":
+		return runRestoreScheduled(args[1:], stdout, stderr)
+	case "changelog":
+		return runChangeLog(args[1:], stdout, stderr)
+	case "recover":
+		return runRecover(args[1:], stdout, stderr)
+	default:
+		fmt.Fprintln(stderr, backupUsage)
+		return 2
+	}
+}
+
+func runClusterBackup(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("backup cluster", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	file := fs.String("config-file", "sharding.toml", "Config file with the shards to back up")
+	format := fs.String("config-format", "", "Format of the config file: toml, json or yaml (detected by the extension by default)")
+	out := fs.String("out", "backups", "Directory to store the backup set in")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	c, err := config.ParseFileFormat(*file, *format)
+	if err != nil {
+		fmt.Fprintf(stderr, "Error parsing config %q: %v\n", *file, err)
+		return 1
+	}
+
+	m, err := backup.Cluster(context.Background(), c, *out)
+	if err != nil {
+		fmt.Fprintf(stderr, "Error backing up the cluster: %v\n", err)
+		return 1
+	}
+
+	fmt.Fprintf(stdout, "Backup %s of %d shards stored in %s\n", m.Label, len(m.Shards), *out)
+	return 0
+}
+
+func runRestore(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("backup restore", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	dbPath := fs.String("db-location", "", "The path to the bolt db database to replace")
+	from := fs.String("from", "", "Backup file to restore")
+	dir := fs.String("backup-dir", "", "Cluster backup directory to restore the shard from")
+	shardName := fs.String("shard", "", "The name of the shard to restore from the cluster backup")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	if *dbPath == "" || (*from == "") == (*dir == "") || (*dir != "" && *shardName == "") {
+		fmt.Fprintln(stderr, backupUsage)
+		return 2
+	}
+
+	src := *from
+	if *dir != "" {
+		var err error
+		if src, err = backup.ShardFile(*dir, *shardName); err != nil {
+			fmt.Fprintf(stderr, "Error finding the shard backup: %v\n", err)
+			return 1
+		}
+	}
+
+	if err := db.Restore(src, *dbPath); err != nil {
+		fmt.Fprintf(stderr, "Error restoring %q: %v\n", *dbPath, err)
+		return 1
+	}
+
+	fmt.Fprintf(stdout, "Restored %s from %s\n", *dbPath, src)
+	return 0
+}
+
+// scheduledTarget parses the config given with the flags
+// and returns the target of the scheduled backups.
+func scheduledTarget(file, format string, stderr io.Writer) (backup.Target, bool) {
+	c, err := config.ParseFileFormat(file, format)
+	if err != nil {
+		fmt.Fprintf(stderr, "Error parsing config %q: %v\n", file, err)
+		return nil, false
+	}
+
+	target, err := backup.NewTarget(c.Node.Backup)
+	if err != nil {
+		fmt.Fprintf(stderr, "Error in config %q: %v\n", file, err)
+		return nil, false
+	}
+	return target, true
+}
+
+func runListScheduled(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("backup list", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	file := fs.String("config-file", "sharding.toml", "Config file with the backup settings")
+	format := fs.String("config-format", "", "Format of the config file: toml, json or yaml (detected by the extension by default)")
+	shardName := fs.String("shard", "", "The name of the shard to list the backups of")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	if *shardName == "" {
+		fmt.Fprintln(stderr, backupUsage)
+		return 2
+	}
+
+	target, ok := scheduledTarget(*file, *format, stderr)
+	if !ok {
+		return 1
+	}
+
+	ms, err := backup.List(context.Background(), target, *shardName)
+	if err != nil {
+		fmt.Fprintf(stderr, "Error listing backups: %v\n", err)
+		return 1
+	}
+
+	for _, m := range ms {
+		fmt.Fprintf(stdout, "%s\t%s\tepoch %d\t%d bytes\n", m.ID, m.Kind, m.Epoch, m.Size)
+	}
+	return 0
+}
+
+func runRestoreScheduled(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("backup restore-scheduled", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	file := fs.String("config-file", "sharding.toml", "Config file with the backup settings")
+	format := fs.String("config-format", "", "Format of the config file: toml, json or yaml (detected by the extension by default)")
+	shardName := fs.String("shard", "", "The name of the shard to restore")
+	dbPath := fs.String("db-location", "", "The path to the bolt db database to replace")
+	id := fs.String("id", "", "The backup to restore, the newest one if empty")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	if *shardName == "" || *dbPath == "" {
+		fmt.Fprintln(stderr, backupUsage)
+		return 2
+	}
+
+	target, ok := scheduledTarget(*file, *format, stderr)
+	if !ok {
+		return 1
+	}
+
+	m, err := backup.RestoreChain(context.Background(), target, *shardName, *id, *dbPath)
+	if err != nil {
+		fmt.Fprintf(stderr, "Error restoring %q: %v\n", *dbPath, err)
+		return 1
+	}
+
+	fmt.Fprintf(stdout, "Restored %s from %s backup %s\n", *dbPath, m.Kind, m.ID)
+	return 0
+}
+
+func runChangeLog(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("backup changelog", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	from := fs.String("from", "", "Backup or stopped database file to read the change log from")
+	after := fs.Uint64("after", 0, "Only print the records after this sequence number")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	if *from == "" {
+		fmt.Fprintln(stderr, backupUsage)
+		return 2
+	}
+
+	err := db.ReadChangeLog(*from, *after, func(rec db.LogRecord) bool {
+		fmt.Fprintf(stdout, "%d\t%s\t%s\t%s\t%s\n", rec.Seq, rec.Time.Format(time.RFC3339Nano), rec.Op, rec.Bucket, rec.Key)
+		return true
+	})
+	if err != nil {
+		fmt.Fprintf(stderr, "Error reading the change log: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+func runRecover(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("backup recover", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	base := fs.String("base", "", "Backup to start the recovery from")
+	logFile := fs.String("log", "", "Later backup of the same shard with the change log to replay")
+	dbPath := fs.String("db-location", "", "The path to the bolt db database to replace")
+	until := fs.String("until", "", "Replay the changes made up to this RFC 3339 time")
+	beforeSeq := fs.Uint64("before-seq", 0, "Replay the changes before this sequence number")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	if *base == "" || *logFile == "" || *dbPath == "" || (*until != "" && *beforeSeq != 0) {
+		fmt.Fprintln(stderr, backupUsage)
+		return 2
+	}
+
+	stop := func(db.LogRecord) bool { return false }
+	if *until != "" {
+		t, err := time.Parse(time.RFC3339Nano, *until)
+		if err != nil {
+			fmt.Fprintf(stderr, "Invalid time %q: %v\n", *until, err)
+			return 2
+		}
+		stop = func(rec db.LogRecord) bool { return rec.Time.After(t) }
+	}
+	if *beforeSeq != 0 {
+		stop = func(rec db.LogRecord) bool { return rec.Seq >= *beforeSeq }
+	}
+
+	last, err := db.Recover(*base, *logFile, *dbPath, stop)
+	if err != nil {
+		fmt.Fprintf(stderr, "Error recovering %q: %v\n", *dbPath, err)
+		return 1
+	}
+
+	if last.Seq == 0 {
+		fmt.Fprintf(stdout, "Restored %s from %s, no changes to replay\n", *dbPath, *base)
+		return 0
+	}
+	fmt.Fprintf(stdout, "Recovered %s up to change log record %d (%s)\n", *dbPath, last.Seq, last.Time.Format(time.RFC3339Nano))
+	return 0
+}
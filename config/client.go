@@ -0,0 +1,87 @@
+package config
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+// ClientTimeout bounds how long a request to another node may take to
+// connect and to receive the response headers. The body of a response,
+// e.g. of an export, may take longer.
+const ClientTimeout = time.Minute
+
+// Client sends the requests between the nodes, the coordinator and the
+// command line tools of a cluster.
+type Client struct {
+	*http.Client
+
+	// Scheme is "https" if the nodes serve TLS and "http" otherwise.
+	Scheme string
+}
+
+// DefaultClient reaches the nodes of clusters without TLS.
+var DefaultClient = newClient(nil, "http")
+
+func newClient(tlsConfig *tls.Config, scheme string) *Client {
+	dialer := &net.Dialer{Timeout: 10 * time.Second, KeepAlive: 30 * time.Second}
+	return &Client{
+		Client: &http.Client{Transport: &http.Transport{
+			Proxy:                 http.ProxyFromEnvironment,
+			DialContext:           dialer.DialContext,
+			TLSClientConfig:       tlsConfig,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ResponseHeaderTimeout: ClientTimeout,
+			IdleConnTimeout:       90 * time.Second,
+			MaxIdleConnsPerHost:   16,
+		}},
+		Scheme: scheme,
+	}
+}
+
+// NewClient returns the client for a cluster whose nodes are served with
+// the TLS config, or DefaultClient if TLS is disabled.
+func NewClient(t TLSConfig) (*Client, error) {
+	if !t.Enabled() {
+		return DefaultClient, nil
+	}
+	tlsConfig, err := t.ClientConfig()
+	if err != nil {
+		return nil, err
+	}
+	return newClient(tlsConfig, "https"), nil
+}
+
+// URL returns the URL of the path, which may include a query, on the
+// node at addr.
+func (c *Client) URL(addr, path string) string {
+	return c.Scheme + "://" + addr + path
+}
+
+// ClientConfig returns the TLS config for the connections to the other
+// nodes, which trusts the certificates described in TLSConfig.
+func (t TLSConfig) ClientConfig() (*tls.Config, error) {
+	roots, err := x509.SystemCertPool()
+	if err != nil {
+		roots = x509.NewCertPool()
+	}
+
+	file := t.CAFile
+	if file == "" {
+		file = t.CertFile
+	}
+	if file != "" {
+		pem, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", file)
+		}
+	}
+	return &tls.Config{RootCAs: roots}, nil
+}
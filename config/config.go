@@ -2,31 +2,58 @@ package config
 
 import (
 	"fmt"
-	"hash/fnv"
-
-	"github.com/BurntSushi/toml"
 )
 
 // Shard describes a shard that holds the appropriate set of keys.
-// Each shard has unique set of keys.
+// Each shard has unique set of keys. GRPCAddress is the address of the
+// gRPC listener of the shard, if it has one.
 type Shard struct {
-	Name    string
-	Idx     int
-	Address string
+	Name        string `toml:"name" json:"name" yaml:"name"`
+	Idx         int    `toml:"idx" json:"idx" yaml:"idx"`
+	Address     string `toml:"address" json:"address" yaml:"address"`
+	GRPCAddress string `toml:"grpc_address,omitempty" json:"grpc_address,omitempty" yaml:"grpc_address,omitempty"`
 }
 
 // Config describes the sharding config.
+//
+// Epoch is the version of the topology. It must be increased every time
+// the set of shards or their addresses change so that nodes can detect
+// requests routed using an outdated view of the cluster.
+//
+// Sharding selects how keys are assigned to shards: "hash" (the default)
+// or "range". With range sharding Splits holds the sorted split points:
+// shard i owns the keys in [Splits[i-1], Splits[i]), the first shard owns
+// everything below Splits[0] and the last one everything from the last
+// split point onwards.
+//
+// Hash selects the hash function used by hash sharding: "fnv" (the
+// default), "xxhash", "murmur3" or "crc32". With HashTags only the hash
+// tag of the key is hashed, see HashTag. It is off by default, because
+// turning it on moves the existing keys with a tag to other shards, so
+// a cluster that enables it must run /migrate on every shard afterwards.
+//
+// Node holds the settings of the individual nodes.
 type Config struct {
-	Shards []Shard
+	Epoch    int64      `toml:"epoch" json:"epoch" yaml:"epoch"`
+	Sharding string     `toml:"sharding,omitempty" json:"sharding,omitempty" yaml:"sharding,omitempty"`
+	Hash     string     `toml:"hash,omitempty" json:"hash,omitempty" yaml:"hash,omitempty"`
+	HashTags bool       `toml:"hash_tags,omitempty" json:"hash_tags,omitempty" yaml:"hash_tags,omitempty"`
+	Splits   []string   `toml:"splits,omitempty" json:"splits,omitempty" yaml:"splits,omitempty"`
+	Shards   []Shard    `toml:"shards" json:"shards" yaml:"shards"`
+	Node     NodeConfig `toml:"node" json:"node" yaml:"node"`
 }
 
+const (
+	// HashSharding spreads keys over shards using a hash of the key.
+	HashSharding = "hash"
+	// RangeSharding assigns contiguous key ranges to shards.
+	RangeSharding = "range"
+)
+
 // ParseFile parses the config and returns it upon success.
+// The format is detected by the file extension, see ParseFileFormat.
 func ParseFile(filename string) (Config, error) {
-	var c Config
-	if _, err := toml.DecodeFile(filename, &c); err != nil {
-		return Config{}, err
-	}
-	return c, nil
+	return ParseFileFormat(filename, "")
 }
 
 // Shards represents an easier-to-use representation of
@@ -36,6 +63,18 @@ type Shards struct {
 	Count  int
 	CurIdx int
 	Addrs  map[int]string
+	Epoch  int64
+
+	// GRPCAddrs are the addresses of the gRPC listeners of the shards
+	// that have one.
+	GRPCAddrs map[int]string
+
+	// Splits are the range split points, only set for range sharding.
+	Splits []string
+	// Hash is the name of the hash function, FNV-64 if empty.
+	Hash string
+	// HashTags is whether only the hash tags of the keys are hashed.
+	HashTags bool
 }
 
 // ParseShards converts and verifies the list of shards
@@ -45,12 +84,43 @@ func ParseShards(shards []Shard, curShardName string) (*Shards, error) {
 	shardCount := len(shards)
 	shardIdx := -1
 	addrs := make(map[int]string)
+	var grpcAddrs map[int]string
+	names := make(map[string]bool)
+	seenAddrs := make(map[string]bool)
 
 	for _, s := range shards {
 		if _, ok := addrs[s.Idx]; ok {
 			return nil, fmt.Errorf("duplicate shard index: %d", s.Idx)
 		}
 
+		if names[s.Name] {
+			return nil, fmt.Errorf("duplicate shard name: %q", s.Name)
+		}
+		names[s.Name] = true
+
+		if err := validateAddress(s.Address); err != nil {
+			return nil, fmt.Errorf("shard %q: %w", s.Name, err)
+		}
+		if seenAddrs[s.Address] {
+			return nil, fmt.Errorf("duplicate shard address: %q", s.Address)
+		}
+		seenAddrs[s.Address] = true
+
+		if s.GRPCAddress != "" {
+			if err := validateAddress(s.GRPCAddress); err != nil {
+				return nil, fmt.Errorf("shard %q: gRPC %w", s.Name, err)
+			}
+			if seenAddrs[s.GRPCAddress] {
+				return nil, fmt.Errorf("duplicate shard address: %q", s.GRPCAddress)
+			}
+			seenAddrs[s.GRPCAddress] = true
+
+			if grpcAddrs == nil {
+				grpcAddrs = make(map[int]string)
+			}
+			grpcAddrs[s.Idx] = s.GRPCAddress
+		}
+
 		addrs[s.Idx] = s.Address
 		if s.Name == curShardName {
 			shardIdx = s.Idx
@@ -68,15 +138,49 @@ func ParseShards(shards []Shard, curShardName string) (*Shards, error) {
 	}
 
 	return &Shards{
-		Addrs:  addrs,
-		Count:  shardCount,
-		CurIdx: shardIdx,
+		Addrs:     addrs,
+		Count:     shardCount,
+		CurIdx:    shardIdx,
+		GRPCAddrs: grpcAddrs,
 	}, nil
 }
 
+// NewShards converts and verifies the whole sharding config,
+// including the topology epoch and the sharding scheme.
+func NewShards(c Config, curShardName string) (*Shards, error) {
+	s, err := ParseShards(c.Shards, curShardName)
+	if err != nil {
+		return nil, err
+	}
+	s.Epoch = c.Epoch
+
+	if err := validateHash(c.Hash); err != nil {
+		return nil, err
+	}
+	s.Hash, s.HashTags = c.Hash, c.HashTags
+
+	switch c.Sharding {
+	case "", HashSharding:
+		if len(c.Splits) != 0 {
+			return nil, fmt.Errorf("split points are only allowed with %q sharding", RangeSharding)
+		}
+	case RangeSharding:
+		if err := validateSplits(c.Splits, s.Count); err != nil {
+			return nil, err
+		}
+		s.Splits = c.Splits
+	default:
+		return nil, fmt.Errorf("unknown sharding %q", c.Sharding)
+	}
+
+	return s, nil
+}
+
 // Index returns the shard number for the corresponding key.
 func (s *Shards) Index(key string) int {
-	h := fnv.New64()
-	h.Write([]byte(key))
-	return int(h.Sum64() % uint64(s.Count))
+	if s.Splits != nil {
+		return rangeIndex(s.Splits, key)
+	}
+
+	return int(s.hashKey(key) % uint64(s.Count))
 }
@@ -47,6 +47,7 @@ func TestParseConfig(t *testing.T) {
 				Address: "localhost:8080",
 			},
 		},
+		Node: config.DefaultNodeConfig(),
 	}
 
 	if !reflect.DeepEqual(got, want) {
@@ -83,3 +84,38 @@ func TestParseShards(t *testing.T) {
 		t.Errorf("The shards config does match: got: %#v, want: %#v", got, want)
 	}
 }
+
+func TestParseGRPCAddresses(t *testing.T) {
+	c := createConfig(t, `
+	[[shards]]
+		name = "shard1"
+		idx = 0
+		address = "localhost:8080"
+		grpc_address = "localhost:9090"
+	[[shards]]
+		name = "shard2"
+		idx = 1
+		address = "localhost:8081"`)
+
+	got, err := config.ParseShards(c.Shards, "shard1")
+	if err != nil {
+		t.Fatalf("Could not parse shards %#v: %v", c.Shards, err)
+	}
+
+	want := map[int]string{0: "localhost:9090"}
+	if !reflect.DeepEqual(got.GRPCAddrs, want) {
+		t.Errorf("Unexpected gRPC addresses: got %v, want %v", got.GRPCAddrs, want)
+	}
+}
+
+func TestParseEpoch(t *testing.T) {
+	got := createConfig(t, `epoch = 7
+	[[shards]]
+		name = "shard1"
+		idx = 0
+		address = "localhost:8080"`)
+
+	if got.Epoch != 7 {
+		t.Errorf("Unexpected epoch: got %d, want %d", got.Epoch, 7)
+	}
+}
@@ -0,0 +1,152 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// Supported config file formats.
+const (
+	FormatTOML = "toml"
+	FormatJSON = "json"
+	FormatYAML = "yaml"
+)
+
+// FormatOf detects the config format by the file extension.
+// Files with other extensions are treated as TOML.
+func FormatOf(filename string) string {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".json":
+		return FormatJSON
+	case ".yaml", ".yml":
+		return FormatYAML
+	default:
+		return FormatTOML
+	}
+}
+
+// ParseFileFormat parses the config in the given format, or in the format
+// detected by the file extension if format is empty. Unknown fields are
+// rejected, unset node settings get their defaults and can be overridden
+// with KVDB_* environment variables.
+func ParseFileFormat(filename, format string) (Config, error) {
+	if format == "" {
+		format = FormatOf(filename)
+	}
+
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return Config{}, err
+	}
+
+	c, err := Decode(data, format)
+	if err != nil {
+		return Config{}, fmt.Errorf("%s: %w", filename, err)
+	}
+
+	if err := c.Complete(); err != nil {
+		return Config{}, err
+	}
+	return c, nil
+}
+
+// Complete gives the unset node settings their defaults and overrides
+// them with the KVDB_* environment variables. Configs that do not come
+// from a file, such as the ones served by the coordinator, must be
+// completed before they are validated and used.
+func (c *Config) Complete() error {
+	c.Node.applyDefaults()
+	return c.Node.applyEnv()
+}
+
+// Decode strictly decodes the config in the given format.
+func Decode(data []byte, format string) (Config, error) {
+	var c Config
+
+	switch format {
+	case FormatTOML:
+		md, err := toml.Decode(string(data), &c)
+		if err != nil {
+			var perr toml.ParseError
+			if errors.As(err, &perr) {
+				return Config{}, errors.New(perr.ErrorWithPosition())
+			}
+			return Config{}, err
+		}
+
+		if undecoded := md.Undecoded(); len(undecoded) > 0 {
+			return Config{}, fmt.Errorf("unknown field %q", undecoded[0].String())
+		}
+
+	case FormatJSON:
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&c); err != nil {
+			return Config{}, jsonErrorWithPosition(data, err)
+		}
+
+	case FormatYAML:
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		// An empty document decodes into an empty config.
+		if err := dec.Decode(&c); err != nil && err != io.EOF {
+			return Config{}, err
+		}
+
+	default:
+		return Config{}, fmt.Errorf("unknown config format %q", format)
+	}
+
+	return c, nil
+}
+
+// jsonErrorWithPosition adds the line and column to JSON errors that have an offset.
+func jsonErrorWithPosition(data []byte, err error) error {
+	var offset int64
+	var serr *json.SyntaxError
+	var terr *json.UnmarshalTypeError
+
+	switch {
+	case errors.As(err, &serr):
+		offset = serr.Offset
+	case errors.As(err, &terr):
+		offset = terr.Offset
+	default:
+		return err
+	}
+
+	before := data[:offset]
+	line := bytes.Count(before, []byte("\n")) + 1
+	col := int(offset) - bytes.LastIndexByte(before, '\n')
+	return fmt.Errorf("line %d, column %d: %w", line, col, err)
+}
+
+// Encode writes the config in the given format.
+func Encode(w io.Writer, c Config, format string) error {
+	switch format {
+	case FormatTOML:
+		return toml.NewEncoder(w).Encode(c)
+	case FormatJSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(c)
+	case FormatYAML:
+		enc := yaml.NewEncoder(w)
+		enc.SetIndent(2)
+		if err := enc.Encode(c); err != nil {
+			return err
+		}
+		return enc.Close()
+	default:
+		return fmt.Errorf("unknown config format %q", format)
+	}
+}
@@ -0,0 +1,138 @@
+package config_test
+
+import (
+	"bytes"
+	"go-kvdb/config"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func fullConfig() config.Config {
+	c := config.Config{
+		Epoch:    4,
+		Sharding: config.RangeSharding,
+		Hash:     config.HashXXHash,
+		HashTags: true,
+		Splits:   []string{"m"},
+		Shards: []config.Shard{
+			{Name: "shard1", Idx: 0, Address: "localhost:8080"},
+			{Name: "shard2", Idx: 1, Address: "localhost:8081"},
+		},
+		Node: config.DefaultNodeConfig(),
+	}
+	c.Node.DataDir = "/var/lib/kvdb"
+	c.Node.ReadTimeout = config.Duration(1500 * time.Millisecond)
+	c.Node.TLS = config.TLSConfig{CertFile: "cert.pem", KeyFile: "key.pem"}
+	return c
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, ext := range []string{".toml", ".json", ".yaml", ".yml"} {
+		want := fullConfig()
+
+		var buf bytes.Buffer
+		if err := config.Encode(&buf, want, config.FormatOf(ext)); err != nil {
+			t.Fatalf("Could not encode %s: %v", ext, err)
+		}
+
+		path := filepath.Join(t.TempDir(), "sharding"+ext)
+		if err := os.WriteFile(path, buf.Bytes(), 0600); err != nil {
+			t.Fatalf("Could not write %s: %v", path, err)
+		}
+
+		got, err := config.ParseFile(path)
+		if err != nil {
+			t.Fatalf("Could not parse %s:\n%s\nerror: %v", ext, buf.Bytes(), err)
+		}
+
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s round trip mismatch:\ngot:  %#v\nwant: %#v", ext, got, want)
+		}
+
+		if err := got.Validate(); err != nil {
+			t.Errorf("%s: unexpected validation error: %v", ext, err)
+		}
+	}
+}
+
+func TestParseFormats(t *testing.T) {
+	files := map[string]string{
+		"sharding.json": `{
+			"epoch": 1,
+			"shards": [
+				{"name": "shard1", "idx": 0, "address": "localhost:8080"}
+			],
+			"node": {"write_timeout": "2s"}
+		}`,
+		"sharding.yaml": `
+epoch: 1
+shards:
+  - name: shard1
+    idx: 0
+    address: localhost:8080
+node:
+  write_timeout: 2s
+`,
+	}
+
+	want := config.Config{
+		Epoch:  1,
+		Shards: []config.Shard{{Name: "shard1", Idx: 0, Address: "localhost:8080"}},
+		Node:   config.DefaultNodeConfig(),
+	}
+	want.Node.WriteTimeout = config.Duration(2 * time.Second)
+
+	for name, contents := range files {
+		got, err := config.ParseFile(writeConfig(t, name, contents))
+		if err != nil {
+			t.Fatalf("Could not parse %s: %v", name, err)
+		}
+
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: unexpected config:\ngot:  %#v\nwant: %#v", name, got, want)
+		}
+	}
+}
+
+func TestParseFormatErrors(t *testing.T) {
+	files := map[string]string{
+		"unknown.json": `{"shards": [{"name": "a", "idx": 0, "adress": "localhost:8080"}]}`,
+		"syntax.json":  "{\n\"epoch\": 1,,\n}",
+		"unknown.yaml": "shards:\n  - name: a\n    adress: localhost:8080\n",
+		"syntax.yaml":  "shards:\n  - name: a\n - idx: 1\n",
+	}
+
+	wants := map[string]string{
+		"unknown.json": `unknown field "adress"`,
+		"syntax.json":  "line 2",
+		"unknown.yaml": "line 3",
+		"syntax.yaml":  "line 2",
+	}
+
+	for name, contents := range files {
+		_, err := config.ParseFile(writeConfig(t, name, contents))
+		if err == nil || !strings.Contains(err.Error(), wants[name]) {
+			t.Errorf("%s: expected an error containing %q, got %v", name, wants[name], err)
+		}
+	}
+}
+
+func TestExplicitFormat(t *testing.T) {
+	path := writeConfig(t, "sharding.conf", `{"epoch": 3, "shards": [{"name": "a", "idx": 0, "address": "localhost:8080"}]}`)
+
+	c, err := config.ParseFileFormat(path, config.FormatJSON)
+	if err != nil {
+		t.Fatalf("Could not parse the config as JSON: %v", err)
+	}
+	if c.Epoch != 3 {
+		t.Errorf("Unexpected epoch: got %d, want 3", c.Epoch)
+	}
+
+	if _, err := config.ParseFileFormat(path, "ini"); err == nil {
+		t.Errorf("Expected an error for an unknown format")
+	}
+}
@@ -0,0 +1,73 @@
+package config
+
+import (
+	"fmt"
+	"hash/crc32"
+	"hash/fnv"
+	"strings"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/spaolacci/murmur3"
+)
+
+// Supported hash functions for hash sharding.
+const (
+	HashFNV     = "fnv"
+	HashXXHash  = "xxhash"
+	HashMurmur3 = "murmur3"
+	HashCRC32   = "crc32"
+)
+
+var hashFuncs = map[string]func([]byte) uint64{
+	HashFNV: func(b []byte) uint64 {
+		h := fnv.New64()
+		h.Write(b)
+		return h.Sum64()
+	},
+	HashXXHash:  xxhash.Sum64,
+	HashMurmur3: murmur3.Sum64,
+	HashCRC32: func(b []byte) uint64 {
+		return uint64(crc32.ChecksumIEEE(b))
+	},
+}
+
+func validateHash(name string) error {
+	if name == "" {
+		return nil
+	}
+	if _, ok := hashFuncs[name]; !ok {
+		return fmt.Errorf("unknown hash function %q", name)
+	}
+	return nil
+}
+
+// HashTag returns the part of the key that is hashed with HashTags.
+// If the key contains a non-empty substring between the first "{" and
+// the following "}", only that substring is hashed, so "user:{42}:profile"
+// and "user:{42}:settings" always end up on the same shard.
+// Otherwise the whole key is hashed.
+func HashTag(key string) string {
+	start := strings.IndexByte(key, '{')
+	if start < 0 {
+		return key
+	}
+
+	end := strings.IndexByte(key[start+1:], '}')
+	if end <= 0 {
+		return key
+	}
+	return key[start+1 : start+1+end]
+}
+
+// hashKey hashes the key, or its hash tag with HashTags, with the hash
+// function of the shards, FNV-64 by default.
+func (s *Shards) hashKey(key string) uint64 {
+	f, ok := hashFuncs[s.Hash]
+	if !ok {
+		f = hashFuncs[HashFNV]
+	}
+	if s.HashTags {
+		key = HashTag(key)
+	}
+	return f([]byte(key))
+}
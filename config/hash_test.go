@@ -0,0 +1,84 @@
+package config_test
+
+import (
+	"fmt"
+	"go-kvdb/config"
+	"testing"
+)
+
+func TestHashTag(t *testing.T) {
+	tags := map[string]string{
+		"user:{42}:profile": "42",
+		"{42}":              "42",
+		"user:42":           "user:42",
+		"user:{}:profile":   "user:{}:profile",
+		"user:{42":          "user:{42",
+		"a{b}{c}":           "b",
+		"}a{b}":             "b",
+	}
+
+	for key, want := range tags {
+		if got := config.HashTag(key); got != want {
+			t.Errorf("HashTag(%q) = %q, want %q", key, got, want)
+		}
+	}
+}
+
+func TestHashFunctions(t *testing.T) {
+	for _, hash := range []string{"", config.HashFNV, config.HashXXHash, config.HashMurmur3, config.HashCRC32} {
+		c := config.Config{
+			Hash:     hash,
+			HashTags: true,
+			Shards: []config.Shard{
+				{Name: "a", Idx: 0, Address: "localhost:8080"},
+				{Name: "b", Idx: 1, Address: "localhost:8081"},
+				{Name: "c", Idx: 2, Address: "localhost:8082"},
+			},
+		}
+
+		s, err := config.NewShards(c, "a")
+		if err != nil {
+			t.Fatalf("Could not parse shards with hash %q: %v", hash, err)
+		}
+
+		used := make(map[int]bool)
+		for i := 0; i < 100; i++ {
+			idx := s.Index(fmt.Sprintf("user:{%d}:profile", i))
+			if other := s.Index(fmt.Sprintf("user:{%d}:settings", i)); other != idx {
+				t.Errorf("Hash %q: keys with the same hash tag %d landed on shards %d and %d", hash, i, idx, other)
+			}
+			used[idx] = true
+		}
+
+		if len(used) != 3 {
+			t.Errorf("Hash %q: expected keys to be spread over 3 shards, got %d", hash, len(used))
+		}
+	}
+
+	// Without hash tags the whole key is hashed.
+	s, err := config.NewShards(config.Config{
+		Shards: []config.Shard{
+			{Name: "a", Idx: 0, Address: "localhost:8080"},
+			{Name: "b", Idx: 1, Address: "localhost:8081"},
+			{Name: "c", Idx: 2, Address: "localhost:8082"},
+		},
+	}, "a")
+	if err != nil {
+		t.Fatalf("Could not parse shards: %v", err)
+	}
+	split := false
+	for i := 0; i < 100 && !split; i++ {
+		split = s.Index(fmt.Sprintf("user:{%d}:profile", i)) != s.Index(fmt.Sprintf("user:{%d}:settings", i))
+	}
+	if !split {
+		t.Errorf("Keys with the same hash tag always landed on the same shard without hash tags")
+	}
+
+	_, err = config.NewShards(config.Config{
+		Hash:   "md5",
+		Shards: []config.Shard{{Name: "a", Idx: 0, Address: "localhost:8080"}},
+	}, "a")
+	if err == nil {
+		t.Errorf("Expected an error for an unknown hash function")
+	}
+}
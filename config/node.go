@@ -0,0 +1,268 @@
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Duration is a time.Duration that is written as a string like "10s" in config files.
+type Duration time.Duration
+
+// UnmarshalText parses the duration in the time.ParseDuration format.
+func (d *Duration) UnmarshalText(text []byte) error {
+	v, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// MarshalText formats the duration in the time.ParseDuration format.
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+// NodeConfig describes the settings of a single node.
+type NodeConfig struct {
+	// DataDir is the directory for the shard databases. It is used when
+	// the database location is not given explicitly.
+	DataDir      string   `toml:"data_dir,omitempty" json:"data_dir,omitempty" yaml:"data_dir,omitempty"`
+	ReadTimeout  Duration `toml:"read_timeout,omitempty" json:"read_timeout,omitempty" yaml:"read_timeout,omitempty"`
+	WriteTimeout Duration `toml:"write_timeout,omitempty" json:"write_timeout,omitempty" yaml:"write_timeout,omitempty"`
+	IdleTimeout  Duration `toml:"idle_timeout,omitempty" json:"idle_timeout,omitempty" yaml:"idle_timeout,omitempty"`
+	// Replicas is the number of copies of every key in the cluster.
+	// Replication is not implemented yet, so it must be 1.
+	Replicas int       `toml:"replicas,omitempty" json:"replicas,omitempty" yaml:"replicas,omitempty"`
+	TLS      TLSConfig `toml:"tls,omitempty" json:"tls,omitempty" yaml:"tls,omitempty"`
+	Limits   Limits    `toml:"limits,omitempty" json:"limits,omitempty" yaml:"limits,omitempty"`
+	Backup   Backup    `toml:"backup,omitempty" json:"backup,omitempty" yaml:"backup,omitempty"`
+}
+
+// TLSConfig holds the certificate used to serve HTTPS and gRPC. TLS is
+// disabled when both files are empty. The other nodes are trusted if their
+// certificates are signed by the system roots, by the CA certificates in
+// CAFile or, without CAFile, if they are the certificate of CertFile.
+type TLSConfig struct {
+	CertFile string `toml:"cert_file,omitempty" json:"cert_file,omitempty" yaml:"cert_file,omitempty"`
+	KeyFile  string `toml:"key_file,omitempty" json:"key_file,omitempty" yaml:"key_file,omitempty"`
+	CAFile   string `toml:"ca_file,omitempty" json:"ca_file,omitempty" yaml:"ca_file,omitempty"`
+}
+
+// Enabled reports whether the node must serve HTTPS.
+func (t TLSConfig) Enabled() bool {
+	return t.CertFile != "" || t.KeyFile != ""
+}
+
+// Limits restricts the size of the stored data. Zero means no limit.
+type Limits struct {
+	MaxKeySize   int `toml:"max_key_size,omitempty" json:"max_key_size,omitempty" yaml:"max_key_size,omitempty"`
+	MaxValueSize int `toml:"max_value_size,omitempty" json:"max_value_size,omitempty" yaml:"max_value_size,omitempty"`
+}
+
+// Backup configures the scheduled backups of the node. Scheduled backups
+// are disabled when Interval is zero.
+//
+// Every FullEvery-th backup is a full copy of the database and the ones in
+// between only hold the changes since the previous backup. A full backup
+// together with its incremental backups forms a chain. Keep is the number
+// of chains to keep and MaxAge removes the chains whose newest backup is
+// older than that; zero disables the respective rule. The newest chain is
+// never removed.
+//
+// Backups are written either to Dir or to the S3-compatible object store.
+type Backup struct {
+	Interval  Duration `toml:"interval,omitempty" json:"interval,omitempty" yaml:"interval,omitempty"`
+	FullEvery int      `toml:"full_every,omitempty" json:"full_every,omitempty" yaml:"full_every,omitempty"`
+	Keep      int      `toml:"keep,omitempty" json:"keep,omitempty" yaml:"keep,omitempty"`
+	MaxAge    Duration `toml:"max_age,omitempty" json:"max_age,omitempty" yaml:"max_age,omitempty"`
+	Dir       string   `toml:"dir,omitempty" json:"dir,omitempty" yaml:"dir,omitempty"`
+	S3        S3       `toml:"s3,omitempty" json:"s3,omitempty" yaml:"s3,omitempty"`
+}
+
+// Enabled reports whether the node must take scheduled backups.
+func (b Backup) Enabled() bool {
+	return b.Interval > 0
+}
+
+// S3 describes a bucket in an S3-compatible object store. Objects are
+// addressed path-style: Endpoint/Bucket/Prefix/name. Region is us-east-1
+// if empty.
+type S3 struct {
+	Endpoint  string `toml:"endpoint,omitempty" json:"endpoint,omitempty" yaml:"endpoint,omitempty"`
+	Bucket    string `toml:"bucket,omitempty" json:"bucket,omitempty" yaml:"bucket,omitempty"`
+	Prefix    string `toml:"prefix,omitempty" json:"prefix,omitempty" yaml:"prefix,omitempty"`
+	Region    string `toml:"region,omitempty" json:"region,omitempty" yaml:"region,omitempty"`
+	AccessKey string `toml:"access_key,omitempty" json:"access_key,omitempty" yaml:"access_key,omitempty"`
+	SecretKey string `toml:"secret_key,omitempty" json:"secret_key,omitempty" yaml:"secret_key,omitempty"`
+}
+
+// maxBoltKeySize is the largest key bolt can store.
+const maxBoltKeySize = 32768
+
+// DefaultNodeConfig returns the node settings used for the fields
+// that are not set in the config file.
+func DefaultNodeConfig() NodeConfig {
+	return NodeConfig{
+		ReadTimeout:  Duration(10 * time.Second),
+		WriteTimeout: Duration(10 * time.Second),
+		IdleTimeout:  Duration(60 * time.Second),
+		Replicas:     1,
+		Limits: Limits{
+			MaxKeySize:   maxBoltKeySize,
+			MaxValueSize: 8 << 20,
+		},
+	}
+}
+
+func (n *NodeConfig) applyDefaults() {
+	def := DefaultNodeConfig()
+
+	if n.ReadTimeout == 0 {
+		n.ReadTimeout = def.ReadTimeout
+	}
+	if n.WriteTimeout == 0 {
+		n.WriteTimeout = def.WriteTimeout
+	}
+	if n.IdleTimeout == 0 {
+		n.IdleTimeout = def.IdleTimeout
+	}
+	if n.Replicas == 0 {
+		n.Replicas = def.Replicas
+	}
+	if n.Limits.MaxKeySize == 0 {
+		n.Limits.MaxKeySize = def.Limits.MaxKeySize
+	}
+	if n.Limits.MaxValueSize == 0 {
+		n.Limits.MaxValueSize = def.Limits.MaxValueSize
+	}
+}
+
+// envOverrides maps environment variables to the node settings they override.
+var envOverrides = []struct {
+	name string
+	set  func(n *NodeConfig, v string) error
+}{
+	{"KVDB_DATA_DIR", func(n *NodeConfig, v string) error { n.DataDir = v; return nil }},
+	{"KVDB_READ_TIMEOUT", func(n *NodeConfig, v string) error { return n.ReadTimeout.UnmarshalText([]byte(v)) }},
+	{"KVDB_WRITE_TIMEOUT", func(n *NodeConfig, v string) error { return n.WriteTimeout.UnmarshalText([]byte(v)) }},
+	{"KVDB_IDLE_TIMEOUT", func(n *NodeConfig, v string) error { return n.IdleTimeout.UnmarshalText([]byte(v)) }},
+	{"KVDB_REPLICAS", func(n *NodeConfig, v string) error { return parseInt(v, &n.Replicas) }},
+	{"KVDB_TLS_CERT_FILE", func(n *NodeConfig, v string) error { n.TLS.CertFile = v; return nil }},
+	{"KVDB_TLS_KEY_FILE", func(n *NodeConfig, v string) error { n.TLS.KeyFile = v; return nil }},
+	{"KVDB_TLS_CA_FILE", func(n *NodeConfig, v string) error { n.TLS.CAFile = v; return nil }},
+	{"KVDB_MAX_KEY_SIZE", func(n *NodeConfig, v string) error { return parseInt(v, &n.Limits.MaxKeySize) }},
+	{"KVDB_MAX_VALUE_SIZE", func(n *NodeConfig, v string) error { return parseInt(v, &n.Limits.MaxValueSize) }},
+	{"KVDB_BACKUP_INTERVAL", func(n *NodeConfig, v string) error { return n.Backup.Interval.UnmarshalText([]byte(v)) }},
+	{"KVDB_BACKUP_DIR", func(n *NodeConfig, v string) error { n.Backup.Dir = v; return nil }},
+	{"KVDB_BACKUP_S3_ACCESS_KEY", func(n *NodeConfig, v string) error { n.Backup.S3.AccessKey = v; return nil }},
+	{"KVDB_BACKUP_S3_SECRET_KEY", func(n *NodeConfig, v string) error { n.Backup.S3.SecretKey = v; return nil }},
+}
+
+func parseInt(v string, dst *int) error {
+	i, err := strconv.Atoi(v)
+	if err != nil {
+		return err
+	}
+	*dst = i
+	return nil
+}
+
+// applyEnv overrides the node settings with the KVDB_* environment variables.
+func (n *NodeConfig) applyEnv() error {
+	for _, o := range envOverrides {
+		v, ok := os.LookupEnv(o.name)
+		if !ok {
+			continue
+		}
+		if err := o.set(n, v); err != nil {
+			return fmt.Errorf("environment variable %s=%q: %w", o.name, v, err)
+		}
+	}
+	return nil
+}
+
+// validate checks the node settings for a cluster with the given number of shards.
+func (n NodeConfig) validate(shardCount int) []error {
+	var errs []error
+
+	timeouts := []struct {
+		name string
+		d    Duration
+	}{
+		{"read_timeout", n.ReadTimeout},
+		{"write_timeout", n.WriteTimeout},
+		{"idle_timeout", n.IdleTimeout},
+	}
+	for _, t := range timeouts {
+		if t.d < 0 {
+			errs = append(errs, fmt.Errorf("node.%s: must not be negative, got %s", t.name, time.Duration(t.d)))
+		}
+	}
+
+	if n.Replicas != 1 {
+		errs = append(errs, fmt.Errorf("node.replicas: replication is not supported, must be 1, got %d", n.Replicas))
+	}
+
+	if n.TLS.Enabled() && (n.TLS.CertFile == "" || n.TLS.KeyFile == "") {
+		errs = append(errs, fmt.Errorf("node.tls: both cert_file and key_file must be set"))
+	}
+
+	if n.Limits.MaxKeySize < 0 || n.Limits.MaxKeySize > maxBoltKeySize {
+		errs = append(errs, fmt.Errorf("node.limits.max_key_size: must be between 0 and %d, got %d", maxBoltKeySize, n.Limits.MaxKeySize))
+	}
+	if n.Limits.MaxValueSize < 0 {
+		errs = append(errs, fmt.Errorf("node.limits.max_value_size: must not be negative, got %d", n.Limits.MaxValueSize))
+	}
+
+	errs = append(errs, n.Backup.validate()...)
+
+	return errs
+}
+
+func (b Backup) validate() []error {
+	var errs []error
+
+	durations := []struct {
+		name string
+		d    Duration
+	}{
+		{"interval", b.Interval},
+		{"max_age", b.MaxAge},
+	}
+	for _, d := range durations {
+		if d.d < 0 {
+			errs = append(errs, fmt.Errorf("node.backup.%s: must not be negative, got %s", d.name, time.Duration(d.d)))
+		}
+	}
+
+	if b.FullEvery < 0 {
+		errs = append(errs, fmt.Errorf("node.backup.full_every: must not be negative, got %d", b.FullEvery))
+	}
+	if b.Keep < 0 {
+		errs = append(errs, fmt.Errorf("node.backup.keep: must not be negative, got %d", b.Keep))
+	}
+
+	if !b.Enabled() {
+		return errs
+	}
+
+	switch {
+	case b.Dir == "" && b.S3.Endpoint == "":
+		errs = append(errs, fmt.Errorf("node.backup: either dir or s3.endpoint must be set"))
+	case b.Dir != "" && b.S3.Endpoint != "":
+		errs = append(errs, fmt.Errorf("node.backup: only one of dir and s3.endpoint may be set"))
+	case b.S3.Endpoint != "":
+		if u, err := url.Parse(b.S3.Endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("node.backup.s3.endpoint: must be an http or https URL, got %q", b.S3.Endpoint))
+		}
+		if b.S3.Bucket == "" {
+			errs = append(errs, fmt.Errorf("node.backup.s3.bucket: bucket is empty"))
+		}
+	}
+
+	return errs
+}
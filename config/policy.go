@@ -0,0 +1,101 @@
+package config
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Bucket sharding strategies.
+const (
+	// PolicyDefault spreads the bucket keys over all shards
+	// using the cluster-wide sharding scheme.
+	PolicyDefault = "default"
+	// PolicyPinned keeps all bucket keys on a single shard.
+	PolicyPinned = "pinned"
+	// PolicySubset hashes the bucket keys across a subset of shards.
+	PolicySubset = "subset"
+)
+
+// BucketPolicy describes how the keys of a bucket are spread over shards.
+type BucketPolicy struct {
+	Strategy string `json:"strategy"`
+	Shards   []int  `json:"shards,omitempty"`
+}
+
+// Equal reports whether both policies spread the keys in the same way.
+// An empty strategy is the default one.
+func (p BucketPolicy) Equal(o BucketPolicy) bool {
+	strategy := func(s string) string {
+		if s == "" {
+			return PolicyDefault
+		}
+		return s
+	}
+	if strategy(p.Strategy) != strategy(o.Strategy) || len(p.Shards) != len(o.Shards) {
+		return false
+	}
+	for i := range p.Shards {
+		if p.Shards[i] != o.Shards[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Validate checks that the policy can be used with the topology.
+func (p BucketPolicy) Validate(s *Shards) error {
+	switch p.Strategy {
+	case "", PolicyDefault:
+		if len(p.Shards) != 0 {
+			return fmt.Errorf("%q policy does not accept shards", PolicyDefault)
+		}
+		return nil
+	case PolicyPinned:
+		if len(p.Shards) != 1 {
+			return fmt.Errorf("%q policy needs exactly one shard, got %d", PolicyPinned, len(p.Shards))
+		}
+	case PolicySubset:
+		if len(p.Shards) == 0 {
+			return fmt.Errorf("%q policy needs at least one shard", PolicySubset)
+		}
+	default:
+		return fmt.Errorf("unknown bucket policy %q", p.Strategy)
+	}
+
+	seen := make(map[int]bool)
+	for _, idx := range p.Shards {
+		if _, ok := s.Addrs[idx]; !ok {
+			return fmt.Errorf("shard %d is not found", idx)
+		}
+		if seen[idx] {
+			return fmt.Errorf("duplicate shard index: %d", idx)
+		}
+		seen[idx] = true
+	}
+	return nil
+}
+
+// BucketIndex returns the shard number for the key in a bucket with the policy.
+func (s *Shards) BucketIndex(p BucketPolicy, key string) int {
+	switch p.Strategy {
+	case PolicyPinned:
+		return p.Shards[0]
+	case PolicySubset:
+		return p.Shards[s.hashKey(key)%uint64(len(p.Shards))]
+	default:
+		return s.Index(key)
+	}
+}
+
+// BucketOverlapping returns the indexes of the shards that may hold
+// keys in [start, end) for a bucket with the policy.
+func (s *Shards) BucketOverlapping(p BucketPolicy, start, end string) []int {
+	switch p.Strategy {
+	case PolicyPinned, PolicySubset:
+		res := append([]int(nil), p.Shards...)
+		sort.Ints(res)
+		return res
+	default:
+		return s.Overlapping(start, end)
+	}
+}
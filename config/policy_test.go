@@ -0,0 +1,54 @@
+package config_test
+
+import (
+	"go-kvdb/config"
+	"reflect"
+	"testing"
+)
+
+func TestBucketPolicy(t *testing.T) {
+	s := &config.Shards{
+		Count:  3,
+		CurIdx: 0,
+		Addrs:  map[int]string{0: "localhost:8080", 1: "localhost:8081", 2: "localhost:8082"},
+	}
+
+	pinned := config.BucketPolicy{Strategy: config.PolicyPinned, Shards: []int{2}}
+	if err := pinned.Validate(s); err != nil {
+		t.Fatalf("Unexpected error for a valid policy: %v", err)
+	}
+
+	subset := config.BucketPolicy{Strategy: config.PolicySubset, Shards: []int{2, 1}}
+	if err := subset.Validate(s); err != nil {
+		t.Fatalf("Unexpected error for a valid policy: %v", err)
+	}
+
+	for _, key := range []string{"a", "b", "c", "d", "e", "f"} {
+		if got := s.BucketIndex(pinned, key); got != 2 {
+			t.Errorf("BucketIndex(pinned, %q) = %d, want 2", key, got)
+		}
+		if got := s.BucketIndex(subset, key); got != 1 && got != 2 {
+			t.Errorf("BucketIndex(subset, %q) = %d, want 1 or 2", key, got)
+		}
+		if got, want := s.BucketIndex(config.BucketPolicy{}, key), s.Index(key); got != want {
+			t.Errorf("BucketIndex(default, %q) = %d, want %d", key, got, want)
+		}
+	}
+
+	if got, want := s.BucketOverlapping(subset, "", ""), []int{1, 2}; !reflect.DeepEqual(got, want) {
+		t.Errorf("BucketOverlapping(subset) = %v, want %v", got, want)
+	}
+
+	invalid := []config.BucketPolicy{
+		{Strategy: config.PolicyPinned, Shards: []int{0, 1}},
+		{Strategy: config.PolicyPinned, Shards: []int{3}},
+		{Strategy: config.PolicySubset, Shards: []int{1, 1}},
+		{Strategy: config.PolicySubset},
+		{Strategy: "random"},
+	}
+	for _, p := range invalid {
+		if err := p.Validate(s); err == nil {
+			t.Errorf("Expected an error for policy %#v", p)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package config
+
+import (
+	"fmt"
+	"sort"
+)
+
+func validateSplits(splits []string, shardCount int) error {
+	if len(splits) != shardCount-1 {
+		return fmt.Errorf("range sharding with %d shards needs %d split points, got %d", shardCount, shardCount-1, len(splits))
+	}
+
+	for i := 1; i < len(splits); i++ {
+		if splits[i-1] >= splits[i] {
+			return fmt.Errorf("split points must be strictly increasing: %q >= %q", splits[i-1], splits[i])
+		}
+	}
+	return nil
+}
+
+// rangeIndex finds the range containing the key using binary search.
+func rangeIndex(splits []string, key string) int {
+	return sort.Search(len(splits), func(i int) bool { return splits[i] > key })
+}
+
+// Range returns the key range [start, end) owned by the shard.
+// An empty end means that the range is unbounded.
+// For hash sharding every shard can hold any key.
+func (s *Shards) Range(idx int) (start, end string) {
+	if s.Splits == nil {
+		return "", ""
+	}
+	if idx > 0 {
+		start = s.Splits[idx-1]
+	}
+	if idx < len(s.Splits) {
+		end = s.Splits[idx]
+	}
+	return start, end
+}
+
+// Overlapping returns the indexes of the shards that may hold keys
+// in [start, end). An empty end means that the range is unbounded.
+// With hash sharding every shard overlaps with any range.
+func (s *Shards) Overlapping(start, end string) []int {
+	var res []int
+	for i := 0; i < s.Count; i++ {
+		rs, re := s.Range(i)
+		if (end == "" || rs < end) && (re == "" || start < re) {
+			res = append(res, i)
+		}
+	}
+	return res
+}
+
+// PrefixRange returns the key range [start, end) that contains
+// exactly the keys with the given prefix.
+func PrefixRange(prefix string) (start, end string) {
+	b := []byte(prefix)
+	for i := len(b) - 1; i >= 0; i-- {
+		if b[i] < 0xff {
+			b[i]++
+			return prefix, string(b[:i+1])
+		}
+	}
+	// The prefix is empty or consists of 0xff bytes only.
+	return prefix, ""
+}
+
+// SplitRange returns a new config with the range that contains the split
+// point divided in two: the keys starting from the split point are moved
+// to the new shard. Shards are renumbered to keep the ranges in order and
+// the epoch is increased; the other settings are kept.
+func (c Config) SplitRange(at string, shard Shard) (Config, error) {
+	if c.Sharding != RangeSharding {
+		return Config{}, fmt.Errorf("only %q sharding can be split", RangeSharding)
+	}
+	for _, s := range c.Shards {
+		if s.Name == shard.Name {
+			return Config{}, fmt.Errorf("shard %q already exists", shard.Name)
+		}
+	}
+
+	pos := rangeIndex(c.Splits, at)
+	if pos > 0 && c.Splits[pos-1] == at {
+		return Config{}, fmt.Errorf("split point %q already exists", at)
+	}
+
+	splits := make([]string, 0, len(c.Splits)+1)
+	splits = append(splits, c.Splits[:pos]...)
+	splits = append(splits, at)
+	splits = append(splits, c.Splits[pos:]...)
+
+	// The new shard takes over the upper part of the range at index pos.
+	shards := make([]Shard, 0, len(c.Shards)+1)
+	for _, s := range c.Shards {
+		if s.Idx > pos {
+			s.Idx++
+		}
+		shards = append(shards, s)
+	}
+	shard.Idx = pos + 1
+	shards = append(shards, shard)
+	sort.Slice(shards, func(i, j int) bool { return shards[i].Idx < shards[j].Idx })
+
+	c.Epoch++
+	c.Splits, c.Shards = splits, shards
+	return c, nil
+}
+
+// MergeRange returns a new config without the named shard: its range is
+// merged into the preceding range, or into the following one if it is the
+// first shard. Shards are renumbered and the epoch is increased; the
+// other settings are kept.
+func (c Config) MergeRange(name string) (Config, error) {
+	if c.Sharding != RangeSharding {
+		return Config{}, fmt.Errorf("only %q sharding can be merged", RangeSharding)
+	}
+	if len(c.Shards) < 2 {
+		return Config{}, fmt.Errorf("cannot merge the only shard")
+	}
+
+	idx := -1
+	for _, s := range c.Shards {
+		if s.Name == name {
+			idx = s.Idx
+		}
+	}
+	if idx < 0 {
+		return Config{}, fmt.Errorf("shard %q was not found", name)
+	}
+
+	// Removing the lower bound merges the range into the previous one,
+	// the first range has no lower bound so we remove its upper bound.
+	drop := idx - 1
+	if idx == 0 {
+		drop = 0
+	}
+	splits := make([]string, 0, len(c.Splits)-1)
+	splits = append(splits, c.Splits[:drop]...)
+	splits = append(splits, c.Splits[drop+1:]...)
+
+	shards := make([]Shard, 0, len(c.Shards)-1)
+	for _, s := range c.Shards {
+		if s.Idx == idx {
+			continue
+		}
+		if s.Idx > idx {
+			s.Idx--
+		}
+		shards = append(shards, s)
+	}
+	sort.Slice(shards, func(i, j int) bool { return shards[i].Idx < shards[j].Idx })
+
+	c.Epoch++
+	c.Splits, c.Shards = splits, shards
+	return c, nil
+}
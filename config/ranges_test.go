@@ -0,0 +1,117 @@
+package config_test
+
+import (
+	"go-kvdb/config"
+	"reflect"
+	"testing"
+)
+
+func rangeConfig() config.Config {
+	return config.Config{
+		Epoch:    1,
+		Sharding: config.RangeSharding,
+		Splits:   []string{"g", "p"},
+		Shards: []config.Shard{
+			{Name: "a", Idx: 0, Address: "localhost:8080"},
+			{Name: "b", Idx: 1, Address: "localhost:8081"},
+			{Name: "c", Idx: 2, Address: "localhost:8082"},
+		},
+	}
+}
+
+func TestRangeIndex(t *testing.T) {
+	s, err := config.NewShards(rangeConfig(), "a")
+	if err != nil {
+		t.Fatalf("Could not parse shards: %v", err)
+	}
+
+	keys := map[string]int{
+		"":       0,
+		"apple":  0,
+		"g":      1,
+		"kiwi":   1,
+		"p":      2,
+		"zebra":  2,
+		"fzzzzz": 0,
+	}
+
+	for key, want := range keys {
+		if got := s.Index(key); got != want {
+			t.Errorf("Index(%q) = %d, want %d", key, got, want)
+		}
+	}
+}
+
+func TestInvalidSplits(t *testing.T) {
+	c := rangeConfig()
+	c.Splits = []string{"p", "g"}
+	if _, err := config.NewShards(c, "a"); err == nil {
+		t.Errorf("Expected an error for unsorted split points")
+	}
+
+	c.Splits = []string{"g"}
+	if _, err := config.NewShards(c, "a"); err == nil {
+		t.Errorf("Expected an error for a wrong number of split points")
+	}
+}
+
+func TestOverlapping(t *testing.T) {
+	s, err := config.NewShards(rangeConfig(), "a")
+	if err != nil {
+		t.Fatalf("Could not parse shards: %v", err)
+	}
+
+	start, end := config.PrefixRange("h")
+	if got, want := s.Overlapping(start, end), []int{1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Overlapping(%q, %q) = %v, want %v", start, end, got, want)
+	}
+
+	if got, want := s.Overlapping("c", "i"), []int{0, 1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Overlapping(c, i) = %v, want %v", got, want)
+	}
+
+	if got, want := s.Overlapping("", ""), []int{0, 1, 2}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Overlapping of everything = %v, want %v", got, want)
+	}
+}
+
+func TestSplitMergeRange(t *testing.T) {
+	// The other settings are kept.
+	base := rangeConfig()
+	base.Hash = "xxhash"
+	base.Node = config.DefaultNodeConfig()
+	base.Node.DataDir = "/var/lib/kvdb"
+
+	c, err := base.SplitRange("k", config.Shard{Name: "d", Address: "localhost:8083"})
+	if err != nil {
+		t.Fatalf("Could not split: %v", err)
+	}
+
+	want := config.Config{
+		Epoch:    2,
+		Sharding: config.RangeSharding,
+		Splits:   []string{"g", "k", "p"},
+		Shards: []config.Shard{
+			{Name: "a", Idx: 0, Address: "localhost:8080"},
+			{Name: "b", Idx: 1, Address: "localhost:8081"},
+			{Name: "d", Idx: 2, Address: "localhost:8083"},
+			{Name: "c", Idx: 3, Address: "localhost:8082"},
+		},
+		Hash: base.Hash,
+		Node: base.Node,
+	}
+	if !reflect.DeepEqual(c, want) {
+		t.Errorf("Unexpected split config: got %#v, want %#v", c, want)
+	}
+
+	c, err = c.MergeRange("d")
+	if err != nil {
+		t.Fatalf("Could not merge: %v", err)
+	}
+
+	want = base
+	want.Epoch = 3
+	if !reflect.DeepEqual(c, want) {
+		t.Errorf("Unexpected merged config: got %#v, want %#v", c, want)
+	}
+}
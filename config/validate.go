@@ -0,0 +1,103 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+)
+
+// validateAddress checks that the address is a valid host:port pair.
+func validateAddress(addr string) error {
+	if addr == "" {
+		return fmt.Errorf("address is empty")
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("malformed address %q: %w", addr, err)
+	}
+	if host == "" {
+		return fmt.Errorf("malformed address %q: missing host", addr)
+	}
+
+	p, err := strconv.Atoi(port)
+	if err != nil || p < 1 || p > 65535 {
+		return fmt.Errorf("malformed address %q: invalid port %q", addr, port)
+	}
+	return nil
+}
+
+// Validate checks the whole config and reports every problem found,
+// each prefixed with the location of the offending field.
+func (c Config) Validate() error {
+	var errs []error
+
+	if len(c.Shards) == 0 {
+		errs = append(errs, fmt.Errorf("shards: at least one shard is required"))
+	}
+
+	names := make(map[string]int)
+	idxs := make(map[int]int)
+	addrs := make(map[string]int)
+
+	for i, s := range c.Shards {
+		loc := fmt.Sprintf("shards[%d]", i)
+
+		if s.Name == "" {
+			errs = append(errs, fmt.Errorf("%s.name: name is empty", loc))
+		} else if j, ok := names[s.Name]; ok {
+			errs = append(errs, fmt.Errorf("%s.name: duplicate name %q, already used by shards[%d]", loc, s.Name, j))
+		} else {
+			names[s.Name] = i
+		}
+
+		if s.Idx < 0 || s.Idx >= len(c.Shards) {
+			errs = append(errs, fmt.Errorf("%s.idx: must be between 0 and %d, got %d", loc, len(c.Shards)-1, s.Idx))
+		} else if j, ok := idxs[s.Idx]; ok {
+			errs = append(errs, fmt.Errorf("%s.idx: duplicate index %d, already used by shards[%d]", loc, s.Idx, j))
+		} else {
+			idxs[s.Idx] = i
+		}
+
+		if err := validateAddress(s.Address); err != nil {
+			errs = append(errs, fmt.Errorf("%s.address: %w", loc, err))
+		} else if j, ok := addrs[s.Address]; ok {
+			errs = append(errs, fmt.Errorf("%s.address: duplicate address %q, already used by shards[%d]", loc, s.Address, j))
+		} else {
+			addrs[s.Address] = i
+		}
+
+		if s.GRPCAddress == "" {
+			continue
+		}
+		if err := validateAddress(s.GRPCAddress); err != nil {
+			errs = append(errs, fmt.Errorf("%s.grpc_address: %w", loc, err))
+		} else if j, ok := addrs[s.GRPCAddress]; ok {
+			errs = append(errs, fmt.Errorf("%s.grpc_address: duplicate address %q, already used by shards[%d]", loc, s.GRPCAddress, j))
+		} else {
+			addrs[s.GRPCAddress] = i
+		}
+	}
+
+	if err := validateHash(c.Hash); err != nil {
+		errs = append(errs, fmt.Errorf("hash: %w", err))
+	}
+
+	switch c.Sharding {
+	case "", HashSharding:
+		if len(c.Splits) != 0 {
+			errs = append(errs, fmt.Errorf("splits: split points are only allowed with %q sharding", RangeSharding))
+		}
+	case RangeSharding:
+		if err := validateSplits(c.Splits, len(c.Shards)); err != nil {
+			errs = append(errs, fmt.Errorf("splits: %w", err))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("sharding: unknown sharding %q", c.Sharding))
+	}
+
+	errs = append(errs, c.Node.validate(len(c.Shards))...)
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,207 @@
+package config_test
+
+import (
+	"go-kvdb/config"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfig(t *testing.T, name, contents string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatalf("Could not write the config contents: %v", err)
+	}
+	return path
+}
+
+func TestParseNodeConfig(t *testing.T) {
+	t.Setenv("KVDB_READ_TIMEOUT", "5s")
+
+	c := createConfig(t, `
+	[[shards]]
+		name = "shard1"
+		idx = 0
+		address = "localhost:8080"
+	[[shards]]
+		name = "shard2"
+		idx = 1
+		address = "localhost:8081"
+	[node]
+		data_dir = "/var/lib/kvdb"
+		read_timeout = "3s"
+		replicas = 1
+	[node.limits]
+		max_value_size = 1024`)
+
+	want := config.DefaultNodeConfig()
+	want.DataDir = "/var/lib/kvdb"
+	want.ReadTimeout = config.Duration(5 * time.Second)
+	want.Limits.MaxValueSize = 1024
+
+	if c.Node != want {
+		t.Errorf("Unexpected node config: got %#v, want %#v", c.Node, want)
+	}
+
+	if err := c.Validate(); err != nil {
+		t.Errorf("Unexpected validation error: %v", err)
+	}
+}
+
+func TestComplete(t *testing.T) {
+	t.Setenv("KVDB_MAX_KEY_SIZE", "100")
+
+	c := config.Config{Shards: []config.Shard{{Name: "shard1", Address: "localhost:8080"}}}
+	c.Node.ReadTimeout = config.Duration(3 * time.Second)
+	if err := c.Complete(); err != nil {
+		t.Fatalf("Could not complete the config: %v", err)
+	}
+
+	want := config.DefaultNodeConfig()
+	want.ReadTimeout = config.Duration(3 * time.Second)
+	want.Limits.MaxKeySize = 100
+
+	if c.Node != want {
+		t.Errorf("Unexpected node config: got %#v, want %#v", c.Node, want)
+	}
+}
+
+func TestParseUnknownField(t *testing.T) {
+	path := writeConfig(t, "config.toml", `
+	[[shards]]
+		name = "shard1"
+		idx = 0
+		adress = "localhost:8080"`)
+
+	_, err := config.ParseFile(path)
+	if err == nil || !strings.Contains(err.Error(), `unknown field "shards.adress"`) {
+		t.Errorf("Expected an unknown field error, got %v", err)
+	}
+}
+
+func TestParseErrorLocation(t *testing.T) {
+	path := writeConfig(t, "config.toml", "epoch = 1\nshards = = 1\n")
+
+	_, err := config.ParseFile(path)
+	if err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Errorf("Expected an error pointing to line 2, got %v", err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	c := config.Config{
+		Shards: []config.Shard{
+			{Name: "a", Idx: 0, Address: "localhost:8080"},
+			{Name: "a", Idx: 0, Address: "localhost:8080"},
+			{Name: "c", Idx: 5, Address: "localhost", GRPCAddress: "localhost:8080"},
+		},
+		Node: config.DefaultNodeConfig(),
+	}
+	c.Node.TLS.CertFile = "cert.pem"
+	c.Node.Replicas = 2
+
+	err := c.Validate()
+	if err == nil {
+		t.Fatalf("Expected validation errors")
+	}
+
+	for _, want := range []string{
+		`shards[1].name: duplicate name "a"`,
+		`shards[1].idx: duplicate index 0`,
+		`shards[1].address: duplicate address "localhost:8080"`,
+		`shards[2].idx: must be between 0 and 2, got 5`,
+		`shards[2].address: malformed address "localhost"`,
+		`shards[2].grpc_address: duplicate address "localhost:8080"`,
+		`node.tls: both cert_file and key_file must be set`,
+		`node.replicas: replication is not supported, must be 1, got 2`,
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("Expected the error to contain %q, got:\n%v", want, err)
+		}
+	}
+}
+
+func TestParseShardsDuplicates(t *testing.T) {
+	_, err := config.ParseShards([]config.Shard{
+		{Name: "a", Idx: 0, Address: "localhost:8080"},
+		{Name: "a", Idx: 1, Address: "localhost:8081"},
+	}, "a")
+	if err == nil {
+		t.Errorf("Expected an error for duplicate shard names")
+	}
+
+	_, err = config.ParseShards([]config.Shard{
+		{Name: "a", Idx: 0, Address: "localhost:8080"},
+		{Name: "b", Idx: 1, Address: "localhost:8080"},
+	}, "a")
+	if err == nil {
+		t.Errorf("Expected an error for duplicate shard addresses")
+	}
+
+	_, err = config.ParseShards([]config.Shard{
+		{Name: "a", Idx: 0, Address: "localhost:http"},
+	}, "a")
+	if err == nil {
+		t.Errorf("Expected an error for a malformed address")
+	}
+
+	_, err = config.ParseShards([]config.Shard{
+		{Name: "a", Idx: 0, Address: "localhost:8080", GRPCAddress: "localhost:9090"},
+		{Name: "b", Idx: 1, Address: "localhost:8081", GRPCAddress: "localhost:9090"},
+	}, "a")
+	if err == nil {
+		t.Errorf("Expected an error for duplicate gRPC addresses")
+	}
+}
+
+func TestValidateBackup(t *testing.T) {
+	t.Setenv("KVDB_BACKUP_S3_SECRET_KEY", "secret")
+
+	c := createConfig(t, `
+	[[shards]]
+		name = "shard1"
+		idx = 0
+		address = "localhost:8080"
+	[node.backup]
+		interval = "1h"
+		full_every = 24
+		keep = 7
+	[node.backup.s3]
+		endpoint = "http://localhost:9000"
+		bucket = "kvdb"
+		access_key = "kvdb"`)
+
+	want := config.Backup{
+		Interval:  config.Duration(time.Hour),
+		FullEvery: 24,
+		Keep:      7,
+		S3: config.S3{
+			Endpoint:  "http://localhost:9000",
+			Bucket:    "kvdb",
+			AccessKey: "kvdb",
+			SecretKey: "secret",
+		},
+	}
+	if c.Node.Backup != want {
+		t.Errorf("Unexpected backup config: got %#v, want %#v", c.Node.Backup, want)
+	}
+	if err := c.Validate(); err != nil {
+		t.Errorf("Unexpected validation error: %v", err)
+	}
+
+	c.Node.Backup.Dir = "/var/backups/kvdb"
+	c.Node.Backup.Keep = -1
+	err := c.Validate()
+	for _, want := range []string{
+		`node.backup: only one of dir and s3.endpoint may be set`,
+		`node.backup.keep: must not be negative, got -1`,
+	} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("Expected the error to contain %q, got:\n%v", want, err)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"go-kvdb/config"
+	"io"
+)
+
+// runConfigCommand implements the "go-kvdb config" subcommands
+// and returns the process exit code.
+func runConfigCommand(args []string, stdout, stderr io.Writer) int {
+	if len(args) == 0 || args[0] != "validate" {
+		fmt.Fprintln(stderr, "Usage: go-kvdb config validate [-config-file=sharding.toml] [-config-format=toml|json|yaml] [files...]")
+		return 2
+	}
+
+	fs := flag.NewFlagSet("config validate", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	file := fs.String("config-file", "sharding.toml", "Config file to validate")
+	format := fs.String("config-format", "", "Format of the config files: toml, json or yaml (detected by the extension by default)")
+	if err := fs.Parse(args[1:]); err != nil {
+		return 2
+	}
+
+	files := fs.Args()
+	if len(files) == 0 {
+		files = []string{*file}
+	}
+
+	code := 0
+	for _, f := range files {
+		c, err := config.ParseFileFormat(f, *format)
+		if err == nil {
+			err = c.Validate()
+		}
+
+		if err != nil {
+			fmt.Fprintf(stderr, "%s: invalid config:\n%v\n", f, err)
+			code = 1
+			continue
+		}
+
+		fmt.Fprintf(stdout, "%s: OK (%d shards, epoch %d)\n", f, len(c.Shards), c.Epoch)
+	}
+	return code
+}
@@ -0,0 +1,354 @@
+package coordinator
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go-kvdb/config"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// DefaultWatchTimeout is how long a watch request is held open
+// when the topology does not change.
+const DefaultWatchTimeout = 30 * time.Second
+
+// errPersist is returned by Update when the topology could not be saved.
+var errPersist = errors.New("persisting topology")
+
+// Coordinator owns the authoritative shard map and serves it to data nodes.
+type Coordinator struct {
+	mu      sync.Mutex
+	cfg     config.Config
+	changed chan struct{}
+
+	// filename and format are where the accepted topologies are saved,
+	// nothing is saved if filename is empty.
+	filename string
+	format   string
+	// token is required to replace the topology over HTTP, which is
+	// refused if it is empty.
+	token string
+	// client reaches the nodes to move the keys after splits and merges.
+	client *config.Client
+
+	watchTimeout time.Duration
+}
+
+// New creates a coordinator that serves the provided topology.
+func New(c config.Config) (*Coordinator, error) {
+	if err := validate(c); err != nil {
+		return nil, err
+	}
+
+	return &Coordinator{
+		cfg:          c,
+		changed:      make(chan struct{}),
+		watchTimeout: DefaultWatchTimeout,
+		client:       config.DefaultClient,
+	}, nil
+}
+
+func validate(c config.Config) error {
+	if len(c.Shards) == 0 {
+		return fmt.Errorf("topology has no shards")
+	}
+	// Any name works here, we only need the topology checks.
+	_, err := config.NewShards(c, c.Shards[0].Name)
+	return err
+}
+
+// SetFile makes Update save every accepted topology to the file in the
+// format, see config.Encode, before it is served. The file is replaced
+// atomically, so that a restarted coordinator never goes back to an
+// epoch it has already handed out.
+func (c *Coordinator) SetFile(filename, format string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.filename, c.format = filename, format
+}
+
+// SetToken makes TopologyHandler require the token as a bearer token in
+// the Authorization header of the requests that replace the topology.
+func (c *Coordinator) SetToken(token string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.token = token
+}
+
+// SetClient sets the client of the requests to the nodes, which must be
+// made with TLS if the nodes serve it.
+func (c *Coordinator) SetClient(client *config.Client) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.client = client
+}
+
+// Config returns the current topology.
+func (c *Coordinator) Config() config.Config {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.cfg
+}
+
+// Update replaces the topology and wakes up all watchers. The node
+// settings of cfg are ignored: the coordinator keeps its own.
+// The new topology must have a greater epoch than the current one.
+// With SetFile it is saved first and rejected if that fails.
+func (c *Coordinator) Update(cfg config.Config) error {
+	if err := validate(cfg); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if cfg.Epoch <= c.cfg.Epoch {
+		return fmt.Errorf("epoch %d must be greater than the current epoch %d", cfg.Epoch, c.cfg.Epoch)
+	}
+	cfg.Node = c.cfg.Node
+
+	if c.filename != "" {
+		if err := writeFile(c.filename, c.format, cfg); err != nil {
+			return fmt.Errorf("%w: %w", errPersist, err)
+		}
+	}
+
+	c.cfg = cfg
+	close(c.changed)
+	c.changed = make(chan struct{})
+	return nil
+}
+
+// writeFile writes the config to a temporary file, syncs it and renames
+// it over the file, then syncs the directory so that the rename survives
+// a crash as well.
+func writeFile(filename, format string, cfg config.Config) error {
+	var buf bytes.Buffer
+	if err := config.Encode(&buf, cfg, format); err != nil {
+		return err
+	}
+
+	tmp := filename + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filename); err != nil {
+		return err
+	}
+
+	dir, err := os.Open(filepath.Dir(filename))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+// wait returns the topology as soon as its epoch is greater than the
+// provided one, or the current topology once the context is done.
+func (c *Coordinator) wait(ctx context.Context, epoch int64) config.Config {
+	for {
+		c.mu.Lock()
+		cfg, changed := c.cfg, c.changed
+		c.mu.Unlock()
+
+		if cfg.Epoch > epoch {
+			return cfg
+		}
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return cfg
+		}
+	}
+}
+
+// TopologyHandler serves the shard map.
+//
+// GET returns the topology without the node settings, which may hold
+// secrets such as the backup credentials; the nodes take theirs from the
+// environment. If the epoch parameter is given the request is held until
+// the topology epoch becomes greater than it (long-poll).
+//
+// PUT replaces the topology with the JSON-encoded config in the body,
+// which is decoded as strictly as a config file and must not have node
+// settings. It requires the token of SetToken as a bearer token and is
+// refused without one, since whoever can replace the topology can send
+// the keys of the cluster elsewhere.
+func (c *Coordinator) TopologyHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		c.getTopology(w, r)
+	case http.MethodPut, http.MethodPost:
+		c.putTopology(w, r)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (c *Coordinator) getTopology(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Error parsing form", http.StatusBadRequest)
+		return
+	}
+
+	cfg := c.Config()
+	if e := r.Form.Get("epoch"); e != "" {
+		epoch, err := strconv.ParseInt(e, 10, 64)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid epoch %q: %v", e, err), http.StatusBadRequest)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), c.watchTimeout)
+		defer cancel()
+		cfg = c.wait(ctx, epoch)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(topologyOf(cfg))
+}
+
+// topologyOf returns the config without the node settings.
+func topologyOf(c config.Config) config.Config {
+	return config.Config{
+		Epoch:    c.Epoch,
+		Sharding: c.Sharding,
+		Hash:     c.Hash,
+		HashTags: c.HashTags,
+		Splits:   c.Splits,
+		Shards:   c.Shards,
+	}
+}
+
+// authorize reports an error to the client unless the request carries
+// the token that allows it to change the topology.
+func (c *Coordinator) authorize(w http.ResponseWriter, r *http.Request) bool {
+	c.mu.Lock()
+	token := c.token
+	c.mu.Unlock()
+
+	if token == "" {
+		http.Error(w, "Topology updates are disabled: the coordinator has no token", http.StatusForbidden)
+		return false
+	}
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+token)) != 1 {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// updateError reports the error of Update to the client.
+func updateError(w http.ResponseWriter, err error) {
+	code := http.StatusConflict
+	if errors.Is(err, errPersist) {
+		code = http.StatusInternalServerError
+	}
+	http.Error(w, fmt.Sprintf("Error updating topology: %v", err), code)
+}
+
+func (c *Coordinator) putTopology(w http.ResponseWriter, r *http.Request) {
+	if !c.authorize(w, r) {
+		return
+	}
+
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error reading topology: %v", err), http.StatusBadRequest)
+		return
+	}
+	cfg, err := config.Decode(data, config.FormatJSON)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error decoding topology: %v", err), http.StatusBadRequest)
+		return
+	}
+	if cfg.Node != (config.NodeConfig{}) {
+		http.Error(w, "Node settings cannot be changed through the coordinator", http.StatusBadRequest)
+		return
+	}
+
+	if err := c.Update(cfg); err != nil {
+		updateError(w, err)
+		return
+	}
+
+	fmt.Fprintf(w, "Successfully updated topology to epoch %d", cfg.Epoch)
+}
+
+// Fetch gets the topology from the coordinator at addr with the client.
+// If epoch is non-negative the call blocks until the coordinator has a
+// topology newer than epoch or the watch timeout expires.
+func Fetch(ctx context.Context, client *config.Client, addr string, epoch int64) (config.Config, error) {
+	u := client.URL(addr, "/topology")
+	if epoch >= 0 {
+		u += "?" + url.Values{"epoch": {strconv.FormatInt(epoch, 10)}}.Encode()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return config.Config{}, err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return config.Config{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return config.Config{}, fmt.Errorf("coordinator returned %s", resp.Status)
+	}
+
+	var cfg config.Config
+	if err := json.NewDecoder(resp.Body).Decode(&cfg); err != nil {
+		return config.Config{}, fmt.Errorf("decoding topology: %w", err)
+	}
+	return cfg, nil
+}
+
+// Watch follows topology changes on the coordinator at addr, calling
+// onChange for every topology with an epoch greater than the given one.
+// Watch returns when the context is cancelled.
+func Watch(ctx context.Context, client *config.Client, addr string, epoch int64, onChange func(config.Config)) {
+	for ctx.Err() == nil {
+		cfg, err := Fetch(ctx, client, addr, epoch)
+		if err != nil {
+			// The coordinator might be restarting, retry a bit later.
+			select {
+			case <-time.After(time.Second):
+			case <-ctx.Done():
+			}
+			continue
+		}
+
+		if cfg.Epoch > epoch {
+			epoch = cfg.Epoch
+			onChange(cfg)
+		}
+	}
+}
@@ -0,0 +1,348 @@
+package coordinator_test
+
+import (
+	"context"
+	"go-kvdb/config"
+	"go-kvdb/coordinator"
+	"go-kvdb/db"
+	"go-kvdb/web"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func topology(epoch int64, addrs ...string) config.Config {
+	c := config.Config{Epoch: epoch}
+	for i, addr := range addrs {
+		c.Shards = append(c.Shards, config.Shard{
+			Name:    "shard" + string(rune('1'+i)),
+			Idx:     i,
+			Address: addr,
+		})
+	}
+	return c
+}
+
+func TestFetchAndWatch(t *testing.T) {
+	coord, err := coordinator.New(topology(1, "localhost:8080"))
+	if err != nil {
+		t.Fatalf("Could not create coordinator: %v", err)
+	}
+
+	ts := httptest.NewServer(http.HandlerFunc(coord.TopologyHandler))
+	defer ts.Close()
+	addr := strings.TrimPrefix(ts.URL, "http://")
+
+	got, err := coordinator.Fetch(context.Background(), config.DefaultClient, addr, -1)
+	if err != nil {
+		t.Fatalf("Could not fetch topology: %v", err)
+	}
+	if want := topology(1, "localhost:8080"); !reflect.DeepEqual(got, want) {
+		t.Errorf("Unexpected topology: got %#v, want %#v", got, want)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	changes := make(chan config.Config, 1)
+	go coordinator.Watch(ctx, config.DefaultClient, addr, 1, func(c config.Config) { changes <- c })
+
+	want := topology(2, "localhost:8080", "localhost:8081")
+	if err := coord.Update(want); err != nil {
+		t.Fatalf("Could not update topology: %v", err)
+	}
+
+	select {
+	case got := <-changes:
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("Unexpected watched topology: got %#v, want %#v", got, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for the topology change")
+	}
+}
+
+func TestUpdateRejectsOldEpoch(t *testing.T) {
+	coord, err := coordinator.New(topology(3, "localhost:8080"))
+	if err != nil {
+		t.Fatalf("Could not create coordinator: %v", err)
+	}
+
+	if err := coord.Update(topology(3, "localhost:8081")); err == nil {
+		t.Errorf("Expected an error when updating the topology with the same epoch")
+	}
+
+	if err := coord.Update(config.Config{Epoch: 4}); err == nil {
+		t.Errorf("Expected an error when updating the topology with no shards")
+	}
+}
+
+func TestUpdatePersists(t *testing.T) {
+	for _, format := range []string{config.FormatTOML, config.FormatJSON, config.FormatYAML} {
+		t.Run(format, func(t *testing.T) {
+			coord, err := coordinator.New(topology(1, "localhost:8080"))
+			if err != nil {
+				t.Fatalf("Could not create coordinator: %v", err)
+			}
+			filename := filepath.Join(t.TempDir(), "sharding."+format)
+			coord.SetFile(filename, format)
+
+			want := topology(2, "localhost:8080", "localhost:8081")
+			if err := coord.Update(want); err != nil {
+				t.Fatalf("Could not update topology: %v", err)
+			}
+
+			got, err := config.ParseFileFormat(filename, format)
+			if err != nil {
+				t.Fatalf("Could not parse the saved topology: %v", err)
+			}
+			if got.Epoch != want.Epoch || !reflect.DeepEqual(got.Shards, want.Shards) {
+				t.Errorf("Unexpected saved topology: got %#v, want %#v", got, want)
+			}
+
+			// The topology is not served if it cannot be saved.
+			coord.SetFile(filepath.Join(t.TempDir(), "missing", "sharding."+format), format)
+			if err := coord.Update(topology(3, "localhost:8080")); err == nil {
+				t.Errorf("Expected an error when the topology cannot be saved")
+			}
+			if epoch := coord.Config().Epoch; epoch != 2 {
+				t.Errorf("Unexpected epoch after a failed update: got %d, want 2", epoch)
+			}
+		})
+	}
+}
+
+func TestPutTopologyToken(t *testing.T) {
+	coord, err := coordinator.New(topology(1, "localhost:8080"))
+	if err != nil {
+		t.Fatalf("Could not create coordinator: %v", err)
+	}
+	coord.SetToken("secret")
+
+	ts := httptest.NewServer(http.HandlerFunc(coord.TopologyHandler))
+	defer ts.Close()
+
+	for _, tc := range []struct {
+		auth string
+		body string
+		want int
+	}{
+		{"", `{"epoch":2,"shards":[{"name":"shard1","idx":0,"address":"localhost:8080"}]}`, http.StatusUnauthorized},
+		{"Bearer wrong", `{"epoch":2,"shards":[{"name":"shard1","idx":0,"address":"localhost:8080"}]}`, http.StatusUnauthorized},
+		{"Bearer secret", `{"epoch":2,"shards":[{"name":"shard1","idx":0,"adress":"localhost:8080"}]}`, http.StatusBadRequest},
+		{"Bearer secret", `{"epoch":2,"shards":[{"name":"shard1","idx":0,"address":"localhost:8080"}],"node":{"data_dir":"/tmp"}}`, http.StatusBadRequest},
+		{"Bearer secret", `{"epoch":2,"shards":[{"name":"shard1","idx":0,"address":"localhost:8080"}]}`, http.StatusOK},
+	} {
+		req, err := http.NewRequest(http.MethodPut, ts.URL, strings.NewReader(tc.body))
+		if err != nil {
+			t.Fatalf("Could not create the request: %v", err)
+		}
+		if tc.auth != "" {
+			req.Header.Set("Authorization", tc.auth)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Could not put the topology: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tc.want {
+			t.Errorf("Unexpected status with %q and %s: got %d, want %d", tc.auth, tc.body, resp.StatusCode, tc.want)
+		}
+	}
+}
+
+func TestPutTopologyWithoutToken(t *testing.T) {
+	coord, err := coordinator.New(topology(1, "localhost:8080"))
+	if err != nil {
+		t.Fatalf("Could not create coordinator: %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	coord.TopologyHandler(w, httptest.NewRequest(http.MethodPut, "/topology", strings.NewReader(`{"epoch":2,"shards":[{"name":"shard1","idx":0,"address":"localhost:8080"}]}`)))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Unexpected status without a token: got %d, want %d", w.Code, http.StatusForbidden)
+	}
+	if epoch := coord.Config().Epoch; epoch != 1 {
+		t.Errorf("Unexpected epoch after a refused update: got %d, want 1", epoch)
+	}
+}
+
+func TestTopologyHidesNodeSettings(t *testing.T) {
+	c := topology(1, "localhost:8080")
+	c.Node.Backup.S3.SecretKey = "s3cret"
+	coord, err := coordinator.New(c)
+	if err != nil {
+		t.Fatalf("Could not create coordinator: %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	coord.TopologyHandler(w, httptest.NewRequest(http.MethodGet, "/topology", nil))
+	if w.Code != http.StatusOK || strings.Contains(w.Body.String(), "s3cret") {
+		t.Errorf("Unexpected topology: %d %s", w.Code, w.Body)
+	}
+
+	// Updates keep the node settings of the coordinator.
+	if err := coord.Update(topology(2, "localhost:8080")); err != nil {
+		t.Fatalf("Could not update topology: %v", err)
+	}
+	if key := coord.Config().Node.Backup.S3.SecretKey; key != "s3cret" {
+		t.Errorf("Unexpected node settings after an update: got secret key %q", key)
+	}
+}
+
+// testNode is a node of a shard that follows the topology of the
+// coordinator. Its requests wait until it has fetched the topology.
+type testNode struct {
+	name  string
+	addr  string
+	db    *db.Database
+	srv   *web.Server
+	ready chan struct{}
+}
+
+func newNode(t *testing.T, name string) *testNode {
+	t.Helper()
+
+	d, closeFunc, err := db.NewDatabase(filepath.Join(t.TempDir(), name+".db"))
+	if err != nil {
+		t.Fatalf("Could not create a new database: %v", err)
+	}
+	t.Cleanup(func() { closeFunc() })
+
+	n := &testNode{name: name, db: d, ready: make(chan struct{})}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-n.ready
+		switch r.URL.Path {
+		case "/migrate":
+			n.srv.MigrateHandler(w, r)
+		case "/createBucket":
+			n.srv.CreateBucket(w, r)
+		case "/admin/export":
+			n.srv.ExportHandler(w, r)
+		case "/admin/import":
+			n.srv.ImportHandler(w, r)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(ts.Close)
+	n.addr = strings.TrimPrefix(ts.URL, "http://")
+	return n
+}
+
+// follow fetches the topology from the coordinator and starts serving.
+func (n *testNode) follow(t *testing.T, coordAddr string) {
+	t.Helper()
+
+	cfg, err := coordinator.Fetch(context.Background(), config.DefaultClient, coordAddr, -1)
+	if err != nil {
+		t.Fatalf("Could not fetch the topology: %v", err)
+	}
+	shards, err := config.NewShards(cfg, n.name)
+	if err != nil {
+		t.Fatalf("Could not create the shards of %q: %v", n.name, err)
+	}
+	n.srv = web.NewServer(n.db, shards)
+	close(n.ready)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go coordinator.Watch(ctx, config.DefaultClient, coordAddr, cfg.Epoch, func(c config.Config) {
+		// The node of a merged shard keeps its last topology.
+		if shards, err := config.NewShards(c, n.name); err == nil {
+			n.srv.SetShards(shards)
+		}
+	})
+}
+
+func TestSplitAndMerge(t *testing.T) {
+	first, second := newNode(t, "shard1"), newNode(t, "shard2")
+
+	c := topology(1, first.addr)
+	c.Sharding = config.RangeSharding
+	coord, err := coordinator.New(c)
+	if err != nil {
+		t.Fatalf("Could not create coordinator: %v", err)
+	}
+	coord.SetToken("secret")
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/topology", coord.TopologyHandler)
+	mux.HandleFunc("/topology/split", coord.SplitHandler)
+	mux.HandleFunc("/topology/merge", coord.MergeHandler)
+	// Closed after the watches of the nodes are cancelled.
+	ts := httptest.NewServer(mux)
+	t.Cleanup(ts.Close)
+	coordAddr := strings.TrimPrefix(ts.URL, "http://")
+
+	first.follow(t, coordAddr)
+	for _, key := range []string{"apple", "kiwi", "zebra"} {
+		if err := first.db.SetKey(key, "default", []byte("value-"+key)); err != nil {
+			t.Fatalf("Could not set key: %v", err)
+		}
+	}
+
+	post := func(path string, form url.Values) (int, string) {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodPost, ts.URL+path, strings.NewReader(form.Encode()))
+		if err != nil {
+			t.Fatalf("Could not create the request: %v", err)
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Authorization", "Bearer secret")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("POST %s failed: %v", path, err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	// The keys from "k" onwards move to the new shard, whose node can
+	// only fetch its topology once the split is under way.
+	type result struct {
+		code int
+		body string
+	}
+	split := make(chan result, 1)
+	go func() {
+		code, body := post("/topology/split", url.Values{"at": {"k"}, "name": {"shard2"}, "address": {second.addr}})
+		split <- result{code, body}
+	}()
+	for coord.Config().Epoch < 2 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	second.follow(t, coordAddr)
+	if res := <-split; res.code != http.StatusOK {
+		t.Fatalf("Could not split: %d %s", res.code, res.body)
+	}
+
+	for key, moved := range map[string]bool{"apple": false, "kiwi": true, "zebra": true} {
+		if v, err := second.db.GetKey(key, "default"); err != nil || (v != nil) != moved {
+			t.Errorf("Unexpected value of %q on the new shard: %q, %v", key, v, err)
+		}
+		if v, err := first.db.GetKey(key, "default"); err != nil || (v != nil) == moved {
+			t.Errorf("Unexpected value of %q on the first shard: %q, %v", key, v, err)
+		}
+	}
+
+	// Merging copies the keys back.
+	if code, body := post("/topology/merge", url.Values{"name": {"shard2"}}); code != http.StatusOK {
+		t.Fatalf("Could not merge: %d %s", code, body)
+	}
+	for _, key := range []string{"apple", "kiwi", "zebra"} {
+		if v, err := first.db.GetKey(key, "default"); err != nil || string(v) != "value-"+key {
+			t.Errorf("Unexpected value of %q after the merge: %q, %v", key, v, err)
+		}
+	}
+	if epoch := coord.Config().Epoch; epoch != 3 {
+		t.Errorf("Unexpected epoch after the split and merge: got %d, want 3", epoch)
+	}
+}
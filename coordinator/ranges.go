@@ -0,0 +1,202 @@
+package coordinator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go-kvdb/config"
+	"go-kvdb/transfer"
+	"go-kvdb/web"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// EpochTimeout is how long a split or merge waits for the nodes to
+// fetch the new topology before it moves the keys.
+const EpochTimeout = time.Minute
+
+// SplitHandler splits the range that contains the at parameter: the
+// keys from at onwards move to a new shard with the name, address and
+// optional grpc_address parameters. The node of the new shard must
+// already run and fetch its topology from the coordinator.
+//
+// Like MergeHandler, it increases the epoch, waits for the nodes to fetch
+// the new topology and then runs /migrate on every shard, since the shards
+// after the changed range are renumbered. Both require the token like PUT
+// /topology. If the keys cannot be moved the new topology stays in place
+// and the error says what is left to do.
+func (c *Coordinator) SplitHandler(w http.ResponseWriter, r *http.Request) {
+	if !c.authorizeRange(w, r) {
+		return
+	}
+
+	shard := config.Shard{
+		Name:        r.Form.Get("name"),
+		Address:     r.Form.Get("address"),
+		GRPCAddress: r.Form.Get("grpc_address"),
+	}
+	cfg, err := c.Config().SplitRange(r.Form.Get("at"), shard)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error splitting range: %v", err), http.StatusBadRequest)
+		return
+	}
+	if err := c.Update(cfg); err != nil {
+		updateError(w, err)
+		return
+	}
+
+	if err := c.moveKeys(r.Context(), cfg, nil); err != nil {
+		http.Error(w, fmt.Sprintf("Topology epoch %d is active, but moving the keys failed, run /migrate?all=true on every shard: %v", cfg.Epoch, err), http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprintf(w, "Successfully split the range at %q to shard %q, epoch %d", r.Form.Get("at"), shard.Name, cfg.Epoch)
+}
+
+// MergeHandler merges the range of the shard with the name parameter
+// into its neighbour and copies its keys there, see SplitHandler. Keys
+// written to the new owner in the meantime are kept. The node of the
+// merged shard can be stopped afterwards.
+func (c *Coordinator) MergeHandler(w http.ResponseWriter, r *http.Request) {
+	if !c.authorizeRange(w, r) {
+		return
+	}
+
+	name := r.Form.Get("name")
+	old := c.Config()
+	cfg, err := old.MergeRange(name)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error merging range: %v", err), http.StatusBadRequest)
+		return
+	}
+	var removed config.Shard
+	for _, s := range old.Shards {
+		if s.Name == name {
+			removed = s
+		}
+	}
+	if err := c.Update(cfg); err != nil {
+		updateError(w, err)
+		return
+	}
+
+	if err := c.moveKeys(r.Context(), cfg, &removed); err != nil {
+		http.Error(w, fmt.Sprintf("Topology epoch %d is active, but moving the keys failed: %v", cfg.Epoch, err), http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprintf(w, "Successfully merged shard %q, epoch %d", name, cfg.Epoch)
+}
+
+func (c *Coordinator) authorizeRange(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return false
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Error parsing form", http.StatusBadRequest)
+		return false
+	}
+	return c.authorize(w, r)
+}
+
+// moveKeys waits for the nodes of the topology to fetch it, copies the
+// keys of the removed shard, if any, to their new owners and then moves
+// the keys every shard no longer owns.
+func (c *Coordinator) moveKeys(ctx context.Context, cfg config.Config, removed *config.Shard) error {
+	c.mu.Lock()
+	client := c.client
+	c.mu.Unlock()
+
+	for _, s := range cfg.Shards {
+		if err := waitEpoch(ctx, client, s.Address, cfg.Epoch); err != nil {
+			return fmt.Errorf("shard %q: %w", s.Name, err)
+		}
+	}
+
+	if removed != nil {
+		if err := copyShard(ctx, cfg, *removed); err != nil {
+			return fmt.Errorf("copying the keys of shard %q: %w", removed.Name, err)
+		}
+	}
+
+	var errs []error
+	for _, s := range cfg.Shards {
+		if err := migrate(ctx, client, s.Address, cfg.Epoch); err != nil {
+			errs = append(errs, fmt.Errorf("migrating shard %q: %w", s.Name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// waitEpoch waits until the node at addr has a topology of the epoch.
+// It sends empty imports, which the nodes reject while their topology
+// is older than the epoch of the request.
+func waitEpoch(ctx context.Context, client *config.Client, addr string, epoch int64) error {
+	ctx, cancel := context.WithTimeout(ctx, EpochTimeout)
+	defer cancel()
+
+	h := http.Header{}
+	h.Set(web.EpochHeader, strconv.FormatInt(epoch, 10))
+	for {
+		_, err := transfer.SendBatch(ctx, client, addr, nil, transfer.ConflictSkip, h)
+		var serr *transfer.StatusError
+		if !errors.As(err, &serr) || serr.Status != http.StatusMisdirectedRequest {
+			return err
+		}
+
+		select {
+		case <-time.After(100 * time.Millisecond):
+		case <-ctx.Done():
+			return fmt.Errorf("waiting for epoch %d: %w", epoch, ctx.Err())
+		}
+	}
+}
+
+// copyShard exports the keys the removed shard owned and imports them
+// into the shards of the topology without replacing existing keys.
+func copyShard(ctx context.Context, cfg config.Config, removed config.Shard) error {
+	pr, pw := io.Pipe()
+	go func() {
+		w, err := transfer.NewWriter(pw, transfer.FormatNDJSON)
+		if err == nil {
+			src := config.Config{Shards: []config.Shard{removed}, Node: cfg.Node}
+			_, err = transfer.Export(ctx, src, nil, w, nil)
+		}
+		pw.CloseWithError(err)
+	}()
+
+	r, err := transfer.NewReader(pr, transfer.FormatNDJSON)
+	if err != nil {
+		pr.CloseWithError(err)
+		return err
+	}
+	_, err = transfer.Import(ctx, cfg, r, transfer.ConflictSkip, nil)
+	pr.CloseWithError(err)
+	return err
+}
+
+// migrate runs /migrate for all buckets on the node at addr.
+func migrate(ctx context.Context, client *config.Client, addr string, epoch int64) error {
+	form := url.Values{"all": {"true"}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, client.URL(addr, "/migrate"), strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set(web.EpochHeader, strconv.FormatInt(epoch, 10))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package db
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// Backuper is implemented by the stores that support online backups.
+type Backuper interface {
+	// Backup writes a consistent snapshot of the store to w
+	// and returns the number of bytes written.
+	Backup(w io.Writer) (int64, error)
+}
+
+var _ Backuper = (*Database)(nil)
+
+// Backup writes a consistent copy of the database to w. It runs inside
+// a read transaction, so writes can continue while the backup is taken.
+func (d *Database) Backup(w io.Writer) (int64, error) {
+	var n int64
+	err := d.db.View(func(tx *bolt.Tx) error {
+		var err error
+		n, err = tx.WriteTo(w)
+		return err
+	})
+	return n, err
+}
+
+// VerifyBackup checks that the file is a consistent bolt database
+// that can be used as a shard database.
+func VerifyBackup(path string) error {
+	bdb, err := bolt.Open(path, 0600, &bolt.Options{ReadOnly: true, Timeout: time.Second})
+	if err != nil {
+		return fmt.Errorf("opening backup: %w", err)
+	}
+	defer bdb.Close()
+
+	return bdb.View(func(tx *bolt.Tx) error {
+		for err := range tx.Check() {
+			return fmt.Errorf("backup is corrupted: %w", err)
+		}
+
+		if tx.Bucket([]byte("default")) == nil {
+			return fmt.Errorf("backup has no default bucket")
+		}
+		return nil
+	})
+}
+
+// Restore validates the backup and atomically replaces the database at
+// dbPath with it. The database must not be open: Restore fails if another
+// process holds the database lock.
+func Restore(backupPath, dbPath string) error {
+	if err := VerifyBackup(backupPath); err != nil {
+		return err
+	}
+
+	// Make sure that no server is using the database.
+	if _, err := os.Stat(dbPath); err == nil {
+		bdb, err := bolt.Open(dbPath, 0600, &bolt.Options{Timeout: time.Second})
+		if err != nil {
+			return fmt.Errorf("database %s is in use: %w", dbPath, err)
+		}
+		bdb.Close()
+	}
+
+	// Copy next to the database first, so that the rename is atomic.
+	tmp, err := os.CreateTemp(filepath.Dir(dbPath), filepath.Base(dbPath)+".restore-*")
+	if err != nil {
+		return err
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+
+	if err := copyFile(backupPath, tmp.Name()); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), dbPath)
+}
+
+// copyFile copies the file and syncs the copy to disk.
+func copyFile(srcPath, dstPath string) error {
+	src, err := os.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(dstPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return err
+	}
+	if err := dst.Sync(); err != nil {
+		dst.Close()
+		return err
+	}
+	return dst.Close()
+}
@@ -0,0 +1,71 @@
+package db_test
+
+import (
+	"bytes"
+	"go-kvdb/db"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBackupRestore(t *testing.T) {
+	dir := t.TempDir()
+	dbPath := filepath.Join(dir, "shard.db")
+	backupPath := filepath.Join(dir, "backup.db")
+
+	d, closeFunc, err := db.NewDatabase(dbPath)
+	if err != nil {
+		t.Fatalf("Could not create a new database: %v", err)
+	}
+	setKey(t, d, "party", "Great", "default")
+
+	f, err := os.Create(backupPath)
+	if err != nil {
+		t.Fatalf("Could not create the backup file: %v", err)
+	}
+	if _, err := d.Backup(f); err != nil {
+		t.Fatalf("Could not back up the database: %v", err)
+	}
+	f.Close()
+
+	// Changes after the backup must be undone by the restore.
+	setKey(t, d, "party", "Over", "default")
+
+	if err := db.Restore(backupPath, dbPath); err == nil {
+		t.Errorf("Expected error when restoring a database that is in use")
+	}
+	closeFunc()
+
+	if err := db.Restore(backupPath, dbPath); err != nil {
+		t.Fatalf("Could not restore the database: %v", err)
+	}
+
+	d, closeFunc, err = db.NewDatabase(dbPath)
+	if err != nil {
+		t.Fatalf("Could not open the restored database: %v", err)
+	}
+	defer closeFunc()
+
+	if value := getKey(t, d, "party", "default"); value != "Great" {
+		t.Errorf(`Unexpected value for key "party": got %q, want %q`, value, "Great")
+	}
+}
+
+func TestVerifyBackup(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "garbage.db")
+	if err := os.WriteFile(path, bytes.Repeat([]byte("garbage"), 1000), 0600); err != nil {
+		t.Fatalf("Could not write the file: %v", err)
+	}
+
+	if err := db.VerifyBackup(path); err == nil {
+		t.Errorf("Expected error when verifying a garbage backup")
+	}
+
+	dbPath := filepath.Join(t.TempDir(), "shard.db")
+	if err := db.Restore(path, dbPath); err == nil {
+		t.Errorf("Expected error when restoring a garbage backup")
+	}
+	if _, err := os.Stat(dbPath); !os.IsNotExist(err) {
+		t.Errorf("Invalid backup must not be restored, stat error: %v", err)
+	}
+}
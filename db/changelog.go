@@ -0,0 +1,285 @@
+package db
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// changeLogBucket is the system bucket with the change log.
+const changeLogBucket = "__changelog"
+
+// replayChunk is the number of log records applied per transaction
+// during recovery, so that long logs do not have to fit in memory.
+const replayChunk = 10000
+
+// LogRecord is an entry of the change log.
+//
+// When the change log is enabled, every mutation is appended to it in the
+// same transaction as the mutation itself, so the log holds exactly the
+// committed changes in commit order. Records are numbered from 1 without
+// gaps. The log is stored in the database file, so a backup carries the
+// log up to the moment it was taken.
+type LogRecord struct {
+	Seq  uint64    `json:"seq"`
+	Time time.Time `json:"time"`
+	Change
+}
+
+func seqKey(seq uint64) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, seq)
+	return k
+}
+
+func opChange(bucketName string, op Op) Change {
+	if op.Delete {
+		return Change{Op: ChangeDelete, Bucket: bucketName, Key: op.Key}
+	}
+	return Change{Op: ChangeSet, Bucket: bucketName, Key: op.Key, Value: op.Value}
+}
+
+// logChange stamps the version of the changed key and appends the change
+// to the log if it is enabled. The record is published to the watchers
+// once the transaction commits.
+func (d *Database) logChange(tx *bolt.Tx, c Change) error {
+	if c.Key != "" && !IsSystemBucket(c.Bucket) {
+		if err := setVersion(tx, c.Bucket, c.Key); err != nil {
+			return err
+		}
+	}
+	if !d.changeLog {
+		return nil
+	}
+
+	rec, err := appendLog(tx, LogRecord{Time: time.Now().UTC(), Change: c})
+	if err != nil {
+		return err
+	}
+	tx.OnCommit(func() { d.events.publish(rec) })
+	return nil
+}
+
+// appendLog appends the record to the log and returns it. A zero
+// sequence number is replaced with the next one.
+func appendLog(tx *bolt.Tx, rec LogRecord) (LogRecord, error) {
+	b := tx.Bucket([]byte(changeLogBucket))
+	if b == nil {
+		return rec, fmt.Errorf("change log not found")
+	}
+
+	if rec.Seq == 0 {
+		seq, err := b.NextSequence()
+		if err != nil {
+			return rec, err
+		}
+		rec.Seq = seq
+	} else if err := b.SetSequence(rec.Seq); err != nil {
+		return rec, err
+	}
+
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return rec, err
+	}
+	return rec, b.Put(seqKey(rec.Seq), data)
+}
+
+// ChangeLog calls fn for the records of the change log with sequence
+// numbers greater than after, in order, until fn returns false.
+func (d *Database) ChangeLog(after uint64, fn func(LogRecord) bool) error {
+	return d.db.View(func(tx *bolt.Tx) error {
+		return readLog(tx, after, fn)
+	})
+}
+
+func readLog(tx *bolt.Tx, after uint64, fn func(LogRecord) bool) error {
+	b := tx.Bucket([]byte(changeLogBucket))
+	if b == nil {
+		return fmt.Errorf("change log not found")
+	}
+
+	c := b.Cursor()
+	for k, v := c.Seek(seqKey(after + 1)); k != nil; k, v = c.Next() {
+		var rec LogRecord
+		if err := json.Unmarshal(v, &rec); err != nil {
+			return fmt.Errorf("change log record %d: %w", binary.BigEndian.Uint64(k), err)
+		}
+		if !fn(rec) {
+			return nil
+		}
+	}
+	return nil
+}
+
+// TruncateChangeLog removes the records older than the time
+// and returns the number of records removed.
+func (d *Database) TruncateChangeLog(before time.Time) (int, error) {
+	n := 0
+	err := d.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(changeLogBucket))
+		if b == nil {
+			return fmt.Errorf("change log not found")
+		}
+
+		var old [][]byte
+		err := readLog(tx, 0, func(rec LogRecord) bool {
+			if !rec.Time.Before(before) {
+				return false
+			}
+			old = append(old, seqKey(rec.Seq))
+			return true
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, k := range old {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		n = len(old)
+		return nil
+	})
+	return n, err
+}
+
+// ReadChangeLog calls fn for the records of the change log in the database
+// file at path with sequence numbers greater than after. The database must
+// not be in use, so the log of a running node is read from a fresh backup.
+func ReadChangeLog(path string, after uint64, fn func(LogRecord) bool) error {
+	bdb, err := bolt.Open(path, 0600, &bolt.Options{ReadOnly: true, Timeout: time.Second})
+	if err != nil {
+		return fmt.Errorf("opening %s: %w", path, err)
+	}
+	defer bdb.Close()
+
+	return bdb.View(func(tx *bolt.Tx) error {
+		return readLog(tx, after, fn)
+	})
+}
+
+// Recover rebuilds the database at dbPath from the base backup and the
+// change log read from the database file at logPath, usually a backup taken
+// after the base one. The records that follow the base backup are replayed
+// in order until stop returns true for one of them; that record and the
+// ones after it are not applied. Recover returns the last applied record,
+// which is zero if there was nothing to replay.
+//
+// The base backup must have been taken with the change log enabled and the
+// log must not have been truncated past it. Like Restore, it fails if the
+// database at dbPath is in use.
+func Recover(basePath, logPath, dbPath string, stop func(LogRecord) bool) (LogRecord, error) {
+	var last LogRecord
+
+	if err := VerifyBackup(basePath); err != nil {
+		return last, err
+	}
+
+	tmp, err := os.MkdirTemp(filepath.Dir(dbPath), filepath.Base(dbPath)+".recover-*")
+	if err != nil {
+		return last, err
+	}
+	defer os.RemoveAll(tmp)
+
+	work := filepath.Join(tmp, "recover.db")
+	if err := copyFile(basePath, work); err != nil {
+		return last, err
+	}
+
+	bdb, err := bolt.Open(work, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return last, err
+	}
+	defer bdb.Close()
+
+	var baseSeq uint64
+	if err := bdb.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(changeLogBucket))
+		if b == nil {
+			return fmt.Errorf("base backup %s was taken without the change log", basePath)
+		}
+		baseSeq = b.Sequence()
+		return nil
+	}); err != nil {
+		return last, err
+	}
+
+	var chunk []LogRecord
+	flush := func() error {
+		err := bdb.Update(func(tx *bolt.Tx) error {
+			for _, rec := range chunk {
+				if err := applyChange(tx, rec.Change); err != nil {
+					return fmt.Errorf("change log record %d: %w", rec.Seq, err)
+				}
+				if _, err := appendLog(tx, rec); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		chunk = chunk[:0]
+		return err
+	}
+
+	logDB, err := bolt.Open(logPath, 0600, &bolt.Options{ReadOnly: true, Timeout: time.Second})
+	if err != nil {
+		return last, fmt.Errorf("opening %s: %w", logPath, err)
+	}
+	defer logDB.Close()
+
+	var applyErr error
+	err = logDB.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(changeLogBucket))
+		if b == nil {
+			return fmt.Errorf("%s has no change log", logPath)
+		}
+		if b.Sequence() < baseSeq {
+			return fmt.Errorf("change log ends at record %d, before the base backup at record %d", b.Sequence(), baseSeq)
+		}
+
+		next := baseSeq + 1
+		err := readLog(tx, baseSeq, func(rec LogRecord) bool {
+			if rec.Seq != next {
+				applyErr = fmt.Errorf("change log record %d is missing, got %d instead", next, rec.Seq)
+				return false
+			}
+			next++
+
+			if stop(rec) {
+				return false
+			}
+
+			chunk = append(chunk, rec)
+			last = rec
+			if len(chunk) == replayChunk {
+				applyErr = flush()
+			}
+			return applyErr == nil
+		})
+		if err == nil && applyErr == nil && next == baseSeq+1 && b.Sequence() > baseSeq {
+			applyErr = fmt.Errorf("change log record %d is missing", next)
+		}
+		return err
+	})
+	if err == nil {
+		err = applyErr
+	}
+	if err == nil {
+		err = flush()
+	}
+	if err != nil {
+		return LogRecord{}, err
+	}
+
+	if err := bdb.Close(); err != nil {
+		return LogRecord{}, err
+	}
+	return last, Restore(work, dbPath)
+}
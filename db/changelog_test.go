@@ -0,0 +1,125 @@
+package db_test
+
+import (
+	"go-kvdb/db"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func backupTo(t *testing.T, d *db.Database, path string) {
+	t.Helper()
+
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("Could not create the backup file: %v", err)
+	}
+	defer f.Close()
+
+	if _, err := d.Backup(f); err != nil {
+		t.Fatalf("Could not back up the database: %v", err)
+	}
+}
+
+func TestPointInTimeRecovery(t *testing.T) {
+	dir := t.TempDir()
+	dbPath := filepath.Join(dir, "shard.db")
+	basePath := filepath.Join(dir, "base.db")
+	laterPath := filepath.Join(dir, "later.db")
+
+	d, closeFunc, err := db.OpenDatabase(dbPath, db.Options{ChangeLog: true})
+	if err != nil {
+		t.Fatalf("Could not create a new database: %v", err)
+	}
+	defer closeFunc()
+
+	if err := d.CreateBucketIfNotExists("users"); err != nil {
+		t.Fatalf("Could not create bucket: %v", err)
+	}
+	setKey(t, d, "party", "Great", "default")
+	backupTo(t, d, basePath)
+
+	setKey(t, d, "alice", "admin", "users")
+	setKey(t, d, "party", "Over", "default")
+	if err := d.DeleteBucket("users"); err != nil {
+		t.Fatalf("Could not delete bucket: %v", err)
+	}
+	setKey(t, d, "after", "delete", "default")
+	backupTo(t, d, laterPath)
+
+	var deleteSeq uint64
+	if err := d.ChangeLog(0, func(rec db.LogRecord) bool {
+		if rec.Op == db.ChangeDeleteBucket {
+			deleteSeq = rec.Seq
+		}
+		return true
+	}); err != nil {
+		t.Fatalf("Could not read the change log: %v", err)
+	}
+	if deleteSeq == 0 {
+		t.Fatalf("The bucket deletion is missing from the change log")
+	}
+
+	restored := filepath.Join(dir, "restored.db")
+	last, err := db.Recover(basePath, laterPath, restored, func(rec db.LogRecord) bool { return rec.Seq >= deleteSeq })
+	if err != nil {
+		t.Fatalf("Could not recover the database: %v", err)
+	}
+	if last.Seq != deleteSeq-1 {
+		t.Errorf("Unexpected last replayed record: got %d, want %d", last.Seq, deleteSeq-1)
+	}
+
+	r, closeRestored, err := db.OpenDatabase(restored, db.Options{ChangeLog: true})
+	if err != nil {
+		t.Fatalf("Could not open the restored database: %v", err)
+	}
+	defer closeRestored()
+
+	if value := getKey(t, r, "alice", "users"); value != "admin" {
+		t.Errorf(`Unexpected value for key "alice": got %q, want %q`, value, "admin")
+	}
+	if value := getKey(t, r, "party", "default"); value != "Over" {
+		t.Errorf(`Unexpected value for key "party": got %q, want %q`, value, "Over")
+	}
+	if value := getKey(t, r, "after", "default"); value != "" {
+		t.Errorf(`Unexpected value for key "after": got %q, want none`, value)
+	}
+
+	// The restored log continues from the last replayed record.
+	setKey(t, r, "next", "write", "default")
+	var seqs []uint64
+	r.ChangeLog(deleteSeq-2, func(rec db.LogRecord) bool {
+		seqs = append(seqs, rec.Seq)
+		return true
+	})
+	if len(seqs) != 2 || seqs[1] != deleteSeq {
+		t.Errorf("Unexpected change log after recovery: %v", seqs)
+	}
+}
+
+func TestRecoverTruncatedLog(t *testing.T) {
+	dir := t.TempDir()
+	basePath := filepath.Join(dir, "base.db")
+	laterPath := filepath.Join(dir, "later.db")
+
+	d, closeFunc, err := db.OpenDatabase(filepath.Join(dir, "shard.db"), db.Options{ChangeLog: true})
+	if err != nil {
+		t.Fatalf("Could not create a new database: %v", err)
+	}
+	defer closeFunc()
+
+	backupTo(t, d, basePath)
+	setKey(t, d, "party", "Great", "default")
+
+	n, err := d.TruncateChangeLog(time.Now().Add(time.Minute))
+	if err != nil || n == 0 {
+		t.Fatalf("Could not truncate the change log: %d removed, %v", n, err)
+	}
+	backupTo(t, d, laterPath)
+
+	never := func(db.LogRecord) bool { return false }
+	if _, err := db.Recover(basePath, laterPath, filepath.Join(dir, "restored.db"), never); err == nil {
+		t.Errorf("Expected error when the change log does not cover the base backup")
+	}
+}
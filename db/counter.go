@@ -0,0 +1,121 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+)
+
+var (
+	// ErrNotInteger is returned when adding an integer to a value
+	// that is not a decimal int64.
+	ErrNotInteger = errors.New("value is not an integer")
+	// ErrNotNumber is returned when adding a float to a value
+	// that is not a number.
+	ErrNotNumber = errors.New("value is not a number")
+	// ErrOverflow is returned when the result does not fit the type.
+	ErrOverflow = errors.New("numeric overflow")
+	// ErrOutOfBounds is returned when the result is outside of the bounds.
+	ErrOutOfBounds = errors.New("value out of bounds")
+)
+
+// IntOptions configures an integer counter update.
+type IntOptions struct {
+	// Initial is the value of a missing key before the delta is added.
+	Initial int64
+	// Min and Max, if set, bound the result. Updates that would leave
+	// the bounds fail with ErrOutOfBounds and change nothing.
+	Min, Max *int64
+}
+
+// FloatOptions configures a float counter update.
+type FloatOptions struct {
+	// Initial is the value of a missing key before the delta is added.
+	Initial float64
+	// Min and Max, if set, bound the result like in IntOptions.
+	Min, Max *float64
+}
+
+// Add atomically adds the delta to the decimal int64 value of the key
+// and returns the new value.
+func Add(s Store, bucketName, key string, delta int64, opts IntOptions) (int64, error) {
+	var result int64
+	err := s.Modify(bucketName, key, func(value []byte) ([]byte, error) {
+		n := opts.Initial
+		if value != nil {
+			var err error
+			if n, err = strconv.ParseInt(string(value), 10, 64); errors.Is(err, strconv.ErrRange) {
+				// An integer too large for int64 is not a float either.
+				return nil, fmt.Errorf("%w: %q", ErrOverflow, value)
+			} else if err != nil {
+				return nil, fmt.Errorf("%w: %q", ErrNotInteger, value)
+			}
+		}
+
+		if (delta > 0 && n > math.MaxInt64-delta) || (delta < 0 && n < math.MinInt64-delta) {
+			return nil, fmt.Errorf("%w: %d%+d", ErrOverflow, n, delta)
+		}
+		n += delta
+
+		if (opts.Min != nil && n < *opts.Min) || (opts.Max != nil && n > *opts.Max) {
+			return nil, fmt.Errorf("%w: %d", ErrOutOfBounds, n)
+		}
+
+		result = n
+		return strconv.AppendInt(nil, n, 10), nil
+	})
+	return result, err
+}
+
+// AddFloat atomically adds the delta to the float64 value of the key
+// and returns the new value. Integer values are accepted as well.
+func AddFloat(s Store, bucketName, key string, delta float64, opts FloatOptions) (float64, error) {
+	var result float64
+	err := s.Modify(bucketName, key, func(value []byte) ([]byte, error) {
+		f := opts.Initial
+		if value != nil {
+			var err error
+			if f, err = strconv.ParseFloat(string(value), 64); err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+				return nil, fmt.Errorf("%w: %q", ErrNotNumber, value)
+			}
+		}
+
+		f += delta
+		if math.IsNaN(f) || math.IsInf(f, 0) {
+			return nil, fmt.Errorf("%w: %v", ErrOverflow, f)
+		}
+
+		if (opts.Min != nil && f < *opts.Min) || (opts.Max != nil && f > *opts.Max) {
+			return nil, fmt.Errorf("%w: %v", ErrOutOfBounds, f)
+		}
+
+		result = f
+		return strconv.AppendFloat(nil, f, 'g', -1, 64), nil
+	})
+	return result, err
+}
+
+// Incr atomically adds one to the integer value of the key,
+// which starts from zero, and returns the new value.
+func (d *Database) Incr(bucketName, key string) (int64, error) {
+	return Add(d, bucketName, key, 1, IntOptions{})
+}
+
+// Decr atomically subtracts one from the integer value of the key,
+// which starts from zero, and returns the new value.
+func (d *Database) Decr(bucketName, key string) (int64, error) {
+	return Add(d, bucketName, key, -1, IntOptions{})
+}
+
+// Add atomically adds the delta to the integer value of the key
+// within a single transaction and returns the new value.
+func (d *Database) Add(bucketName, key string, delta int64, opts IntOptions) (int64, error) {
+	return Add(d, bucketName, key, delta, opts)
+}
+
+// AddFloat atomically adds the delta to the float value of the key
+// within a single transaction and returns the new value.
+func (d *Database) AddFloat(bucketName, key string, delta float64, opts FloatOptions) (float64, error) {
+	return AddFloat(d, bucketName, key, delta, opts)
+}
@@ -0,0 +1,78 @@
+package db_test
+
+import (
+	"errors"
+	"go-kvdb/db"
+	"math"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestCounters(t *testing.T) {
+	d, closeFunc, err := db.OpenDatabase(filepath.Join(t.TempDir(), "shard.db"), db.Options{GroupCommit: true})
+	if err != nil {
+		t.Fatalf("Could not create a new database: %v", err)
+	}
+	defer closeFunc()
+
+	const workers, incrs = 20, 25
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < incrs; j++ {
+				if _, err := d.Incr("default", "hits"); err != nil {
+					t.Errorf("Could not increment: %v", err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if value := getKey(t, d, "hits", "default"); value != "500" {
+		t.Errorf("Unexpected counter after concurrent increments: got %q, want %q", value, "500")
+	}
+
+	if n, err := d.Decr("default", "hits"); err != nil || n != 499 {
+		t.Errorf("Unexpected result of Decr: got %d, %v, want 499", n, err)
+	}
+
+	if n, err := d.Add("default", "stock", -3, db.IntOptions{Initial: 10}); err != nil || n != 7 {
+		t.Errorf("Unexpected result of Add with an initial value: got %d, %v, want 7", n, err)
+	}
+
+	zero := int64(0)
+	if _, err := d.Add("default", "stock", -8, db.IntOptions{Min: &zero}); !errors.Is(err, db.ErrOutOfBounds) {
+		t.Errorf("Unexpected error below the minimum: got %v, want %v", err, db.ErrOutOfBounds)
+	}
+	if value := getKey(t, d, "stock", "default"); value != "7" {
+		t.Errorf("Unexpected value after a failed update: got %q, want %q", value, "7")
+	}
+
+	setKey(t, d, "big", "9223372036854775806", "default")
+	if _, err := d.Add("default", "big", 2, db.IntOptions{}); !errors.Is(err, db.ErrOverflow) {
+		t.Errorf("Unexpected error on overflow: got %v, want %v", err, db.ErrOverflow)
+	}
+	setKey(t, d, "huge", "9223372036854775808", "default")
+	if _, err := d.Incr("default", "huge"); !errors.Is(err, db.ErrOverflow) {
+		t.Errorf("Unexpected error for a value beyond int64: got %v, want %v", err, db.ErrOverflow)
+	}
+
+	setKey(t, d, "name", "alice", "default")
+	if _, err := d.Incr("default", "name"); !errors.Is(err, db.ErrNotInteger) {
+		t.Errorf("Unexpected error for a text value: got %v, want %v", err, db.ErrNotInteger)
+	}
+
+	if f, err := d.AddFloat("default", "stock", 0.5, db.FloatOptions{}); err != nil || f != 7.5 {
+		t.Errorf("Unexpected result of AddFloat: got %v, %v, want 7.5", f, err)
+	}
+	if _, err := d.Incr("default", "stock"); !errors.Is(err, db.ErrNotInteger) {
+		t.Errorf("Unexpected error incrementing a float: got %v, want %v", err, db.ErrNotInteger)
+	}
+	if _, err := d.AddFloat("default", "stock", math.Inf(1), db.FloatOptions{}); !errors.Is(err, db.ErrOverflow) {
+		t.Errorf("Unexpected error adding infinity: got %v, want %v", err, db.ErrOverflow)
+	}
+}
@@ -1,52 +1,200 @@
 package db
 
 import (
+	"bytes"
 	"fmt"
 	"sort"
+	"strings"
+	"time"
 
 	"github.com/boltdb/bolt"
 )
 
+// metaBucket is the system bucket that holds the metadata of other buckets.
+// Deleting it would break every bucket, so DeleteBucket refuses to delete
+// any of the system buckets.
+const metaBucket = "__buckets"
+
 // Database is an open bolt database.
 type Database struct {
-	db *bolt.DB
+	db          *bolt.DB
+	groupCommit bool
+	changeLog   bool
+	events      *events
+	snapshots   snapshots
+}
+
+// update runs the key writes, as part of a group commit if enabled.
+// The function may be called more than once, so it must be idempotent.
+func (d *Database) update(fn func(tx *bolt.Tx) error) error {
+	if d.groupCommit {
+		return d.db.Batch(fn)
+	}
+	return d.db.Update(fn)
+}
+
+// Options configures how writes are committed.
+type Options struct {
+	// GroupCommit coalesces concurrent writes into shared transactions,
+	// so that they share a single fsync instead of waiting for each other.
+	GroupCommit bool
+	// MaxBatchSize is the number of writes that triggers a group commit.
+	// It should be close to the number of concurrent writers: a batch
+	// is committed right away when it is full. 128 if zero.
+	MaxBatchSize int
+	// MaxBatchDelay is how long a write may wait for others to join
+	// its group commit when the batch is not full. 1ms if zero.
+	MaxBatchDelay time.Duration
+	// ChangeLog records every mutation in the change log, see LogRecord.
+	ChangeLog bool
+	// MmapSize is the size of the memory map of the database file. Writes
+	// that grow the file beyond it wait for the open snapshots of
+	// transactions to end. 1GB if zero.
+	MmapSize int
 }
 
+// Group commit defaults. Bolt's own defaults (1000 writes, 10ms) make
+// every write wait for the full delay unless there are a lot of writers.
+const (
+	defaultMaxBatchSize  = 128
+	defaultMaxBatchDelay = time.Millisecond
+)
+
+// defaultMmapSize only reserves address space, the file grows as needed.
+const defaultMmapSize = 1 << 30
+
 // NewDatabase returns an instance of a database that we can work with.
 func NewDatabase(dbPath string) (db *Database, closeFunc func() error, err error) {
-	boltDb, err := bolt.Open(dbPath, 0600, nil)
+	return OpenDatabase(dbPath, Options{})
+}
+
+// OpenDatabase returns an instance of a database with the provided options.
+func OpenDatabase(dbPath string, opts Options) (db *Database, closeFunc func() error, err error) {
+	mmapSize := defaultMmapSize
+	if opts.MmapSize > 0 {
+		mmapSize = opts.MmapSize
+	}
+	boltDb, err := bolt.Open(dbPath, 0600, &bolt.Options{InitialMmapSize: mmapSize})
 	if err != nil {
 		return nil, nil, err
 	}
 
-	db = &Database{db: boltDb}
+	boltDb.MaxBatchSize = defaultMaxBatchSize
+	if opts.MaxBatchSize > 0 {
+		boltDb.MaxBatchSize = opts.MaxBatchSize
+	}
+	boltDb.MaxBatchDelay = defaultMaxBatchDelay
+	if opts.MaxBatchDelay > 0 {
+		boltDb.MaxBatchDelay = opts.MaxBatchDelay
+	}
+
+	db = &Database{db: boltDb, groupCommit: opts.GroupCommit, changeLog: opts.ChangeLog}
 	closeFunc = boltDb.Close
 
+	// The change log goes first, so that it records the other buckets.
+	if opts.ChangeLog {
+		if err := boltDb.Update(func(tx *bolt.Tx) error {
+			b, err := tx.CreateBucketIfNotExists([]byte(changeLogBucket))
+			if err == nil {
+				db.events = newEvents(b.Sequence())
+			}
+			return err
+		}); err != nil {
+			closeFunc()
+			return nil, nil, fmt.Errorf("creating change log bucket: %w", err)
+		}
+	}
+
 	// Optionally create default bucket
 	if err := db.CreateBucketIfNotExists("default"); err != nil {
 		closeFunc()
 		return nil, nil, fmt.Errorf("creating default bucket: %w", err)
 	}
 
+	if err := db.CreateBucketIfNotExists(metaBucket); err != nil {
+		closeFunc()
+		return nil, nil, fmt.Errorf("creating metadata bucket: %w", err)
+	}
+
+	if err := db.CreateBucketIfNotExists(expireBucket); err != nil {
+		closeFunc()
+		return nil, nil, fmt.Errorf("creating expiry bucket: %w", err)
+	}
+
+	if err := db.CreateBucketIfNotExists(flagsBucket); err != nil {
+		closeFunc()
+		return nil, nil, fmt.Errorf("creating flags bucket: %w", err)
+	}
+
+	for _, name := range []string{txnBucket, txnLockBucket, txnDecisionBucket, versionBucket, deletedVersionBucket} {
+		if err := db.CreateBucketIfNotExists(name); err != nil {
+			closeFunc()
+			return nil, nil, fmt.Errorf("creating transaction bucket: %w", err)
+		}
+	}
+	if err := db.CreateBucketIfNotExists(cursorBucket); err != nil {
+		closeFunc()
+		return nil, nil, fmt.Errorf("creating cursor bucket: %w", err)
+	}
+
 	return db, closeFunc, nil
 }
 
-// createBucketIfNotExists creates a bucket in the database if it doesn't exist.
+// CreateBucketIfNotExists creates a bucket in the database if it doesn't exist.
 func (d *Database) CreateBucketIfNotExists(bucketName string) error {
 	return d.db.Update(func(tx *bolt.Tx) error {
-		_, err := tx.CreateBucketIfNotExists([]byte(bucketName))
-		return err
+		if tx.Bucket([]byte(bucketName)) != nil {
+			return nil
+		}
+		if _, err := tx.CreateBucket([]byte(bucketName)); err != nil {
+			return err
+		}
+		return d.logChange(tx, Change{Op: ChangeCreateBucket, Bucket: bucketName})
 	})
 }
 
+// SystemPrefix starts the names of the buckets used internally, such as
+// the bucket metadata and the change log. Clients cannot create, delete or
+// otherwise reach them. User buckets whose names start with the prefix,
+// created before it was reserved, can no longer be reached either.
+const SystemPrefix = "__"
+
+// IsSystemBucket reports whether the bucket is used internally.
+func IsSystemBucket(bucketName string) bool {
+	return strings.HasPrefix(bucketName, SystemPrefix)
+}
+
+// Buckets returns the names of all buckets apart from the system ones.
+func (d *Database) Buckets() ([]string, error) {
+	var names []string
+	err := d.db.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+			if !IsSystemBucket(string(name)) {
+				names = append(names, string(name))
+			}
+			return nil
+		})
+	})
+	return names, err
+}
+
 // SetKey sets the key to the requested value in the specified bucket.
 func (d *Database) SetKey(key string, bucketName string, value []byte) error {
-	return d.db.Update(func(tx *bolt.Tx) error {
+	return d.update(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(bucketName))
 		if b == nil {
 			return fmt.Errorf("bucket %s not found", bucketName)
 		}
-		return b.Put([]byte(key), value)
+		if err := checkLock(tx, bucketName, key, ""); err != nil {
+			return err
+		}
+		if err := putValue(b, []byte(key), value); err != nil {
+			return err
+		}
+		if err := d.clearKeyMeta(tx, bucketName, key); err != nil {
+			return err
+		}
+		return d.logChange(tx, Change{Op: ChangeSet, Bucket: bucketName, Key: key, Value: value})
 	})
 }
 
@@ -58,7 +206,10 @@ func (d *Database) GetKey(key string, bucketName string) ([]byte, error) {
 		if b == nil {
 			return fmt.Errorf("bucket %s not found", bucketName)
 		}
-		result = b.Get([]byte(key))
+		// The value is only valid during the transaction.
+		if v := b.Get([]byte(key)); v != nil && !expired(tx, bucketName, key, time.Now()) {
+			result = append([]byte{}, v...)
+		}
 		return nil
 	})
 
@@ -68,24 +219,38 @@ func (d *Database) GetKey(key string, bucketName string) ([]byte, error) {
 	return nil, err
 }
 
-// DeleteKey
+// DelKey deletes the key from the specified bucket.
 func (d *Database) DelKey(bucketName string, key string) error {
-	return d.db.Update(func(tx *bolt.Tx) error {
+	return d.update(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(bucketName))
 		if b == nil {
 			return fmt.Errorf("bucket %s not found", bucketName)
 		}
+		if err := checkLock(tx, bucketName, key, ""); err != nil {
+			return err
+		}
 
-		return b.Delete(([]byte(key)))
+		if err := deleteValue(b, []byte(key)); err != nil {
+			return err
+		}
+		if err := d.clearKeyMeta(tx, bucketName, key); err != nil {
+			return err
+		}
+		return d.logChange(tx, Change{Op: ChangeDelete, Bucket: bucketName, Key: key})
 	})
 }
 
-// DeleteExtraKeys deletes the keys that do not belong to this shard.
+// DeleteExtraKeys deletes the keys that do not belong to this shard. It
+// fails with ErrLocked, deleting nothing, if one of them is locked by a
+// prepared transaction.
 func (d *Database) DeleteExtraKeys(isExtra func(string) bool, bucketName string) error {
 	var keys []string
 
 	err := d.db.View(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(bucketName))
+		if b == nil {
+			return fmt.Errorf("bucket %s not found", bucketName)
+		}
 		return b.ForEach(func(k, v []byte) error {
 			ks := string(k)
 			if isExtra(ks) {
@@ -103,7 +268,16 @@ func (d *Database) DeleteExtraKeys(isExtra func(string) bool, bucketName string)
 		b := tx.Bucket([]byte(bucketName))
 
 		for _, k := range keys {
-			if err := b.Delete([]byte(k)); err != nil {
+			if err := checkLock(tx, bucketName, k, ""); err != nil {
+				return fmt.Errorf("key %q: %w", k, err)
+			}
+			if err := deleteValue(b, []byte(k)); err != nil {
+				return err
+			}
+			if err := d.clearKeyMeta(tx, bucketName, k); err != nil {
+				return err
+			}
+			if err := d.logChange(tx, Change{Op: ChangeDelete, Bucket: bucketName, Key: k}); err != nil {
 				return err
 			}
 		}
@@ -121,8 +295,11 @@ func (d *Database) ListKeys(bucketName string) ([]string, error) {
 			return fmt.Errorf("bucket %s not found", bucketName)
 		}
 
+		now := time.Now()
 		return b.ForEach(func(k, v []byte) error {
-			keys = append(keys, string(k))
+			if !expired(tx, bucketName, string(k), now) {
+				keys = append(keys, string(k))
+			}
 			return nil
 		})
 	})
@@ -135,14 +312,205 @@ func (d *Database) ListKeys(bucketName string) ([]string, error) {
 	return keys, nil
 }
 
-// DeleteBucket deletes the specified bucket and all its contents.
+// DeleteBucket deletes the specified bucket and all its contents. It fails
+// with ErrLocked while a prepared transaction holds locks on its keys.
+// System buckets cannot be deleted.
 func (d *Database) DeleteBucket(bucketName string) error {
+	if IsSystemBucket(bucketName) {
+		return fmt.Errorf("bucket %s is a system bucket", bucketName)
+	}
+	return d.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucketName))
+		if b == nil {
+			return fmt.Errorf("bucket %s not found", bucketName)
+		}
+		if err := checkBucketLocks(tx, bucketName); err != nil {
+			return err
+		}
+
+		if err := tx.DeleteBucket([]byte(bucketName)); err != nil {
+			return err
+		}
+		if err := tx.Bucket([]byte(metaBucket)).Delete([]byte(bucketName)); err != nil {
+			return err
+		}
+		if err := d.clearBucketMeta(tx, bucketName); err != nil {
+			return err
+		}
+		return d.logChange(tx, Change{Op: ChangeDeleteBucket, Bucket: bucketName})
+	})
+}
+
+// SetBucketMeta stores the metadata of the specified bucket.
+func (d *Database) SetBucketMeta(bucketName string, meta []byte) error {
 	return d.db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte(bucketName)) == nil {
+			return fmt.Errorf("bucket %s not found", bucketName)
+		}
+		if err := tx.Bucket([]byte(metaBucket)).Put([]byte(bucketName), meta); err != nil {
+			return err
+		}
+		return d.logChange(tx, Change{Op: ChangeSet, Bucket: metaBucket, Key: bucketName, Value: meta})
+	})
+}
+
+// BucketMeta returns the metadata of the specified bucket
+// or nil if no metadata was stored for it.
+func (d *Database) BucketMeta(bucketName string) ([]byte, error) {
+	var result []byte
+	err := d.db.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket([]byte(metaBucket)).Get([]byte(bucketName)); v != nil {
+			result = append([]byte{}, v...)
+		}
+		return nil
+	})
+	return result, err
+}
+
+// ScanKeys returns the keys in [start, end) from the specified bucket in sorted order.
+// An empty end means that the range is unbounded.
+func (d *Database) ScanKeys(bucketName string, start, end string) ([]string, error) {
+	var keys []string
+
+	err := d.db.View(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(bucketName))
 		if b == nil {
 			return fmt.Errorf("bucket %s not found", bucketName)
 		}
 
-		return tx.DeleteBucket([]byte(bucketName))
+		now := time.Now()
+		c := b.Cursor()
+		for k, _ := c.Seek([]byte(start)); k != nil; k, _ = c.Next() {
+			if end != "" && string(k) >= end {
+				break
+			}
+			if !expired(tx, bucketName, string(k), now) {
+				keys = append(keys, string(k))
+			}
+		}
+		return nil
 	})
+
+	if err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// Batch applies all operations to the specified bucket in a single transaction.
+func (d *Database) Batch(bucketName string, ops []Op) error {
+	return d.update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucketName))
+		if b == nil {
+			return fmt.Errorf("bucket %s not found", bucketName)
+		}
+
+		for _, op := range ops {
+			if err := checkLock(tx, bucketName, op.Key, ""); err != nil {
+				return fmt.Errorf("key %q: %w", op.Key, err)
+			}
+			if err := d.applyOp(tx, b, bucketName, op); err != nil {
+				return fmt.Errorf("key %q: %w", op.Key, err)
+			}
+			if err := d.clearKeyMeta(tx, bucketName, op.Key); err != nil {
+				return fmt.Errorf("key %q: %w", op.Key, err)
+			}
+		}
+		return nil
+	})
+}
+
+// applyOp writes the operation to the bucket and logs it. Deletes
+// remove the expiry time and the flags of the key as well.
+func (d *Database) applyOp(tx *bolt.Tx, b *bolt.Bucket, bucketName string, op Op) error {
+	var err error
+	if op.Delete {
+		if err = deleteValue(b, []byte(op.Key)); err == nil {
+			err = d.clearKeyMeta(tx, bucketName, op.Key)
+		}
+	} else if err = putValue(b, []byte(op.Key), op.Value); err == nil {
+		// Like SetKey, a set resets the expiry time and the flags.
+		err = d.clearKeyMeta(tx, bucketName, op.Key)
+	}
+	if err != nil {
+		return err
+	}
+	return d.logChange(tx, opChange(bucketName, op))
+}
+
+// Modify atomically replaces the value of the key with the result of fn,
+// keeping its expiry time. It fails with ErrWrongType for typed values.
+func (d *Database) Modify(bucketName, key string, fn func(value []byte) ([]byte, error)) error {
+	return d.ModifyTTL(bucketName, key, func(value []byte, expires time.Time) ([]byte, time.Time, error) {
+		value, err := fn(value)
+		return value, expires, err
+	})
+}
+
+// walkChunk is the number of keys read per transaction by Walk.
+const walkChunk = 1000
+
+// Walk calls fn for every key of the bucket in sorted order. The keys are
+// read in chunks, each in its own transaction, so that a slow reader does
+// not hold a transaction open. Keys written during the walk may or may
+// not be seen, expired keys are skipped.
+func (d *Database) Walk(bucketName string, fn func(key string, value []byte) error) error {
+	return d.walk(bucketName, false, func(e Entry) error {
+		return fn(e.Key, e.Value)
+	})
+}
+
+// WalkEntries calls fn for every plain and typed key of the bucket in
+// sorted order, reading the keys in chunks like Walk.
+func (d *Database) WalkEntries(bucketName string, fn func(e Entry) error) error {
+	return d.walk(bucketName, true, fn)
+}
+
+// walk reads the entries of the bucket in chunks, the typed ones only if
+// typed is true.
+func (d *Database) walk(bucketName string, typed bool, fn func(e Entry) error) error {
+	var start []byte
+	for {
+		var chunk []Entry
+		err := d.db.View(func(tx *bolt.Tx) error {
+			b := tx.Bucket([]byte(bucketName))
+			if b == nil {
+				return fmt.Errorf("bucket %s not found", bucketName)
+			}
+
+			now := time.Now()
+			c := b.Cursor()
+			k, v := c.Seek(start)
+			if start != nil && bytes.Equal(k, start) {
+				k, v = c.Next()
+			}
+			for ; k != nil && len(chunk) < walkChunk; k, v = c.Next() {
+				switch {
+				case v != nil:
+					at := expiry(tx, bucketName, string(k))
+					if !at.IsZero() && !now.Before(at) {
+						continue
+					}
+					chunk = append(chunk, Entry{Key: string(k), Value: append([]byte{}, v...), Expires: at, Flags: flags(tx, bucketName, string(k))})
+				case typed:
+					chunk = append(chunk, Entry{Key: string(k), Commands: typedCommands(b.Bucket(k))})
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, e := range chunk {
+			if err := fn(e); err != nil {
+				return err
+			}
+		}
+
+		if len(chunk) < walkChunk {
+			return nil
+		}
+		start = []byte(chunk[len(chunk)-1].Key)
+	}
 }
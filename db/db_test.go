@@ -2,11 +2,17 @@ package db_test
 
 import (
 	"bytes"
+	"fmt"
 	"go-kvdb/db"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"runtime"
 	"slices"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestGetSet(t *testing.T) {
@@ -220,4 +226,186 @@ func TestDeleteBucket(t *testing.T) {
 	if err == nil {
 		t.Error("Expected error when deleting non-existent bucket")
 	}
+
+	// The metadata bucket must survive, the other buckets depend on it
+	if err := db.DeleteBucket("__buckets"); err == nil {
+		t.Error("Expected error when deleting the metadata bucket")
+	}
+	if _, err := db.BucketMeta("default"); err != nil {
+		t.Errorf("Could not read the bucket metadata: %v", err)
+	}
+}
+
+func TestScanKeys(t *testing.T) {
+	f, err := ioutil.TempFile(os.TempDir(), "database")
+	if err != nil {
+		t.Fatalf("Could not create temp file: %v", err)
+	}
+	name := f.Name()
+	f.Close()
+	defer os.Remove(name)
+
+	db, closeFunc, err := db.NewDatabase(name)
+	if err != nil {
+		t.Fatalf("Could not create a new database: %v", err)
+	}
+	defer closeFunc()
+
+	for _, key := range []string{"a", "ba", "bb", "c"} {
+		setKey(t, db, key, "value", "default")
+	}
+
+	keys, err := db.ScanKeys("default", "b", "c")
+	if err != nil {
+		t.Fatalf("Could not scan keys: %v", err)
+	}
+
+	if want := []string{"ba", "bb"}; !slices.Equal(keys, want) {
+		t.Errorf("Unexpected keys: got %v, want %v", keys, want)
+	}
+
+	keys, err = db.ScanKeys("default", "bb", "")
+	if err != nil {
+		t.Fatalf("Could not scan keys: %v", err)
+	}
+
+	if want := []string{"bb", "c"}; !slices.Equal(keys, want) {
+		t.Errorf("Unexpected keys: got %v, want %v", keys, want)
+	}
+}
+
+func TestBucketMeta(t *testing.T) {
+	f, err := ioutil.TempFile(os.TempDir(), "database")
+	if err != nil {
+		t.Fatalf("Could not create temp file: %v", err)
+	}
+	name := f.Name()
+	f.Close()
+	defer os.Remove(name)
+
+	db, closeFunc, err := db.NewDatabase(name)
+	if err != nil {
+		t.Fatalf("Could not create a new database: %v", err)
+	}
+	defer closeFunc()
+
+	if err := db.SetBucketMeta("missing", []byte("meta")); err == nil {
+		t.Errorf("Expected error when setting metadata of a non-existent bucket")
+	}
+
+	if err := db.CreateBucketIfNotExists("test_bucket"); err != nil {
+		t.Fatalf("Could not create bucket: %v", err)
+	}
+
+	if err := db.SetBucketMeta("test_bucket", []byte("meta")); err != nil {
+		t.Fatalf("Could not set bucket metadata: %v", err)
+	}
+
+	meta, err := db.BucketMeta("test_bucket")
+	if err != nil {
+		t.Fatalf("Could not get bucket metadata: %v", err)
+	}
+	if string(meta) != "meta" {
+		t.Errorf("Unexpected bucket metadata: got %q, want %q", meta, "meta")
+	}
+
+	// Metadata must not outlive the bucket.
+	if err := db.DeleteBucket("test_bucket"); err != nil {
+		t.Fatalf("Could not delete bucket: %v", err)
+	}
+	if err := db.CreateBucketIfNotExists("test_bucket"); err != nil {
+		t.Fatalf("Could not create bucket: %v", err)
+	}
+
+	meta, err = db.BucketMeta("test_bucket")
+	if err != nil {
+		t.Fatalf("Could not get bucket metadata: %v", err)
+	}
+	if meta != nil {
+		t.Errorf("Unexpected bucket metadata after re-creation: got %q, want nil", meta)
+	}
+}
+
+func TestGroupCommitConcurrentWrites(t *testing.T) {
+	db, closeFunc, err := db.OpenDatabase(filepath.Join(t.TempDir(), "database"), db.Options{
+		GroupCommit:   true,
+		MaxBatchSize:  16,
+		MaxBatchDelay: time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("Could not create a new database: %v", err)
+	}
+	defer closeFunc()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := db.SetKey(fmt.Sprintf("key-%d", i), "default", []byte("value")); err != nil {
+				t.Errorf("SetKey failed: %v", err)
+			}
+		}(i)
+	}
+
+	// A failing write must not affect the others in its group.
+	if err := db.SetKey("key", "missing", []byte("value")); err == nil {
+		t.Errorf("Expected error when setting a key in a missing bucket")
+	}
+	wg.Wait()
+
+	keys, err := db.ListKeys("default")
+	if err != nil {
+		t.Fatalf("Could not list keys: %v", err)
+	}
+	if len(keys) != 50 {
+		t.Errorf("Expected 50 keys, got %d", len(keys))
+	}
+}
+
+func benchmarkParallelSetKey(b *testing.B, opts db.Options) {
+	db, closeFunc, err := db.OpenDatabase(filepath.Join(b.TempDir(), "database"), opts)
+	if err != nil {
+		b.Fatalf("Could not create a new database: %v", err)
+	}
+	defer closeFunc()
+
+	var n atomic.Int64
+	value := make([]byte, 100)
+
+	// Simulate many concurrent HTTP writers.
+	b.SetParallelism(16)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if err := db.SetKey(fmt.Sprintf("key-%d", n.Add(1)), "default", value); err != nil {
+				b.Errorf("SetKey failed: %v", err)
+				return
+			}
+		}
+	})
+}
+
+func BenchmarkSetKeyParallel(b *testing.B) {
+	benchmarkParallelSetKey(b, db.Options{})
+}
+
+func BenchmarkSetKeyParallelGroupCommit(b *testing.B) {
+	// The batch is committed as soon as every writer has joined it,
+	// the delay only matters when there are fewer writers.
+	writers := 16 * runtime.GOMAXPROCS(0)
+
+	b.Run("size=writers,delay=1ms", func(b *testing.B) {
+		benchmarkParallelSetKey(b, db.Options{GroupCommit: true, MaxBatchSize: writers, MaxBatchDelay: time.Millisecond})
+	})
+	b.Run("size=writers/2,delay=1ms", func(b *testing.B) {
+		benchmarkParallelSetKey(b, db.Options{GroupCommit: true, MaxBatchSize: writers / 2, MaxBatchDelay: time.Millisecond})
+	})
+	b.Run("size=default,delay=default", func(b *testing.B) {
+		benchmarkParallelSetKey(b, db.Options{GroupCommit: true})
+	})
+	b.Run("size=1000,delay=10ms", func(b *testing.B) {
+		// Bolt's own defaults.
+		benchmarkParallelSetKey(b, db.Options{GroupCommit: true, MaxBatchSize: 1000, MaxBatchDelay: 10 * time.Millisecond})
+	})
 }
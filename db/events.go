@@ -0,0 +1,199 @@
+package db
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"sync"
+
+	"github.com/boltdb/bolt"
+)
+
+// eventRingSize is the number of recent change log records kept in
+// memory, so that watchers that keep up never have to read the log.
+const eventRingSize = 4096
+
+var (
+	// ErrNoChangeLog is returned by Watch when the change log is disabled.
+	ErrNoChangeLog = errors.New("change log is disabled")
+	// ErrUnknownSeq is returned by Watch when the changes after the
+	// sequence number are no longer, or not yet, in the change log.
+	ErrUnknownSeq = errors.New("sequence number is not in the change log")
+)
+
+// Watcher is implemented by the stores that can stream their changes.
+type Watcher interface {
+	// LastSeq returns the sequence number of the last committed change.
+	LastSeq() (uint64, error)
+	// Watch calls fn for the committed changes with sequence numbers
+	// greater than after, in order, and then for the new ones as they are
+	// committed, until ctx is done or fn returns an error.
+	Watch(ctx context.Context, after uint64, fn func(LogRecord) error) error
+
+	// Cursor returns the sequence number stored for the named reader
+	// of the change log and false if there is none.
+	Cursor(name string) (uint64, bool, error)
+	// SetCursor stores the sequence number of the last change the
+	// reader has handled. Cursors are not changes: storing them is not
+	// logged and does not wake up the watchers.
+	SetCursor(name string, seq uint64) error
+	// DeleteCursor removes the cursor of the reader.
+	DeleteCursor(name string) error
+}
+
+var _ Watcher = (*Database)(nil)
+
+// events keeps the recent change log records in memory
+// and wakes up the watchers when new ones are committed.
+type events struct {
+	mu   sync.Mutex
+	ring []LogRecord
+	last uint64
+	wake chan struct{}
+}
+
+func newEvents(last uint64) *events {
+	return &events{
+		ring: make([]LogRecord, eventRingSize),
+		last: last,
+		wake: make(chan struct{}),
+	}
+}
+
+// publish adds a committed record. Transactions commit in sequence order,
+// but their commit handlers may run out of order, so when a record is
+// published all records before it are already committed, even if they
+// are not in the ring yet.
+func (e *events) publish(rec LogRecord) {
+	rec.Value = append([]byte(nil), rec.Value...)
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.ring[rec.Seq%eventRingSize] = rec
+	if rec.Seq > e.last {
+		e.last = rec.Seq
+		close(e.wake)
+		e.wake = make(chan struct{})
+	}
+}
+
+// since returns the records following after that are in the ring, the
+// last committed sequence number and a channel closed on the next publish.
+func (e *events) since(after uint64) ([]LogRecord, uint64, <-chan struct{}) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	var recs []LogRecord
+	for seq := after + 1; seq <= e.last; seq++ {
+		rec := e.ring[seq%eventRingSize]
+		if rec.Seq != seq {
+			break
+		}
+		recs = append(recs, rec)
+	}
+	return recs, e.last, e.wake
+}
+
+// cursorBucket holds the cursors of the readers of the change log. Like
+// versionBucket, it is written directly and never through the change log.
+const cursorBucket = SystemPrefix + "cursors"
+
+// Cursor returns the sequence number stored for the reader.
+func (d *Database) Cursor(name string) (uint64, bool, error) {
+	var seq uint64
+	var ok bool
+	err := d.db.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket([]byte(cursorBucket)).Get([]byte(name)); v != nil {
+			seq, ok = binary.BigEndian.Uint64(v), true
+		}
+		return nil
+	})
+	return seq, ok, err
+}
+
+// SetCursor stores the sequence number of the last change handled by the reader.
+func (d *Database) SetCursor(name string, seq uint64) error {
+	return d.update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(cursorBucket)).Put([]byte(name), binary.BigEndian.AppendUint64(nil, seq))
+	})
+}
+
+// DeleteCursor removes the cursor of the reader.
+func (d *Database) DeleteCursor(name string) error {
+	return d.update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(cursorBucket)).Delete([]byte(name))
+	})
+}
+
+// LastSeq returns the sequence number of the last committed change.
+func (d *Database) LastSeq() (uint64, error) {
+	if d.events == nil {
+		return 0, ErrNoChangeLog
+	}
+	d.events.mu.Lock()
+	defer d.events.mu.Unlock()
+	return d.events.last, nil
+}
+
+// Watch calls fn for the changes after the sequence number and then waits
+// for new ones. Recent changes are served from memory, older ones are read
+// from the change log in chunks, so a slow watcher does not keep a
+// transaction open. It fails with ErrUnknownSeq if the log has been
+// truncated past after or ends before it.
+func (d *Database) Watch(ctx context.Context, after uint64, fn func(LogRecord) error) error {
+	if d.events == nil {
+		return ErrNoChangeLog
+	}
+
+	for {
+		recs, last, wake := d.events.since(after)
+		if after > last {
+			return ErrUnknownSeq
+		}
+		if len(recs) == 0 && after < last {
+			var err error
+			if recs, err = d.readEvents(after, last); err != nil {
+				return err
+			}
+		}
+
+		for _, rec := range recs {
+			if err := fn(rec); err != nil {
+				return err
+			}
+			after = rec.Seq
+		}
+		if len(recs) > 0 {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-wake:
+		}
+	}
+}
+
+// readEvents reads up to eventRingSize records in (after, last] from the log.
+func (d *Database) readEvents(after, last uint64) ([]LogRecord, error) {
+	var recs []LogRecord
+	err := d.db.View(func(tx *bolt.Tx) error {
+		return readLog(tx, after, func(rec LogRecord) bool {
+			if rec.Seq > last {
+				return false
+			}
+			recs = append(recs, rec)
+			return len(recs) < eventRingSize
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(recs) == 0 || recs[0].Seq != after+1 {
+		return nil, ErrUnknownSeq
+	}
+	return recs, nil
+}
@@ -0,0 +1,136 @@
+package db_test
+
+import (
+	"context"
+	"errors"
+	"go-kvdb/db"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// watch collects n records after the sequence number.
+func watch(t *testing.T, d *db.Database, after uint64, n int) []db.LogRecord {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	errDone := errors.New("done")
+	var recs []db.LogRecord
+	err := d.Watch(ctx, after, func(rec db.LogRecord) error {
+		recs = append(recs, rec)
+		if len(recs) == n {
+			return errDone
+		}
+		return nil
+	})
+	if err != errDone {
+		t.Fatalf("Could not watch %d changes after %d: got %d, %v", n, after, len(recs), err)
+	}
+	return recs
+}
+
+func TestWatch(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "shard.db")
+
+	d, closeFunc, err := db.OpenDatabase(dbPath, db.Options{ChangeLog: true, GroupCommit: true})
+	if err != nil {
+		t.Fatalf("Could not create a new database: %v", err)
+	}
+
+	start, err := d.LastSeq()
+	if err != nil {
+		t.Fatalf("Could not get the last sequence number: %v", err)
+	}
+
+	go func() {
+		for _, k := range []string{"a", "b", "c"} {
+			d.SetKey(k, "default", []byte("value-"+k))
+		}
+		d.DelKey("default", "b")
+	}()
+
+	recs := watch(t, d, start, 4)
+	for i, rec := range recs {
+		if rec.Seq != start+uint64(i)+1 {
+			t.Errorf("Unexpected sequence number of record %d: got %d, want %d", i, rec.Seq, start+uint64(i)+1)
+		}
+	}
+	if recs[0].Op != db.ChangeSet || recs[0].Key != "a" || string(recs[0].Value) != "value-a" {
+		t.Errorf("Unexpected first change: %+v", recs[0].Change)
+	}
+	if recs[3].Op != db.ChangeDelete || recs[3].Key != "b" {
+		t.Errorf("Unexpected last change: %+v", recs[3].Change)
+	}
+
+	closeFunc()
+
+	// After a restart the changes are read back from the log.
+	d, closeFunc, err = db.OpenDatabase(dbPath, db.Options{ChangeLog: true})
+	if err != nil {
+		t.Fatalf("Could not reopen the database: %v", err)
+	}
+	defer closeFunc()
+
+	reread := watch(t, d, start+1, 3)
+	if reread[0].Seq != recs[1].Seq || reread[0].Key != "b" {
+		t.Errorf("Unexpected first change after a restart: %+v", reread[0])
+	}
+
+	if _, err := d.TruncateChangeLog(time.Now().Add(time.Minute)); err != nil {
+		t.Fatalf("Could not truncate the change log: %v", err)
+	}
+	err = d.Watch(context.Background(), 0, func(db.LogRecord) error { return nil })
+	if !errors.Is(err, db.ErrUnknownSeq) {
+		t.Errorf("Unexpected error watching a truncated log: got %v, want %v", err, db.ErrUnknownSeq)
+	}
+}
+
+func TestWatchDisabled(t *testing.T) {
+	d, closeFunc, err := db.NewDatabase(filepath.Join(t.TempDir(), "shard.db"))
+	if err != nil {
+		t.Fatalf("Could not create a new database: %v", err)
+	}
+	defer closeFunc()
+
+	err = d.Watch(context.Background(), 0, func(db.LogRecord) error { return nil })
+	if !errors.Is(err, db.ErrNoChangeLog) {
+		t.Errorf("Unexpected error without the change log: got %v, want %v", err, db.ErrNoChangeLog)
+	}
+}
+
+func TestCursor(t *testing.T) {
+	d, closeFunc, err := db.OpenDatabase(filepath.Join(t.TempDir(), "shard.db"), db.Options{ChangeLog: true})
+	if err != nil {
+		t.Fatalf("Could not create a new database: %v", err)
+	}
+	defer closeFunc()
+
+	if _, ok, err := d.Cursor("reader"); err != nil || ok {
+		t.Fatalf("Unexpected cursor before it was set: %v, %v", ok, err)
+	}
+
+	start, err := d.LastSeq()
+	if err != nil {
+		t.Fatalf("Could not get the last sequence number: %v", err)
+	}
+	if err := d.SetCursor("reader", 42); err != nil {
+		t.Fatalf("Could not set the cursor: %v", err)
+	}
+	if seq, ok, err := d.Cursor("reader"); err != nil || !ok || seq != 42 {
+		t.Errorf("Unexpected cursor: got %d, %v, %v, want 42", seq, ok, err)
+	}
+
+	// Storing a cursor is not a change.
+	if seq, err := d.LastSeq(); err != nil || seq != start {
+		t.Errorf("Unexpected last sequence number after setting the cursor: got %d, %v, want %d", seq, err, start)
+	}
+
+	if err := d.DeleteCursor("reader"); err != nil {
+		t.Fatalf("Could not delete the cursor: %v", err)
+	}
+	if _, ok, err := d.Cursor("reader"); err != nil || ok {
+		t.Errorf("Unexpected cursor after it was deleted: %v, %v", ok, err)
+	}
+}
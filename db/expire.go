@@ -0,0 +1,260 @@
+package db
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// expireBucket is the system bucket that holds the expiry times of the
+// keys, both by key and by time, so that DeleteExpired finds the expired
+// keys without reading the others.
+const expireBucket = SystemPrefix + "expires"
+
+// Prefixes of the expiry entries by key and by time.
+const (
+	expiryByKey  = 'k'
+	expiryByTime = 't'
+)
+
+// expireChunk is the number of expired keys deleted per transaction.
+const expireChunk = 1000
+
+// Expirer is implemented by the stores that support plain values with a
+// time to live. Expired keys read as missing until DeleteExpired deletes
+// them. Setting a key removes its expiry time, while Modify keeps it.
+type Expirer interface {
+	// ModifyTTL is like Modify, but fn also gets the expiry time of the
+	// key and returns its new one. The zero time means no expiry.
+	ModifyTTL(bucketName, key string, fn func(value []byte, expires time.Time) ([]byte, time.Time, error)) error
+	// Expiry returns the expiry time of the key, which is zero if the
+	// key does not expire or does not exist.
+	Expiry(bucketName, key string) (time.Time, error)
+	// DeleteExpired deletes the keys that expired at or before now
+	// and returns their number.
+	DeleteExpired(now time.Time) (int, error)
+}
+
+var _ Expirer = (*Database)(nil)
+
+func expiryKey(bucketName, key string) []byte {
+	return []byte(string(expiryByKey) + bucketName + "\x00" + key)
+}
+
+func expiryTimeKey(at time.Time, bucketName, key string) []byte {
+	k := make([]byte, 9, 9+len(bucketName)+1+len(key))
+	k[0] = expiryByTime
+	binary.BigEndian.PutUint64(k[1:], uint64(at.UnixNano()))
+	return append(append(append(k, bucketName...), 0), key...)
+}
+
+func decodeExpiry(v []byte) time.Time {
+	return time.Unix(0, int64(binary.BigEndian.Uint64(v)))
+}
+
+// expiry returns the expiry time of the key, zero if it has none.
+func expiry(tx *bolt.Tx, bucketName, key string) time.Time {
+	b := tx.Bucket([]byte(expireBucket))
+	if b == nil {
+		return time.Time{}
+	}
+	if v := b.Get(expiryKey(bucketName, key)); v != nil {
+		return decodeExpiry(v)
+	}
+	return time.Time{}
+}
+
+// expired reports whether the key has expired at the time.
+func expired(tx *bolt.Tx, bucketName, key string, now time.Time) bool {
+	at := expiry(tx, bucketName, key)
+	return !at.IsZero() && !now.Before(at)
+}
+
+// setExpiry changes the expiry time of the key and logs the change.
+// The zero time removes it.
+func (d *Database) setExpiry(tx *bolt.Tx, bucketName, key string, at time.Time) error {
+	b := tx.Bucket([]byte(expireBucket))
+	if b == nil {
+		if at.IsZero() {
+			return nil
+		}
+		return fmt.Errorf("bucket %s not found", expireBucket)
+	}
+
+	k := expiryKey(bucketName, key)
+	v := b.Get(k)
+	if v == nil && at.IsZero() || v != nil && decodeExpiry(v).Equal(at) {
+		return nil
+	}
+	// Changing only the expiry time is a write of the key too.
+	if err := setVersion(tx, bucketName, key); err != nil {
+		return err
+	}
+	if v != nil {
+		if err := d.deleteSystemKey(tx, expireBucket, expiryTimeKey(decodeExpiry(v), bucketName, key)); err != nil {
+			return err
+		}
+	}
+
+	if at.IsZero() {
+		return d.deleteSystemKey(tx, expireBucket, k)
+	}
+
+	v = make([]byte, 8)
+	binary.BigEndian.PutUint64(v, uint64(at.UnixNano()))
+	if err := d.putSystemKey(tx, expireBucket, k, v); err != nil {
+		return err
+	}
+	return d.putSystemKey(tx, expireBucket, expiryTimeKey(at, bucketName, key), []byte{})
+}
+
+// putSystemKey writes a key of the system bucket and logs it.
+func (d *Database) putSystemKey(tx *bolt.Tx, systemBucket string, k, v []byte) error {
+	if err := tx.Bucket([]byte(systemBucket)).Put(k, v); err != nil {
+		return err
+	}
+	return d.logChange(tx, Change{Op: ChangeSet, Bucket: systemBucket, Key: string(k), Value: v})
+}
+
+// deleteSystemKey deletes a key of the system bucket and logs it.
+func (d *Database) deleteSystemKey(tx *bolt.Tx, systemBucket string, k []byte) error {
+	if err := tx.Bucket([]byte(systemBucket)).Delete(k); err != nil {
+		return err
+	}
+	return d.logChange(tx, Change{Op: ChangeDelete, Bucket: systemBucket, Key: string(k)})
+}
+
+// clearKeyMeta removes the expiry time and the flags of the key.
+func (d *Database) clearKeyMeta(tx *bolt.Tx, bucketName, key string) error {
+	if err := d.setExpiry(tx, bucketName, key, time.Time{}); err != nil {
+		return err
+	}
+	return d.setFlags(tx, bucketName, key, 0)
+}
+
+// clearBucketMeta removes the expiry times, the versions and the flags of
+// all keys of the bucket.
+func (d *Database) clearBucketMeta(tx *bolt.Tx, bucketName string) error {
+	b := tx.Bucket([]byte(expireBucket))
+	if b == nil {
+		return nil
+	}
+
+	prefix := expiryKey(bucketName, "")
+	var keys []string
+	c := b.Cursor()
+	for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+		keys = append(keys, string(k[len(prefix):]))
+	}
+
+	for _, key := range keys {
+		if err := d.setExpiry(tx, bucketName, key, time.Time{}); err != nil {
+			return err
+		}
+	}
+	if err := clearBucketVersions(tx, bucketName); err != nil {
+		return err
+	}
+	return d.clearBucketFlags(tx, bucketName)
+}
+
+// ModifyTTL atomically replaces the value and the expiry time of the key
+// with the results of fn, keeping its flags.
+func (d *Database) ModifyTTL(bucketName, key string, fn func(value []byte, expires time.Time) ([]byte, time.Time, error)) error {
+	return d.ModifyItem(bucketName, key, func(item *Item) (*Item, error) {
+		var old Item
+		if item != nil {
+			old = *item
+		}
+
+		value, expires, err := fn(old.Value, old.Expires)
+		if err != nil || value == nil {
+			return nil, err
+		}
+		return &Item{Value: value, Expires: expires, Flags: old.Flags}, nil
+	})
+}
+
+// Expiry returns the expiry time of the key.
+func (d *Database) Expiry(bucketName, key string) (time.Time, error) {
+	var at time.Time
+	err := d.db.View(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte(bucketName)) == nil {
+			return fmt.Errorf("bucket %s not found", bucketName)
+		}
+		at = expiry(tx, bucketName, key)
+		return nil
+	})
+	return at, err
+}
+
+// DeleteExpired deletes the expired keys in chunks, each in its own
+// transaction. Keys locked by a distributed transaction are left alone
+// until it is resolved, like any other write would be.
+func (d *Database) DeleteExpired(now time.Time) (int, error) {
+	type expiredKey struct {
+		bucket, key string
+	}
+
+	n := 0
+	var start []byte
+	for {
+		var keys []expiredKey
+		err := d.db.View(func(tx *bolt.Tx) error {
+			b := tx.Bucket([]byte(expireBucket))
+			if b == nil {
+				return nil
+			}
+
+			// The chunks start after the last key of the previous one,
+			// which may have been skipped.
+			end := expiryTimeKey(now, "", "")[:9]
+			c := b.Cursor()
+			k, _ := c.Seek([]byte{expiryByTime})
+			if start != nil {
+				if k, _ = c.Seek(start); bytes.Equal(k, start) {
+					k, _ = c.Next()
+				}
+			}
+			for ; k != nil && k[0] == expiryByTime && len(keys) < expireChunk; k, _ = c.Next() {
+				if bytes.Compare(k[:9], end) > 0 {
+					break
+				}
+				bucket, key, _ := bytes.Cut(k[9:], []byte{0})
+				keys = append(keys, expiredKey{string(bucket), string(key)})
+				start = append(start[:0], k...)
+			}
+			return nil
+		})
+		if err != nil || len(keys) == 0 {
+			return n, err
+		}
+
+		deleted := 0
+		err = d.update(func(tx *bolt.Tx) error {
+			deleted = 0
+			for _, k := range keys {
+				// The key may have been written since.
+				if !expired(tx, k.bucket, k.key, now) || checkLock(tx, k.bucket, k.key, "") != nil {
+					continue
+				}
+				if b := tx.Bucket([]byte(k.bucket)); b != nil {
+					if err := d.applyOp(tx, b, k.bucket, Op{Key: k.key, Delete: true}); err != nil {
+						return err
+					}
+				} else if err := d.clearKeyMeta(tx, k.bucket, k.key); err != nil {
+					return err
+				}
+				deleted++
+			}
+			return nil
+		})
+		if err != nil {
+			return n, err
+		}
+		n += deleted
+	}
+}
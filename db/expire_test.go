@@ -0,0 +1,82 @@
+package db_test
+
+import (
+	"go-kvdb/db"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func setTTL(t *testing.T, d *db.Database, key, value string, at time.Time) {
+	t.Helper()
+	err := d.ModifyTTL("default", key, func([]byte, time.Time) ([]byte, time.Time, error) {
+		return []byte(value), at, nil
+	})
+	if err != nil {
+		t.Fatalf("Could not set key %q with an expiry time: %v", key, err)
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	d, closeFunc, err := db.OpenDatabase(filepath.Join(t.TempDir(), "shard.db"), db.Options{ChangeLog: true})
+	if err != nil {
+		t.Fatalf("Could not create a new database: %v", err)
+	}
+	defer closeFunc()
+
+	past, future := time.Now().Add(-time.Second), time.Now().Add(time.Hour)
+	setTTL(t, d, "gone", "old", past)
+	setTTL(t, d, "kept", "1", future)
+	setTTL(t, d, "reset", "v", past)
+	setKey(t, d, "reset", "new", "default")
+
+	if value := getKey(t, d, "gone", "default"); value != "" {
+		t.Errorf("Unexpected value of an expired key: got %q, want none", value)
+	}
+	if keys, err := d.ListKeys("default"); err != nil || len(keys) != 2 || keys[0] != "kept" || keys[1] != "reset" {
+		t.Errorf("Unexpected keys: got %v, %v, want [kept reset]", keys, err)
+	}
+
+	// Modify keeps the expiry time, while setting a key removes it.
+	if _, err := d.Incr("default", "kept"); err != nil {
+		t.Fatalf("Could not increment: %v", err)
+	}
+	if at, err := d.Expiry("default", "kept"); err != nil || !at.Equal(future) {
+		t.Errorf("Unexpected expiry time after Modify: got %v, %v, want %v", at, err, future)
+	}
+	if at, _ := d.Expiry("default", "reset"); !at.IsZero() {
+		t.Errorf("Unexpected expiry time after SetKey: got %v, want none", at)
+	}
+
+	n, err := d.DeleteExpired(time.Now())
+	if err != nil || n != 1 {
+		t.Errorf("Unexpected result of DeleteExpired: got %d, %v, want 1", n, err)
+	}
+	if at, _ := d.Expiry("default", "gone"); !at.IsZero() {
+		t.Errorf("The expiry time of a deleted key was kept: %v", at)
+	}
+
+	if n, err := d.DeleteExpired(future.Add(time.Second)); err != nil || n != 1 {
+		t.Errorf("Unexpected result of DeleteExpired later: got %d, %v, want 1", n, err)
+	}
+	if value := getKey(t, d, "reset", "default"); value != "new" {
+		t.Errorf("Unexpected value of a key without expiry: got %q, want %q", value, "new")
+	}
+
+	// Keys locked by a prepared transaction are deleted once it is aborted.
+	setTTL(t, d, "locked", "1", past)
+	setTTL(t, d, "unlocked", "1", past)
+	txn := db.PreparedTxn{ID: "t1", Bucket: "default", Prepared: time.Now(), Ops: []db.TxnOp{{Op: db.Op{Key: "locked", Value: []byte("2")}}}}
+	if err := d.Prepare(txn); err != nil {
+		t.Fatalf("Could not prepare: %v", err)
+	}
+	if n, err := d.DeleteExpired(time.Now()); err != nil || n != 1 {
+		t.Errorf("Unexpected result of DeleteExpired with a locked key: got %d, %v, want 1", n, err)
+	}
+	if err := d.AbortPrepared("t1"); err != nil {
+		t.Fatalf("Could not abort: %v", err)
+	}
+	if n, err := d.DeleteExpired(time.Now()); err != nil || n != 1 {
+		t.Errorf("Unexpected result of DeleteExpired after the abort: got %d, %v, want 1", n, err)
+	}
+}
@@ -0,0 +1,357 @@
+package db
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// Change operations.
+const (
+	ChangeSet          = "set"
+	ChangeDelete       = "delete"
+	ChangeCreateBucket = "createBucket"
+	ChangeDeleteBucket = "deleteBucket"
+	ChangeTyped        = "typed"
+)
+
+// Change is a single modification of the database. Key and Value are
+// only set for the key operations; the value of a ChangeTyped change is
+// the JSON encoded Cmd.
+type Change struct {
+	Op     string `json:"op"`
+	Bucket string `json:"bucket"`
+	Key    string `json:"key,omitempty"`
+	Value  []byte `json:"value,omitempty"`
+}
+
+// MetaBucket returns the bucket whose metadata the change sets, if any.
+func (c Change) MetaBucket() (string, bool) {
+	return c.Key, c.Bucket == metaBucket && c.Op == ChangeSet
+}
+
+// Digest remembers the contents of the database at the time of a backup
+// as a hash of the value of every key in every bucket, including the
+// contents of typed values and the metadata in the system buckets, but
+// not the key versions. It is used to find the changes made since then.
+//
+// The records of the change log never change once written, so instead of
+// hashing them the digest only keeps their range.
+type Digest struct {
+	Buckets map[string]map[string]uint64 `json:"buckets"`
+	Log     LogRange                     `json:"log"`
+}
+
+// LogRange is the range of the sequence numbers of the change log
+// records. First is Last+1 if the log is empty.
+type LogRange struct {
+	First uint64 `json:"first"`
+	Last  uint64 `json:"last"`
+	// Hash is the hash of the last record, which tells the log from
+	// another one with the same sequence numbers, e.g. after a restore.
+	Hash uint64 `json:"hash,omitempty"`
+}
+
+// IncrementalBackuper is implemented by the stores that can back up
+// only the changes made since an earlier backup.
+type IncrementalBackuper interface {
+	Backuper
+
+	// Changes writes the changes made since the digest was taken to w,
+	// one JSON encoded Change per line, and returns the new digest and
+	// the number of changes.
+	Changes(w io.Writer, since Digest) (Digest, int, error)
+}
+
+var _ IncrementalBackuper = (*Database)(nil)
+
+func hashValue(v []byte) uint64 {
+	h := fnv.New64a()
+	h.Write(v)
+	return h.Sum64()
+}
+
+// digest hashes all key values of the transaction.
+func digest(tx *bolt.Tx) (Digest, error) {
+	d := Digest{Buckets: make(map[string]map[string]uint64)}
+	err := tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+		switch string(name) {
+		case versionBucket, deletedVersionBucket:
+			// The versions are IDs of the transactions of this file,
+			// which mean nothing in another one.
+			return nil
+		case changeLogBucket:
+			d.Buckets[changeLogBucket] = nil
+			d.Log = logRange(b)
+			return nil
+		}
+		keys := make(map[string]uint64)
+		d.Buckets[string(name)] = keys
+		return b.ForEach(func(k, v []byte) error {
+			if v != nil {
+				keys[string(k)] = hashValue(v)
+			} else {
+				keys[string(k)] = typedDigest(b.Bucket(k))
+			}
+			return nil
+		})
+	})
+	return d, err
+}
+
+func logRange(b *bolt.Bucket) LogRange {
+	r := LogRange{Last: b.Sequence()}
+	r.First = r.Last + 1
+	if k, _ := b.Cursor().First(); k != nil {
+		r.First = binary.BigEndian.Uint64(k)
+	}
+	if v := b.Get(seqKey(r.Last)); v != nil {
+		r.Hash = hashValue(v)
+	}
+	return r
+}
+
+// FileDigest returns the digest of the backup at path.
+func FileDigest(path string) (Digest, error) {
+	bdb, err := bolt.Open(path, 0600, &bolt.Options{ReadOnly: true, Timeout: time.Second})
+	if err != nil {
+		return Digest{}, fmt.Errorf("opening backup: %w", err)
+	}
+	defer bdb.Close()
+
+	var d Digest
+	err = bdb.View(func(tx *bolt.Tx) (err error) {
+		d, err = digest(tx)
+		return err
+	})
+	return d, err
+}
+
+// Changes writes the changes made since the digest was taken. Deleted
+// buckets come first, then the new buckets and then the key changes
+// in bucket and key order. It runs inside a read transaction,
+// so writes can continue while the changes are collected.
+func (d *Database) Changes(w io.Writer, since Digest) (Digest, int, error) {
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+
+	var cur Digest
+	n := 0
+
+	err := d.db.View(func(tx *bolt.Tx) error {
+		var err error
+		if cur, err = digest(tx); err != nil {
+			return err
+		}
+
+		// A log that is behind the digest or has another record at its
+		// end was replaced and is copied again.
+		_, hadLog := since.Buckets[changeLogBucket]
+		resetLog := false
+		if b := tx.Bucket([]byte(changeLogBucket)); b != nil && hadLog {
+			v := b.Get(seqKey(since.Log.Last))
+			resetLog = cur.Log.Last < since.Log.Last || (v != nil && hashValue(v) != since.Log.Hash)
+		}
+
+		var changes []Change
+		for _, bucket := range sortedBuckets(since) {
+			if _, ok := cur.Buckets[bucket]; !ok || (bucket == changeLogBucket && resetLog) {
+				changes = append(changes, Change{Op: ChangeDeleteBucket, Bucket: bucket})
+			}
+		}
+		for _, bucket := range sortedBuckets(cur) {
+			if _, ok := since.Buckets[bucket]; !ok || (bucket == changeLogBucket && resetLog) {
+				changes = append(changes, Change{Op: ChangeCreateBucket, Bucket: bucket})
+			}
+		}
+
+		for _, c := range changes {
+			if err := enc.Encode(c); err != nil {
+				return err
+			}
+		}
+		n += len(changes)
+
+		return tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			bucket := string(name)
+			switch bucket {
+			case versionBucket, deletedVersionBucket:
+				return nil
+			case changeLogBucket:
+				old := since.Log
+				if !hadLog || resetLog {
+					old = LogRange{First: 1}
+				}
+				m, err := logChanges(enc, b, old, cur.Log)
+				n += m
+				return err
+			}
+			old := since.Buckets[bucket]
+
+			if err := b.ForEach(func(k, v []byte) error {
+				if h, ok := old[string(k)]; ok && h == cur.Buckets[bucket][string(k)] {
+					return nil
+				}
+				if v != nil {
+					n++
+					return enc.Encode(Change{Op: ChangeSet, Bucket: bucket, Key: string(k), Value: v})
+				}
+
+				// Typed values are replaced by the commands that rebuild them.
+				changes := []Change{{Op: ChangeDelete, Bucket: bucket, Key: string(k)}}
+				for _, cmd := range typedCommands(b.Bucket(k)) {
+					data, err := json.Marshal(cmd)
+					if err != nil {
+						return err
+					}
+					changes = append(changes, Change{Op: ChangeTyped, Bucket: bucket, Key: string(k), Value: data})
+				}
+				for _, c := range changes {
+					if err := enc.Encode(c); err != nil {
+						return err
+					}
+				}
+				n += len(changes)
+				return nil
+			}); err != nil {
+				return err
+			}
+
+			var deleted []string
+			for k := range old {
+				if _, ok := cur.Buckets[bucket][k]; !ok {
+					deleted = append(deleted, k)
+				}
+			}
+			sort.Strings(deleted)
+
+			for _, k := range deleted {
+				if err := enc.Encode(Change{Op: ChangeDelete, Bucket: bucket, Key: k}); err != nil {
+					return err
+				}
+				n++
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return Digest{}, 0, err
+	}
+
+	if err := bw.Flush(); err != nil {
+		return Digest{}, 0, err
+	}
+	return cur, n, nil
+}
+
+// logChanges writes the changes of the change log bucket b from the old
+// range to the current one: the deletes of the records truncated since,
+// then the new records.
+func logChanges(enc *json.Encoder, b *bolt.Bucket, old, cur LogRange) (int, error) {
+	n := 0
+	for seq := old.First; seq <= old.Last && seq < cur.First; seq++ {
+		if err := enc.Encode(Change{Op: ChangeDelete, Bucket: changeLogBucket, Key: string(seqKey(seq))}); err != nil {
+			return n, err
+		}
+		n++
+	}
+
+	c := b.Cursor()
+	for k, v := c.Seek(seqKey(old.Last + 1)); k != nil; k, v = c.Next() {
+		if err := enc.Encode(Change{Op: ChangeSet, Bucket: changeLogBucket, Key: string(k), Value: v}); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// ApplyChanges applies the changes read from r to the database file at
+// path in a single transaction and returns the number of changes applied.
+// The database must not be in use.
+func ApplyChanges(path string, r io.Reader) (int, error) {
+	bdb, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return 0, fmt.Errorf("opening %s: %w", path, err)
+	}
+	defer bdb.Close()
+
+	n := 0
+	err = bdb.Update(func(tx *bolt.Tx) error {
+		dec := json.NewDecoder(bufio.NewReader(r))
+		for {
+			var c Change
+			if err := dec.Decode(&c); err == io.EOF {
+				return nil
+			} else if err != nil {
+				return fmt.Errorf("change %d: %w", n+1, err)
+			}
+
+			if err := applyChange(tx, c); err != nil {
+				return fmt.Errorf("change %d: %w", n+1, err)
+			}
+			n++
+		}
+	})
+	if err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+func sortedBuckets(d Digest) []string {
+	buckets := make([]string, 0, len(d.Buckets))
+	for b := range d.Buckets {
+		buckets = append(buckets, b)
+	}
+	sort.Strings(buckets)
+	return buckets
+}
+
+func applyChange(tx *bolt.Tx, c Change) error {
+	switch c.Op {
+	case ChangeCreateBucket:
+		_, err := tx.CreateBucketIfNotExists([]byte(c.Bucket))
+		return err
+	case ChangeDeleteBucket:
+		if err := tx.DeleteBucket([]byte(c.Bucket)); err != nil && err != bolt.ErrBucketNotFound {
+			return err
+		}
+		if meta := tx.Bucket([]byte(metaBucket)); meta != nil {
+			return meta.Delete([]byte(c.Bucket))
+		}
+		return nil
+	}
+
+	b := tx.Bucket([]byte(c.Bucket))
+	if b == nil {
+		return fmt.Errorf("bucket %s not found", c.Bucket)
+	}
+
+	switch c.Op {
+	case ChangeSet:
+		// Keep the log sequence in step with the copied log records.
+		if c.Bucket == changeLogBucket && len(c.Key) == 8 {
+			if seq := binary.BigEndian.Uint64([]byte(c.Key)); seq > b.Sequence() {
+				if err := b.SetSequence(seq); err != nil {
+					return err
+				}
+			}
+		}
+		// A nil value would mean a nested bucket to bolt.
+		return putValue(b, []byte(c.Key), append([]byte{}, c.Value...))
+	case ChangeDelete:
+		return deleteValue(b, []byte(c.Key))
+	case ChangeTyped:
+		return applyTyped(b, c)
+	default:
+		return fmt.Errorf("unknown operation %q", c.Op)
+	}
+}
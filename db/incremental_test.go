@@ -0,0 +1,152 @@
+package db_test
+
+import (
+	"bytes"
+	"go-kvdb/db"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestChanges(t *testing.T) {
+	dir := t.TempDir()
+	backupPath := filepath.Join(dir, "backup.db")
+
+	d, closeFunc, err := db.NewDatabase(filepath.Join(dir, "shard.db"))
+	if err != nil {
+		t.Fatalf("Could not create a new database: %v", err)
+	}
+	defer closeFunc()
+
+	setKey(t, d, "party", "Great", "default")
+	setKey(t, d, "gone", "Soon", "default")
+	setKey(t, d, "same", "Same", "default")
+	if err := d.CreateBucketIfNotExists("old"); err != nil {
+		t.Fatalf("Could not create bucket: %v", err)
+	}
+
+	f, err := os.Create(backupPath)
+	if err != nil {
+		t.Fatalf("Could not create the backup file: %v", err)
+	}
+	if _, err := d.Backup(f); err != nil {
+		t.Fatalf("Could not back up the database: %v", err)
+	}
+	f.Close()
+
+	digest, err := db.FileDigest(backupPath)
+	if err != nil {
+		t.Fatalf("Could not compute the backup digest: %v", err)
+	}
+
+	setKey(t, d, "party", "Over", "default")
+	setKey(t, d, "empty", "", "default")
+	if err := d.DelKey("default", "gone"); err != nil {
+		t.Fatalf("Could not delete key: %v", err)
+	}
+	if err := d.DeleteBucket("old"); err != nil {
+		t.Fatalf("Could not delete bucket: %v", err)
+	}
+	if err := d.CreateBucketIfNotExists("new"); err != nil {
+		t.Fatalf("Could not create bucket: %v", err)
+	}
+	setKey(t, d, "fresh", "Key", "new")
+
+	var buf bytes.Buffer
+	next, n, err := d.Changes(&buf, digest)
+	if err != nil {
+		t.Fatalf("Could not collect the changes: %v", err)
+	}
+
+	want := []string{
+		`{"op":"deleteBucket","bucket":"old"}`,
+		`{"op":"createBucket","bucket":"new"}`,
+		`{"op":"set","bucket":"default","key":"empty"}`,
+		`{"op":"set","bucket":"default","key":"party","value":"T3Zlcg=="}`,
+		`{"op":"delete","bucket":"default","key":"gone"}`,
+		`{"op":"set","bucket":"new","key":"fresh","value":"S2V5"}`,
+	}
+	if got := strings.Split(strings.TrimSpace(buf.String()), "\n"); strings.Join(got, "\n") != strings.Join(want, "\n") || n != len(want) {
+		t.Errorf("Unexpected changes (%d): got\n%s\nwant\n%s", n, strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	applied, err := db.ApplyChanges(backupPath, &buf)
+	if err != nil || applied != len(want) {
+		t.Fatalf("Could not apply the changes: %d applied, %v", applied, err)
+	}
+
+	restored, err := db.FileDigest(backupPath)
+	if err != nil {
+		t.Fatalf("Could not compute the backup digest: %v", err)
+	}
+
+	buf.Reset()
+	if _, n, err := d.Changes(&buf, restored); err != nil || n != 0 {
+		t.Errorf("Expected no changes after applying them, got %d (%v):\n%s", n, err, buf.String())
+	}
+	if _, n, _ := d.Changes(&buf, next); n != 0 {
+		t.Errorf("Expected no changes since the last digest, got %d", n)
+	}
+}
+
+func TestChangesLog(t *testing.T) {
+	dir := t.TempDir()
+	backupPath := filepath.Join(dir, "backup.db")
+
+	d, closeFunc, err := db.OpenDatabase(filepath.Join(dir, "shard.db"), db.Options{ChangeLog: true})
+	if err != nil {
+		t.Fatalf("Could not create a new database: %v", err)
+	}
+	defer closeFunc()
+
+	setKey(t, d, "party", "Great", "default")
+	backupTo(t, d, backupPath)
+
+	digest, err := db.FileDigest(backupPath)
+	if err != nil {
+		t.Fatalf("Could not compute the backup digest: %v", err)
+	}
+	if keys, ok := digest.Buckets["__changelog"]; !ok || len(keys) != 0 || digest.Log.First != 1 || digest.Log.Last == 0 {
+		t.Errorf("Unexpected change log in the digest: %v, %+v", keys, digest.Log)
+	}
+
+	// The truncated records are deleted and the new ones copied.
+	if _, err := d.TruncateChangeLog(time.Now().Add(time.Minute)); err != nil {
+		t.Fatalf("Could not truncate the change log: %v", err)
+	}
+	setKey(t, d, "party", "Over", "default")
+
+	var buf bytes.Buffer
+	next, n, err := d.Changes(&buf, digest)
+	if err != nil {
+		t.Fatalf("Could not collect the changes: %v", err)
+	}
+	deletes := strings.Count(buf.String(), `{"op":"delete","bucket":"__changelog"`)
+	if want := int(digest.Log.Last); deletes != want || next.Log.First != digest.Log.Last+1 || next.Log.Last != digest.Log.Last+1 {
+		t.Errorf("Unexpected log changes: %d deletes, want %d, range %+v:\n%s", deletes, want, next.Log, buf.String())
+	}
+	if applied, err := db.ApplyChanges(backupPath, &buf); err != nil || applied != n {
+		t.Fatalf("Could not apply the changes: %d applied, %v", applied, err)
+	}
+
+	restored, err := db.FileDigest(backupPath)
+	if err != nil {
+		t.Fatalf("Could not compute the backup digest: %v", err)
+	}
+	buf.Reset()
+	if _, n, err := d.Changes(&buf, restored); err != nil || n != 0 {
+		t.Errorf("Expected no changes after applying them, got %d (%v):\n%s", n, err, buf.String())
+	}
+
+	// A log with another record at the end of the digest is copied again.
+	next.Log.Hash++
+	buf.Reset()
+	if _, _, err := d.Changes(&buf, next); err != nil {
+		t.Fatalf("Could not collect the changes: %v", err)
+	}
+	if !strings.HasPrefix(buf.String(), `{"op":"deleteBucket","bucket":"__changelog"}`+"\n"+`{"op":"createBucket","bucket":"__changelog"}`) {
+		t.Errorf("Expected the change log to be copied again, got:\n%s", buf.String())
+	}
+}
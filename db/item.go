@@ -0,0 +1,177 @@
+package db
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// flagsBucket is the system bucket that holds the non-zero flags of the keys.
+const flagsBucket = SystemPrefix + "flags"
+
+// Item is a plain value with its metadata.
+type Item struct {
+	Value []byte
+	// Expires is the expiry time of the key, zero if it does not expire.
+	Expires time.Time
+	// Flags are opaque to the database, e.g. the flags memcached clients
+	// use to mark serialized or compressed values.
+	Flags uint32
+	// Version changes with every write of the key, including the changes
+	// of its expiry time and flags. It is ignored in the results of the
+	// ModifyItem functions.
+	Version uint64
+}
+
+// ItemStore is implemented by the stores that keep flags with the
+// values. Like the expiry time, setting a key resets its flags, while
+// Modify and ModifyTTL keep them.
+type ItemStore interface {
+	Expirer
+
+	// GetItem returns the item of the key, nil if it does not exist.
+	GetItem(bucketName, key string) (*Item, error)
+	// ModifyItem atomically replaces the item of the key with the result
+	// of fn. Missing and expired keys are passed as nil and a nil result
+	// deletes the key. The item is only valid during the call of fn,
+	// which may be called more than once.
+	ModifyItem(bucketName, key string, fn func(item *Item) (*Item, error)) error
+}
+
+var _ ItemStore = (*Database)(nil)
+
+func flagsKey(bucketName, key string) []byte {
+	return []byte(bucketName + "\x00" + key)
+}
+
+// flags returns the flags of the key.
+func flags(tx *bolt.Tx, bucketName, key string) uint32 {
+	b := tx.Bucket([]byte(flagsBucket))
+	if b == nil {
+		return 0
+	}
+	if v := b.Get(flagsKey(bucketName, key)); v != nil {
+		return binary.BigEndian.Uint32(v)
+	}
+	return 0
+}
+
+// setFlags changes the flags of the key and logs the change.
+// Zero flags are not stored.
+func (d *Database) setFlags(tx *bolt.Tx, bucketName, key string, f uint32) error {
+	b := tx.Bucket([]byte(flagsBucket))
+	if b == nil {
+		if f == 0 {
+			return nil
+		}
+		return fmt.Errorf("bucket %s not found", flagsBucket)
+	}
+
+	k := flagsKey(bucketName, key)
+	if f == flags(tx, bucketName, key) {
+		return nil
+	}
+	// Changing only the flags is a write of the key too.
+	if err := setVersion(tx, bucketName, key); err != nil {
+		return err
+	}
+	if f == 0 {
+		return d.deleteSystemKey(tx, flagsBucket, k)
+	}
+	return d.putSystemKey(tx, flagsBucket, k, binary.BigEndian.AppendUint32(nil, f))
+}
+
+// clearBucketFlags removes the flags of all keys of the bucket.
+func (d *Database) clearBucketFlags(tx *bolt.Tx, bucketName string) error {
+	b := tx.Bucket([]byte(flagsBucket))
+	if b == nil {
+		return nil
+	}
+
+	prefix := flagsKey(bucketName, "")
+	var keys [][]byte
+	c := b.Cursor()
+	for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+		keys = append(keys, clone(k))
+	}
+
+	for _, k := range keys {
+		if err := d.deleteSystemKey(tx, flagsBucket, k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// item returns the item of the key, nil if it is missing or expired.
+func item(tx *bolt.Tx, b *bolt.Bucket, bucketName, key string) *Item {
+	v := b.Get([]byte(key))
+	if v == nil {
+		return nil
+	}
+	at := expiry(tx, bucketName, key)
+	if !at.IsZero() && !time.Now().Before(at) {
+		return nil
+	}
+	return &Item{Value: v, Expires: at, Flags: flags(tx, bucketName, key), Version: version(tx, bucketName, key)}
+}
+
+// GetItem returns the item of the key.
+func (d *Database) GetItem(bucketName, key string) (*Item, error) {
+	var result *Item
+	err := d.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucketName))
+		if b == nil {
+			return fmt.Errorf("bucket %s not found", bucketName)
+		}
+		if result = item(tx, b, bucketName, key); result != nil {
+			// The value is only valid during the transaction.
+			result.Value = clone(result.Value)
+		}
+		return nil
+	})
+	return result, err
+}
+
+// ModifyItem atomically replaces the item of the key with the result of fn.
+// It fails with ErrWrongType for typed values.
+func (d *Database) ModifyItem(bucketName, key string, fn func(item *Item) (*Item, error)) error {
+	return d.update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucketName))
+		if b == nil {
+			return fmt.Errorf("bucket %s not found", bucketName)
+		}
+		if b.Bucket([]byte(key)) != nil {
+			return ErrWrongType
+		}
+		if err := checkLock(tx, bucketName, key, ""); err != nil {
+			return err
+		}
+
+		old := item(tx, b, bucketName, key)
+		newItem, err := fn(old)
+		if err != nil {
+			return err
+		}
+
+		if newItem == nil {
+			if b.Get([]byte(key)) == nil {
+				return nil
+			}
+			return d.applyOp(tx, b, bucketName, Op{Key: key, Delete: true})
+		}
+
+		if old == nil || !bytes.Equal(old.Value, newItem.Value) {
+			if err := d.applyOp(tx, b, bucketName, Op{Key: key, Value: newItem.Value}); err != nil {
+				return err
+			}
+		}
+		if err := d.setExpiry(tx, bucketName, key, newItem.Expires); err != nil {
+			return err
+		}
+		return d.setFlags(tx, bucketName, key, newItem.Flags)
+	})
+}
@@ -0,0 +1,76 @@
+package db_test
+
+import (
+	"go-kvdb/db"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func putItem(t *testing.T, d *db.Database, key string, item *db.Item) {
+	t.Helper()
+	err := d.ModifyItem("default", key, func(*db.Item) (*db.Item, error) {
+		return item, nil
+	})
+	if err != nil {
+		t.Fatalf("Could not modify the item of %q: %v", key, err)
+	}
+}
+
+func TestItems(t *testing.T) {
+	d, closeFunc, err := db.OpenDatabase(filepath.Join(t.TempDir(), "shard.db"), db.Options{ChangeLog: true})
+	if err != nil {
+		t.Fatalf("Could not create a new database: %v", err)
+	}
+	defer closeFunc()
+
+	future := time.Now().Add(time.Hour)
+	putItem(t, d, "a", &db.Item{Value: []byte("1"), Expires: future, Flags: 42})
+
+	item, err := d.GetItem("default", "a")
+	if err != nil || item == nil || string(item.Value) != "1" || item.Flags != 42 || !item.Expires.Equal(future) {
+		t.Fatalf("Unexpected item: got %+v, %v", item, err)
+	}
+
+	// Modify keeps the flags, while setting a key removes them.
+	if _, err := d.Incr("default", "a"); err != nil {
+		t.Fatalf("Could not increment: %v", err)
+	}
+	if item, _ := d.GetItem("default", "a"); item == nil || string(item.Value) != "2" || item.Flags != 42 {
+		t.Errorf("Unexpected item after Modify: got %+v", item)
+	}
+	setKey(t, d, "a", "3", "default")
+	if item, _ := d.GetItem("default", "a"); item == nil || item.Flags != 0 || !item.Expires.IsZero() {
+		t.Errorf("Unexpected item after SetKey: got %+v", item)
+	}
+
+	// Expired items are passed as nil and a nil result deletes the key.
+	putItem(t, d, "b", &db.Item{Value: []byte("v"), Expires: time.Now().Add(-time.Second), Flags: 1})
+	err = d.ModifyItem("default", "b", func(item *db.Item) (*db.Item, error) {
+		if item != nil {
+			t.Errorf("Unexpected expired item: got %+v, want nil", item)
+		}
+		return nil, nil
+	})
+	if err != nil {
+		t.Fatalf("Could not delete the item: %v", err)
+	}
+	if item, _ := d.GetItem("default", "b"); item != nil {
+		t.Errorf("Unexpected deleted item: got %+v", item)
+	}
+
+	putItem(t, d, "c", &db.Item{Value: []byte("v"), Flags: 7})
+	if err := d.DeleteBucket("default"); err != nil {
+		t.Fatalf("Could not delete the bucket: %v", err)
+	}
+	if err := d.CreateBucketIfNotExists("default"); err != nil {
+		t.Fatalf("Could not create the bucket: %v", err)
+	}
+	// Modify keeps the flags, so it would reveal the ones left behind.
+	if err := d.Modify("default", "c", func([]byte) ([]byte, error) { return []byte("v"), nil }); err != nil {
+		t.Fatalf("Could not modify: %v", err)
+	}
+	if item, _ := d.GetItem("default", "c"); item == nil || item.Flags != 0 {
+		t.Errorf("The flags of a deleted bucket were kept: got %+v", item)
+	}
+}
@@ -0,0 +1,63 @@
+package lsm
+
+import (
+	"hash/fnv"
+	"math"
+)
+
+// bloom is a bloom filter over the keys of an SSTable. The first byte
+// of the encoded filter is the number of hash functions.
+type bloom []byte
+
+const bloomBitsPerKey = 10
+
+func newBloom(keys []string) bloom {
+	bits := len(keys) * bloomBitsPerKey
+	if bits < 64 {
+		bits = 64
+	}
+
+	// k = ln(2) * bits per key is optimal.
+	k := int(math.Round(bloomBitsPerKey * math.Ln2))
+
+	b := make(bloom, 1+(bits+7)/8)
+	b[0] = byte(k)
+	for _, key := range keys {
+		b.add(key)
+	}
+	return b
+}
+
+func bloomHashes(key string) (uint32, uint32) {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	sum := h.Sum64()
+	return uint32(sum), uint32(sum >> 32)
+}
+
+func (b bloom) add(key string) {
+	bits := uint32(len(b)-1) * 8
+	h1, h2 := bloomHashes(key)
+	for i := uint32(0); i < uint32(b[0]); i++ {
+		pos := (h1 + i*h2) % bits
+		b[1+pos/8] |= 1 << (pos % 8)
+	}
+}
+
+// mayContain reports whether the key might be in the set.
+// False positives are possible, false negatives are not.
+func (b bloom) mayContain(key string) bool {
+	if len(b) < 2 {
+		return true
+	}
+
+	bits := uint32(len(b)-1) * 8
+	h1, h2 := bloomHashes(key)
+	for i := uint32(0); i < uint32(b[0]); i++ {
+		pos := (h1 + i*h2) % bits
+		if b[1+pos/8]&(1<<(pos%8)) == 0 {
+			return false
+		}
+	}
+	return true
+}
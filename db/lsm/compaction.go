@@ -0,0 +1,384 @@
+package lsm
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+const numLevels = 7
+
+// tableMeta describes a live SSTable in the manifest.
+type tableMeta struct {
+	ID       uint64
+	Smallest string
+	Largest  string
+	Size     int64
+}
+
+// manifest lists the live SSTables of every level. Level 0 tables may
+// overlap and are ordered from the newest to the oldest, the tables of
+// the other levels are sorted by key and never overlap.
+type manifest struct {
+	NextID uint64
+	Levels [][]tableMeta
+}
+
+func (s *Store) tablePath(id uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%06d.sst", id))
+}
+
+// writeManifest durably replaces the manifest: the new one is synced
+// before it is renamed into place and the directory after, which also
+// persists the renames of the tables it lists. The caller must hold the
+// write lock.
+func (s *Store) writeManifest() error {
+	m := manifest{NextID: s.nextID.Load(), Levels: make([][]tableMeta, numLevels)}
+	for i, level := range s.levels {
+		for _, t := range level {
+			m.Levels[i] = append(m.Levels[i], t.meta)
+		}
+	}
+
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(s.dir, "MANIFEST")
+	f, err := os.OpenFile(path+".tmp", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return err
+	}
+	return syncDir(s.dir)
+}
+
+// syncDir makes the entries created or renamed in the directory durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if cerr := d.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (s *Store) readManifest() (manifest, error) {
+	m := manifest{NextID: 1}
+
+	data, err := os.ReadFile(filepath.Join(s.dir, "MANIFEST"))
+	if os.IsNotExist(err) {
+		return m, nil
+	} else if err != nil {
+		return m, err
+	}
+
+	if err := json.Unmarshal(data, &m); err != nil {
+		return m, fmt.Errorf("decoding manifest: %w", err)
+	}
+	return m, nil
+}
+
+// l0StopFactor times L0CompactionTrigger is the number of level 0 tables
+// at which flushes wait for the compaction to catch up.
+const l0StopFactor = 3
+
+// flush writes the memtable into a new level 0 table, empties the log
+// once the manifest listing the table is durable and wakes up the
+// compaction. The caller must hold the write lock.
+func (s *Store) flush() error {
+	if len(s.mem.m) == 0 {
+		return nil
+	}
+
+	// Without back pressure level 0 would grow without bound when writes
+	// outpace the compaction, and every read would check all its tables.
+	for len(s.levels[0]) >= l0StopFactor*s.opts.L0CompactionTrigger && s.compactErr == nil && !s.closed {
+		s.startCompaction()
+		s.compacted.Wait()
+	}
+	if err := s.compactErr; err != nil {
+		s.compactErr = nil
+		return fmt.Errorf("compaction failed: %w", err)
+	}
+
+	tables, err := s.writeTables(s.mem.iter("", ""), false, 0)
+	if err != nil {
+		return err
+	}
+
+	s.levels[0] = append(tables, s.levels[0]...)
+	if err := s.writeManifest(); err != nil {
+		return err
+	}
+
+	s.mem = newMemtable()
+	if err := s.wal.reset(); err != nil {
+		return err
+	}
+
+	s.startCompaction()
+	return nil
+}
+
+// startCompaction wakes up the compaction goroutine.
+func (s *Store) startCompaction() {
+	select {
+	case s.compactC <- struct{}{}:
+	default:
+	}
+}
+
+// compactor runs the compactions in the background until the store is
+// closed. Errors are reported by the next flush.
+func (s *Store) compactor() {
+	defer close(s.compactorDone)
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-s.compactC:
+		}
+
+		err := s.compact()
+
+		s.mu.Lock()
+		if err != nil {
+			s.compactErr = err
+		}
+		s.compacted.Broadcast()
+		s.mu.Unlock()
+	}
+}
+
+// writeTables writes the entries of the iterator into new tables of at
+// most maxSize bytes each (no limit if zero). Tombstones are dropped
+// when dropDeleted is set.
+func (s *Store) writeTables(it iterator, dropDeleted bool, maxSize int64) ([]*table, error) {
+	defer it.close()
+
+	var tables []*table
+	var w *tableWriter
+	var id uint64
+
+	finish := func() error {
+		meta, err := w.finish()
+		if err != nil {
+			return err
+		}
+		meta.ID = id
+
+		t, err := openTable(s.tablePath(id), meta)
+		if err != nil {
+			return err
+		}
+		tables = append(tables, t)
+		w = nil
+		return nil
+	}
+
+	for it.next() {
+		if dropDeleted && it.entry().deleted {
+			continue
+		}
+
+		if w == nil {
+			id = s.nextID.Add(1) - 1
+
+			var err error
+			if w, err = newTableWriter(s.tablePath(id)); err != nil {
+				return nil, err
+			}
+		}
+
+		if err := w.add(it.key(), it.entry()); err != nil {
+			w.abort(err)
+			return nil, err
+		}
+
+		if maxSize > 0 && w.size() >= maxSize {
+			if err := finish(); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if err := it.err(); err != nil {
+		if w != nil {
+			w.abort(err)
+		}
+		return nil, err
+	}
+
+	if w != nil {
+		if err := finish(); err != nil {
+			return nil, err
+		}
+	}
+	return tables, nil
+}
+
+func levelSize(tables []*table) int64 {
+	var size int64
+	for _, t := range tables {
+		size += t.meta.Size
+	}
+	return size
+}
+
+// maxLevelSize returns the size level i (i >= 1) may grow to before
+// it is compacted into the next level.
+func (s *Store) maxLevelSize(i int) int64 {
+	size := s.opts.BaseLevelSize
+	for ; i > 1; i-- {
+		size *= 10
+	}
+	return size
+}
+
+func overlaps(t *table, smallest, largest string) bool {
+	return t.meta.Smallest <= largest && smallest <= t.meta.Largest
+}
+
+// compact runs leveled compactions until every level is within its
+// limits. Only the compaction goroutine calls it; it holds the lock only
+// to pick the tables and to install the result, so that writes and reads
+// go on while the tables are merged.
+func (s *Store) compact() error {
+	for {
+		select {
+		case <-s.stop:
+			// The remaining work is picked up after the next open.
+			return nil
+		default:
+		}
+
+		i, inputs := s.pickCompaction()
+		if inputs == nil {
+			return nil
+		}
+		if err := s.compactLevel(i, inputs); err != nil {
+			return err
+		}
+	}
+}
+
+// pickCompaction returns the level to compact and its input tables, nil
+// if every level is within its limits.
+func (s *Store) pickCompaction() (int, []*table) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if len(s.levels[0]) >= s.opts.L0CompactionTrigger {
+		return 0, append([]*table{}, s.levels[0]...)
+	}
+
+	for i := 1; i < numLevels-1; i++ {
+		if levelSize(s.levels[i]) > s.maxLevelSize(i) {
+			// Tables are compacted in a round-robin fashion to
+			// spread the work over the whole key space.
+			t := s.levels[i][s.compactPtr[i]%len(s.levels[i])]
+			s.compactPtr[i]++
+			return i, []*table{t}
+		}
+	}
+	return 0, nil
+}
+
+// compactLevel merges the inputs from level i with the overlapping
+// tables of level i+1 and puts the result into level i+1. Flushes only
+// add tables to level 0 meanwhile, so the other levels stay as they were.
+func (s *Store) compactLevel(i int, inputs []*table) error {
+	smallest, largest := inputs[0].meta.Smallest, inputs[0].meta.Largest
+	for _, t := range inputs {
+		if t.meta.Smallest < smallest {
+			smallest = t.meta.Smallest
+		}
+		if t.meta.Largest > largest {
+			largest = t.meta.Largest
+		}
+	}
+
+	s.mu.RLock()
+	var next, keep []*table
+	for _, t := range s.levels[i+1] {
+		if overlaps(t, smallest, largest) {
+			next = append(next, t)
+		} else {
+			keep = append(keep, t)
+		}
+	}
+
+	// Tombstones can only be dropped if no older data lives below.
+	bottom := true
+	for j := i + 2; j < numLevels; j++ {
+		if len(s.levels[j]) > 0 {
+			bottom = false
+		}
+	}
+	s.mu.RUnlock()
+
+	// Inputs are newer than the tables of the next level.
+	var sources []iterator
+	for _, t := range inputs {
+		sources = append(sources, t.iter("", ""))
+	}
+	for _, t := range next {
+		sources = append(sources, t.iter("", ""))
+	}
+
+	out, err := s.writeTables(newMergeIter(sources), bottom, s.opts.TableSize)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	removed := make(map[*table]bool)
+	for _, t := range inputs {
+		removed[t] = true
+	}
+	var rest []*table
+	for _, t := range s.levels[i] {
+		if !removed[t] {
+			rest = append(rest, t)
+		}
+	}
+
+	level := append(keep, out...)
+	sortTables(level)
+	s.levels[i] = rest
+	s.levels[i+1] = level
+
+	if err := s.writeManifest(); err != nil {
+		return err
+	}
+
+	for _, tables := range [][]*table{inputs, next} {
+		for _, t := range tables {
+			t.close()
+			os.Remove(s.tablePath(t.meta.ID))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package lsm
+
+// iterator walks over sorted keys of a single source.
+type iterator interface {
+	// next advances to the next key and reports whether there is one.
+	next() bool
+	key() string
+	entry() entry
+	err() error
+	close()
+}
+
+// mergeIter merges sorted sources into one sorted stream. Sources are
+// ordered from the newest to the oldest: when several sources contain
+// the same key only the newest entry is returned.
+type mergeIter struct {
+	sources []iterator
+	valid   []bool
+	started bool
+
+	curKey   string
+	curEntry entry
+	lastErr  error
+}
+
+func newMergeIter(sources []iterator) *mergeIter {
+	return &mergeIter{
+		sources: sources,
+		valid:   make([]bool, len(sources)),
+	}
+}
+
+func (m *mergeIter) next() bool {
+	if !m.started {
+		m.started = true
+		for i, src := range m.sources {
+			m.advance(i, src)
+		}
+	}
+
+	best := -1
+	for i, src := range m.sources {
+		if m.valid[i] && (best < 0 || src.key() < m.sources[best].key()) {
+			best = i
+		}
+	}
+	if best < 0 || m.lastErr != nil {
+		return false
+	}
+
+	m.curKey = m.sources[best].key()
+	m.curEntry = m.sources[best].entry()
+
+	// Skip the same key in the older sources.
+	for i, src := range m.sources {
+		if m.valid[i] && src.key() == m.curKey {
+			m.advance(i, src)
+		}
+	}
+	return true
+}
+
+func (m *mergeIter) advance(i int, src iterator) {
+	m.valid[i] = src.next()
+	if !m.valid[i] {
+		if err := src.err(); err != nil && m.lastErr == nil {
+			m.lastErr = err
+		}
+	}
+}
+
+func (m *mergeIter) key() string  { return m.curKey }
+func (m *mergeIter) entry() entry { return m.curEntry }
+func (m *mergeIter) err() error   { return m.lastErr }
+
+func (m *mergeIter) close() {
+	for _, src := range m.sources {
+		src.close()
+	}
+}
@@ -0,0 +1,473 @@
+// Package lsm implements a log-structured merge-tree storage engine.
+//
+// Writes go to a write-ahead log and an in-memory memtable. Full
+// memtables are flushed into immutable sorted SSTable files with bloom
+// filters, which are then merged by leveled compaction in the background.
+// Compared to bolt, writes are much cheaper at the cost of reads that may
+// have to consult several tables.
+package lsm
+
+import (
+	"encoding/binary"
+	"fmt"
+	"go-kvdb/db"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// Options configures the storage engine. Zero fields get the defaults.
+type Options struct {
+	// MemtableSize is the size in bytes at which the memtable is flushed.
+	MemtableSize int
+	// TableSize is the target size of the SSTables produced by compaction.
+	TableSize int64
+	// L0CompactionTrigger is the number of level 0 tables that
+	// triggers a compaction into level 1.
+	L0CompactionTrigger int
+	// BaseLevelSize is the maximum size of level 1, every following
+	// level may be 10 times larger than the previous one.
+	BaseLevelSize int64
+	// SyncWrites makes every write wait for the log to reach the disk.
+	SyncWrites bool
+}
+
+func (o *Options) applyDefaults() {
+	if o.MemtableSize <= 0 {
+		o.MemtableSize = 4 << 20
+	}
+	if o.TableSize <= 0 {
+		o.TableSize = 2 << 20
+	}
+	if o.L0CompactionTrigger <= 0 {
+		o.L0CompactionTrigger = 4
+	}
+	if o.BaseLevelSize <= 0 {
+		o.BaseLevelSize = 10 << 20
+	}
+}
+
+// Store is an LSM-tree storage engine. It implements db.Store.
+type Store struct {
+	dir  string
+	opts Options
+
+	mu         sync.RWMutex
+	wal        *wal
+	mem        *memtable
+	levels     [][]*table
+	nextID     atomic.Uint64
+	compactPtr []int
+	closed     bool
+
+	// The compaction runs in its own goroutine, woken up through
+	// compactC. compacted is signalled, with mu held, after every run and
+	// compactErr keeps the error of the last failed one.
+	compactC      chan struct{}
+	compacted     *sync.Cond
+	compactErr    error
+	stop          chan struct{}
+	compactorDone chan struct{}
+}
+
+var _ db.Store = (*Store)(nil)
+
+// Open opens or creates the store in the directory.
+func Open(dir string, opts Options) (s *Store, closeFunc func() error, err error) {
+	opts.applyDefaults()
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, nil, err
+	}
+
+	s = &Store{
+		dir:           dir,
+		opts:          opts,
+		mem:           newMemtable(),
+		levels:        make([][]*table, numLevels),
+		compactPtr:    make([]int, numLevels),
+		compactC:      make(chan struct{}, 1),
+		stop:          make(chan struct{}),
+		compactorDone: make(chan struct{}),
+	}
+	s.compacted = sync.NewCond(&s.mu)
+
+	m, err := s.readManifest()
+	if err != nil {
+		return nil, nil, err
+	}
+	s.nextID.Store(m.NextID)
+
+	for i, level := range m.Levels {
+		for _, meta := range level {
+			t, err := openTable(s.tablePath(meta.ID), meta)
+			if err != nil {
+				s.closeTables()
+				return nil, nil, err
+			}
+			s.levels[i] = append(s.levels[i], t)
+		}
+	}
+
+	if s.wal, err = openWAL(filepath.Join(dir, "wal.log"), opts.SyncWrites); err != nil {
+		s.closeTables()
+		return nil, nil, err
+	}
+
+	go s.compactor()
+	s.startCompaction()
+
+	err = s.wal.replay(func(ops []op) {
+		for _, o := range ops {
+			s.mem.put(o.key, o.e)
+		}
+	})
+	if err != nil {
+		s.Close()
+		return nil, nil, fmt.Errorf("replaying the write-ahead log: %w", err)
+	}
+
+	if err := s.CreateBucketIfNotExists("default"); err != nil {
+		s.Close()
+		return nil, nil, fmt.Errorf("creating default bucket: %w", err)
+	}
+
+	return s, s.Close, nil
+}
+
+// Close flushes the memtable, waits for the running compaction and
+// closes all files.
+func (s *Store) Close() error {
+	s.mu.Lock()
+	err := s.flush()
+	s.closed = true
+	s.compacted.Broadcast()
+	s.mu.Unlock()
+
+	close(s.stop)
+	<-s.compactorDone
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if cerr := s.wal.close(); err == nil {
+		err = cerr
+	}
+	s.closeTables()
+	return err
+}
+
+func (s *Store) closeTables() {
+	for _, level := range s.levels {
+		for _, t := range level {
+			t.close()
+		}
+	}
+}
+
+func sortTables(tables []*table) {
+	sort.Slice(tables, func(i, j int) bool { return tables[i].meta.Smallest < tables[j].meta.Smallest })
+}
+
+// The internal key space is split into namespaces by the first byte.
+const (
+	nsBucket = 'b' // bucket markers: 'b' + bucket name
+	nsMeta   = 'm' // bucket metadata: 'm' + bucket name
+	nsData   = 'd' // data: 'd' + uvarint(len(bucket)) + bucket + key
+)
+
+func bucketKey(bucketName string) string {
+	return string(nsBucket) + bucketName
+}
+
+func metaKey(bucketName string) string {
+	return string(nsMeta) + bucketName
+}
+
+func dataPrefix(bucketName string) string {
+	buf := []byte{nsData}
+	buf = binary.AppendUvarint(buf, uint64(len(bucketName)))
+	return string(append(buf, bucketName...))
+}
+
+// prefixEnd returns the smallest key greater than all keys with the prefix.
+func prefixEnd(prefix string) string {
+	b := []byte(prefix)
+	for i := len(b) - 1; i >= 0; i-- {
+		if b[i] < 0xff {
+			b[i]++
+			return string(b[:i+1])
+		}
+	}
+	return ""
+}
+
+// get looks the key up from the newest to the oldest data.
+// The caller must hold the lock.
+func (s *Store) get(key string) ([]byte, error) {
+	if e, ok := s.mem.get(key); ok {
+		return liveValue(e), nil
+	}
+
+	for _, level := range s.levels {
+		for _, t := range level {
+			e, ok, err := t.get(key)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				return liveValue(e), nil
+			}
+		}
+	}
+	return nil, nil
+}
+
+func liveValue(e entry) []byte {
+	if e.deleted {
+		return nil
+	}
+	return append([]byte{}, e.value...)
+}
+
+// scan calls fn for every live key in [start, end) in sorted order.
+// The caller must hold the lock.
+func (s *Store) scan(start, end string, fn func(key string, value []byte)) error {
+	sources := []iterator{s.mem.iter(start, end)}
+	for _, level := range s.levels {
+		for _, t := range level {
+			if end != "" && t.meta.Smallest >= end || t.meta.Largest < start {
+				continue
+			}
+			sources = append(sources, t.iter(start, end))
+		}
+	}
+
+	it := newMergeIter(sources)
+	defer it.close()
+
+	for it.next() {
+		if !it.entry().deleted {
+			fn(it.key(), it.entry().value)
+		}
+	}
+	return it.err()
+}
+
+// apply writes the operations to the log and the memtable.
+// The caller must hold the write lock.
+func (s *Store) apply(ops []op) error {
+	if err := s.wal.append(ops); err != nil {
+		return err
+	}
+	for _, o := range ops {
+		s.mem.put(o.key, o.e)
+	}
+
+	if s.mem.size >= s.opts.MemtableSize {
+		return s.flush()
+	}
+	return nil
+}
+
+// checkBucket returns an error if the bucket does not exist.
+// The caller must hold the lock.
+func (s *Store) checkBucket(bucketName string) error {
+	v, err := s.get(bucketKey(bucketName))
+	if err != nil {
+		return err
+	}
+	if v == nil {
+		return fmt.Errorf("bucket %s not found", bucketName)
+	}
+	return nil
+}
+
+// CreateBucketIfNotExists creates a bucket if it doesn't exist.
+func (s *Store) CreateBucketIfNotExists(bucketName string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.checkBucket(bucketName) == nil {
+		return nil
+	}
+	return s.apply([]op{{key: bucketKey(bucketName), e: entry{value: []byte{}}}})
+}
+
+// DeleteBucket deletes the specified bucket, its contents and metadata.
+func (s *Store) DeleteBucket(bucketName string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.checkBucket(bucketName); err != nil {
+		return err
+	}
+
+	ops := []op{
+		{key: bucketKey(bucketName), e: entry{deleted: true}},
+		{key: metaKey(bucketName), e: entry{deleted: true}},
+	}
+
+	prefix := dataPrefix(bucketName)
+	err := s.scan(prefix, prefixEnd(prefix), func(key string, _ []byte) {
+		ops = append(ops, op{key: key, e: entry{deleted: true}})
+	})
+	if err != nil {
+		return err
+	}
+	return s.apply(ops)
+}
+
+// Buckets returns the names of all buckets.
+func (s *Store) Buckets() ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var names []string
+	prefix := string(nsBucket)
+	err := s.scan(prefix, prefixEnd(prefix), func(key string, _ []byte) {
+		names = append(names, key[len(prefix):])
+	})
+	if err != nil {
+		return nil, err
+	}
+	return names, nil
+}
+
+// SetBucketMeta stores the metadata of the specified bucket.
+func (s *Store) SetBucketMeta(bucketName string, meta []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.checkBucket(bucketName); err != nil {
+		return err
+	}
+	return s.apply([]op{{key: metaKey(bucketName), e: entry{value: meta}}})
+}
+
+// BucketMeta returns the metadata of the specified bucket
+// or nil if no metadata was stored for it.
+func (s *Store) BucketMeta(bucketName string) ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.get(metaKey(bucketName))
+}
+
+// SetKey sets the key to the requested value in the specified bucket.
+func (s *Store) SetKey(key string, bucketName string, value []byte) error {
+	return s.Batch(bucketName, []db.Op{{Key: key, Value: value}})
+}
+
+// GetKey gets the value of the requested key from the specified bucket.
+func (s *Store) GetKey(key string, bucketName string) ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if err := s.checkBucket(bucketName); err != nil {
+		return nil, err
+	}
+	return s.get(dataPrefix(bucketName) + key)
+}
+
+// DelKey deletes the key from the specified bucket.
+func (s *Store) DelKey(bucketName string, key string) error {
+	return s.Batch(bucketName, []db.Op{{Key: key, Delete: true}})
+}
+
+// Batch applies all operations to the specified bucket atomically.
+func (s *Store) Batch(bucketName string, ops []db.Op) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.checkBucket(bucketName); err != nil {
+		return err
+	}
+
+	prefix := dataPrefix(bucketName)
+	internal := make([]op, len(ops))
+	for i, o := range ops {
+		internal[i] = op{key: prefix + o.Key, e: entry{value: o.Value, deleted: o.Delete}}
+		if !o.Delete && o.Value == nil {
+			internal[i].e.value = []byte{}
+		}
+	}
+	return s.apply(internal)
+}
+
+// Modify atomically replaces the value of the key with the result of fn.
+func (s *Store) Modify(bucketName, key string, fn func(value []byte) ([]byte, error)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.checkBucket(bucketName); err != nil {
+		return err
+	}
+
+	ikey := dataPrefix(bucketName) + key
+	old, err := s.get(ikey)
+	if err != nil {
+		return err
+	}
+
+	value, err := fn(old)
+	if err != nil {
+		return err
+	}
+	return s.apply([]op{{key: ikey, e: entry{value: value, deleted: value == nil}}})
+}
+
+// ListKeys returns all keys in the specified bucket in sorted order.
+func (s *Store) ListKeys(bucketName string) ([]string, error) {
+	return s.ScanKeys(bucketName, "", "")
+}
+
+// ScanKeys returns the keys in [start, end) from the specified bucket in sorted order.
+// An empty end means that the range is unbounded.
+func (s *Store) ScanKeys(bucketName string, start, end string) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if err := s.checkBucket(bucketName); err != nil {
+		return nil, err
+	}
+
+	prefix := dataPrefix(bucketName)
+	iend := prefixEnd(prefix)
+	if end != "" {
+		iend = prefix + end
+	}
+
+	var keys []string
+	err := s.scan(prefix+start, iend, func(key string, _ []byte) {
+		keys = append(keys, key[len(prefix):])
+	})
+	if err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// DeleteExtraKeys deletes the keys that do not belong to this shard.
+func (s *Store) DeleteExtraKeys(isExtra func(string) bool, bucketName string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.checkBucket(bucketName); err != nil {
+		return err
+	}
+
+	prefix := dataPrefix(bucketName)
+	var ops []op
+	err := s.scan(prefix, prefixEnd(prefix), func(key string, _ []byte) {
+		if isExtra(key[len(prefix):]) {
+			ops = append(ops, op{key: key, e: entry{deleted: true}})
+		}
+	})
+	if err != nil || len(ops) == 0 {
+		return err
+	}
+	return s.apply(ops)
+}
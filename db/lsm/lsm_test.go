@@ -0,0 +1,217 @@
+package lsm_test
+
+import (
+	"fmt"
+	"go-kvdb/db"
+	"go-kvdb/db/lsm"
+	"go-kvdb/db/storetest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// smallOptions make the store flush and compact after a few writes.
+var smallOptions = lsm.Options{
+	MemtableSize:        256,
+	TableSize:           512,
+	L0CompactionTrigger: 2,
+	BaseLevelSize:       1024,
+}
+
+func openStore(t *testing.T, dir string, opts lsm.Options) (*lsm.Store, func() error) {
+	t.Helper()
+
+	s, closeFunc, err := lsm.Open(dir, opts)
+	if err != nil {
+		t.Fatalf("Could not open the store: %v", err)
+	}
+	return s, closeFunc
+}
+
+func TestConformance(t *testing.T) {
+	for name, opts := range map[string]lsm.Options{"default": {}, "small": smallOptions} {
+		opts := opts
+		t.Run(name, func(t *testing.T) {
+			storetest.Run(t, func(t *testing.T) db.Store {
+				s, closeFunc := openStore(t, t.TempDir(), opts)
+				t.Cleanup(func() { closeFunc() })
+				return s
+			})
+		})
+	}
+}
+
+func TestCompactionAndReopen(t *testing.T) {
+	dir := t.TempDir()
+	s, closeFunc := openStore(t, dir, smallOptions)
+
+	if err := s.CreateBucketIfNotExists("other"); err != nil {
+		t.Fatalf("Could not create bucket: %v", err)
+	}
+
+	const n = 500
+	for i := 0; i < n; i++ {
+		key := fmt.Sprintf("key-%04d", i)
+		if err := s.SetKey(key, "default", []byte("value-"+key)); err != nil {
+			t.Fatalf("SetKey(%q) failed: %v", key, err)
+		}
+		// Overwrite and delete some keys to leave older versions in lower levels.
+		if i%3 == 0 {
+			if err := s.SetKey(key, "default", []byte("new-"+key)); err != nil {
+				t.Fatalf("SetKey(%q) failed: %v", key, err)
+			}
+		}
+		if i%5 == 0 {
+			if err := s.DelKey("default", key); err != nil {
+				t.Fatalf("DelKey(%q) failed: %v", key, err)
+			}
+		}
+	}
+
+	tables, _ := filepath.Glob(filepath.Join(dir, "*.sst"))
+	if len(tables) == 0 {
+		t.Fatalf("Expected the memtable to be flushed into tables")
+	}
+
+	check := func(s *lsm.Store) {
+		t.Helper()
+
+		for i := 0; i < n; i++ {
+			key := fmt.Sprintf("key-%04d", i)
+			want := "value-" + key
+			switch {
+			case i%5 == 0:
+				want = ""
+			case i%3 == 0:
+				want = "new-" + key
+			}
+
+			got, err := s.GetKey(key, "default")
+			if err != nil {
+				t.Fatalf("GetKey(%q) failed: %v", key, err)
+			}
+			if string(got) != want {
+				t.Errorf("Unexpected value of %q: got %q, want %q", key, got, want)
+			}
+		}
+
+		keys, err := s.ListKeys("default")
+		if err != nil {
+			t.Fatalf("ListKeys failed: %v", err)
+		}
+		if want := n - n/5; len(keys) != want {
+			t.Errorf("Unexpected number of keys: got %d, want %d", len(keys), want)
+		}
+
+		if keys, err := s.ListKeys("other"); err != nil || len(keys) != 0 {
+			t.Errorf("Unexpected keys in the other bucket: %v, %v", keys, err)
+		}
+	}
+
+	check(s)
+
+	if err := closeFunc(); err != nil {
+		t.Fatalf("Could not close the store: %v", err)
+	}
+
+	s, closeFunc = openStore(t, dir, smallOptions)
+	defer closeFunc()
+	check(s)
+}
+
+func TestWALRecovery(t *testing.T) {
+	dir := t.TempDir()
+
+	// Large memtable so that everything stays in the log.
+	s, _ := openStore(t, dir, lsm.Options{})
+	if err := s.SetKey("a", "default", []byte("1")); err != nil {
+		t.Fatalf("SetKey failed: %v", err)
+	}
+	if err := s.Batch("default", []db.Op{{Key: "b", Value: []byte("2")}, {Key: "a", Delete: true}}); err != nil {
+		t.Fatalf("Batch failed: %v", err)
+	}
+
+	// Simulate a crash in the middle of writing the next record.
+	f, err := os.OpenFile(filepath.Join(dir, "wal.log"), os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatalf("Could not open the log: %v", err)
+	}
+	f.Write([]byte{1, 2, 3, 4, 5})
+	f.Close()
+
+	// The store is not closed, as if the process died.
+	s, closeFunc := openStore(t, dir, lsm.Options{})
+	defer closeFunc()
+
+	if v, err := s.GetKey("a", "default"); err != nil || v != nil {
+		t.Errorf("Unexpected value of a: got %q, %v, want nil", v, err)
+	}
+	if v, err := s.GetKey("b", "default"); err != nil || string(v) != "2" {
+		t.Errorf("Unexpected value of b: got %q, %v, want %q", v, err, "2")
+	}
+
+	// New writes after the recovery must be readable.
+	if err := s.SetKey("c", "default", []byte("3")); err != nil {
+		t.Fatalf("SetKey after recovery failed: %v", err)
+	}
+	if v, err := s.GetKey("c", "default"); err != nil || string(v) != "3" {
+		t.Errorf("Unexpected value of c: got %q, %v, want %q", v, err, "3")
+	}
+}
+
+func BenchmarkSetKey(b *testing.B) {
+	s, closeFunc, err := lsm.Open(b.TempDir(), lsm.Options{})
+	if err != nil {
+		b.Fatalf("Could not open the store: %v", err)
+	}
+	defer closeFunc()
+
+	value := make([]byte, 100)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := s.SetKey(fmt.Sprintf("key-%d", i), "default", value); err != nil {
+			b.Fatalf("SetKey failed: %v", err)
+		}
+	}
+}
+
+func TestConcurrentCompaction(t *testing.T) {
+	dir := t.TempDir()
+	s, closeFunc := openStore(t, dir, smallOptions)
+
+	const writers, n = 4, 200
+	errs := make(chan error, writers)
+	for w := 0; w < writers; w++ {
+		go func(w int) {
+			for i := 0; i < n; i++ {
+				key := fmt.Sprintf("key-%d-%04d", w, i)
+				if err := s.SetKey(key, "default", []byte(key)); err != nil {
+					errs <- err
+					return
+				}
+			}
+			errs <- nil
+		}(w)
+	}
+	for w := 0; w < writers; w++ {
+		if err := <-errs; err != nil {
+			t.Fatalf("SetKey failed: %v", err)
+		}
+	}
+
+	if err := closeFunc(); err != nil {
+		t.Fatalf("Could not close the store: %v", err)
+	}
+	s, closeFunc = openStore(t, dir, smallOptions)
+	defer closeFunc()
+
+	keys, err := s.ListKeys("default")
+	if err != nil || len(keys) != writers*n {
+		t.Fatalf("Unexpected number of keys after reopening: got %d, %v, want %d", len(keys), err, writers*n)
+	}
+	for _, key := range keys {
+		if v, err := s.GetKey(key, "default"); err != nil || string(v) != key {
+			t.Errorf("Unexpected value of %q: got %q, %v", key, v, err)
+		}
+	}
+}
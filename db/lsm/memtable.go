@@ -0,0 +1,68 @@
+package lsm
+
+import "sort"
+
+// entry is a value or a tombstone of a deleted key.
+type entry struct {
+	value   []byte
+	deleted bool
+}
+
+// memtable holds the most recent writes in memory until they are
+// flushed to an SSTable.
+type memtable struct {
+	m    map[string]entry
+	size int
+}
+
+func newMemtable() *memtable {
+	return &memtable{m: make(map[string]entry)}
+}
+
+func (m *memtable) put(key string, e entry) {
+	if old, ok := m.m[key]; ok {
+		m.size -= len(key) + len(old.value)
+	}
+	m.m[key] = e
+	m.size += len(key) + len(e.value)
+}
+
+func (m *memtable) get(key string) (entry, bool) {
+	e, ok := m.m[key]
+	return e, ok
+}
+
+// iter returns a snapshot iterator over the keys in [start, end).
+// An empty end means that the range is unbounded.
+func (m *memtable) iter(start, end string) iterator {
+	var keys []string
+	for k := range m.m {
+		if k >= start && (end == "" || k < end) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	entries := make([]entry, len(keys))
+	for i, k := range keys {
+		entries[i] = m.m[k]
+	}
+	return &sliceIter{keys: keys, entries: entries, pos: -1}
+}
+
+// sliceIter iterates over sorted in-memory entries.
+type sliceIter struct {
+	keys    []string
+	entries []entry
+	pos     int
+}
+
+func (it *sliceIter) next() bool {
+	it.pos++
+	return it.pos < len(it.keys)
+}
+
+func (it *sliceIter) key() string  { return it.keys[it.pos] }
+func (it *sliceIter) entry() entry { return it.entries[it.pos] }
+func (it *sliceIter) err() error   { return nil }
+func (it *sliceIter) close()       {}
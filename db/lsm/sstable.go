@@ -0,0 +1,375 @@
+package lsm
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+)
+
+// SSTable layout:
+//
+//	data:   repeated [uvarint key len][key][kind][uvarint value len][value]
+//	index:  repeated [uvarint key len][key][uvarint offset], one per block
+//	bloom:  the bloom filter of all keys
+//	footer: [index offset u64][bloom offset u64][magic u64]
+//
+// Entries are sorted by key and every block starts with an index entry.
+const (
+	tableMagic    = 0x6b76646273737401
+	footerSize    = 24
+	blockEntries  = 16
+	kindValue     = 0
+	kindTombstone = 1
+)
+
+var errCorruptTable = errors.New("corrupt sstable")
+
+// tableWriter writes a new SSTable from entries added in sorted order.
+type tableWriter struct {
+	f    *os.File
+	w    *bufio.Writer
+	path string
+
+	offset int64
+	count  int
+	keys   []string
+	index  []indexEntry
+
+	smallest, largest string
+}
+
+type indexEntry struct {
+	key    string
+	offset int64
+}
+
+func newTableWriter(path string) (*tableWriter, error) {
+	f, err := os.Create(path + ".tmp")
+	if err != nil {
+		return nil, err
+	}
+	return &tableWriter{f: f, w: bufio.NewWriter(f), path: path}, nil
+}
+
+func (t *tableWriter) write(b []byte) error {
+	n, err := t.w.Write(b)
+	t.offset += int64(n)
+	return err
+}
+
+func (t *tableWriter) writeUvarint(v uint64) error {
+	var buf [binary.MaxVarintLen64]byte
+	return t.write(buf[:binary.PutUvarint(buf[:], v)])
+}
+
+func (t *tableWriter) add(key string, e entry) error {
+	if t.count%blockEntries == 0 {
+		t.index = append(t.index, indexEntry{key: key, offset: t.offset})
+	}
+	if t.count == 0 {
+		t.smallest = key
+	}
+	t.largest = key
+	t.count++
+	t.keys = append(t.keys, key)
+
+	kind := byte(kindValue)
+	if e.deleted {
+		kind = kindTombstone
+	}
+
+	if err := t.writeUvarint(uint64(len(key))); err != nil {
+		return err
+	}
+	if err := t.write([]byte(key)); err != nil {
+		return err
+	}
+	if err := t.write([]byte{kind}); err != nil {
+		return err
+	}
+	if err := t.writeUvarint(uint64(len(e.value))); err != nil {
+		return err
+	}
+	return t.write(e.value)
+}
+
+// size returns the number of bytes written so far.
+func (t *tableWriter) size() int64 {
+	return t.offset
+}
+
+// finish writes the index, bloom filter and footer and atomically
+// moves the table into place.
+func (t *tableWriter) finish() (tableMeta, error) {
+	indexOff := t.offset
+	for _, ie := range t.index {
+		if err := t.writeUvarint(uint64(len(ie.key))); err != nil {
+			return tableMeta{}, t.abort(err)
+		}
+		if err := t.write([]byte(ie.key)); err != nil {
+			return tableMeta{}, t.abort(err)
+		}
+		if err := t.writeUvarint(uint64(ie.offset)); err != nil {
+			return tableMeta{}, t.abort(err)
+		}
+	}
+
+	bloomOff := t.offset
+	if err := t.write(newBloom(t.keys)); err != nil {
+		return tableMeta{}, t.abort(err)
+	}
+
+	var footer [footerSize]byte
+	binary.LittleEndian.PutUint64(footer[0:], uint64(indexOff))
+	binary.LittleEndian.PutUint64(footer[8:], uint64(bloomOff))
+	binary.LittleEndian.PutUint64(footer[16:], tableMagic)
+	if err := t.write(footer[:]); err != nil {
+		return tableMeta{}, t.abort(err)
+	}
+
+	if err := t.w.Flush(); err != nil {
+		return tableMeta{}, t.abort(err)
+	}
+	if err := t.f.Sync(); err != nil {
+		return tableMeta{}, t.abort(err)
+	}
+	if err := t.f.Close(); err != nil {
+		return tableMeta{}, t.abort(err)
+	}
+	if err := os.Rename(t.path+".tmp", t.path); err != nil {
+		return tableMeta{}, err
+	}
+
+	return tableMeta{Smallest: t.smallest, Largest: t.largest, Size: t.offset}, nil
+}
+
+func (t *tableWriter) abort(err error) error {
+	t.f.Close()
+	os.Remove(t.path + ".tmp")
+	return err
+}
+
+// table is an open SSTable. The index and the bloom filter are kept
+// in memory, the data is read from the file on demand.
+type table struct {
+	meta     tableMeta
+	f        *os.File
+	index    []indexEntry
+	bloom    bloom
+	indexOff int64
+}
+
+func openTable(path string, meta tableMeta) (*table, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	t, err := readTable(f, meta)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return t, nil
+}
+
+func readTable(f *os.File, meta tableMeta) (*table, error) {
+	st, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if st.Size() < footerSize {
+		return nil, errCorruptTable
+	}
+
+	var footer [footerSize]byte
+	if _, err := f.ReadAt(footer[:], st.Size()-footerSize); err != nil {
+		return nil, err
+	}
+	indexOff := int64(binary.LittleEndian.Uint64(footer[0:]))
+	bloomOff := int64(binary.LittleEndian.Uint64(footer[8:]))
+	if binary.LittleEndian.Uint64(footer[16:]) != tableMagic || indexOff > bloomOff || bloomOff > st.Size()-footerSize {
+		return nil, errCorruptTable
+	}
+
+	buf := make([]byte, st.Size()-footerSize-indexOff)
+	if _, err := f.ReadAt(buf, indexOff); err != nil {
+		return nil, err
+	}
+
+	t := &table{
+		meta:     meta,
+		f:        f,
+		bloom:    bloom(buf[bloomOff-indexOff:]),
+		indexOff: indexOff,
+	}
+
+	r := &byteReader{buf: buf[:bloomOff-indexOff]}
+	for r.len() > 0 {
+		key, err := r.bytes()
+		if err != nil {
+			return nil, err
+		}
+		off, err := r.uvarint()
+		if err != nil {
+			return nil, err
+		}
+		t.index = append(t.index, indexEntry{key: string(key), offset: int64(off)})
+	}
+	return t, nil
+}
+
+func (t *table) close() error {
+	return t.f.Close()
+}
+
+// block returns the index of the block that may contain the key.
+func (t *table) block(key string) int {
+	i := sort.Search(len(t.index), func(i int) bool { return t.index[i].key > key })
+	if i > 0 {
+		i--
+	}
+	return i
+}
+
+func (t *table) get(key string) (entry, bool, error) {
+	if len(t.index) == 0 || key < t.meta.Smallest || key > t.meta.Largest || !t.bloom.mayContain(key) {
+		return entry{}, false, nil
+	}
+
+	it := t.iterFrom(t.block(key))
+	defer it.close()
+
+	for it.next() {
+		if it.key() == key {
+			return it.entry(), true, nil
+		}
+		if it.key() > key {
+			break
+		}
+	}
+	return entry{}, false, it.err()
+}
+
+// iterFrom returns an iterator starting at the beginning of the block.
+func (t *table) iterFrom(block int) *tableIter {
+	off := t.indexOff
+	if block < len(t.index) {
+		off = t.index[block].offset
+	}
+	return &tableIter{r: bufio.NewReader(io.NewSectionReader(t.f, off, t.indexOff-off))}
+}
+
+// iter returns an iterator over the keys in [start, end).
+func (t *table) iter(start, end string) iterator {
+	it := t.iterFrom(t.block(start))
+	it.start, it.end = start, end
+	return it
+}
+
+// tableIter reads the entries of an SSTable sequentially.
+type tableIter struct {
+	r          *bufio.Reader
+	start, end string
+
+	k     string
+	e     entry
+	error error
+}
+
+func (it *tableIter) next() bool {
+	for {
+		klen, err := binary.ReadUvarint(it.r)
+		if err == io.EOF {
+			return false
+		}
+		if err != nil {
+			it.error = err
+			return false
+		}
+
+		key := make([]byte, klen)
+		if _, err := io.ReadFull(it.r, key); err != nil {
+			it.error = err
+			return false
+		}
+
+		kind, err := it.r.ReadByte()
+		if err != nil {
+			it.error = err
+			return false
+		}
+
+		vlen, err := binary.ReadUvarint(it.r)
+		if err != nil {
+			it.error = err
+			return false
+		}
+
+		value := make([]byte, vlen)
+		if _, err := io.ReadFull(it.r, value); err != nil {
+			it.error = err
+			return false
+		}
+
+		it.k = string(key)
+		it.e = entry{value: value, deleted: kind == kindTombstone}
+
+		if it.k < it.start {
+			continue
+		}
+		if it.end != "" && it.k >= it.end {
+			return false
+		}
+		return true
+	}
+}
+
+func (it *tableIter) key() string  { return it.k }
+func (it *tableIter) entry() entry { return it.e }
+func (it *tableIter) err() error   { return it.error }
+func (it *tableIter) close()       {}
+
+// byteReader decodes uvarint-prefixed fields from a buffer.
+type byteReader struct {
+	buf []byte
+}
+
+func (r *byteReader) len() int {
+	return len(r.buf)
+}
+
+func (r *byteReader) uvarint() (uint64, error) {
+	v, n := binary.Uvarint(r.buf)
+	if n <= 0 {
+		return 0, errCorruptTable
+	}
+	r.buf = r.buf[n:]
+	return v, nil
+}
+
+func (r *byteReader) bytes() ([]byte, error) {
+	n, err := r.uvarint()
+	if err != nil {
+		return nil, err
+	}
+	if uint64(len(r.buf)) < n {
+		return nil, errCorruptTable
+	}
+	b := r.buf[:n]
+	r.buf = r.buf[n:]
+	return b, nil
+}
+
+func (r *byteReader) byte() (byte, error) {
+	if len(r.buf) == 0 {
+		return 0, errCorruptTable
+	}
+	b := r.buf[0]
+	r.buf = r.buf[1:]
+	return b, nil
+}
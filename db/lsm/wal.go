@@ -0,0 +1,140 @@
+package lsm
+
+import (
+	"bufio"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+// op is a single write to the internal key space.
+type op struct {
+	key string
+	e   entry
+}
+
+// wal is the write-ahead log of the memtable. Every batch is written as
+// one record, [crc32 u32][payload len u32][payload], so that a batch is
+// either fully replayed or not at all.
+type wal struct {
+	f    *os.File
+	sync bool
+}
+
+func openWAL(path string, sync bool) (*wal, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &wal{f: f, sync: sync}, nil
+}
+
+func encodeOps(ops []op) []byte {
+	var buf []byte
+	buf = binary.AppendUvarint(buf, uint64(len(ops)))
+	for _, o := range ops {
+		kind := byte(kindValue)
+		if o.e.deleted {
+			kind = kindTombstone
+		}
+		buf = binary.AppendUvarint(buf, uint64(len(o.key)))
+		buf = append(buf, o.key...)
+		buf = append(buf, kind)
+		buf = binary.AppendUvarint(buf, uint64(len(o.e.value)))
+		buf = append(buf, o.e.value...)
+	}
+	return buf
+}
+
+func decodeOps(buf []byte) ([]op, error) {
+	r := &byteReader{buf: buf}
+	n, err := r.uvarint()
+	if err != nil {
+		return nil, err
+	}
+
+	ops := make([]op, 0, n)
+	for i := uint64(0); i < n; i++ {
+		key, err := r.bytes()
+		if err != nil {
+			return nil, err
+		}
+		kind, err := r.byte()
+		if err != nil {
+			return nil, err
+		}
+		value, err := r.bytes()
+		if err != nil {
+			return nil, err
+		}
+		ops = append(ops, op{
+			key: string(key),
+			e:   entry{value: append([]byte{}, value...), deleted: kind == kindTombstone},
+		})
+	}
+	return ops, nil
+}
+
+func (w *wal) append(ops []op) error {
+	payload := encodeOps(ops)
+
+	rec := make([]byte, 8, 8+len(payload))
+	binary.LittleEndian.PutUint32(rec[0:], crc32.ChecksumIEEE(payload))
+	binary.LittleEndian.PutUint32(rec[4:], uint32(len(payload)))
+	rec = append(rec, payload...)
+
+	if _, err := w.f.Write(rec); err != nil {
+		return err
+	}
+	if w.sync {
+		return w.f.Sync()
+	}
+	return nil
+}
+
+// replay calls apply for every complete record in the log. A torn or
+// corrupted tail, e.g. after a crash in the middle of a write, is cut off.
+func (w *wal) replay(apply func([]op)) error {
+	if _, err := w.f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	r := bufio.NewReader(w.f)
+	var valid int64
+	for {
+		var hdr [8]byte
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			break
+		}
+
+		payload := make([]byte, binary.LittleEndian.Uint32(hdr[4:]))
+		if _, err := io.ReadFull(r, payload); err != nil {
+			break
+		}
+		if crc32.ChecksumIEEE(payload) != binary.LittleEndian.Uint32(hdr[0:]) {
+			break
+		}
+
+		ops, err := decodeOps(payload)
+		if err != nil {
+			break
+		}
+		apply(ops)
+		valid += int64(len(hdr) + len(payload))
+	}
+
+	return w.f.Truncate(valid)
+}
+
+// reset empties the log once the memtable has been flushed.
+func (w *wal) reset() error {
+	if err := w.f.Truncate(0); err != nil {
+		return err
+	}
+	return w.f.Sync()
+}
+
+func (w *wal) close() error {
+	return w.f.Close()
+}
@@ -0,0 +1,205 @@
+package db
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// MemStore is an in-memory storage engine. It is useful for tests
+// and caches since nothing is persisted.
+type MemStore struct {
+	mu      sync.RWMutex
+	buckets map[string]map[string][]byte
+	meta    map[string][]byte
+}
+
+// NewMemStore returns an empty in-memory store with the default bucket.
+func NewMemStore() *MemStore {
+	return &MemStore{
+		buckets: map[string]map[string][]byte{"default": {}},
+		meta:    make(map[string][]byte),
+	}
+}
+
+func clone(v []byte) []byte {
+	if v == nil {
+		return nil
+	}
+	return append([]byte{}, v...)
+}
+
+// CreateBucketIfNotExists creates a bucket if it doesn't exist.
+func (m *MemStore) CreateBucketIfNotExists(bucketName string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.buckets[bucketName]; !ok {
+		m.buckets[bucketName] = make(map[string][]byte)
+	}
+	return nil
+}
+
+// DeleteBucket deletes the specified bucket, its contents and metadata.
+func (m *MemStore) DeleteBucket(bucketName string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.buckets[bucketName]; !ok {
+		return fmt.Errorf("bucket %s not found", bucketName)
+	}
+	delete(m.buckets, bucketName)
+	delete(m.meta, bucketName)
+	return nil
+}
+
+// Buckets returns the names of all buckets.
+func (m *MemStore) Buckets() ([]string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	names := make([]string, 0, len(m.buckets))
+	for name := range m.buckets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// SetBucketMeta stores the metadata of the specified bucket.
+func (m *MemStore) SetBucketMeta(bucketName string, meta []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.buckets[bucketName]; !ok {
+		return fmt.Errorf("bucket %s not found", bucketName)
+	}
+	m.meta[bucketName] = clone(meta)
+	return nil
+}
+
+// BucketMeta returns the metadata of the specified bucket
+// or nil if no metadata was stored for it.
+func (m *MemStore) BucketMeta(bucketName string) ([]byte, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return clone(m.meta[bucketName]), nil
+}
+
+// bucket returns the bucket contents, the caller must hold the lock.
+func (m *MemStore) bucket(bucketName string) (map[string][]byte, error) {
+	b, ok := m.buckets[bucketName]
+	if !ok {
+		return nil, fmt.Errorf("bucket %s not found", bucketName)
+	}
+	return b, nil
+}
+
+// SetKey sets the key to the requested value in the specified bucket.
+func (m *MemStore) SetKey(key string, bucketName string, value []byte) error {
+	return m.Batch(bucketName, []Op{{Key: key, Value: value}})
+}
+
+// GetKey gets the value of the requested key from the specified bucket.
+func (m *MemStore) GetKey(key string, bucketName string) ([]byte, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	b, err := m.bucket(bucketName)
+	if err != nil {
+		return nil, err
+	}
+	return clone(b[key]), nil
+}
+
+// DelKey deletes the key from the specified bucket.
+func (m *MemStore) DelKey(bucketName string, key string) error {
+	return m.Batch(bucketName, []Op{{Key: key, Delete: true}})
+}
+
+// Batch applies all operations to the specified bucket atomically.
+func (m *MemStore) Batch(bucketName string, ops []Op) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	b, err := m.bucket(bucketName)
+	if err != nil {
+		return err
+	}
+
+	for _, op := range ops {
+		if op.Delete {
+			delete(b, op.Key)
+		} else {
+			// Bolt stores nil values as empty ones, so do we.
+			b[op.Key] = append([]byte{}, op.Value...)
+		}
+	}
+	return nil
+}
+
+// Modify atomically replaces the value of the key with the result of fn.
+func (m *MemStore) Modify(bucketName, key string, fn func(value []byte) ([]byte, error)) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	b, err := m.bucket(bucketName)
+	if err != nil {
+		return err
+	}
+
+	value, err := fn(b[key])
+	if err != nil {
+		return err
+	}
+	if value == nil {
+		delete(b, key)
+	} else {
+		b[key] = append([]byte{}, value...)
+	}
+	return nil
+}
+
+// ListKeys returns all keys in the specified bucket in sorted order.
+func (m *MemStore) ListKeys(bucketName string) ([]string, error) {
+	return m.ScanKeys(bucketName, "", "")
+}
+
+// ScanKeys returns the keys in [start, end) from the specified bucket in sorted order.
+// An empty end means that the range is unbounded.
+func (m *MemStore) ScanKeys(bucketName string, start, end string) ([]string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	b, err := m.bucket(bucketName)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []string
+	for k := range b {
+		if k >= start && (end == "" || k < end) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// DeleteExtraKeys deletes the keys that do not belong to this shard.
+func (m *MemStore) DeleteExtraKeys(isExtra func(string) bool, bucketName string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	b, err := m.bucket(bucketName)
+	if err != nil {
+		return err
+	}
+
+	for k := range b {
+		if isExtra(k) {
+			delete(b, k)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,366 @@
+package db
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// versionBucket is the system bucket that holds the versions of the keys:
+// the ID of the last bolt transaction that wrote them. The versions of
+// deleted keys are kept, so that transactions notice the deletes, until
+// PruneVersions finds that no open snapshot is older than them.
+const versionBucket = SystemPrefix + "versions"
+
+// deletedVersionBucket indexes the versions of the deleted keys by the
+// version followed by the version key, oldest first.
+const deletedVersionBucket = SystemPrefix + "deletedversions"
+
+var (
+	// ErrTxnConflict is returned by Commit if a key written by the
+	// transaction was written by someone else after its snapshot.
+	ErrTxnConflict = errors.New("transaction conflict")
+	// ErrTxnDone is returned for transactions already committed or rolled back.
+	ErrTxnDone = errors.New("transaction is already finished")
+)
+
+// Snapshotter is implemented by the stores that support interactive
+// transactions with snapshot isolation.
+type Snapshotter interface {
+	// Begin starts a transaction that reads from a snapshot of the store.
+	Begin() (*Txn, error)
+}
+
+var _ Snapshotter = (*Database)(nil)
+
+func versionKey(bucketName, key string) []byte {
+	return []byte(bucketName + "\x00" + key)
+}
+
+// version returns the version of the key, zero if it was never written.
+func version(tx *bolt.Tx, bucketName, key string) uint64 {
+	b := tx.Bucket([]byte(versionBucket))
+	if b == nil {
+		return 0
+	}
+	if v := b.Get(versionKey(bucketName, key)); v != nil {
+		return binary.BigEndian.Uint64(v)
+	}
+	return 0
+}
+
+// setVersion stamps the key with the ID of the transaction and indexes
+// the version if the key no longer exists. It is not logged, since the
+// IDs only mean something in this database file.
+func setVersion(tx *bolt.Tx, bucketName, key string) error {
+	b := tx.Bucket([]byte(versionBucket))
+	if b == nil {
+		return nil
+	}
+	k := versionKey(bucketName, key)
+	v := binary.BigEndian.AppendUint64(nil, uint64(tx.ID()))
+	if err := b.Put(k, v); err != nil {
+		return err
+	}
+
+	deleted := tx.Bucket([]byte(deletedVersionBucket))
+	if deleted == nil {
+		return nil
+	}
+	if kb := tx.Bucket([]byte(bucketName)); kb != nil && (kb.Get([]byte(key)) != nil || kb.Bucket([]byte(key)) != nil) {
+		return nil
+	}
+	return deleted.Put(append(v, k...), nil)
+}
+
+// pruneChunk is the number of deleted versions removed per transaction
+// by PruneVersions.
+const pruneChunk = 10000
+
+// PruneVersions removes the versions of the deleted keys that are not
+// newer than any open snapshot, since no transaction can conflict with
+// them any more, and returns how many were removed. The versions are
+// removed in chunks, each in its own transaction.
+func (d *Database) PruneVersions() (int, error) {
+	total := 0
+	for {
+		n, more, err := d.pruneVersions()
+		total += n
+		if err != nil || !more {
+			return total, err
+		}
+	}
+}
+
+// pruneVersions removes a chunk of the deleted versions and reports
+// whether there may be more.
+func (d *Database) pruneVersions() (n int, more bool, err error) {
+	err = d.db.Update(func(tx *bolt.Tx) error {
+		limit, ok := d.snapshots.oldest()
+		if !ok {
+			// A snapshot is being taken, its version is not known yet.
+			return nil
+		}
+
+		versions, deleted := tx.Bucket([]byte(versionBucket)), tx.Bucket([]byte(deletedVersionBucket))
+		if versions == nil || deleted == nil {
+			return nil
+		}
+
+		var keys [][]byte
+		c := deleted.Cursor()
+		for k, _ := c.First(); k != nil && len(keys) < pruneChunk && binary.BigEndian.Uint64(k) <= limit; k, _ = c.Next() {
+			keys = append(keys, clone(k))
+		}
+		more = len(keys) == pruneChunk
+
+		for _, k := range keys {
+			if err := deleted.Delete(k); err != nil {
+				return err
+			}
+			// The key may have been written again since.
+			if v := versions.Get(k[8:]); bytes.Equal(v, k[:8]) {
+				if err := versions.Delete(k[8:]); err != nil {
+					return err
+				}
+				n++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, false, err
+	}
+	return n, more, nil
+}
+
+// snapshots tracks the versions of the open snapshots.
+type snapshots struct {
+	mu sync.Mutex
+	// opening is the number of snapshots being taken.
+	opening int
+	open    map[uint64]int
+}
+
+// begin must be called before a snapshot is taken and taken after it.
+func (s *snapshots) begin() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.opening++
+}
+
+func (s *snapshots) taken(version uint64, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.opening--
+	if !ok {
+		return
+	}
+	if s.open == nil {
+		s.open = make(map[uint64]int)
+	}
+	s.open[version]++
+}
+
+func (s *snapshots) release(version uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.open[version]--; s.open[version] <= 0 {
+		delete(s.open, version)
+	}
+}
+
+// oldest returns the version of the oldest open snapshot, the largest
+// version if there is none, or false while a snapshot is being taken.
+func (s *snapshots) oldest() (uint64, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.opening > 0 {
+		return 0, false
+	}
+	oldest := uint64(math.MaxUint64)
+	for v := range s.open {
+		oldest = min(oldest, v)
+	}
+	return oldest, true
+}
+
+// clearBucketVersions removes the versions of all keys of the bucket.
+func clearBucketVersions(tx *bolt.Tx, bucketName string) error {
+	b := tx.Bucket([]byte(versionBucket))
+	if b == nil {
+		return nil
+	}
+
+	prefix := versionKey(bucketName, "")
+	var keys [][]byte
+	c := b.Cursor()
+	for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+		keys = append(keys, clone(k))
+	}
+
+	for _, k := range keys {
+		if err := b.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type txnKey struct {
+	bucket, key string
+}
+
+// Txn is an interactive transaction. It reads from the snapshot taken
+// when it began, along with its own writes, which are buffered until the
+// commit. Commit fails with ErrTxnConflict if another writer changed one
+// of the written keys in the meantime, so of two concurrent transactions
+// writing the same key only the first to commit succeeds. Keys that were
+// only read are not checked.
+//
+// The snapshot is an open bolt read transaction: until the transaction
+// ends, the pages freed by other writes cannot be reused and writes that
+// grow the file beyond Options.MmapSize wait, so transactions should be
+// short. A Txn must not be used concurrently.
+type Txn struct {
+	d      *Database
+	tx     *bolt.Tx
+	writes map[txnKey]Op
+	// order holds the written keys in the order of their first write.
+	order []txnKey
+}
+
+// Begin starts a transaction that reads from a snapshot of the database.
+func (d *Database) Begin() (*Txn, error) {
+	d.snapshots.begin()
+	tx, err := d.db.Begin(false)
+	if err != nil {
+		d.snapshots.taken(0, false)
+		return nil, err
+	}
+	d.snapshots.taken(uint64(tx.ID()), true)
+	return &Txn{d: d, tx: tx, writes: make(map[txnKey]Op)}, nil
+}
+
+// Version returns the version of the snapshot.
+func (t *Txn) Version() uint64 {
+	if t.tx == nil {
+		return 0
+	}
+	return uint64(t.tx.ID())
+}
+
+// Get returns the value of the key in the snapshot, or as written by the
+// transaction, nil if it does not exist. It fails with ErrWrongType for
+// typed values.
+func (t *Txn) Get(bucketName, key string) ([]byte, error) {
+	if t.tx == nil {
+		return nil, ErrTxnDone
+	}
+	if op, ok := t.writes[txnKey{bucketName, key}]; ok {
+		if op.Delete {
+			return nil, nil
+		}
+		return clone(op.Value), nil
+	}
+
+	b := t.tx.Bucket([]byte(bucketName))
+	if b == nil {
+		return nil, fmt.Errorf("bucket %s not found", bucketName)
+	}
+	if b.Bucket([]byte(key)) != nil {
+		return nil, ErrWrongType
+	}
+	if expired(t.tx, bucketName, key, time.Now()) {
+		return nil, nil
+	}
+	// The value is only valid during the bolt transaction.
+	return clone(b.Get([]byte(key))), nil
+}
+
+// Set buffers the write of the key until the commit.
+func (t *Txn) Set(bucketName, key string, value []byte) error {
+	return t.write(bucketName, Op{Key: key, Value: clone(value)})
+}
+
+// Delete buffers the delete of the key until the commit.
+func (t *Txn) Delete(bucketName, key string) error {
+	return t.write(bucketName, Op{Key: key, Delete: true})
+}
+
+func (t *Txn) write(bucketName string, op Op) error {
+	if t.tx == nil {
+		return ErrTxnDone
+	}
+	k := txnKey{bucketName, op.Key}
+	if _, ok := t.writes[k]; !ok {
+		t.order = append(t.order, k)
+	}
+	t.writes[k] = op
+	return nil
+}
+
+// Commit atomically applies the writes of the transaction unless one of
+// the keys was written after the snapshot. The transaction is finished
+// either way.
+func (t *Txn) Commit() error {
+	if t.tx == nil {
+		return ErrTxnDone
+	}
+	snapshot := t.Version()
+	// The bolt read transaction must end before writing: a write that
+	// grows the memory map waits for all read transactions to end. The
+	// snapshot stays open until the commit is done, so that PruneVersions
+	// keeps the versions of the keys deleted since.
+	err := t.tx.Rollback()
+	t.tx = nil
+	defer t.d.snapshots.release(snapshot)
+	if err != nil {
+		return err
+	}
+	if len(t.order) == 0 {
+		return nil
+	}
+
+	return t.d.update(func(tx *bolt.Tx) error {
+		for _, k := range t.order {
+			b := tx.Bucket([]byte(k.bucket))
+			if b == nil {
+				return fmt.Errorf("bucket %s not found", k.bucket)
+			}
+			if version(tx, k.bucket, k.key) > snapshot {
+				return fmt.Errorf("%w: key %q was written after the snapshot", ErrTxnConflict, k.key)
+			}
+			if err := checkLock(tx, k.bucket, k.key, ""); err != nil {
+				return fmt.Errorf("key %q: %w", k.key, err)
+			}
+
+			if err := t.d.applyOp(tx, b, k.bucket, t.writes[k]); err != nil {
+				return fmt.Errorf("key %q: %w", k.key, err)
+			}
+			if err := t.d.clearKeyMeta(tx, k.bucket, k.key); err != nil {
+				return fmt.Errorf("key %q: %w", k.key, err)
+			}
+		}
+		return nil
+	})
+}
+
+// Rollback discards the transaction. Rolling back a finished transaction
+// does nothing.
+func (t *Txn) Rollback() error {
+	if t.tx == nil {
+		return nil
+	}
+	version := t.Version()
+	err := t.tx.Rollback()
+	t.d.snapshots.release(version)
+	t.tx = nil
+	return err
+}
@@ -0,0 +1,179 @@
+package db_test
+
+import (
+	"errors"
+	"go-kvdb/db"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func txnGet(t *testing.T, txn *db.Txn, key string) string {
+	t.Helper()
+	value, err := txn.Get("default", key)
+	if err != nil {
+		t.Fatalf("Could not get key %q: %v", key, err)
+	}
+	return string(value)
+}
+
+func TestTxnSnapshot(t *testing.T) {
+	d, closeFunc, err := db.OpenDatabase(filepath.Join(t.TempDir(), "shard.db"), db.Options{GroupCommit: true})
+	if err != nil {
+		t.Fatalf("Could not create a new database: %v", err)
+	}
+	defer closeFunc()
+
+	setKey(t, d, "a", "1", "default")
+	setKey(t, d, "b", "1", "default")
+
+	first, err := d.Begin()
+	if err != nil {
+		t.Fatalf("Could not begin: %v", err)
+	}
+	defer first.Rollback()
+
+	// Writes after the snapshot are not seen, the writes of the
+	// transaction itself are.
+	setKey(t, d, "a", "2", "default")
+	if got := txnGet(t, first, "a"); got != "1" {
+		t.Errorf("Unexpected value of a in the snapshot: got %q, want %q", got, "1")
+	}
+	if err := first.Set("default", "b", []byte("3")); err != nil {
+		t.Fatalf("Could not set key: %v", err)
+	}
+	if err := first.Delete("default", "c"); err != nil {
+		t.Fatalf("Could not delete key: %v", err)
+	}
+	if got := txnGet(t, first, "b"); got != "3" {
+		t.Errorf("Unexpected value of b in the transaction: got %q, want %q", got, "3")
+	}
+	if got := getKey(t, d, "b", "default"); got != "1" {
+		t.Errorf("Unexpected value of b before the commit: got %q, want %q", got, "1")
+	}
+
+	// Of two transactions writing the same key, the first commit wins.
+	second, err := d.Begin()
+	if err != nil {
+		t.Fatalf("Could not begin: %v", err)
+	}
+	if err := second.Set("default", "b", []byte("4")); err != nil {
+		t.Fatalf("Could not set key: %v", err)
+	}
+	if err := second.Commit(); err != nil {
+		t.Fatalf("Could not commit: %v", err)
+	}
+	if err := first.Commit(); !errors.Is(err, db.ErrTxnConflict) {
+		t.Errorf("Unexpected error for a conflicting commit: got %v, want ErrTxnConflict", err)
+	}
+	if got := getKey(t, d, "b", "default"); got != "4" {
+		t.Errorf("Unexpected value of b after the conflict: got %q, want %q", got, "4")
+	}
+	if err := first.Set("default", "b", []byte("5")); !errors.Is(err, db.ErrTxnDone) {
+		t.Errorf("Unexpected error for a finished transaction: got %v, want ErrTxnDone", err)
+	}
+
+	// Keys that were only read do not conflict, deleted keys do.
+	third, err := d.Begin()
+	if err != nil {
+		t.Fatalf("Could not begin: %v", err)
+	}
+	txnGet(t, third, "a")
+	if err := third.Set("default", "b", []byte("6")); err != nil {
+		t.Fatalf("Could not set key: %v", err)
+	}
+	setKey(t, d, "a", "7", "default")
+	if err := third.Commit(); err != nil {
+		t.Errorf("Could not commit after a write of a read key: %v", err)
+	}
+
+	fourth, err := d.Begin()
+	if err != nil {
+		t.Fatalf("Could not begin: %v", err)
+	}
+	if err := fourth.Set("default", "a", []byte("8")); err != nil {
+		t.Fatalf("Could not set key: %v", err)
+	}
+	if err := d.DelKey("default", "a"); err != nil {
+		t.Fatalf("Could not delete key: %v", err)
+	}
+	if err := fourth.Commit(); !errors.Is(err, db.ErrTxnConflict) {
+		t.Errorf("Unexpected error for a key deleted after the snapshot: got %v, want ErrTxnConflict", err)
+	}
+}
+
+func TestPruneVersions(t *testing.T) {
+	d, closeFunc, err := db.NewDatabase(filepath.Join(t.TempDir(), "shard.db"))
+	if err != nil {
+		t.Fatalf("Could not create a new database: %v", err)
+	}
+	defer closeFunc()
+
+	setKey(t, d, "a", "1", "default")
+	setKey(t, d, "b", "1", "default")
+	setKey(t, d, "gone", "1", "default")
+	if err := d.DelKey("default", "gone"); err != nil {
+		t.Fatalf("Could not delete key: %v", err)
+	}
+
+	txn, err := d.Begin()
+	if err != nil {
+		t.Fatalf("Could not begin: %v", err)
+	}
+	if err := txn.Set("default", "a", []byte("2")); err != nil {
+		t.Fatalf("Could not set key: %v", err)
+	}
+	if err := d.DelKey("default", "a"); err != nil {
+		t.Fatalf("Could not delete key: %v", err)
+	}
+
+	// The delete of a is newer than the snapshot, the one of gone is not.
+	if n, err := d.PruneVersions(); err != nil || n != 1 {
+		t.Errorf("Unexpected result of pruning with an open snapshot: got %d, %v, want 1", n, err)
+	}
+	if err := txn.Commit(); !errors.Is(err, db.ErrTxnConflict) {
+		t.Errorf("Unexpected error for a key deleted after the snapshot: got %v, want ErrTxnConflict", err)
+	}
+
+	if n, err := d.PruneVersions(); err != nil || n != 1 {
+		t.Errorf("Unexpected result of pruning without snapshots: got %d, %v, want 1", n, err)
+	}
+	item, err := d.GetItem("default", "b")
+	if err != nil || item == nil || item.Version == 0 {
+		t.Errorf("The version of an existing key was pruned: got %+v, %v", item, err)
+	}
+}
+
+func TestPruneVersionsDuringCommit(t *testing.T) {
+	// The commit waits for others to join its group commit, which is
+	// when the versions are pruned.
+	d, closeFunc, err := db.OpenDatabase(filepath.Join(t.TempDir(), "shard.db"), db.Options{GroupCommit: true, MaxBatchDelay: 200 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("Could not create a new database: %v", err)
+	}
+	defer closeFunc()
+
+	setKey(t, d, "a", "1", "default")
+
+	txn, err := d.Begin()
+	if err != nil {
+		t.Fatalf("Could not begin: %v", err)
+	}
+	if err := txn.Set("default", "a", []byte("2")); err != nil {
+		t.Fatalf("Could not set key: %v", err)
+	}
+	if err := d.DelKey("default", "a"); err != nil {
+		t.Fatalf("Could not delete key: %v", err)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- txn.Commit() }()
+
+	time.Sleep(50 * time.Millisecond)
+	if n, err := d.PruneVersions(); err != nil || n != 0 {
+		t.Errorf("Unexpected result of pruning during the commit: got %d, %v, want 0", n, err)
+	}
+	if err := <-done; !errors.Is(err, db.ErrTxnConflict) {
+		t.Errorf("Unexpected error for a key deleted after the snapshot: got %v, want ErrTxnConflict", err)
+	}
+}
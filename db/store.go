@@ -0,0 +1,115 @@
+package db
+
+import "time"
+
+// Store is a storage engine that keeps keys in named buckets.
+//
+// GetKey returns a nil value without an error for missing keys, while
+// operations on missing buckets fail. Buckets, ListKeys and ScanKeys
+// return the names in sorted order.
+type Store interface {
+	CreateBucketIfNotExists(bucketName string) error
+	DeleteBucket(bucketName string) error
+	// Buckets returns the names of all buckets apart from the system ones.
+	Buckets() ([]string, error)
+	SetBucketMeta(bucketName string, meta []byte) error
+	BucketMeta(bucketName string) ([]byte, error)
+
+	SetKey(key string, bucketName string, value []byte) error
+	GetKey(key string, bucketName string) ([]byte, error)
+	DelKey(bucketName string, key string) error
+
+	// Batch applies all operations to the bucket atomically.
+	Batch(bucketName string, ops []Op) error
+	// Modify atomically replaces the value of the key with the one
+	// returned by fn, which gets the current value or nil if the key does
+	// not exist. A nil result deletes the key. If fn fails, nothing is
+	// written and Modify returns its error. fn may be called more than
+	// once and must not keep the value.
+	Modify(bucketName, key string, fn func(value []byte) ([]byte, error)) error
+
+	ListKeys(bucketName string) ([]string, error)
+	ScanKeys(bucketName string, start, end string) ([]string, error)
+	DeleteExtraKeys(isExtra func(string) bool, bucketName string) error
+}
+
+// Op is a single write in a batch: either a set or a delete of the key.
+type Op struct {
+	Key    string
+	Value  []byte
+	Delete bool
+}
+
+var (
+	_ Store       = (*Database)(nil)
+	_ Store       = (*MemStore)(nil)
+	_ Walker      = (*Database)(nil)
+	_ EntryWalker = (*Database)(nil)
+)
+
+// Walker is implemented by the stores that can stream the contents of a
+// bucket without holding all keys in memory.
+type Walker interface {
+	// Walk calls fn for every key of the bucket in sorted order until fn
+	// returns an error. The value is only valid during the call.
+	Walk(bucketName string, fn func(key string, value []byte) error) error
+}
+
+// Walk calls fn for every key of the bucket in sorted order. Stores that
+// do not implement Walker list all keys of the bucket first.
+func Walk(s Store, bucketName string, fn func(key string, value []byte) error) error {
+	if w, ok := s.(Walker); ok {
+		return w.Walk(bucketName, fn)
+	}
+
+	keys, err := s.ListKeys(bucketName)
+	if err != nil {
+		return err
+	}
+
+	for _, k := range keys {
+		v, err := s.GetKey(k, bucketName)
+		if err != nil {
+			return err
+		}
+		// The key may have been deleted in the meantime.
+		if v == nil {
+			continue
+		}
+		if err := fn(k, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Entry is a key of a bucket with what it takes to recreate it in another
+// store: either its plain value or the commands that rebuild its typed value.
+type Entry struct {
+	Key      string
+	Value    []byte
+	Commands []Cmd
+	// Expires and Flags are the expiry time and the flags of a plain
+	// value, see Item. Typed values have neither.
+	Expires time.Time
+	Flags   uint32
+}
+
+// EntryWalker is implemented by the stores that hold typed values.
+type EntryWalker interface {
+	// WalkEntries calls fn for every plain and typed key of the bucket
+	// in sorted order until fn returns an error.
+	WalkEntries(bucketName string, fn func(e Entry) error) error
+}
+
+// WalkEntries calls fn for every key of the bucket in sorted order.
+// Stores that do not implement EntryWalker only hold plain values and
+// are walked with Walk.
+func WalkEntries(s Store, bucketName string, fn func(e Entry) error) error {
+	if w, ok := s.(EntryWalker); ok {
+		return w.WalkEntries(bucketName, fn)
+	}
+	return Walk(s, bucketName, func(key string, value []byte) error {
+		return fn(Entry{Key: key, Value: value})
+	})
+}
@@ -0,0 +1,36 @@
+package db_test
+
+import (
+	"go-kvdb/db"
+	"go-kvdb/db/storetest"
+	"path/filepath"
+	"testing"
+)
+
+func TestBoltStore(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) db.Store {
+		d, closeFunc, err := db.NewDatabase(filepath.Join(t.TempDir(), "bolt.db"))
+		if err != nil {
+			t.Fatalf("Could not create a new database: %v", err)
+		}
+		t.Cleanup(func() { closeFunc() })
+		return d
+	})
+}
+
+func TestBoltStoreGroupCommit(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) db.Store {
+		d, closeFunc, err := db.OpenDatabase(filepath.Join(t.TempDir(), "bolt.db"), db.Options{GroupCommit: true})
+		if err != nil {
+			t.Fatalf("Could not create a new database: %v", err)
+		}
+		t.Cleanup(func() { closeFunc() })
+		return d
+	})
+}
+
+func TestMemStore(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) db.Store {
+		return db.NewMemStore()
+	})
+}
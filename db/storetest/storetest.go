@@ -0,0 +1,345 @@
+// Package storetest contains the conformance tests that every
+// db.Store implementation must pass.
+package storetest
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"go-kvdb/db"
+	"slices"
+	"testing"
+)
+
+// Run runs the conformance tests against stores created by newStore.
+// Every new store must be empty apart from the "default" bucket.
+func Run(t *testing.T, newStore func(t *testing.T) db.Store) {
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, s db.Store)
+	}{
+		{"GetSet", testGetSet},
+		{"MissingBucket", testMissingBucket},
+		{"DelKey", testDelKey},
+		{"Buckets", testBuckets},
+		{"BucketMeta", testBucketMeta},
+		{"Batch", testBatch},
+		{"ListAndScan", testListAndScan},
+		{"DeleteExtraKeys", testDeleteExtraKeys},
+		{"ListBuckets", testListBuckets},
+		{"Walk", testWalk},
+		{"Modify", testModify},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.fn(t, newStore(t))
+		})
+	}
+}
+
+func set(t *testing.T, s db.Store, bucketName, key, value string) {
+	t.Helper()
+
+	if err := s.SetKey(key, bucketName, []byte(value)); err != nil {
+		t.Fatalf("SetKey(%q, %q) failed: %v", key, bucketName, err)
+	}
+}
+
+func get(t *testing.T, s db.Store, bucketName, key string) []byte {
+	t.Helper()
+
+	value, err := s.GetKey(key, bucketName)
+	if err != nil {
+		t.Fatalf("GetKey(%q, %q) failed: %v", key, bucketName, err)
+	}
+	return value
+}
+
+func testGetSet(t *testing.T, s db.Store) {
+	if v := get(t, s, "default", "missing"); v != nil {
+		t.Errorf("Unexpected value of a missing key: got %q, want nil", v)
+	}
+
+	set(t, s, "default", "party", "Great")
+	v := get(t, s, "default", "party")
+	if !bytes.Equal(v, []byte("Great")) {
+		t.Errorf("Unexpected value: got %q, want %q", v, "Great")
+	}
+
+	// The returned value must not change with later writes.
+	set(t, s, "default", "party", "Over")
+	if !bytes.Equal(v, []byte("Great")) {
+		t.Errorf("Previously returned value changed to %q", v)
+	}
+	if v := get(t, s, "default", "party"); !bytes.Equal(v, []byte("Over")) {
+		t.Errorf("Unexpected overwritten value: got %q, want %q", v, "Over")
+	}
+
+	set(t, s, "default", "empty", "")
+	if v := get(t, s, "default", "empty"); v == nil || len(v) != 0 {
+		t.Errorf("Unexpected empty value: got %#v, want an empty non-nil slice", v)
+	}
+}
+
+func testMissingBucket(t *testing.T, s db.Store) {
+	if err := s.SetKey("key", "missing", []byte("value")); err == nil {
+		t.Errorf("Expected error when setting a key in a missing bucket")
+	}
+	if _, err := s.GetKey("key", "missing"); err == nil {
+		t.Errorf("Expected error when getting a key from a missing bucket")
+	}
+	if err := s.DelKey("missing", "key"); err == nil {
+		t.Errorf("Expected error when deleting a key from a missing bucket")
+	}
+	if _, err := s.ListKeys("missing"); err == nil {
+		t.Errorf("Expected error when listing a missing bucket")
+	}
+	if _, err := s.ScanKeys("missing", "", ""); err == nil {
+		t.Errorf("Expected error when scanning a missing bucket")
+	}
+	if err := s.DeleteExtraKeys(func(string) bool { return true }, "missing"); err == nil {
+		t.Errorf("Expected error when purging a missing bucket")
+	}
+	if err := s.Batch("missing", []db.Op{{Key: "key"}}); err == nil {
+		t.Errorf("Expected error when applying a batch to a missing bucket")
+	}
+	if err := s.DeleteBucket("missing"); err == nil {
+		t.Errorf("Expected error when deleting a missing bucket")
+	}
+}
+
+func testDelKey(t *testing.T, s db.Store) {
+	set(t, s, "default", "key", "value")
+
+	if err := s.DelKey("default", "key"); err != nil {
+		t.Fatalf("DelKey failed: %v", err)
+	}
+	if v := get(t, s, "default", "key"); v != nil {
+		t.Errorf("Unexpected value of a deleted key: got %q, want nil", v)
+	}
+
+	// Deleting a missing key is not an error.
+	if err := s.DelKey("default", "key"); err != nil {
+		t.Errorf("DelKey of a missing key failed: %v", err)
+	}
+}
+
+func testBuckets(t *testing.T, s db.Store) {
+	for i := 0; i < 2; i++ {
+		if err := s.CreateBucketIfNotExists("test_bucket"); err != nil {
+			t.Fatalf("CreateBucketIfNotExists failed: %v", err)
+		}
+	}
+
+	set(t, s, "test_bucket", "key", "bucket value")
+	set(t, s, "default", "key", "default value")
+
+	if v := get(t, s, "test_bucket", "key"); string(v) != "bucket value" {
+		t.Errorf("Buckets are not isolated: got %q, want %q", v, "bucket value")
+	}
+
+	if err := s.DeleteBucket("test_bucket"); err != nil {
+		t.Fatalf("DeleteBucket failed: %v", err)
+	}
+	if _, err := s.GetKey("key", "test_bucket"); err == nil {
+		t.Errorf("Expected error when getting a key from a deleted bucket")
+	}
+
+	if err := s.CreateBucketIfNotExists("test_bucket"); err != nil {
+		t.Fatalf("CreateBucketIfNotExists failed: %v", err)
+	}
+	if v := get(t, s, "test_bucket", "key"); v != nil {
+		t.Errorf("Re-created bucket is not empty: got %q", v)
+	}
+}
+
+func testBucketMeta(t *testing.T, s db.Store) {
+	if err := s.SetBucketMeta("missing", []byte("meta")); err == nil {
+		t.Errorf("Expected error when setting metadata of a missing bucket")
+	}
+
+	if err := s.CreateBucketIfNotExists("test_bucket"); err != nil {
+		t.Fatalf("CreateBucketIfNotExists failed: %v", err)
+	}
+
+	meta, err := s.BucketMeta("test_bucket")
+	if err != nil || meta != nil {
+		t.Errorf("Unexpected metadata of a new bucket: got %q, %v, want nil", meta, err)
+	}
+
+	if err := s.SetBucketMeta("test_bucket", []byte("meta")); err != nil {
+		t.Fatalf("SetBucketMeta failed: %v", err)
+	}
+	if meta, err := s.BucketMeta("test_bucket"); err != nil || string(meta) != "meta" {
+		t.Errorf("Unexpected metadata: got %q, %v, want %q", meta, err, "meta")
+	}
+
+	if err := s.DeleteBucket("test_bucket"); err != nil {
+		t.Fatalf("DeleteBucket failed: %v", err)
+	}
+	if meta, err := s.BucketMeta("test_bucket"); err != nil || meta != nil {
+		t.Errorf("Metadata outlived the bucket: got %q, %v", meta, err)
+	}
+}
+
+func testBatch(t *testing.T, s db.Store) {
+	set(t, s, "default", "old", "value")
+
+	err := s.Batch("default", []db.Op{
+		{Key: "a", Value: []byte("1")},
+		{Key: "b", Value: []byte("2")},
+		{Key: "old", Delete: true},
+		{Key: "a", Value: []byte("3")},
+	})
+	if err != nil {
+		t.Fatalf("Batch failed: %v", err)
+	}
+
+	if v := get(t, s, "default", "a"); string(v) != "3" {
+		t.Errorf("Later operations in a batch must win: got %q, want %q", v, "3")
+	}
+	if v := get(t, s, "default", "b"); string(v) != "2" {
+		t.Errorf("Unexpected value of b: got %q, want %q", v, "2")
+	}
+	if v := get(t, s, "default", "old"); v != nil {
+		t.Errorf("Key deleted in a batch still exists: %q", v)
+	}
+}
+
+func testListAndScan(t *testing.T, s db.Store) {
+	for _, key := range []string{"c", "ba", "a", "bb"} {
+		set(t, s, "default", key, "value")
+	}
+
+	keys, err := s.ListKeys("default")
+	if err != nil {
+		t.Fatalf("ListKeys failed: %v", err)
+	}
+	if want := []string{"a", "ba", "bb", "c"}; !slices.Equal(keys, want) {
+		t.Errorf("Unexpected keys: got %v, want %v", keys, want)
+	}
+
+	cases := []struct {
+		start, end string
+		want       []string
+	}{
+		{"b", "c", []string{"ba", "bb"}},
+		{"bb", "", []string{"bb", "c"}},
+		{"", "b", []string{"a"}},
+		{"d", "", nil},
+	}
+	for _, c := range cases {
+		keys, err := s.ScanKeys("default", c.start, c.end)
+		if err != nil {
+			t.Fatalf("ScanKeys(%q, %q) failed: %v", c.start, c.end, err)
+		}
+		if !slices.Equal(keys, c.want) {
+			t.Errorf("ScanKeys(%q, %q) = %v, want %v", c.start, c.end, keys, c.want)
+		}
+	}
+}
+
+func testDeleteExtraKeys(t *testing.T, s db.Store) {
+	set(t, s, "default", "party", "Great")
+	set(t, s, "default", "us", "CapitalistPigs")
+
+	if err := s.DeleteExtraKeys(func(key string) bool { return key == "us" }, "default"); err != nil {
+		t.Fatalf("DeleteExtraKeys failed: %v", err)
+	}
+
+	if v := get(t, s, "default", "party"); string(v) != "Great" {
+		t.Errorf("Unexpected value of party: got %q, want %q", v, "Great")
+	}
+	if v := get(t, s, "default", "us"); v != nil {
+		t.Errorf("Extra key was not deleted: %q", v)
+	}
+}
+
+func testListBuckets(t *testing.T, s db.Store) {
+	for _, name := range []string{"b", "a"} {
+		if err := s.CreateBucketIfNotExists(name); err != nil {
+			t.Fatalf("CreateBucketIfNotExists failed: %v", err)
+		}
+	}
+	if err := s.SetBucketMeta("a", []byte("meta")); err != nil {
+		t.Fatalf("SetBucketMeta failed: %v", err)
+	}
+	if err := s.DeleteBucket("b"); err != nil {
+		t.Fatalf("DeleteBucket failed: %v", err)
+	}
+
+	names, err := s.Buckets()
+	if err != nil {
+		t.Fatalf("Buckets failed: %v", err)
+	}
+	if want := []string{"a", "default"}; !slices.Equal(names, want) {
+		t.Errorf("Unexpected buckets: got %q, want %q", names, want)
+	}
+}
+
+func testWalk(t *testing.T, s db.Store) {
+	// More keys than a single chunk of the bolt walk.
+	var want []string
+	var ops []db.Op
+	for i := 0; i < 2500; i++ {
+		key := fmt.Sprintf("key%04d", i)
+		ops = append(ops, db.Op{Key: key, Value: []byte("value-" + key)})
+		want = append(want, key)
+	}
+	if err := s.Batch("default", ops); err != nil {
+		t.Fatalf("Batch failed: %v", err)
+	}
+
+	var keys []string
+	err := db.Walk(s, "default", func(key string, value []byte) error {
+		if string(value) != "value-"+key {
+			t.Errorf("Unexpected value of %q: got %q", key, value)
+		}
+		keys = append(keys, key)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Walk failed: %v", err)
+	}
+	if !slices.Equal(keys, want) {
+		t.Errorf("Unexpected walked keys: got %d keys, want %d", len(keys), len(want))
+	}
+
+	if err := db.Walk(s, "missing", func(string, []byte) error { return nil }); err == nil {
+		t.Errorf("Expected error when walking a missing bucket")
+	}
+}
+
+func testModify(t *testing.T, s db.Store) {
+	appendX := func(v []byte) ([]byte, error) { return append(append([]byte{}, v...), 'x'), nil }
+
+	for i := 0; i < 2; i++ {
+		if err := s.Modify("default", "k", appendX); err != nil {
+			t.Fatalf("Modify failed: %v", err)
+		}
+	}
+	if v := get(t, s, "default", "k"); string(v) != "xx" {
+		t.Errorf("Unexpected value after Modify: got %q, want %q", v, "xx")
+	}
+
+	errAbort := errors.New("abort")
+	err := s.Modify("default", "k", func([]byte) ([]byte, error) { return []byte("lost"), errAbort })
+	if !errors.Is(err, errAbort) {
+		t.Errorf("Unexpected error from Modify: got %v, want %v", err, errAbort)
+	}
+	if v := get(t, s, "default", "k"); string(v) != "xx" {
+		t.Errorf("Unexpected value after a failed Modify: got %q, want %q", v, "xx")
+	}
+
+	if err := s.Modify("default", "k", func([]byte) ([]byte, error) { return nil, nil }); err != nil {
+		t.Fatalf("Modify failed: %v", err)
+	}
+	if v := get(t, s, "default", "k"); v != nil {
+		t.Errorf("Unexpected value after deleting with Modify: got %q, want nil", v)
+	}
+
+	if err := s.Modify("missing", "k", appendX); err == nil {
+		t.Errorf("Expected error modifying a key of a missing bucket")
+	}
+}
@@ -0,0 +1,305 @@
+package db
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// System buckets of the two-phase commit: the prepare records of the
+// transactions in doubt on this shard, the locks they hold on their keys
+// and the commit decisions of the transactions this shard coordinates.
+const (
+	txnBucket         = SystemPrefix + "txns"
+	txnLockBucket     = SystemPrefix + "txnlocks"
+	txnDecisionBucket = SystemPrefix + "txndecisions"
+)
+
+var (
+	// ErrLocked is returned for writes of keys locked by a prepared transaction.
+	ErrLocked = errors.New("key is locked by a transaction")
+	// ErrConditionFailed is returned by Prepare if a condition does not hold.
+	ErrConditionFailed = errors.New("condition failed")
+)
+
+// TxnOp is an operation of a transaction with the conditions the key
+// must meet for the transaction to commit.
+type TxnOp struct {
+	Op
+	// Check only verifies the conditions, without writing the key.
+	Check bool `json:",omitempty"`
+	// IfValue requires the key to have this value if it is not nil.
+	IfValue []byte `json:",omitempty"`
+	// IfMissing requires the key not to exist.
+	IfMissing bool `json:",omitempty"`
+}
+
+// PreparedTxn is the part of a transaction that runs on one shard.
+type PreparedTxn struct {
+	ID string
+	// Coordinator is the address of the shard that decides the outcome of
+	// the transaction. Unlike its index, it stays the same when shards are
+	// added or removed.
+	Coordinator string
+	Bucket      string
+	Ops         []TxnOp
+	Prepared    time.Time
+}
+
+// TxnStore is implemented by the stores that can take part in two-phase
+// commits. A prepared transaction locks its keys until it is committed or
+// aborted: writing them fails with ErrLocked, while reads still see the
+// values from before the transaction.
+type TxnStore interface {
+	// Prepare checks the conditions of the transaction and locks its keys,
+	// then durably records it. Preparing a recorded transaction again does
+	// nothing.
+	Prepare(txn PreparedTxn) error
+	// CommitPrepared applies the writes of the prepared transaction and
+	// releases its locks. Unknown transactions are ignored, so that the
+	// commit can be retried.
+	CommitPrepared(id string) error
+	// AbortPrepared releases the locks of the prepared transaction
+	// without applying its writes. Unknown transactions are ignored.
+	AbortPrepared(id string) error
+	// PreparedTxns returns the transactions prepared on this shard that
+	// were neither committed nor aborted yet.
+	PreparedTxns() ([]PreparedTxn, error)
+
+	// LogDecision durably records that the transaction coordinated by this
+	// shard commits on the participant shards, given by their addresses.
+	LogDecision(id string, participants []string) error
+	// Decision returns the participants of the committed transaction,
+	// false if there is no commit decision for it.
+	Decision(id string) ([]string, bool, error)
+	// Decisions returns the participants of all recorded commit decisions.
+	Decisions() (map[string][]string, error)
+	// ForgetDecision removes the decision once every participant committed.
+	ForgetDecision(id string) error
+}
+
+var _ TxnStore = (*Database)(nil)
+
+func lockKey(bucketName, key string) []byte {
+	return []byte(bucketName + "\x00" + key)
+}
+
+// checkLock fails with ErrLocked if the key is locked by a transaction
+// other than the owner, which is empty for writes outside of transactions.
+func checkLock(tx *bolt.Tx, bucketName, key, owner string) error {
+	b := tx.Bucket([]byte(txnLockBucket))
+	if b == nil {
+		return nil
+	}
+	if v := b.Get(lockKey(bucketName, key)); v != nil && string(v) != owner {
+		return ErrLocked
+	}
+	return nil
+}
+
+// checkBucketLocks fails with ErrLocked if a key of the bucket is locked
+// by a transaction.
+func checkBucketLocks(tx *bolt.Tx, bucketName string) error {
+	b := tx.Bucket([]byte(txnLockBucket))
+	if b == nil {
+		return nil
+	}
+	prefix := lockKey(bucketName, "")
+	if k, _ := b.Cursor().Seek(prefix); k != nil && bytes.HasPrefix(k, prefix) {
+		return ErrLocked
+	}
+	return nil
+}
+
+// checkTxnOp verifies the conditions of the operation.
+func checkTxnOp(tx *bolt.Tx, b *bolt.Bucket, bucketName string, op TxnOp) error {
+	var value []byte
+	if !expired(tx, bucketName, op.Key, time.Now()) {
+		value = b.Get([]byte(op.Key))
+	}
+	exists := value != nil || b.Bucket([]byte(op.Key)) != nil
+
+	if op.IfMissing && exists {
+		return fmt.Errorf("%w: key %q exists", ErrConditionFailed, op.Key)
+	}
+	// Typed values never match the value condition.
+	if op.IfValue != nil && !bytes.Equal(value, op.IfValue) {
+		return fmt.Errorf("%w: key %q has a different value", ErrConditionFailed, op.Key)
+	}
+	return nil
+}
+
+// Prepare checks the conditions of the transaction and locks its keys.
+func (d *Database) Prepare(txn PreparedTxn) error {
+	data, err := json.Marshal(txn)
+	if err != nil {
+		return err
+	}
+
+	return d.update(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte(txnBucket)).Get([]byte(txn.ID)) != nil {
+			return nil
+		}
+		b := tx.Bucket([]byte(txn.Bucket))
+		if b == nil {
+			return fmt.Errorf("bucket %s not found", txn.Bucket)
+		}
+
+		for _, op := range txn.Ops {
+			if err := checkLock(tx, txn.Bucket, op.Key, txn.ID); err != nil {
+				return fmt.Errorf("key %q: %w", op.Key, err)
+			}
+			if err := checkTxnOp(tx, b, txn.Bucket, op); err != nil {
+				return err
+			}
+		}
+
+		// Checked keys are locked as well, so that their conditions
+		// still hold when the transaction commits.
+		for _, op := range txn.Ops {
+			if err := d.putSystemKey(tx, txnLockBucket, lockKey(txn.Bucket, op.Key), []byte(txn.ID)); err != nil {
+				return err
+			}
+		}
+		return d.putSystemKey(tx, txnBucket, []byte(txn.ID), data)
+	})
+}
+
+// preparedTxn returns the prepare record of the transaction, nil if there is none.
+func preparedTxn(tx *bolt.Tx, id string) (*PreparedTxn, error) {
+	v := tx.Bucket([]byte(txnBucket)).Get([]byte(id))
+	if v == nil {
+		return nil, nil
+	}
+	var txn PreparedTxn
+	if err := json.Unmarshal(v, &txn); err != nil {
+		return nil, fmt.Errorf("decoding transaction %s: %w", id, err)
+	}
+	return &txn, nil
+}
+
+// releaseTxn removes the locks and the prepare record of the transaction.
+func (d *Database) releaseTxn(tx *bolt.Tx, txn *PreparedTxn) error {
+	locks := tx.Bucket([]byte(txnLockBucket))
+	for _, op := range txn.Ops {
+		k := lockKey(txn.Bucket, op.Key)
+		// Keys may appear more than once in a transaction.
+		if string(locks.Get(k)) != txn.ID {
+			continue
+		}
+		if err := d.deleteSystemKey(tx, txnLockBucket, k); err != nil {
+			return err
+		}
+	}
+	return d.deleteSystemKey(tx, txnBucket, []byte(txn.ID))
+}
+
+// CommitPrepared applies the writes of the prepared transaction.
+func (d *Database) CommitPrepared(id string) error {
+	return d.update(func(tx *bolt.Tx) error {
+		txn, err := preparedTxn(tx, id)
+		if err != nil || txn == nil {
+			return err
+		}
+		b := tx.Bucket([]byte(txn.Bucket))
+		if b == nil {
+			return fmt.Errorf("bucket %s not found", txn.Bucket)
+		}
+
+		for _, op := range txn.Ops {
+			if op.Check {
+				continue
+			}
+			if err := d.applyOp(tx, b, txn.Bucket, op.Op); err != nil {
+				return fmt.Errorf("key %q: %w", op.Key, err)
+			}
+			if err := d.clearKeyMeta(tx, txn.Bucket, op.Key); err != nil {
+				return fmt.Errorf("key %q: %w", op.Key, err)
+			}
+		}
+		return d.releaseTxn(tx, txn)
+	})
+}
+
+// AbortPrepared releases the locks of the prepared transaction.
+func (d *Database) AbortPrepared(id string) error {
+	return d.update(func(tx *bolt.Tx) error {
+		txn, err := preparedTxn(tx, id)
+		if err != nil || txn == nil {
+			return err
+		}
+		return d.releaseTxn(tx, txn)
+	})
+}
+
+// PreparedTxns returns the transactions in doubt on this shard.
+func (d *Database) PreparedTxns() ([]PreparedTxn, error) {
+	var txns []PreparedTxn
+	err := d.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(txnBucket)).ForEach(func(k, v []byte) error {
+			var txn PreparedTxn
+			if err := json.Unmarshal(v, &txn); err != nil {
+				return fmt.Errorf("decoding transaction %s: %w", k, err)
+			}
+			txns = append(txns, txn)
+			return nil
+		})
+	})
+	return txns, err
+}
+
+// LogDecision records the commit decision of the transaction.
+func (d *Database) LogDecision(id string, participants []string) error {
+	data, err := json.Marshal(participants)
+	if err != nil {
+		return err
+	}
+	return d.update(func(tx *bolt.Tx) error {
+		return d.putSystemKey(tx, txnDecisionBucket, []byte(id), data)
+	})
+}
+
+// Decision returns the participants of the committed transaction.
+func (d *Database) Decision(id string) ([]string, bool, error) {
+	var participants []string
+	var found bool
+	err := d.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket([]byte(txnDecisionBucket)).Get([]byte(id))
+		if v == nil {
+			return nil
+		}
+		found = true
+		return json.Unmarshal(v, &participants)
+	})
+	return participants, found, err
+}
+
+// Decisions returns the participants of all committed transactions.
+func (d *Database) Decisions() (map[string][]string, error) {
+	res := make(map[string][]string)
+	err := d.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(txnDecisionBucket)).ForEach(func(k, v []byte) error {
+			var participants []string
+			if err := json.Unmarshal(v, &participants); err != nil {
+				return fmt.Errorf("decoding decision %s: %w", k, err)
+			}
+			res[string(k)] = participants
+			return nil
+		})
+	})
+	return res, err
+}
+
+// ForgetDecision removes the commit decision of the transaction.
+func (d *Database) ForgetDecision(id string) error {
+	return d.update(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte(txnDecisionBucket)).Get([]byte(id)) == nil {
+			return nil
+		}
+		return d.deleteSystemKey(tx, txnDecisionBucket, []byte(id))
+	})
+}
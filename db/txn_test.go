@@ -0,0 +1,112 @@
+package db_test
+
+import (
+	"errors"
+	"go-kvdb/db"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPreparedTxns(t *testing.T) {
+	d, closeFunc, err := db.OpenDatabase(filepath.Join(t.TempDir(), "shard.db"), db.Options{ChangeLog: true})
+	if err != nil {
+		t.Fatalf("Could not create a new database: %v", err)
+	}
+	defer closeFunc()
+
+	if err := d.SetKey("a", "default", []byte("1")); err != nil {
+		t.Fatalf("Could not set key: %v", err)
+	}
+
+	txn := db.PreparedTxn{ID: "t1", Bucket: "default", Prepared: time.Now(), Ops: []db.TxnOp{
+		{Op: db.Op{Key: "a"}, Check: true, IfValue: []byte("1")},
+		{Op: db.Op{Key: "b", Value: []byte("2")}, IfMissing: true},
+	}}
+	if err := d.Prepare(txn); err != nil {
+		t.Fatalf("Could not prepare: %v", err)
+	}
+	// Preparing again does nothing, even with the keys locked.
+	if err := d.Prepare(txn); err != nil {
+		t.Errorf("Could not prepare again: %v", err)
+	}
+
+	// The keys are locked, but still read with their old values.
+	if err := d.SetKey("a", "default", []byte("x")); !errors.Is(err, db.ErrLocked) {
+		t.Errorf("Unexpected error for a locked key: got %v, want ErrLocked", err)
+	}
+	if err := d.Batch("default", []db.Op{{Key: "b", Delete: true}}); !errors.Is(err, db.ErrLocked) {
+		t.Errorf("Unexpected error for a locked key in a batch: got %v, want ErrLocked", err)
+	}
+	other := db.PreparedTxn{ID: "t2", Bucket: "default", Ops: []db.TxnOp{{Op: db.Op{Key: "a", Delete: true}}}}
+	if err := d.Prepare(other); !errors.Is(err, db.ErrLocked) {
+		t.Errorf("Unexpected error for a key locked by another transaction: got %v, want ErrLocked", err)
+	}
+	if got := getKey(t, d, "b", "default"); got != "" {
+		t.Errorf("Unexpected value of b before the commit: got %q", got)
+	}
+
+	// Neither the keys nor their bucket can be deleted from under the
+	// transaction.
+	if err := d.DeleteExtraKeys(func(key string) bool { return key == "a" }, "default"); !errors.Is(err, db.ErrLocked) {
+		t.Errorf("Unexpected error for deleting a locked key: got %v, want ErrLocked", err)
+	}
+	if err := d.DeleteBucket("default"); !errors.Is(err, db.ErrLocked) {
+		t.Errorf("Unexpected error for deleting a bucket with locked keys: got %v, want ErrLocked", err)
+	}
+
+	if txns, err := d.PreparedTxns(); err != nil || len(txns) != 1 || txns[0].ID != "t1" || len(txns[0].Ops) != 2 {
+		t.Errorf("Unexpected prepared transactions: got %+v, %v", txns, err)
+	}
+
+	if err := d.CommitPrepared("t1"); err != nil {
+		t.Fatalf("Could not commit: %v", err)
+	}
+	if err := d.CommitPrepared("t1"); err != nil {
+		t.Errorf("Could not commit again: %v", err)
+	}
+	if got := getKey(t, d, "b", "default"); got != "2" {
+		t.Errorf("Unexpected value of b after the commit: got %q, want %q", got, "2")
+	}
+	if err := d.SetKey("a", "default", []byte("x")); err != nil {
+		t.Errorf("Could not set a key after the commit: %v", err)
+	}
+
+	// A failed condition neither locks nor records anything.
+	failed := db.PreparedTxn{ID: "t3", Bucket: "default", Ops: []db.TxnOp{
+		{Op: db.Op{Key: "c", Value: []byte("3")}},
+		{Op: db.Op{Key: "b", Value: []byte("3")}, IfMissing: true},
+	}}
+	if err := d.Prepare(failed); !errors.Is(err, db.ErrConditionFailed) {
+		t.Errorf("Unexpected error for a failed condition: got %v, want ErrConditionFailed", err)
+	}
+	if err := d.SetKey("c", "default", []byte("x")); err != nil {
+		t.Errorf("Could not set a key of a failed transaction: %v", err)
+	}
+
+	if err := d.Prepare(other); err != nil {
+		t.Fatalf("Could not prepare: %v", err)
+	}
+	if err := d.AbortPrepared("t2"); err != nil {
+		t.Fatalf("Could not abort: %v", err)
+	}
+	if got := getKey(t, d, "a", "default"); got != "x" {
+		t.Errorf("Unexpected value of a after the abort: got %q, want %q", got, "x")
+	}
+	if txns, err := d.PreparedTxns(); err != nil || len(txns) != 0 {
+		t.Errorf("Unexpected prepared transactions: got %+v, %v", txns, err)
+	}
+
+	if err := d.LogDecision("t4", []string{"a:1", "c:1"}); err != nil {
+		t.Fatalf("Could not record a decision: %v", err)
+	}
+	if participants, ok, err := d.Decision("t4"); err != nil || !ok || len(participants) != 2 || participants[1] != "c:1" {
+		t.Errorf("Unexpected decision: got %v, %v, %v", participants, ok, err)
+	}
+	if err := d.ForgetDecision("t4"); err != nil {
+		t.Fatalf("Could not forget a decision: %v", err)
+	}
+	if decisions, err := d.Decisions(); err != nil || len(decisions) != 0 {
+		t.Errorf("Unexpected decisions: got %v, %v", decisions, err)
+	}
+}
@@ -0,0 +1,788 @@
+package db
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// Types of values. Plain values are strings; the other types are stored
+// in a nested bucket under their key.
+const (
+	TypeString = "string"
+	TypeHash   = "hash"
+	TypeList   = "list"
+	TypeSet    = "set"
+	TypeZSet   = "zset"
+)
+
+var (
+	// ErrWrongType is returned for operations on a key of another type.
+	ErrWrongType = errors.New("key holds a value of another type")
+	// ErrUnknownCommand is returned for unknown typed value commands.
+	ErrUnknownCommand = errors.New("unknown command")
+	// ErrSyntax is returned for commands with invalid arguments.
+	ErrSyntax = errors.New("syntax error")
+	// ErrKeyExists is returned by Build for a key that already has a value.
+	ErrKeyExists = errors.New("key already exists")
+)
+
+// TypedStore is implemented by the stores that support hashes, lists,
+// sets and sorted sets. Typed keys are listed with the plain ones, but
+// GetKey does not return them; SetKey and DelKey replace them.
+type TypedStore interface {
+	// Type returns the type of the value of the key or "" if it does not exist.
+	Type(bucketName, key string) (string, error)
+	// Do runs the command on the typed value of the key. Writes to a
+	// missing key create it and a value left empty is deleted.
+	Do(bucketName, key string, cmd Cmd) (Reply, error)
+	// Commands returns the write commands that rebuild the typed value
+	// of the key, e.g. to move it to another shard, or nil if it has none.
+	Commands(bucketName, key string) ([]Cmd, error)
+	// Build atomically replaces the value of the key with the typed value
+	// built by the write commands. Unless replace is true, it fails with
+	// ErrKeyExists, writing nothing, if the key has a value.
+	Build(bucketName, key string, cmds []Cmd, replace bool) error
+}
+
+var _ TypedStore = (*Database)(nil)
+
+// Cmd is a command on a typed value, named like its Redis counterpart:
+//
+//	hash:       hset field value [field value ...], hdel field ..., hget field, hgetall, hlen
+//	list:       lpush value ..., rpush value ..., lpop, rpop, lrange start stop, llen
+//	set:        sadd member ..., srem member ..., smembers, sismember member, scard
+//	sorted set: zadd score member [score member ...], zrem member ..., zscore member,
+//	            zrange start stop, zrangebyscore min max, zcard
+//
+// Ranges by index are inclusive and count from the end when negative.
+// Writes are recorded in the change log as ChangeTyped changes with the
+// JSON encoded command as the value, so that they can be replayed.
+type Cmd struct {
+	Name string   `json:"name"`
+	Args [][]byte `json:"args,omitempty"`
+}
+
+// NewCmd returns the command with the string arguments.
+func NewCmd(name string, args ...string) Cmd {
+	cmd := Cmd{Name: name, Args: make([][]byte, len(args))}
+	for i, a := range args {
+		cmd.Args[i] = []byte(a)
+	}
+	return cmd
+}
+
+// Reply is the result of a command. N holds counts and lengths, Value
+// single values (nil if missing) and Values lists of values: hgetall
+// returns the fields and values interleaved and the sorted set ranges
+// return the members with their scores in Scores.
+type Reply struct {
+	N      int64
+	Value  []byte
+	Values [][]byte
+	Scores []float64
+}
+
+// Keys of the nested buckets. The type is stored under a key that sorts
+// before the data; fields, members and list items are stored with the
+// data prefix, and sorted set members once more by score.
+var (
+	typeKey       = []byte{0}
+	listBoundsKey = []byte{2}
+)
+
+const (
+	dataPrefix  = 1
+	scorePrefix = 3
+)
+
+type command struct {
+	typ   string
+	write bool
+	// args is the minimum number of arguments and step the size of
+	// the repeated groups after them, 0 if the number is fixed.
+	args, step int
+	fn         func(b *bolt.Bucket, args [][]byte) (reply Reply, changed bool, err error)
+}
+
+var commands map[string]command
+
+func init() {
+	commands = map[string]command{
+		"hset":    {TypeHash, true, 2, 2, hset},
+		"hdel":    {TypeHash, true, 1, 1, remove},
+		"hget":    {TypeHash, false, 1, 0, hget},
+		"hgetall": {TypeHash, false, 0, 0, hgetall},
+		"hlen":    {TypeHash, false, 0, 0, count},
+
+		"lpush":  {TypeList, true, 1, 1, lpush},
+		"rpush":  {TypeList, true, 1, 1, rpush},
+		"lpop":   {TypeList, true, 0, 0, lpop},
+		"rpop":   {TypeList, true, 0, 0, rpop},
+		"lrange": {TypeList, false, 2, 0, lrange},
+		"llen":   {TypeList, false, 0, 0, llen},
+
+		"sadd":      {TypeSet, true, 1, 1, sadd},
+		"srem":      {TypeSet, true, 1, 1, remove},
+		"smembers":  {TypeSet, false, 0, 0, smembers},
+		"sismember": {TypeSet, false, 1, 0, sismember},
+		"scard":     {TypeSet, false, 0, 0, count},
+
+		"zadd":          {TypeZSet, true, 2, 2, zadd},
+		"zrem":          {TypeZSet, true, 1, 1, zrem},
+		"zscore":        {TypeZSet, false, 1, 0, zscore},
+		"zrange":        {TypeZSet, false, 2, 0, zrange},
+		"zrangebyscore": {TypeZSet, false, 2, 0, zrangebyscore},
+		"zcard":         {TypeZSet, false, 0, 0, count},
+	}
+}
+
+func lookupCommand(cmd Cmd) (command, error) {
+	c, ok := commands[cmd.Name]
+	if !ok {
+		return c, fmt.Errorf("%w %q", ErrUnknownCommand, cmd.Name)
+	}
+
+	n := len(cmd.Args)
+	if n < c.args || (c.step == 0 && n != c.args) || (c.step > 0 && (n-c.args)%c.step != 0) {
+		return c, fmt.Errorf("%w: wrong number of arguments for %s", ErrSyntax, cmd.Name)
+	}
+	return c, nil
+}
+
+// Type returns the type of the value of the key.
+func (d *Database) Type(bucketName, key string) (string, error) {
+	var typ string
+	err := d.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucketName))
+		if b == nil {
+			return fmt.Errorf("bucket %s not found", bucketName)
+		}
+
+		if b.Get([]byte(key)) != nil {
+			typ = TypeString
+		} else if nested := b.Bucket([]byte(key)); nested != nil {
+			typ = string(nested.Get(typeKey))
+		}
+		return nil
+	})
+	return typ, err
+}
+
+// Do runs the command on the typed value of the key.
+func (d *Database) Do(bucketName, key string, cmd Cmd) (Reply, error) {
+	c, err := lookupCommand(cmd)
+	if err != nil {
+		return Reply{}, err
+	}
+
+	var reply Reply
+	if !c.write {
+		err := d.db.View(func(tx *bolt.Tx) error {
+			b := tx.Bucket([]byte(bucketName))
+			if b == nil {
+				return fmt.Errorf("bucket %s not found", bucketName)
+			}
+
+			if expired(tx, bucketName, key, time.Now()) {
+				return nil
+			}
+			nested, err := typedBucket(b, key, c.typ, false)
+			if err != nil || nested == nil {
+				return err
+			}
+			reply, _, err = c.fn(nested, cmd.Args)
+			return err
+		})
+		// The values are only valid during the transaction.
+		reply.Value = clone(reply.Value)
+		for i, v := range reply.Values {
+			reply.Values[i] = clone(v)
+		}
+		return reply, err
+	}
+
+	err = d.update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucketName))
+		if b == nil {
+			return fmt.Errorf("bucket %s not found", bucketName)
+		}
+		if err := checkLock(tx, bucketName, key, ""); err != nil {
+			return err
+		}
+
+		// An expired plain value makes way for the typed one.
+		if expired(tx, bucketName, key, time.Now()) {
+			if err := d.applyOp(tx, b, bucketName, Op{Key: key, Delete: true}); err != nil {
+				return err
+			}
+		}
+
+		var changed bool
+		var err error
+		if reply, changed, err = runCommand(b, key, c, cmd.Args); err != nil || !changed {
+			return err
+		}
+
+		data, err := json.Marshal(cmd)
+		if err != nil {
+			return err
+		}
+		return d.logChange(tx, Change{Op: ChangeTyped, Bucket: bucketName, Key: key, Value: data})
+	})
+	return reply, err
+}
+
+// Commands returns the write commands that rebuild the typed value of the key.
+func (d *Database) Commands(bucketName, key string) ([]Cmd, error) {
+	var cmds []Cmd
+	err := d.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucketName))
+		if b == nil {
+			return fmt.Errorf("bucket %s not found", bucketName)
+		}
+		if nested := b.Bucket([]byte(key)); nested != nil {
+			cmds = typedCommands(nested)
+		}
+		return nil
+	})
+	return cmds, err
+}
+
+// Build replaces the value of the key with the typed value built by the
+// write commands in a single transaction.
+func (d *Database) Build(bucketName, key string, cmds []Cmd, replace bool) error {
+	tcs := make([]command, len(cmds))
+	for i, cmd := range cmds {
+		c, err := lookupCommand(cmd)
+		if err != nil {
+			return err
+		}
+		if !c.write {
+			return fmt.Errorf("%w: %s does not write", ErrSyntax, cmd.Name)
+		}
+		tcs[i] = c
+	}
+
+	return d.update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucketName))
+		if b == nil {
+			return fmt.Errorf("bucket %s not found", bucketName)
+		}
+		if err := checkLock(tx, bucketName, key, ""); err != nil {
+			return err
+		}
+
+		if b.Get([]byte(key)) != nil || b.Bucket([]byte(key)) != nil {
+			if !replace && !expired(tx, bucketName, key, time.Now()) {
+				return ErrKeyExists
+			}
+			if err := d.applyOp(tx, b, bucketName, Op{Key: key, Delete: true}); err != nil {
+				return err
+			}
+		}
+
+		for i, cmd := range cmds {
+			_, changed, err := runCommand(b, key, tcs[i], cmd.Args)
+			if err != nil {
+				return err
+			}
+			if !changed {
+				continue
+			}
+			data, err := json.Marshal(cmd)
+			if err != nil {
+				return err
+			}
+			if err := d.logChange(tx, Change{Op: ChangeTyped, Bucket: bucketName, Key: key, Value: data}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// runCommand runs a write command, creating the nested bucket of
+// the key if needed and deleting it if it is left empty.
+func runCommand(b *bolt.Bucket, key string, c command, args [][]byte) (Reply, bool, error) {
+	nested, err := typedBucket(b, key, c.typ, true)
+	if err != nil {
+		return Reply{}, false, err
+	}
+
+	reply, changed, err := c.fn(nested, args)
+	if err != nil {
+		return Reply{}, false, err
+	}
+	// The popped values would not survive the deletion of the bucket.
+	reply.Value = clone(reply.Value)
+
+	if k, _ := nested.Cursor().Seek([]byte{dataPrefix}); k == nil || k[0] != dataPrefix {
+		return reply, changed, b.DeleteBucket([]byte(key))
+	}
+	return reply, changed, nil
+}
+
+// applyTyped replays a ChangeTyped change.
+func applyTyped(b *bolt.Bucket, c Change) error {
+	var cmd Cmd
+	if err := json.Unmarshal(c.Value, &cmd); err != nil {
+		return fmt.Errorf("decoding command: %w", err)
+	}
+	tc, err := lookupCommand(cmd)
+	if err != nil {
+		return err
+	}
+	_, _, err = runCommand(b, c.Key, tc, cmd.Args)
+	return err
+}
+
+// typedBucket returns the nested bucket of the key after checking its
+// type. A missing bucket is created if create is true, nil is returned otherwise.
+func typedBucket(b *bolt.Bucket, key, typ string, create bool) (*bolt.Bucket, error) {
+	if b.Get([]byte(key)) != nil {
+		return nil, ErrWrongType
+	}
+
+	nested := b.Bucket([]byte(key))
+	if nested != nil {
+		if string(nested.Get(typeKey)) != typ {
+			return nil, ErrWrongType
+		}
+		return nested, nil
+	}
+	if !create {
+		return nil, nil
+	}
+
+	nested, err := b.CreateBucket([]byte(key))
+	if err != nil {
+		return nil, err
+	}
+	if err := nested.Put(typeKey, []byte(typ)); err != nil {
+		return nil, err
+	}
+	if typ == TypeList {
+		err = setListBounds(nested, listStart, listStart)
+	}
+	return nested, err
+}
+
+// putValue puts the plain value, replacing a typed value of the key.
+func putValue(b *bolt.Bucket, key, value []byte) error {
+	if b.Bucket(key) != nil {
+		if err := b.DeleteBucket(key); err != nil {
+			return err
+		}
+	}
+	return b.Put(key, value)
+}
+
+// deleteValue deletes the plain or typed value of the key.
+func deleteValue(b *bolt.Bucket, key []byte) error {
+	if b.Bucket(key) != nil {
+		return b.DeleteBucket(key)
+	}
+	return b.Delete(key)
+}
+
+func dataKey(k []byte) []byte {
+	return append([]byte{dataPrefix}, k...)
+}
+
+// forEachData calls fn for the data entries with the data prefix removed.
+func forEachData(b *bolt.Bucket, fn func(k, v []byte) bool) {
+	c := b.Cursor()
+	for k, v := c.Seek([]byte{dataPrefix}); k != nil && k[0] == dataPrefix; k, v = c.Next() {
+		if !fn(k[1:], v) {
+			return
+		}
+	}
+}
+
+func count(b *bolt.Bucket, _ [][]byte) (Reply, bool, error) {
+	var n int64
+	forEachData(b, func(_, _ []byte) bool {
+		n++
+		return true
+	})
+	return Reply{N: n}, false, nil
+}
+
+// remove deletes the fields or members given as arguments.
+func remove(b *bolt.Bucket, args [][]byte) (Reply, bool, error) {
+	var n int64
+	for _, a := range args {
+		if b.Get(dataKey(a)) == nil {
+			continue
+		}
+		if err := b.Delete(dataKey(a)); err != nil {
+			return Reply{}, false, err
+		}
+		n++
+	}
+	return Reply{N: n}, n > 0, nil
+}
+
+func hset(b *bolt.Bucket, args [][]byte) (Reply, bool, error) {
+	var n int64
+	for i := 0; i < len(args); i += 2 {
+		k := dataKey(args[i])
+		if b.Get(k) == nil {
+			n++
+		}
+		if err := b.Put(k, append([]byte{}, args[i+1]...)); err != nil {
+			return Reply{}, false, err
+		}
+	}
+	return Reply{N: n}, true, nil
+}
+
+func hget(b *bolt.Bucket, args [][]byte) (Reply, bool, error) {
+	return Reply{Value: b.Get(dataKey(args[0]))}, false, nil
+}
+
+func hgetall(b *bolt.Bucket, _ [][]byte) (Reply, bool, error) {
+	var r Reply
+	forEachData(b, func(k, v []byte) bool {
+		r.Values = append(r.Values, k, v)
+		return true
+	})
+	return r, false, nil
+}
+
+// Lists are stored as items at consecutive positions from head up to
+// tail, starting in the middle of the uint64 range so that they can grow
+// in both directions.
+const listStart = uint64(1) << 63
+
+func listBounds(b *bolt.Bucket) (head, tail uint64) {
+	v := b.Get(listBoundsKey)
+	return binary.BigEndian.Uint64(v[:8]), binary.BigEndian.Uint64(v[8:])
+}
+
+func setListBounds(b *bolt.Bucket, head, tail uint64) error {
+	v := make([]byte, 16)
+	binary.BigEndian.PutUint64(v[:8], head)
+	binary.BigEndian.PutUint64(v[8:], tail)
+	return b.Put(listBoundsKey, v)
+}
+
+func listKey(pos uint64) []byte {
+	return dataKey(seqKey(pos))
+}
+
+func lpush(b *bolt.Bucket, args [][]byte) (Reply, bool, error) {
+	head, tail := listBounds(b)
+	for _, v := range args {
+		head--
+		if err := b.Put(listKey(head), append([]byte{}, v...)); err != nil {
+			return Reply{}, false, err
+		}
+	}
+	return Reply{N: int64(tail - head)}, true, setListBounds(b, head, tail)
+}
+
+func rpush(b *bolt.Bucket, args [][]byte) (Reply, bool, error) {
+	head, tail := listBounds(b)
+	for _, v := range args {
+		if err := b.Put(listKey(tail), append([]byte{}, v...)); err != nil {
+			return Reply{}, false, err
+		}
+		tail++
+	}
+	return Reply{N: int64(tail - head)}, true, setListBounds(b, head, tail)
+}
+
+func lpop(b *bolt.Bucket, _ [][]byte) (Reply, bool, error) {
+	head, tail := listBounds(b)
+	if head == tail {
+		return Reply{}, false, nil
+	}
+
+	v := clone(b.Get(listKey(head)))
+	if err := b.Delete(listKey(head)); err != nil {
+		return Reply{}, false, err
+	}
+	return Reply{Value: v}, true, setListBounds(b, head+1, tail)
+}
+
+func rpop(b *bolt.Bucket, _ [][]byte) (Reply, bool, error) {
+	head, tail := listBounds(b)
+	if head == tail {
+		return Reply{}, false, nil
+	}
+
+	v := clone(b.Get(listKey(tail - 1)))
+	if err := b.Delete(listKey(tail - 1)); err != nil {
+		return Reply{}, false, err
+	}
+	return Reply{Value: v}, true, setListBounds(b, head, tail-1)
+}
+
+func llen(b *bolt.Bucket, _ [][]byte) (Reply, bool, error) {
+	head, tail := listBounds(b)
+	return Reply{N: int64(tail - head)}, false, nil
+}
+
+func lrange(b *bolt.Bucket, args [][]byte) (Reply, bool, error) {
+	start, stop, err := parseRange(args)
+	if err != nil {
+		return Reply{}, false, err
+	}
+
+	head, tail := listBounds(b)
+	from, to := rangeOf(start, stop, int64(tail-head))
+
+	var r Reply
+	c := b.Cursor()
+	k, v := c.Seek(listKey(head + uint64(from)))
+	for i := from; i < to && k != nil; i++ {
+		r.Values = append(r.Values, v)
+		k, v = c.Next()
+	}
+	return r, false, nil
+}
+
+func sadd(b *bolt.Bucket, args [][]byte) (Reply, bool, error) {
+	var n int64
+	for _, m := range args {
+		if b.Get(dataKey(m)) != nil {
+			continue
+		}
+		if err := b.Put(dataKey(m), []byte{}); err != nil {
+			return Reply{}, false, err
+		}
+		n++
+	}
+	return Reply{N: n}, n > 0, nil
+}
+
+func smembers(b *bolt.Bucket, _ [][]byte) (Reply, bool, error) {
+	var r Reply
+	forEachData(b, func(k, _ []byte) bool {
+		r.Values = append(r.Values, k)
+		return true
+	})
+	return r, false, nil
+}
+
+func sismember(b *bolt.Bucket, args [][]byte) (Reply, bool, error) {
+	if b.Get(dataKey(args[0])) != nil {
+		return Reply{N: 1}, false, nil
+	}
+	return Reply{}, false, nil
+}
+
+// Sorted set members are stored with their score and indexed by the
+// score encoded so that the byte order is the numeric order.
+func scoreKey(score float64, member []byte) []byte {
+	bits := math.Float64bits(score)
+	if score >= 0 {
+		bits ^= 1 << 63
+	} else {
+		bits = ^bits
+	}
+
+	k := make([]byte, 9, 9+len(member))
+	k[0] = scorePrefix
+	binary.BigEndian.PutUint64(k[1:], bits)
+	return append(k, member...)
+}
+
+func decodeScore(k []byte) float64 {
+	bits := binary.BigEndian.Uint64(k[1:9])
+	if bits&(1<<63) != 0 {
+		bits ^= 1 << 63
+	} else {
+		bits = ^bits
+	}
+	return math.Float64frombits(bits)
+}
+
+func parseScore(a []byte) (float64, error) {
+	f, err := strconv.ParseFloat(string(a), 64)
+	if err != nil || math.IsNaN(f) {
+		return 0, fmt.Errorf("%w: invalid score %q", ErrSyntax, a)
+	}
+	// Zero is stored without its sign, so that -0 and 0 are the same score.
+	return f + 0, nil
+}
+
+func formatScore(f float64) []byte {
+	return strconv.AppendFloat(nil, f, 'g', -1, 64)
+}
+
+func zadd(b *bolt.Bucket, args [][]byte) (Reply, bool, error) {
+	var n int64
+	for i := 0; i < len(args); i += 2 {
+		score, err := parseScore(args[i])
+		if err != nil {
+			return Reply{}, false, err
+		}
+		member := args[i+1]
+
+		if old := b.Get(dataKey(member)); old != nil {
+			prev, _ := strconv.ParseFloat(string(old), 64)
+			if err := b.Delete(scoreKey(prev, member)); err != nil {
+				return Reply{}, false, err
+			}
+		} else {
+			n++
+		}
+
+		if err := b.Put(dataKey(member), formatScore(score)); err != nil {
+			return Reply{}, false, err
+		}
+		if err := b.Put(scoreKey(score, member), []byte{}); err != nil {
+			return Reply{}, false, err
+		}
+	}
+	return Reply{N: n}, true, nil
+}
+
+func zrem(b *bolt.Bucket, args [][]byte) (Reply, bool, error) {
+	for _, m := range args {
+		if old := b.Get(dataKey(m)); old != nil {
+			prev, _ := strconv.ParseFloat(string(old), 64)
+			if err := b.Delete(scoreKey(prev, m)); err != nil {
+				return Reply{}, false, err
+			}
+		}
+	}
+	return remove(b, args)
+}
+
+func zscore(b *bolt.Bucket, args [][]byte) (Reply, bool, error) {
+	return Reply{Value: b.Get(dataKey(args[0]))}, false, nil
+}
+
+// forEachScore calls fn for the members in score order from the score.
+func forEachScore(b *bolt.Bucket, from float64, fn func(member []byte, score float64) bool) {
+	c := b.Cursor()
+	for k, _ := c.Seek(scoreKey(from, nil)); k != nil && k[0] == scorePrefix; k, _ = c.Next() {
+		if !fn(k[9:], decodeScore(k)) {
+			return
+		}
+	}
+}
+
+func zrange(b *bolt.Bucket, args [][]byte) (Reply, bool, error) {
+	start, stop, err := parseRange(args)
+	if err != nil {
+		return Reply{}, false, err
+	}
+
+	n, _, _ := count(b, nil)
+	from, to := rangeOf(start, stop, n.N)
+
+	var r Reply
+	i := int64(0)
+	forEachScore(b, math.Inf(-1), func(member []byte, score float64) bool {
+		if i >= from && i < to {
+			r.Values = append(r.Values, member)
+			r.Scores = append(r.Scores, score)
+		}
+		i++
+		return i < to
+	})
+	return r, false, nil
+}
+
+func zrangebyscore(b *bolt.Bucket, args [][]byte) (Reply, bool, error) {
+	min, err := parseScore(args[0])
+	if err != nil {
+		return Reply{}, false, err
+	}
+	max, err := parseScore(args[1])
+	if err != nil {
+		return Reply{}, false, err
+	}
+
+	var r Reply
+	forEachScore(b, min, func(member []byte, score float64) bool {
+		if score > max {
+			return false
+		}
+		r.Values = append(r.Values, member)
+		r.Scores = append(r.Scores, score)
+		return true
+	})
+	return r, false, nil
+}
+
+func parseRange(args [][]byte) (start, stop int64, err error) {
+	if start, err = strconv.ParseInt(string(args[0]), 10, 64); err != nil {
+		return 0, 0, fmt.Errorf("%w: invalid index %q", ErrSyntax, args[0])
+	}
+	if stop, err = strconv.ParseInt(string(args[1]), 10, 64); err != nil {
+		return 0, 0, fmt.Errorf("%w: invalid index %q", ErrSyntax, args[1])
+	}
+	return start, stop, nil
+}
+
+// rangeOf converts the inclusive start and stop indexes, which count
+// from the end when negative, to a half-open range within [0, n).
+func rangeOf(start, stop, n int64) (from, to int64) {
+	if start < 0 {
+		start += n
+	}
+	if stop < 0 {
+		stop += n
+	}
+	start = max(start, 0)
+	stop = min(stop, n-1)
+	if start > stop {
+		return 0, 0
+	}
+	return start, stop + 1
+}
+
+// typedDigest hashes the contents of a nested bucket. It hashes the
+// commands that rebuild it, since the list positions depend on the history.
+func typedDigest(b *bolt.Bucket) uint64 {
+	var buf bytes.Buffer
+	buf.Write(b.Get(typeKey))
+	for _, cmd := range typedCommands(b) {
+		for _, a := range cmd.Args {
+			buf.Write(binary.AppendUvarint(nil, uint64(len(a))))
+			buf.Write(a)
+		}
+	}
+	return hashValue(buf.Bytes())
+}
+
+// typedCommands returns the write commands that rebuild the typed value.
+func typedCommands(b *bolt.Bucket) []Cmd {
+	var cmds []Cmd
+	switch string(b.Get(typeKey)) {
+	case TypeHash:
+		forEachData(b, func(k, v []byte) bool {
+			cmds = append(cmds, Cmd{Name: "hset", Args: [][]byte{clone(k), clone(v)}})
+			return true
+		})
+	case TypeList:
+		forEachData(b, func(_, v []byte) bool {
+			cmds = append(cmds, Cmd{Name: "rpush", Args: [][]byte{clone(v)}})
+			return true
+		})
+	case TypeSet:
+		forEachData(b, func(k, _ []byte) bool {
+			cmds = append(cmds, Cmd{Name: "sadd", Args: [][]byte{clone(k)}})
+			return true
+		})
+	case TypeZSet:
+		forEachData(b, func(k, v []byte) bool {
+			cmds = append(cmds, Cmd{Name: "zadd", Args: [][]byte{clone(v), clone(k)}})
+			return true
+		})
+	}
+	return cmds
+}
@@ -0,0 +1,266 @@
+package db_test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"go-kvdb/db"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func do(t *testing.T, d *db.Database, key, name string, args ...string) db.Reply {
+	t.Helper()
+	reply, err := d.Do("default", key, db.NewCmd(name, args...))
+	if err != nil {
+		t.Fatalf("Could not run %s on %q: %v", name, key, err)
+	}
+	return reply
+}
+
+func joined(values [][]byte) string {
+	return string(bytes.Join(values, []byte(",")))
+}
+
+func TestTypes(t *testing.T) {
+	d, closeFunc, err := db.OpenDatabase(filepath.Join(t.TempDir(), "shard.db"), db.Options{ChangeLog: true})
+	if err != nil {
+		t.Fatalf("Could not create a new database: %v", err)
+	}
+	defer closeFunc()
+
+	if n := do(t, d, "user", "hset", "name", "alice", "role", "admin").N; n != 2 {
+		t.Errorf("Unexpected number of new fields: got %d, want 2", n)
+	}
+	if n := do(t, d, "user", "hset", "role", "owner").N; n != 0 {
+		t.Errorf("Unexpected number of new fields after an update: got %d, want 0", n)
+	}
+	if v := do(t, d, "user", "hget", "role").Value; string(v) != "owner" {
+		t.Errorf("Unexpected field value: got %q, want %q", v, "owner")
+	}
+	if v := do(t, d, "user", "hget", "missing").Value; v != nil {
+		t.Errorf("Unexpected value of a missing field: got %q, want nil", v)
+	}
+	if got := joined(do(t, d, "user", "hgetall").Values); got != "name,alice,role,owner" {
+		t.Errorf("Unexpected hash contents: got %q, want %q", got, "name,alice,role,owner")
+	}
+
+	do(t, d, "queue", "rpush", "b", "c")
+	if n := do(t, d, "queue", "lpush", "a", "z").N; n != 4 {
+		t.Errorf("Unexpected list length: got %d, want 4", n)
+	}
+	if got := joined(do(t, d, "queue", "lrange", "0", "-1").Values); got != "z,a,b,c" {
+		t.Errorf("Unexpected list: got %q, want %q", got, "z,a,b,c")
+	}
+	if got := joined(do(t, d, "queue", "lrange", "1", "-2").Values); got != "a,b" {
+		t.Errorf("Unexpected list range: got %q, want %q", got, "a,b")
+	}
+	if v := do(t, d, "queue", "lpop").Value; string(v) != "z" {
+		t.Errorf("Unexpected lpop result: got %q, want %q", v, "z")
+	}
+	if v := do(t, d, "queue", "rpop").Value; string(v) != "c" {
+		t.Errorf("Unexpected rpop result: got %q, want %q", v, "c")
+	}
+
+	if n := do(t, d, "tags", "sadd", "go", "db", "go").N; n != 2 {
+		t.Errorf("Unexpected number of added members: got %d, want 2", n)
+	}
+	do(t, d, "tags", "srem", "db")
+	if got := joined(do(t, d, "tags", "smembers").Values); got != "go" {
+		t.Errorf("Unexpected set members: got %q, want %q", got, "go")
+	}
+	if n := do(t, d, "tags", "sismember", "db").N; n != 0 {
+		t.Errorf("Removed member still in the set")
+	}
+
+	do(t, d, "scores", "zadd", "10", "bob", "-2.5", "carol", "7", "alice", "0", "dave")
+	do(t, d, "scores", "zadd", "12", "alice")
+	if got := joined(do(t, d, "scores", "zrange", "0", "-1").Values); got != "carol,dave,bob,alice" {
+		t.Errorf("Unexpected order by score: got %q, want %q", got, "carol,dave,bob,alice")
+	}
+	reply := do(t, d, "scores", "zrangebyscore", "0", "+inf")
+	if got := joined(reply.Values); got != "dave,bob,alice" || len(reply.Scores) != 3 || reply.Scores[2] != 12 {
+		t.Errorf("Unexpected range by score: got %q %v", got, reply.Scores)
+	}
+	if got := joined(do(t, d, "scores", "zrange", "-2", "-1").Values); got != "bob,alice" {
+		t.Errorf("Unexpected range by rank: got %q, want %q", got, "bob,alice")
+	}
+
+	if _, err := d.Do("default", "user", db.NewCmd("rpush", "x")); !errors.Is(err, db.ErrWrongType) {
+		t.Errorf("Unexpected error for a command on another type: got %v, want %v", err, db.ErrWrongType)
+	}
+	setKey(t, d, "plain", "value", "default")
+	if _, err := d.Do("default", "plain", db.NewCmd("hget", "x")); !errors.Is(err, db.ErrWrongType) {
+		t.Errorf("Unexpected error for a command on a plain value: got %v, want %v", err, db.ErrWrongType)
+	}
+	if _, err := d.Incr("default", "user"); !errors.Is(err, db.ErrWrongType) {
+		t.Errorf("Unexpected error incrementing a hash: got %v, want %v", err, db.ErrWrongType)
+	}
+	if _, err := d.Do("default", "user", db.NewCmd("hset", "odd")); !errors.Is(err, db.ErrSyntax) {
+		t.Errorf("Unexpected error for a wrong number of arguments: got %v, want %v", err, db.ErrSyntax)
+	}
+
+	// Emptied values are deleted and plain writes replace typed values.
+	do(t, d, "tags", "srem", "go")
+	if typ, _ := d.Type("default", "tags"); typ != "" {
+		t.Errorf("Unexpected type of an emptied set: got %q, want none", typ)
+	}
+	setKey(t, d, "user", "plain", "default")
+	if typ, _ := d.Type("default", "user"); typ != db.TypeString {
+		t.Errorf("Unexpected type after a plain write: got %q, want %q", typ, db.TypeString)
+	}
+	if err := d.DelKey("default", "queue"); err != nil {
+		t.Errorf("Could not delete a list: %v", err)
+	}
+	if typ, _ := d.Type("default", "scores"); typ != db.TypeZSet {
+		t.Errorf("Unexpected type: got %q, want %q", typ, db.TypeZSet)
+	}
+}
+
+func TestBuild(t *testing.T) {
+	d, closeFunc, err := db.NewDatabase(filepath.Join(t.TempDir(), "shard.db"))
+	if err != nil {
+		t.Fatalf("Could not create a new database: %v", err)
+	}
+	defer closeFunc()
+
+	cmds := []db.Cmd{db.NewCmd("rpush", "a"), db.NewCmd("rpush", "b")}
+	if err := d.Build("default", "list", cmds, false); err != nil {
+		t.Fatalf("Could not build the list: %v", err)
+	}
+	if err := d.Build("default", "list", []db.Cmd{db.NewCmd("sadd", "x")}, false); !errors.Is(err, db.ErrKeyExists) {
+		t.Errorf("Unexpected error building an existing key: got %v, want %v", err, db.ErrKeyExists)
+	}
+	if got, err := d.Commands("default", "list"); err != nil || !reflect.DeepEqual(got, cmds) {
+		t.Errorf("Unexpected commands of the kept list: got %v, %v", got, err)
+	}
+
+	setKey(t, d, "plain", "1", "default")
+	if err := d.Build("default", "plain", cmds, false); !errors.Is(err, db.ErrKeyExists) {
+		t.Errorf("Unexpected error building a plain key: got %v, want %v", err, db.ErrKeyExists)
+	}
+	if err := d.Build("default", "plain", cmds, true); err != nil {
+		t.Fatalf("Could not replace the plain key: %v", err)
+	}
+	if typ, err := d.Type("default", "plain"); err != nil || typ != db.TypeList {
+		t.Errorf("Unexpected type of the replaced key: got %q, %v", typ, err)
+	}
+
+	// A command that fails writes nothing.
+	if err := d.Build("default", "broken", []db.Cmd{db.NewCmd("sadd", "a"), db.NewCmd("rpush", "b")}, false); !errors.Is(err, db.ErrWrongType) {
+		t.Errorf("Unexpected error of a failed command: got %v, want %v", err, db.ErrWrongType)
+	}
+	if typ, err := d.Type("default", "broken"); err != nil || typ != "" {
+		t.Errorf("Unexpected type after a failed build: got %q, %v", typ, err)
+	}
+	if err := d.Build("default", "read", []db.Cmd{db.NewCmd("llen")}, false); !errors.Is(err, db.ErrSyntax) {
+		t.Errorf("Unexpected error of a read command: got %v, want %v", err, db.ErrSyntax)
+	}
+}
+
+func TestTypedChanges(t *testing.T) {
+	dir := t.TempDir()
+	backupPath := filepath.Join(dir, "backup.db")
+
+	d, closeFunc, err := db.NewDatabase(filepath.Join(dir, "shard.db"))
+	if err != nil {
+		t.Fatalf("Could not create a new database: %v", err)
+	}
+	defer closeFunc()
+
+	do(t, d, "queue", "rpush", "a", "b")
+	do(t, d, "same", "sadd", "x")
+	do(t, d, "gone", "hset", "f", "v")
+
+	f, err := os.Create(backupPath)
+	if err != nil {
+		t.Fatalf("Could not create the backup file: %v", err)
+	}
+	if _, err := d.Backup(f); err != nil {
+		t.Fatalf("Could not back up the database: %v", err)
+	}
+	f.Close()
+
+	digest, err := db.FileDigest(backupPath)
+	if err != nil {
+		t.Fatalf("Could not compute the backup digest: %v", err)
+	}
+
+	do(t, d, "queue", "lpop")
+	do(t, d, "queue", "rpush", "c")
+	do(t, d, "gone", "hdel", "f")
+	do(t, d, "scores", "zadd", "1.5", "bob")
+
+	var buf bytes.Buffer
+	_, n, err := d.Changes(&buf, digest)
+	if err != nil {
+		t.Fatalf("Could not collect the changes: %v", err)
+	}
+	if !strings.Contains(buf.String(), `"op":"typed"`) {
+		t.Errorf("Expected typed changes, got:\n%s", buf.String())
+	}
+
+	applied, err := db.ApplyChanges(backupPath, &buf)
+	if err != nil || applied != n {
+		t.Fatalf("Could not apply the changes: %d applied, %v", applied, err)
+	}
+
+	restored, err := db.FileDigest(backupPath)
+	if err != nil {
+		t.Fatalf("Could not compute the backup digest: %v", err)
+	}
+	buf.Reset()
+	if _, n, err := d.Changes(&buf, restored); err != nil || n != 0 {
+		t.Errorf("Expected no changes after applying them, got %d (%v):\n%s", n, err, buf.String())
+	}
+}
+
+func TestWalkEntries(t *testing.T) {
+	d, closeFunc, err := db.NewDatabase(filepath.Join(t.TempDir(), "shard.db"))
+	if err != nil {
+		t.Fatalf("Could not create a new database: %v", err)
+	}
+	defer closeFunc()
+
+	if err := d.SetKey("a", "default", []byte("1")); err != nil {
+		t.Fatalf("Could not set a: %v", err)
+	}
+	do(t, d, "b", "hset", "f", "v")
+	do(t, d, "c", "rpush", "x", "y")
+
+	// Expired keys are skipped, the others keep their meta.
+	for key, ttl := range map[string]time.Duration{"d": time.Hour, "e": time.Millisecond} {
+		err := d.ModifyItem("default", key, func(*db.Item) (*db.Item, error) {
+			return &db.Item{Value: []byte("2"), Expires: time.Now().Add(ttl), Flags: 3}, nil
+		})
+		if err != nil {
+			t.Fatalf("Could not set %s: %v", key, err)
+		}
+	}
+	time.Sleep(5 * time.Millisecond)
+
+	var got []string
+	err = db.WalkEntries(d, "default", func(e db.Entry) error {
+		var cmds []string
+		for _, cmd := range e.Commands {
+			cmds = append(cmds, cmd.Name+" "+joined(cmd.Args))
+		}
+		if !e.Expires.IsZero() {
+			cmds = append(cmds, fmt.Sprintf(" expires flags %d", e.Flags))
+		}
+		got = append(got, e.Key+"="+string(e.Value)+strings.Join(cmds, ";"))
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Could not walk the entries: %v", err)
+	}
+
+	want := []string{"a=1", "b=hset f,v", "c=rpush x;rpush y", "d=2 expires flags 3"}
+	if strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("Unexpected entries: got %q, want %q", got, want)
+	}
+}
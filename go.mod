@@ -5,5 +5,16 @@ go 1.22
 require (
 	github.com/BurntSushi/toml v1.5.0
 	github.com/boltdb/bolt v1.3.1
+	github.com/cespare/xxhash/v2 v2.3.0
+	github.com/spaolacci/murmur3 v1.1.0
+	google.golang.org/grpc v1.67.1
+	google.golang.org/protobuf v1.35.1
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require (
+	golang.org/x/net v0.28.0 // indirect
 	golang.org/x/sys v0.30.0 // indirect
+	golang.org/x/text v0.17.0 // indirect
+	google.golang.org/genproto/googleapis/rpc v0.0.0-20240814211410-ddb44dafa142 // indirect
 )
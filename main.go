@@ -1,62 +1,432 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"go-kvdb/backup"
 	"go-kvdb/config"
+	"go-kvdb/coordinator"
 	"go-kvdb/db"
+	"go-kvdb/db/lsm"
+	"go-kvdb/memcache"
+	"go-kvdb/resp"
+	"go-kvdb/rpc"
 	"go-kvdb/web"
+	"go-kvdb/webhook"
 	"log"
+	"net"
 	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"google.golang.org/grpc"
 )
 
 var (
-	dbLocation = flag.String("db-location", "", "The path to the bolt db database")
-	httpAddr   = flag.String("http-addr", "127.0.0.1:8080", "HTTP host and port")
-	configFile = flag.String("config-file", "sharding.toml", "Config file for static sharding")
-	shard      = flag.String("shard", "", "The name of the shard for data")
+	dbLocation      = flag.String("db-location", "", "The path to the bolt db database")
+	httpAddr        = flag.String("http-addr", "127.0.0.1:8080", "HTTP host and port")
+	configFile      = flag.String("config-file", "sharding.toml", "Config file for static sharding; the coordinator saves the accepted topology updates to it")
+	configFormat    = flag.String("config-format", "", "Format of the config file: toml, json or yaml (detected by the extension by default)")
+	shard           = flag.String("shard", "", "The name of the shard for data")
+	mode            = flag.String("mode", "node", "Run as a data \"node\" or as the topology \"coordinator\"")
+	storageEngine   = flag.String("storage-engine", "bolt", "Storage engine: \"bolt\", \"lsm\" for write-heavy shards (db-location is a directory) or \"memory\" (nothing is persisted)")
+	groupCommit     = flag.Bool("group-commit", false, "Coalesce concurrent bolt writes into shared transactions")
+	maxBatchSize    = flag.Int("max-batch-size", 0, "Number of writes that triggers a group commit (128 if zero)")
+	maxBatchDelay   = flag.Duration("max-batch-delay", 0, "How long a write waits for others to join its group commit (1ms if zero)")
+	changeLog       = flag.Bool("change-log", false, "Record every mutation in the change log used for point-in-time recovery, /watch and webhooks")
+	changeLogKeep   = flag.Duration("change-log-retention", 0, "How long change log records are kept (forever if zero)")
+	coordinatorAddr = flag.String("coordinator", "", "Host and port of the coordinator to fetch the topology from instead of the config file; the node settings then come from the KVDB_* environment variables")
+	respAddr        = flag.String("resp-addr", "", "Host and port of the Redis protocol (RESP) listener, disabled if empty")
+	grpcAddr        = flag.String("grpc-addr", "", "Host and port of the gRPC listener, disabled if empty; the other shards are reached at their grpc_address")
+	memcacheAddr    = flag.String("memcache-addr", "", "Host and port of the memcached text protocol listener serving the default bucket, disabled if empty")
 )
 
 func parseFlags() {
 	flag.Parse()
 
-	if *dbLocation == "" {
-		log.Fatalf("Must provide db-location")
+	switch *mode {
+	case "node":
+	case "coordinator":
+		return
+	default:
+		log.Fatalf("Unknown mode %q", *mode)
 	}
 
 	if *shard == "" {
 		log.Fatalf("Must provide shard")
 	}
+
+	if *changeLog && *storageEngine != "bolt" {
+		log.Fatalf("The change log requires the bolt storage engine")
+	}
 }
 
-func main() {
-	parseFlags()
+// serve runs the HTTP server with the node settings from the config.
+func serve(handler http.Handler, n config.NodeConfig) error {
+	srv := &http.Server{
+		Addr:         *httpAddr,
+		Handler:      handler,
+		ReadTimeout:  time.Duration(n.ReadTimeout),
+		WriteTimeout: time.Duration(n.WriteTimeout),
+		IdleTimeout:  time.Duration(n.IdleTimeout),
+	}
+
+	if n.TLS.Enabled() {
+		return srv.ListenAndServeTLS(n.TLS.CertFile, n.TLS.KeyFile)
+	}
+	return srv.ListenAndServe()
+}
 
-	c, err := config.ParseFile(*configFile)
+func runCoordinator() {
+	c, err := config.ParseFileFormat(*configFile, *configFormat)
 	if err != nil {
 		log.Fatalf("Error parsing config %q: %v", *configFile, err)
 	}
 
-	shards, err := config.ParseShards(c.Shards, *shard)
+	coord, err := coordinator.New(c)
 	if err != nil {
-		log.Fatalf("Error parsing shards config: %v", err)
+		log.Fatalf("Error creating coordinator: %v", err)
+	}
+	format := *configFormat
+	if format == "" {
+		format = config.FormatOf(*configFile)
 	}
+	coord.SetFile(*configFile, format)
+	if token := os.Getenv("KVDB_TOPOLOGY_TOKEN"); token != "" {
+		coord.SetToken(token)
+	} else {
+		log.Printf("KVDB_TOPOLOGY_TOKEN is not set, topology updates are disabled")
+	}
+
+	log.Printf("Coordinating %d shards, epoch: %d", len(c.Shards), c.Epoch)
+
+	client, err := config.NewClient(c.Node.TLS)
+	if err != nil {
+		log.Fatalf("Error loading the TLS settings: %v", err)
+	}
+	coord.SetClient(client)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/topology", coord.TopologyHandler)
+	mux.HandleFunc("/topology/split", coord.SplitHandler)
+	mux.HandleFunc("/topology/merge", coord.MergeHandler)
 
-	log.Printf("Shard count is %d, current shard: %d", shards.Count, shards.CurIdx)
+	// Long-poll watches are held open longer than the default write timeout.
+	c.Node.WriteTimeout = 0
+	log.Fatal(serve(mux, c.Node))
+}
+
+// completeConfig gives a config fetched from the coordinator the node
+// defaults and environment overrides a config file gets, and validates it.
+func completeConfig(c config.Config) (config.Config, error) {
+	if err := c.Complete(); err != nil {
+		return c, err
+	}
+	return c, c.Validate()
+}
 
-	db, close, err := db.NewDatabase(*dbLocation)
+// coordinatorClient returns the client for the coordinator. The node has
+// no config yet, so its TLS settings come from the environment.
+func coordinatorClient() *config.Client {
+	var c config.Config
+	if err := c.Complete(); err != nil {
+		log.Fatalf("Error reading the node settings: %v", err)
+	}
+	client, err := config.NewClient(c.Node.TLS)
 	if err != nil {
-		log.Fatalf("Error creating %q: %v", *dbLocation, err)
+		log.Fatalf("Error loading the TLS settings: %v", err)
+	}
+	return client
+}
+
+func loadConfig() config.Config {
+	if *coordinatorAddr != "" {
+		c, err := coordinator.Fetch(context.Background(), coordinatorClient(), *coordinatorAddr, -1)
+		if err != nil {
+			log.Fatalf("Error fetching topology from coordinator %q: %v", *coordinatorAddr, err)
+		}
+		c, err = completeConfig(c)
+		if err != nil {
+			log.Fatalf("Invalid topology from coordinator %q:\n%v", *coordinatorAddr, err)
+		}
+		return c
+	}
+
+	c, err := config.ParseFileFormat(*configFile, *configFormat)
+	if err != nil {
+		log.Fatalf("Error parsing config %q: %v", *configFile, err)
+	}
+	if err := c.Validate(); err != nil {
+		log.Fatalf("Invalid config %q:\n%v", *configFile, err)
+	}
+	return c
+}
+
+// truncateChangeLog periodically removes the change log records
+// older than the retention period.
+func truncateChangeLog(d *db.Database, keep time.Duration) {
+	for range time.Tick(min(keep, time.Hour)) {
+		n, err := d.TruncateChangeLog(time.Now().Add(-keep))
+		if err != nil {
+			log.Printf("Error truncating change log: %v", err)
+		} else if n > 0 {
+			log.Printf("Removed %d change log records older than %s", n, keep)
+		}
+	}
+}
+
+// pruneVersions periodically removes the versions of the deleted keys
+// that no open session needs any more.
+func pruneVersions(d *db.Database) {
+	for range time.Tick(time.Minute) {
+		if _, err := d.PruneVersions(); err != nil {
+			log.Printf("Error pruning key versions: %v", err)
+		}
+	}
+}
+
+// deleteExpired periodically deletes the keys whose time to live has passed.
+func deleteExpired(e db.Expirer) {
+	for range time.Tick(time.Second) {
+		if _, err := e.DeleteExpired(time.Now()); err != nil {
+			log.Printf("Error deleting expired keys: %v", err)
+		}
+	}
+}
+
+// txnRecoveryAge is how long a prepared transaction is left to its
+// coordinator before the recovery asks for its outcome.
+const txnRecoveryAge = 10 * time.Second
+
+// resolveTxns finishes the transactions left in doubt by a crash, first
+// at startup and then periodically.
+func resolveTxns(srv *web.Server) {
+	for {
+		if err := srv.ResolveTxns(txnRecoveryAge); err != nil {
+			log.Printf("Error resolving transactions: %v", err)
+		}
+		time.Sleep(txnRecoveryAge)
+	}
+}
+
+// openStore opens the storage engine selected with the flags.
+func openStore(n config.NodeConfig) (db.Store, func() error) {
+	if *storageEngine == "memory" {
+		return db.NewMemStore(), func() error { return nil }
 	}
+
+	if *dbLocation == "" {
+		if n.DataDir == "" {
+			log.Fatalf("Must provide db-location or node.data_dir")
+		}
+		*dbLocation = filepath.Join(n.DataDir, *shard+".db")
+	}
+
+	switch *storageEngine {
+	case "bolt":
+		store, close, err := db.OpenDatabase(*dbLocation, db.Options{
+			GroupCommit:   *groupCommit,
+			MaxBatchSize:  *maxBatchSize,
+			MaxBatchDelay: *maxBatchDelay,
+			ChangeLog:     *changeLog,
+		})
+		if err != nil {
+			log.Fatalf("Error creating %q: %v", *dbLocation, err)
+		}
+		if *changeLog && *changeLogKeep > 0 {
+			go truncateChangeLog(store, *changeLogKeep)
+		}
+		go pruneVersions(store)
+		return store, close
+	case "lsm":
+		store, close, err := lsm.Open(*dbLocation, lsm.Options{})
+		if err != nil {
+			log.Fatalf("Error opening %q: %v", *dbLocation, err)
+		}
+		return store, close
+	default:
+		log.Fatalf("Unknown storage engine %q", *storageEngine)
+		return nil, nil
+	}
+}
+
+// startScheduledBackups runs the backup scheduler of the shard in the background.
+func startScheduledBackups(store db.Store, srv *web.Server, b config.Backup) {
+	bs, ok := store.(db.IncrementalBackuper)
+	if !ok {
+		log.Fatalf("Storage engine %q does not support scheduled backups", *storageEngine)
+	}
+
+	target, err := backup.NewTarget(b)
+	if err != nil {
+		log.Fatalf("Error creating backup target: %v", err)
+	}
+
+	log.Printf("Backing up shard %q every %s", *shard, time.Duration(b.Interval))
+	s := backup.NewScheduler(bs, target, *shard, func() int64 { return srv.Shards().Epoch }, b)
+	go s.Run(context.Background())
+}
+
+// startWebhooks delivers the changes of the shard to the registered webhooks.
+func startWebhooks(store db.Store, srv *web.Server) {
+	m, err := webhook.NewManager(store, srv.Shards().CurIdx, srv.Owns)
+	if err != nil {
+		log.Fatalf("Error starting webhooks: %v", err)
+	}
+	srv.SetWebhooks(m)
+	go m.Run(context.Background())
+}
+
+func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "config":
+			os.Exit(runConfigCommand(os.Args[2:], os.Stdout, os.Stderr))
+		case "backup":
+			os.Exit(runBackupCommand(os.Args[2:], os.Stdout, os.Stderr))
+		case "export":
+			os.Exit(runExportCommand(os.Args[2:], os.Stdout, os.Stderr))
+		case "import":
+			os.Exit(runImportCommand(os.Args[2:], os.Stdout, os.Stderr))
+		}
+	}
+
+	parseFlags()
+
+	if *mode == "coordinator" {
+		runCoordinator()
+		return
+	}
+
+	c := loadConfig()
+
+	shards, err := config.NewShards(c, *shard)
+	if err != nil {
+		log.Fatalf("Error parsing shards config: %v", err)
+	}
+
+	log.Printf("Shard count is %d, current shard: %d, epoch: %d", shards.Count, shards.CurIdx, shards.Epoch)
+
+	store, close := openStore(c.Node)
 	defer close()
 
-	srv := web.NewServer(db, shards)
+	client, err := config.NewClient(c.Node.TLS)
+	if err != nil {
+		log.Fatalf("Error loading the TLS settings: %v", err)
+	}
+
+	srv := web.NewServer(store, shards)
+	srv.SetLimits(c.Node.Limits)
+	srv.SetClient(client)
+
+	if c.Node.Backup.Enabled() {
+		startScheduledBackups(store, srv, c.Node.Backup)
+	}
+	if *changeLog {
+		startWebhooks(store, srv)
+	}
+	if e, ok := store.(db.Expirer); ok {
+		go deleteExpired(e)
+	}
+	if _, ok := store.(db.TxnStore); ok {
+		go resolveTxns(srv)
+	}
+	if *respAddr != "" {
+		log.Printf("Serving RESP on %s", *respAddr)
+		rs := resp.NewServer(store, srv)
+		rs.SetLimits(c.Node.Limits)
+		go func() {
+			log.Fatal(rs.ListenAndServe(*respAddr))
+		}()
+	}
+	if *grpcAddr != "" {
+		l, err := net.Listen("tcp", *grpcAddr)
+		if err != nil {
+			log.Fatalf("Error listening on %s: %v", *grpcAddr, err)
+		}
+		serverCreds, clientCreds, err := rpc.Credentials(c.Node.TLS)
+		if err != nil {
+			log.Fatalf("Error loading the gRPC credentials: %v", err)
+		}
+		rs := rpc.NewServer(store, srv)
+		rs.SetLimits(c.Node.Limits)
+		rs.SetCredentials(clientCreds)
+		defer rs.Close()
+
+		gs := grpc.NewServer(grpc.Creds(serverCreds))
+		rpc.RegisterKVServer(gs, rs)
+		log.Printf("Serving gRPC on %s", *grpcAddr)
+		go func() {
+			log.Fatal(gs.Serve(l))
+		}()
+	}
+	if *memcacheAddr != "" {
+		items, ok := store.(db.ItemStore)
+		if !ok {
+			log.Fatalf("The %s storage engine does not support the memcached protocol", *storageEngine)
+		}
+		ms := memcache.NewServer(items, srv)
+		ms.SetLimits(c.Node.Limits)
+		log.Printf("Serving memcached on %s", *memcacheAddr)
+		go func() {
+			log.Fatal(ms.ListenAndServe(*memcacheAddr))
+		}()
+	}
+
+	if *coordinatorAddr != "" {
+		go coordinator.Watch(context.Background(), client, *coordinatorAddr, c.Epoch, func(c config.Config) {
+			c, err := completeConfig(c)
+			if err != nil {
+				log.Printf("Ignoring topology epoch %d: %v", c.Epoch, err)
+				return
+			}
+			shards, err := config.NewShards(c, *shard)
+			if err != nil {
+				log.Printf("Ignoring topology epoch %d: %v", c.Epoch, err)
+				return
+			}
+
+			log.Printf("Topology changed: shard count is %d, current shard: %d, epoch: %d", shards.Count, shards.CurIdx, shards.Epoch)
+			srv.SetShards(shards)
+		})
+	}
 
 	http.HandleFunc("/get", srv.GetHandler)
 	http.HandleFunc("/set", srv.SetHandler)
+	http.HandleFunc("/mget", srv.MGetHandler)
+	http.HandleFunc("/mset", srv.MSetHandler)
+	http.HandleFunc("/delete", srv.DeleteHandler)
+	http.HandleFunc("/txn", srv.TxnHandler)
+	http.HandleFunc("/txn/prepare", srv.TxnPrepareHandler)
+	http.HandleFunc("/txn/commit", srv.TxnCommitHandler)
+	http.HandleFunc("/txn/abort", srv.TxnAbortHandler)
+	http.HandleFunc("/txn/status", srv.TxnStatusHandler)
+	http.HandleFunc("/session/begin", srv.SessionBeginHandler)
+	http.HandleFunc("/session/get", srv.SessionGetHandler)
+	http.HandleFunc("/session/set", srv.SessionSetHandler)
+	http.HandleFunc("/session/delete", srv.SessionDeleteHandler)
+	http.HandleFunc("/session/commit", srv.SessionCommitHandler)
+	http.HandleFunc("/session/rollback", srv.SessionRollbackHandler)
+	http.HandleFunc("/incr", srv.IncrHandler)
+	http.HandleFunc("/type", srv.TypeHandler)
+	http.HandleFunc("/cmd", srv.CmdHandler)
+	http.HandleFunc("/resp", srv.RESPHandler)
+	http.HandleFunc("/memcache", srv.MemcacheHandler)
+	http.HandleFunc("DELETE /v1/kv/{bucket}/{key...}", srv.DeleteKeyHandler)
 	http.HandleFunc("/purge", srv.DeleteExtraKeysHandler)
 	http.HandleFunc("/createBucket", srv.CreateBucket)
 	http.HandleFunc("/deleteBucket", srv.DeleteBucketHandler)
 	http.HandleFunc("/listKeys", srv.ListKeysHandler)
+	http.HandleFunc("/scan", srv.ScanHandler)
+	http.HandleFunc("/migrate", srv.MigrateHandler)
+	http.HandleFunc("/watch", srv.WatchHandler)
+	http.HandleFunc("/webhooks", srv.WebhooksHandler)
+	http.HandleFunc("/webhooks/delete", srv.DeleteWebhookHandler)
+	http.HandleFunc("/webhooks/deadletters", srv.DeadLettersHandler)
+	http.HandleFunc("/admin/backup", srv.BackupHandler)
+	http.HandleFunc("/admin/export", srv.ExportHandler)
+	http.HandleFunc("/admin/import", srv.ImportHandler)
 
-	log.Fatal(http.ListenAndServe(*httpAddr, nil))
+	log.Fatal(serve(http.DefaultServeMux, c.Node))
 }
@@ -0,0 +1,203 @@
+package memcache
+
+import (
+	"bytes"
+	"errors"
+	"go-kvdb/config"
+	"go-kvdb/db"
+	"strconv"
+	"time"
+)
+
+// Bucket is the bucket served over the memcached protocol.
+const Bucket = "default"
+
+// Version is returned by the version command.
+const Version = "1.6.0-go-kvdb"
+
+// maxRelativeExptime is the largest exptime taken as a number of seconds
+// from now. Larger ones are unix times, like in memcached.
+const maxRelativeExptime = 30 * 24 * 60 * 60
+
+// Outcomes of the commands that leave the item as it was.
+var (
+	errNotStored = errors.New("NOT_STORED")
+	errExists    = errors.New("EXISTS")
+	errNotFound  = errors.New("NOT_FOUND")
+	errNotNumber = errors.New("CLIENT_ERROR cannot increment or decrement non-numeric value")
+)
+
+// Local runs the commands on the current shard without routing them.
+type Local struct {
+	Store db.ItemStore
+	// Limits restricts the size of the keys and values stored by set,
+	// add, replace and cas below the limits of the protocol.
+	Limits config.Limits
+}
+
+// Cas returns the unique value of the item, its version, which changes
+// with every write: a cas fails if the item was changed, even if it was
+// changed back since the gets.
+func Cas(item *db.Item) uint64 {
+	// Zero means no cas in the responses, it is left for keys never
+	// written since the versions were introduced.
+	return max(item.Version, 1)
+}
+
+// expires returns the expiry time for the exptime of a request. Negative
+// exptimes expire the item immediately.
+func expires(exptime int64, now time.Time) time.Time {
+	switch {
+	case exptime == 0:
+		return time.Time{}
+	case exptime < 0:
+		return now
+	case exptime > maxRelativeExptime:
+		return time.Unix(exptime, 0)
+	default:
+		return now.Add(time.Duration(exptime) * time.Second)
+	}
+}
+
+// live returns nil for an item that expires at or before now, which is
+// deleted instead of being stored.
+func live(item *db.Item, now time.Time) *db.Item {
+	if !item.Expires.IsZero() && !now.Before(item.Expires) {
+		return nil
+	}
+	return item
+}
+
+func errorResponse(err error) Response {
+	switch {
+	case errors.Is(err, errNotStored), errors.Is(err, errExists), errors.Is(err, errNotFound), errors.Is(err, errNotNumber):
+		return Response{Status: err.Error()}
+	case errors.Is(err, db.ErrWrongType):
+		return Response{Status: "CLIENT_ERROR key holds a typed value"}
+	case errors.Is(err, db.ErrLocked):
+		return Response{Status: "SERVER_ERROR temporary failure: " + err.Error()}
+	default:
+		return Response{Status: "SERVER_ERROR " + err.Error()}
+	}
+}
+
+// Exec runs the request on the bucket.
+func (l Local) Exec(req *Request) Response {
+	switch req.Name {
+	case "get", "gets":
+		res := Response{Status: "END"}
+		for _, key := range req.Keys {
+			item, err := l.Store.GetItem(Bucket, key)
+			if err != nil {
+				return errorResponse(err)
+			}
+			if item == nil {
+				continue
+			}
+			h := Hit{Key: key, Flags: item.Flags, Value: item.Value}
+			if req.Name == "gets" {
+				h.Cas = Cas(item)
+			}
+			res.Hits = append(res.Hits, h)
+		}
+		return res
+
+	case "set", "add", "replace", "cas":
+		return l.store(req)
+
+	case "delete":
+		return l.modify(req, "DELETED", func(item *db.Item, now time.Time) (*db.Item, error) {
+			if item == nil {
+				return nil, errNotFound
+			}
+			return nil, nil
+		})
+
+	case "touch":
+		return l.modify(req, "TOUCHED", func(item *db.Item, now time.Time) (*db.Item, error) {
+			if item == nil {
+				return nil, errNotFound
+			}
+			touched := *item
+			touched.Expires = expires(req.Exptime, now)
+			return live(&touched, now), nil
+		})
+
+	case "incr", "decr":
+		var n uint64
+		res := l.modify(req, "", func(item *db.Item, now time.Time) (*db.Item, error) {
+			if item == nil {
+				return nil, errNotFound
+			}
+			old, err := strconv.ParseUint(string(bytes.TrimRight(item.Value, " ")), 10, 64)
+			if err != nil {
+				return nil, errNotNumber
+			}
+			// incr wraps around at 64 bits and decr stops at zero.
+			switch {
+			case req.Name == "incr":
+				n = old + req.Delta
+			case req.Delta < old:
+				n = old - req.Delta
+			default:
+				n = 0
+			}
+			updated := *item
+			updated.Value = strconv.AppendUint(nil, n, 10)
+			return &updated, nil
+		})
+		if res.Status == "" {
+			res.Status = strconv.FormatUint(n, 10)
+		}
+		return res
+
+	case "version":
+		return Response{Status: "VERSION " + Version}
+
+	default:
+		return Response{Status: "ERROR"}
+	}
+}
+
+// store handles set, add, replace and cas.
+func (l Local) store(req *Request) Response {
+	if l.Limits.MaxKeySize > 0 && len(req.Keys[0]) > min(l.Limits.MaxKeySize, MaxKeyLen) {
+		return Response{Status: "CLIENT_ERROR key too long"}
+	}
+	if l.Limits.MaxValueSize > 0 && len(req.Value) > min(l.Limits.MaxValueSize, MaxValueLen) {
+		return Response{Status: "SERVER_ERROR " + ErrTooLarge.Error()}
+	}
+	return l.modify(req, "STORED", func(item *db.Item, now time.Time) (*db.Item, error) {
+		switch req.Name {
+		case "add":
+			if item != nil {
+				return nil, errNotStored
+			}
+		case "replace":
+			if item == nil {
+				return nil, errNotStored
+			}
+		case "cas":
+			if item == nil {
+				return nil, errNotFound
+			}
+			if Cas(item) != req.Cas {
+				return nil, errExists
+			}
+		}
+		return live(&db.Item{Value: req.Value, Expires: expires(req.Exptime, now), Flags: req.Flags}, now), nil
+	})
+}
+
+// modify replaces the item of the key with the result of fn and returns
+// the status, or the outcome of fn if it fails.
+func (l Local) modify(req *Request, status string, fn func(item *db.Item, now time.Time) (*db.Item, error)) Response {
+	now := time.Now()
+	err := l.Store.ModifyItem(Bucket, req.Keys[0], func(item *db.Item) (*db.Item, error) {
+		return fn(item, now)
+	})
+	if err != nil {
+		return errorResponse(err)
+	}
+	return Response{Status: status}
+}
@@ -0,0 +1,286 @@
+// Package memcache serves the default bucket over the memcached text
+// protocol, so that the memcached client libraries work against go-kvdb.
+package memcache
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// Limits of the requests, like the defaults of memcached.
+const (
+	MaxKeyLen   = 250
+	MaxValueLen = 1 << 20
+	maxLineLen  = 2048
+)
+
+var (
+	// ErrUnknownCommand is returned for the commands that are not served.
+	ErrUnknownCommand = errors.New("unknown command")
+	// ErrTooLarge is returned for the values above MaxValueLen, which are
+	// read and dropped.
+	ErrTooLarge = errors.New("object too large for cache")
+	// ErrBadChunk is returned for a value not followed by CRLF, after
+	// which the stream cannot be read any further.
+	ErrBadChunk = errors.New("bad data chunk")
+
+	// errLineTooLong leaves the rest of the line unread.
+	errLineTooLong = ClientError("line too long")
+)
+
+// ClientError is returned for a malformed request.
+type ClientError string
+
+func (e ClientError) Error() string {
+	return string(e)
+}
+
+// Request is a memcached command.
+type Request struct {
+	// Name is the command in lowercase.
+	Name string
+	// Keys holds the keys of get and gets and the key of the others.
+	Keys    []string
+	Flags   uint32
+	Exptime int64
+	// Cas is the unique value of cas.
+	Cas uint64
+	// Delta is the amount of incr and decr.
+	Delta   uint64
+	Noreply bool
+	// Value is the data block of the storage commands.
+	Value []byte
+}
+
+// Number of the arguments of the commands after their key, not counting
+// noreply, and whether they are followed by a data block.
+var commands = map[string]struct {
+	args    int
+	storage bool
+}{
+	"get":     {-1, false},
+	"gets":    {-1, false},
+	"set":     {3, true},
+	"add":     {3, true},
+	"replace": {3, true},
+	"cas":     {4, true},
+	"delete":  {0, false},
+	"incr":    {1, false},
+	"decr":    {1, false},
+	"touch":   {1, false},
+	"version": {-1, false},
+	"quit":    {-1, false},
+}
+
+func readLine(r *bufio.Reader) ([]byte, error) {
+	line, err := r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull || len(line) > maxLineLen {
+		return nil, errLineTooLong
+	}
+	if err != nil {
+		return nil, err
+	}
+	return bytes.TrimRight(line, "\r\n"), nil
+}
+
+// ReadRequest reads a command and its data block. Requests with a
+// ClientError or ErrTooLarge are read completely, so that the next one
+// can be read.
+func ReadRequest(r *bufio.Reader) (*Request, error) {
+	var fields [][]byte
+	for len(fields) == 0 {
+		line, err := readLine(r)
+		if err != nil {
+			return nil, err
+		}
+		fields = bytes.Fields(line)
+	}
+
+	req := &Request{Name: string(fields[0])}
+	cmd, ok := commands[req.Name]
+	if !ok {
+		return nil, ErrUnknownCommand
+	}
+	args := fields[1:]
+
+	switch {
+	case req.Name == "version" || req.Name == "quit":
+		return req, nil
+	case cmd.args < 0:
+		if len(args) == 0 {
+			return nil, ErrUnknownCommand
+		}
+		for _, k := range args {
+			req.Keys = append(req.Keys, string(k))
+		}
+		return req, checkKeys(req.Keys)
+	}
+
+	if len(args) == cmd.args+2 && string(args[len(args)-1]) == "noreply" {
+		req.Noreply = true
+		args = args[:len(args)-1]
+	}
+	if len(args) != cmd.args+1 {
+		return nil, ErrUnknownCommand
+	}
+	req.Keys = []string{string(args[0])}
+
+	var err error
+	switch req.Name {
+	case "incr", "decr":
+		if req.Delta, err = strconv.ParseUint(string(args[1]), 10, 64); err != nil {
+			return nil, ClientError("invalid numeric delta argument")
+		}
+	case "touch":
+		if req.Exptime, err = strconv.ParseInt(string(args[1]), 10, 64); err != nil {
+			return nil, ClientError("bad command line format")
+		}
+	}
+	if !cmd.storage {
+		return req, checkKeys(req.Keys)
+	}
+
+	flags, err1 := strconv.ParseUint(string(args[1]), 10, 32)
+	exptime, err2 := strconv.ParseInt(string(args[2]), 10, 64)
+	n, err3 := strconv.Atoi(string(args[3]))
+	if err1 != nil || err2 != nil || err3 != nil || n < 0 {
+		return nil, ClientError("bad command line format")
+	}
+	req.Flags, req.Exptime = uint32(flags), exptime
+	if req.Name == "cas" {
+		if req.Cas, err = strconv.ParseUint(string(args[4]), 10, 64); err != nil {
+			return nil, ClientError("bad command line format")
+		}
+	}
+
+	if n > MaxValueLen {
+		if _, err := io.CopyN(io.Discard, r, int64(n)+2); err != nil {
+			return nil, err
+		}
+		return nil, ErrTooLarge
+	}
+	req.Value = make([]byte, n+2)
+	if _, err := io.ReadFull(r, req.Value); err != nil {
+		return nil, err
+	}
+	if !bytes.HasSuffix(req.Value, []byte("\r\n")) {
+		return nil, ErrBadChunk
+	}
+	req.Value = req.Value[:n]
+	return req, checkKeys(req.Keys)
+}
+
+func checkKeys(keys []string) error {
+	for _, k := range keys {
+		if len(k) > MaxKeyLen {
+			return ClientError("key too long")
+		}
+	}
+	return nil
+}
+
+// Write encodes the request.
+func (req *Request) Write(w *bufio.Writer) error {
+	w.WriteString(req.Name)
+	for _, k := range req.Keys {
+		w.WriteString(" " + k)
+	}
+
+	switch req.Name {
+	case "set", "add", "replace", "cas":
+		fmt.Fprintf(w, " %d %d %d", req.Flags, req.Exptime, len(req.Value))
+		if req.Name == "cas" {
+			fmt.Fprintf(w, " %d", req.Cas)
+		}
+	case "incr", "decr":
+		fmt.Fprintf(w, " %d", req.Delta)
+	case "touch":
+		fmt.Fprintf(w, " %d", req.Exptime)
+	}
+	if req.Noreply {
+		w.WriteString(" noreply")
+	}
+	w.WriteString("\r\n")
+
+	if commands[req.Name].storage {
+		w.Write(req.Value)
+		w.WriteString("\r\n")
+	}
+	return w.Flush()
+}
+
+// Hit is a value returned by get and gets.
+type Hit struct {
+	Key   string
+	Flags uint32
+	// Cas is the unique value of the item, only returned by gets.
+	Cas   uint64
+	Value []byte
+}
+
+// Response is the reply to a command: the hits of get and gets,
+// followed by the status line, e.g. END, STORED or the result of incr.
+type Response struct {
+	Hits   []Hit
+	Status string
+}
+
+// Write encodes the response.
+func (res Response) Write(w *bufio.Writer) error {
+	for _, h := range res.Hits {
+		fmt.Fprintf(w, "VALUE %s %d %d", h.Key, h.Flags, len(h.Value))
+		if h.Cas != 0 {
+			fmt.Fprintf(w, " %d", h.Cas)
+		}
+		w.WriteString("\r\n")
+		w.Write(h.Value)
+		w.WriteString("\r\n")
+	}
+	w.WriteString(res.Status + "\r\n")
+	return w.Flush()
+}
+
+// ReadResponse decodes a response.
+func ReadResponse(r *bufio.Reader) (Response, error) {
+	var res Response
+	for {
+		line, err := readLine(r)
+		if err != nil {
+			return res, err
+		}
+		if !bytes.HasPrefix(line, []byte("VALUE ")) {
+			res.Status = string(line)
+			return res, nil
+		}
+
+		fields := bytes.Fields(line)
+		if len(fields) != 4 && len(fields) != 5 {
+			return res, fmt.Errorf("invalid line %q", line)
+		}
+		h := Hit{Key: string(fields[1])}
+		flags, err1 := strconv.ParseUint(string(fields[2]), 10, 32)
+		n, err2 := strconv.Atoi(string(fields[3]))
+		var err3 error
+		if len(fields) == 5 {
+			h.Cas, err3 = strconv.ParseUint(string(fields[4]), 10, 64)
+		}
+		if err1 != nil || err2 != nil || err3 != nil || n < 0 || n > MaxValueLen {
+			return res, fmt.Errorf("invalid line %q", line)
+		}
+		h.Flags = uint32(flags)
+
+		h.Value = make([]byte, n+2)
+		if _, err := io.ReadFull(r, h.Value); err != nil {
+			return res, err
+		}
+		if !bytes.HasSuffix(h.Value, []byte("\r\n")) {
+			return res, ErrBadChunk
+		}
+		h.Value = h.Value[:n]
+		res.Hits = append(res.Hits, h)
+	}
+}
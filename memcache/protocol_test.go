@@ -0,0 +1,103 @@
+package memcache_test
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"go-kvdb/memcache"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadRequest(t *testing.T) {
+	input := "get a b\r\n" +
+		"set k 5 100 3 noreply\r\nabc\r\n" +
+		"cas k 0 0 2 99\r\nhi\r\n" +
+		"incr n 7\r\n" +
+		"touch k -1\r\n" +
+		"\r\n" +
+		"delete k noreply\r\n"
+	want := []*memcache.Request{
+		{Name: "get", Keys: []string{"a", "b"}},
+		{Name: "set", Keys: []string{"k"}, Flags: 5, Exptime: 100, Noreply: true, Value: []byte("abc")},
+		{Name: "cas", Keys: []string{"k"}, Cas: 99, Value: []byte("hi")},
+		{Name: "incr", Keys: []string{"n"}, Delta: 7},
+		{Name: "touch", Keys: []string{"k"}, Exptime: -1},
+		{Name: "delete", Keys: []string{"k"}, Noreply: true},
+	}
+
+	r := bufio.NewReader(strings.NewReader(input))
+	var buf bytes.Buffer
+	w := bufio.NewWriter(&buf)
+	for _, w2 := range want {
+		req, err := memcache.ReadRequest(r)
+		if err != nil {
+			t.Fatalf("Could not read request %q: %v", w2.Name, err)
+		}
+		if !reflect.DeepEqual(req, w2) {
+			t.Errorf("Unexpected request: got %+v, want %+v", req, w2)
+		}
+		req.Write(w)
+	}
+
+	// The written requests read back as the same.
+	r = bufio.NewReader(&buf)
+	for _, w2 := range want {
+		if req, err := memcache.ReadRequest(r); err != nil || !reflect.DeepEqual(req, w2) {
+			t.Errorf("Unexpected request read back: got %+v, %v, want %+v", req, err, w2)
+		}
+	}
+}
+
+func TestReadRequestErrors(t *testing.T) {
+	cases := []struct {
+		input string
+		want  error
+	}{
+		{"flush_all\r\n", memcache.ErrUnknownCommand},
+		{"get\r\n", memcache.ErrUnknownCommand},
+		{"set k 0 0\r\n", memcache.ErrUnknownCommand},
+		{"set k x 0 1\r\na\r\n", memcache.ClientError("bad command line format")},
+		{"incr k -1\r\n", memcache.ClientError("invalid numeric delta argument")},
+		{"get " + strings.Repeat("k", memcache.MaxKeyLen+1) + "\r\n", memcache.ClientError("key too long")},
+		{"set k 0 0 2\r\nabc\r\n", memcache.ErrBadChunk},
+	}
+	for _, c := range cases {
+		_, err := memcache.ReadRequest(bufio.NewReader(strings.NewReader(c.input)))
+		if !errors.Is(err, c.want) {
+			t.Errorf("Unexpected error for %q: got %v, want %v", c.input, err, c.want)
+		}
+	}
+
+	// Values that are too large are dropped, so that the next request can be read.
+	r := bufio.NewReader(strings.NewReader("set k 0 0 1048577\r\n" + strings.Repeat("a", memcache.MaxValueLen+1) + "\r\nget k\r\n"))
+	if _, err := memcache.ReadRequest(r); !errors.Is(err, memcache.ErrTooLarge) {
+		t.Errorf("Unexpected error for a large value: got %v, want %v", err, memcache.ErrTooLarge)
+	}
+	if req, err := memcache.ReadRequest(r); err != nil || req.Name != "get" {
+		t.Errorf("Could not read the request after a large value: got %+v, %v", req, err)
+	}
+}
+
+func TestReadResponse(t *testing.T) {
+	want := memcache.Response{
+		Hits: []memcache.Hit{
+			{Key: "a", Flags: 1, Value: []byte("x\r\ny")},
+			{Key: "b", Cas: 12, Value: []byte{}},
+		},
+		Status: "END",
+	}
+
+	var buf bytes.Buffer
+	if err := want.Write(bufio.NewWriter(&buf)); err != nil {
+		t.Fatalf("Could not write the response: %v", err)
+	}
+	got, err := memcache.ReadResponse(bufio.NewReader(&buf))
+	if err != nil {
+		t.Fatalf("Could not read the response: %v", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Unexpected response: got %+v, want %+v", got, want)
+	}
+}
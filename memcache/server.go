@@ -0,0 +1,197 @@
+package memcache
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"go-kvdb/config"
+	"go-kvdb/db"
+	"io"
+	"log"
+	"net"
+	"sync"
+)
+
+// Cluster routes the keys to the shards of the cluster.
+type Cluster interface {
+	// Shards returns the current topology.
+	Shards() *config.Shards
+	// Owner returns the shard that owns the key of the bucket.
+	Owner(bucketName, key string) (int, error)
+	// ForwardMemcache runs the request on another shard, which must own
+	// all its keys.
+	ForwardMemcache(shard int, req *Request) (Response, error)
+}
+
+// Server serves the default bucket of the cluster over the memcached text
+// protocol. Each command runs on the shard that owns its key, and get and
+// gets with several keys are split by shard.
+type Server struct {
+	mu      sync.Mutex
+	local   Local
+	cluster Cluster
+}
+
+// NewServer returns a server of the store. Without a cluster all keys
+// are served from the store.
+func NewServer(store db.ItemStore, cluster Cluster) *Server {
+	return &Server{local: Local{Store: store}, cluster: cluster}
+}
+
+// SetLimits restricts the size of keys and values stored by set, add,
+// replace and cas. The limits of the protocol apply if they are smaller.
+func (s *Server) SetLimits(l config.Limits) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.local.Limits = l
+}
+
+// runner returns the runner of the commands on the current shard.
+func (s *Server) runner() Local {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.local
+}
+
+// ListenAndServe listens on the TCP address and serves the connections.
+func (s *Server) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve serves the connections accepted by the listener until it is closed.
+func (s *Server) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go s.serveConn(conn)
+	}
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	defer conn.Close()
+
+	r := bufio.NewReaderSize(conn, maxLineLen)
+	w := bufio.NewWriter(conn)
+
+	for {
+		req, err := ReadRequest(r)
+		var res Response
+		var clientErr ClientError
+		switch {
+		case err == nil:
+		case errors.Is(err, ErrUnknownCommand):
+			res.Status = "ERROR"
+		case errors.As(err, &clientErr), errors.Is(err, ErrBadChunk):
+			res.Status = "CLIENT_ERROR " + err.Error()
+		case errors.Is(err, ErrTooLarge):
+			res.Status = "SERVER_ERROR " + err.Error()
+		default:
+			if err != io.EOF {
+				log.Printf("Error reading memcached command from %s: %v", conn.RemoteAddr(), err)
+			}
+			return
+		}
+
+		if err != nil {
+			if res.Write(w) != nil || errors.Is(err, ErrBadChunk) || errors.Is(err, errLineTooLong) {
+				return
+			}
+			continue
+		}
+		if req.Name == "quit" {
+			return
+		}
+
+		res = s.Exec(req)
+		if req.Noreply {
+			continue
+		}
+		if err := res.Write(w); err != nil {
+			return
+		}
+	}
+}
+
+// Exec runs the request on the shards that own its keys.
+func (s *Server) Exec(req *Request) Response {
+	if s.cluster == nil || len(req.Keys) == 0 {
+		return s.runner().Exec(req)
+	}
+	if len(req.Keys) > 1 {
+		return s.split(req)
+	}
+
+	shard, err := s.cluster.Owner(Bucket, req.Keys[0])
+	if err != nil {
+		return errorResponse(err)
+	}
+	return s.run(shard, req)
+}
+
+// run runs the request on the shard.
+func (s *Server) run(shard int, req *Request) Response {
+	if shard == s.cluster.Shards().CurIdx {
+		return s.runner().Exec(req)
+	}
+
+	res, err := s.cluster.ForwardMemcache(shard, req)
+	if err != nil {
+		return Response{Status: fmt.Sprintf("SERVER_ERROR forwarding to shard %d: %v", shard, err)}
+	}
+	return res
+}
+
+// split runs a get or gets with its keys grouped by shard and returns
+// the hits in the order of the keys.
+func (s *Server) split(req *Request) Response {
+	groups := make(map[int]*Request)
+	var shards []int
+	for _, key := range req.Keys {
+		shard, err := s.cluster.Owner(Bucket, key)
+		if err != nil {
+			return errorResponse(err)
+		}
+		g := groups[shard]
+		if g == nil {
+			g = &Request{Name: req.Name}
+			groups[shard] = g
+			shards = append(shards, shard)
+		}
+		g.Keys = append(g.Keys, key)
+	}
+
+	replies := make([]Response, len(shards))
+	var wg sync.WaitGroup
+	for i, shard := range shards {
+		wg.Add(1)
+		go func(i, shard int) {
+			defer wg.Done()
+			replies[i] = s.run(shard, groups[shard])
+		}(i, shard)
+	}
+	wg.Wait()
+
+	hits := make(map[string]Hit)
+	for _, reply := range replies {
+		if reply.Status != "END" {
+			return reply
+		}
+		for _, h := range reply.Hits {
+			hits[h.Key] = h
+		}
+	}
+
+	res := Response{Status: "END"}
+	for _, key := range req.Keys {
+		if h, ok := hits[key]; ok {
+			res.Hits = append(res.Hits, h)
+		}
+	}
+	return res
+}
@@ -0,0 +1,171 @@
+package memcache_test
+
+import (
+	"bufio"
+	"go-kvdb/config"
+	"go-kvdb/db"
+	"go-kvdb/memcache"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func startServer(t *testing.T, s *memcache.Server) *bufio.ReadWriter {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not listen: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go s.Serve(l)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("Could not connect: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+}
+
+// do sends the raw request and returns the response with its lines
+// joined by spaces.
+func do(t *testing.T, rw *bufio.ReadWriter, request string) string {
+	t.Helper()
+	rw.WriteString(request)
+	if err := rw.Flush(); err != nil {
+		t.Fatalf("Could not send %q: %v", request, err)
+	}
+
+	res, err := memcache.ReadResponse(rw.Reader)
+	if err != nil {
+		t.Fatalf("Could not read the response to %q: %v", request, err)
+	}
+	var parts []string
+	for _, h := range res.Hits {
+		parts = append(parts, h.Key+"="+string(h.Value))
+	}
+	return strings.Join(append(parts, res.Status), " ")
+}
+
+func TestServer(t *testing.T) {
+	d, closeFunc, err := db.NewDatabase(filepath.Join(t.TempDir(), "shard.db"))
+	if err != nil {
+		t.Fatalf("Could not create a new database: %v", err)
+	}
+	defer closeFunc()
+
+	rw := startServer(t, memcache.NewServer(d, nil))
+	cases := []struct {
+		request, want string
+	}{
+		{"set a 3 0 5\r\nhello\r\n", "STORED"},
+		{"add a 0 0 1\r\nx\r\n", "NOT_STORED"},
+		{"replace b 0 0 1\r\nx\r\n", "NOT_STORED"},
+		{"add b 0 0 2\r\n10\r\n", "STORED"},
+		{"get a missing b\r\n", "a=hello b=10 END"},
+		{"incr b 5\r\n", "15"},
+		{"decr b 100\r\n", "0"},
+		{"incr a 1\r\n", "CLIENT_ERROR cannot increment or decrement non-numeric value"},
+		{"incr missing 1\r\n", "NOT_FOUND"},
+		{"set n 0 0 20\r\n18446744073709551615\r\n", "STORED"},
+		{"incr n 2\r\n", "1"},
+		{"cas a 0 0 1 1\r\nx\r\n", "EXISTS"},
+		{"cas missing 0 0 1 1\r\nx\r\n", "NOT_FOUND"},
+		{"touch a 100\r\n", "TOUCHED"},
+		{"touch missing 100\r\n", "NOT_FOUND"},
+		{"delete b\r\n", "DELETED"},
+		{"delete b\r\n", "NOT_FOUND"},
+		{"set c 0 -1 1\r\nx\r\n", "STORED"},
+		{"get c\r\n", "END"},
+		{"set c 0 0 1 noreply\r\nx\r\nget c\r\n", "c=x END"},
+		{"bogus\r\n", "ERROR"},
+		{"set k 0 0 x\r\n", "CLIENT_ERROR bad command line format"},
+		{"version\r\n", "VERSION " + memcache.Version},
+	}
+	for _, c := range cases {
+		if got := do(t, rw, c.request); got != c.want {
+			t.Errorf("Unexpected response to %q: got %q, want %q", c.request, got, c.want)
+		}
+	}
+
+	// cas succeeds with the unique value returned by gets, but only once.
+	rw.WriteString("gets a\r\n")
+	rw.Flush()
+	res, err := memcache.ReadResponse(rw.Reader)
+	if err != nil || len(res.Hits) != 1 || res.Hits[0].Flags != 3 || res.Hits[0].Cas == 0 {
+		t.Fatalf("Unexpected response to gets: got %+v, %v", res, err)
+	}
+	cas := res.Hits[0].Cas
+	if got := do(t, rw, "cas a 4 0 3 "+strconv.FormatUint(cas, 10)+"\r\nbye\r\n"); got != "STORED" {
+		t.Errorf("Unexpected response to cas: got %q, want STORED", got)
+	}
+	if got := do(t, rw, "cas a 4 0 3 "+strconv.FormatUint(cas, 10)+"\r\nbye\r\n"); got != "EXISTS" {
+		t.Errorf("Unexpected response to a stale cas: got %q, want EXISTS", got)
+	}
+	if at, err := d.Expiry("default", "a"); err != nil || !at.IsZero() {
+		t.Errorf("Unexpected expiry time after cas: got %v, %v, want none", at, err)
+	}
+
+	// A cas fails after the item was changed and changed back, or only
+	// touched.
+	for _, change := range [][]string{
+		{"set a 4 0 5\r\nother\r\n", "set a 4 0 3\r\nbye\r\n"},
+		{"touch a 100\r\n"},
+	} {
+		rw.WriteString("gets a\r\n")
+		rw.Flush()
+		res, err := memcache.ReadResponse(rw.Reader)
+		if err != nil || len(res.Hits) != 1 {
+			t.Fatalf("Unexpected response to gets: got %+v, %v", res, err)
+		}
+		for _, request := range change {
+			do(t, rw, request)
+		}
+		if got := do(t, rw, "cas a 4 0 3 "+strconv.FormatUint(res.Hits[0].Cas, 10)+"\r\nbye\r\n"); got != "EXISTS" {
+			t.Errorf("Unexpected response to a cas after %q: got %q, want EXISTS", change, got)
+		}
+	}
+
+	if got := do(t, rw, "touch a 1\r\n"); got != "TOUCHED" {
+		t.Errorf("Unexpected response to touch: got %q, want TOUCHED", got)
+	}
+	if at, _ := d.Expiry("default", "a"); at.Before(time.Now()) || at.After(time.Now().Add(time.Second)) {
+		t.Errorf("Unexpected expiry time after touch: got %v", at)
+	}
+}
+
+func TestLimits(t *testing.T) {
+	d, closeFunc, err := db.NewDatabase(filepath.Join(t.TempDir(), "shard.db"))
+	if err != nil {
+		t.Fatalf("Could not create a new database: %v", err)
+	}
+	defer closeFunc()
+
+	s := memcache.NewServer(d, nil)
+	s.SetLimits(config.Limits{MaxKeySize: 4, MaxValueSize: 4})
+	rw := startServer(t, s)
+	cases := []struct {
+		request, want string
+	}{
+		{"set a 0 0 4\r\n1234\r\n", "STORED"},
+		{"set a 0 0 5\r\n12345\r\n", "SERVER_ERROR object too large for cache"},
+		{"add abcde 0 0 1\r\n1\r\n", "CLIENT_ERROR key too long"},
+		{"cas a 0 0 5 1\r\n12345\r\n", "SERVER_ERROR object too large for cache"},
+		{"get a abcde\r\n", "a=1234 END"},
+	}
+	for _, c := range cases {
+		if got := do(t, rw, c.request); got != c.want {
+			t.Errorf("Unexpected response to %q: got %q, want %q", c.request, got, c.want)
+		}
+	}
+
+	// The limits of the protocol apply if they are smaller.
+	s.SetLimits(config.Limits{MaxKeySize: 1000, MaxValueSize: 8 << 20})
+	key := strings.Repeat("k", memcache.MaxKeyLen+1)
+	if got := do(t, rw, "set "+key+" 0 0 1\r\n1\r\n"); got != "CLIENT_ERROR key too long" {
+		t.Errorf("Unexpected response to a set of a key above the protocol limit: got %q", got)
+	}
+}
@@ -0,0 +1,495 @@
+package resp
+
+import (
+	"encoding/hex"
+	"errors"
+	"go-kvdb/config"
+	"go-kvdb/db"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	errSyntax   = errors.New("syntax error")
+	errNotFound = errors.New("key not found")
+	errNotSet   = errors.New("condition not met")
+)
+
+// Local runs the key commands on the current shard without routing them.
+type Local struct {
+	Store db.Store
+	// Owns reports whether the current shard owns the key, so that KEYS
+	// and SCAN skip the keys left behind by a resharding. All keys are
+	// owned if it is nil.
+	Owns func(bucketName, key string) bool
+	// Limits restricts the size of the keys and values written by SET
+	// and MSET.
+	Limits config.Limits
+}
+
+// Keys returns the keys the command works on, which must all belong to
+// the shard that runs it.
+func Keys(cmd [][]byte) []string {
+	var keys []string
+	switch strings.ToUpper(string(cmd[0])) {
+	case "GET", "SET", "INCR", "INCRBY", "DECR", "DECRBY":
+		if len(cmd) > 1 {
+			keys = append(keys, string(cmd[1]))
+		}
+	case "DEL", "EXISTS", "MGET":
+		for _, k := range cmd[1:] {
+			keys = append(keys, string(k))
+		}
+	case "MSET":
+		for i := 1; i < len(cmd); i += 2 {
+			keys = append(keys, string(cmd[i]))
+		}
+	}
+	return keys
+}
+
+func wrongArgs(cmd [][]byte) Value {
+	return Errorf("ERR wrong number of arguments for '%s' command", strings.ToLower(string(cmd[0])))
+}
+
+func errorValue(err error) Value {
+	switch {
+	case errors.Is(err, errSyntax):
+		return Errorf("ERR syntax error")
+	case errors.Is(err, db.ErrWrongType):
+		return Errorf("WRONGTYPE Operation against a key holding the wrong kind of value")
+	case errors.Is(err, db.ErrNotInteger), errors.Is(err, db.ErrOverflow):
+		return Errorf("ERR value is not an integer or out of range")
+	case errors.Is(err, db.ErrLocked):
+		// Like Redis Cluster during a resharding, the client may retry.
+		return Errorf("TRYAGAIN %v", err)
+	default:
+		return Errorf("ERR %v", err)
+	}
+}
+
+// checkLimits returns an error reply if the key or the value is too large.
+func (l Local) checkLimits(key, value []byte) *Value {
+	var err Value
+	switch {
+	case l.Limits.MaxKeySize > 0 && len(key) > l.Limits.MaxKeySize:
+		err = Errorf("ERR key is too large: %d bytes, the limit is %d", len(key), l.Limits.MaxKeySize)
+	case l.Limits.MaxValueSize > 0 && len(value) > l.Limits.MaxValueSize:
+		err = Errorf("ERR value is too large: %d bytes, the limit is %d", len(value), l.Limits.MaxValueSize)
+	default:
+		return nil
+	}
+	return &err
+}
+
+// Exec runs the command on the bucket.
+func (l Local) Exec(bucketName string, cmd [][]byte) Value {
+	switch strings.ToUpper(string(cmd[0])) {
+	case "GET":
+		if len(cmd) != 2 {
+			return wrongArgs(cmd)
+		}
+		value, err := l.Store.GetKey(string(cmd[1]), bucketName)
+		if err != nil {
+			return errorValue(err)
+		}
+		return Bulk(value)
+
+	case "SET":
+		if len(cmd) < 3 {
+			return wrongArgs(cmd)
+		}
+		return l.set(bucketName, cmd)
+
+	case "INCR", "DECR", "INCRBY", "DECRBY":
+		return l.incr(bucketName, cmd)
+
+	case "DEL":
+		if len(cmd) < 2 {
+			return wrongArgs(cmd)
+		}
+		var n int64
+		for _, key := range cmd[1:] {
+			err := l.Store.Modify(bucketName, string(key), func(value []byte) ([]byte, error) {
+				if value == nil {
+					return nil, errNotFound
+				}
+				return nil, nil
+			})
+			if errors.Is(err, db.ErrWrongType) {
+				err = l.Store.DelKey(bucketName, string(key))
+			}
+			switch {
+			case errors.Is(err, errNotFound):
+			case err != nil:
+				return errorValue(err)
+			default:
+				n++
+			}
+		}
+		return Int(n)
+
+	case "EXISTS":
+		if len(cmd) < 2 {
+			return wrongArgs(cmd)
+		}
+		var n int64
+		for _, key := range cmd[1:] {
+			value, err := l.Store.GetKey(string(key), bucketName)
+			if err != nil {
+				return errorValue(err)
+			}
+			if value != nil {
+				n++
+			}
+		}
+		return Int(n)
+
+	case "MGET":
+		if len(cmd) < 2 {
+			return wrongArgs(cmd)
+		}
+		res := Value{Type: Array, Array: make([]Value, 0, len(cmd)-1)}
+		for _, key := range cmd[1:] {
+			value, err := l.Store.GetKey(string(key), bucketName)
+			if err != nil {
+				return errorValue(err)
+			}
+			res.Array = append(res.Array, Bulk(value))
+		}
+		return res
+
+	case "MSET":
+		if len(cmd) < 3 || len(cmd)%2 == 0 {
+			return wrongArgs(cmd)
+		}
+		ops := make([]db.Op, 0, len(cmd)/2)
+		for i := 1; i < len(cmd); i += 2 {
+			if err := l.checkLimits(cmd[i], cmd[i+1]); err != nil {
+				return *err
+			}
+			ops = append(ops, db.Op{Key: string(cmd[i]), Value: cmd[i+1]})
+		}
+		if err := l.Store.Batch(bucketName, ops); err != nil {
+			return errorValue(err)
+		}
+		return OK()
+
+	case "KEYS":
+		if len(cmd) != 2 {
+			return wrongArgs(cmd)
+		}
+		keys, err := l.keys(bucketName, string(cmd[1]))
+		if err != nil {
+			return errorValue(err)
+		}
+		return Strings(keys)
+
+	case "SCAN":
+		return l.scan(bucketName, cmd)
+
+	default:
+		return Errorf("ERR unknown command '%s'", cmd[0])
+	}
+}
+
+// set handles SET key value [NX|XX] [EX seconds|PX milliseconds|KEEPTTL].
+func (l Local) set(bucketName string, cmd [][]byte) Value {
+	key, value := string(cmd[1]), cmd[2]
+	if err := l.checkLimits(cmd[1], value); err != nil {
+		return *err
+	}
+
+	var nx, xx, keepTTL bool
+	var ttl time.Duration
+	for i := 3; i < len(cmd); i++ {
+		switch opt := strings.ToUpper(string(cmd[i])); opt {
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		case "KEEPTTL":
+			keepTTL = true
+		case "EX", "PX":
+			if i+1 == len(cmd) || ttl != 0 {
+				return Errorf("ERR syntax error")
+			}
+			i++
+			n, err := strconv.ParseInt(string(cmd[i]), 10, 64)
+			if err != nil || n <= 0 || n > math.MaxInt64/int64(time.Second) {
+				return Errorf("ERR invalid expire time in 'set' command")
+			}
+			ttl = time.Duration(n) * time.Millisecond
+			if opt == "EX" {
+				ttl = time.Duration(n) * time.Second
+			}
+		default:
+			return Errorf("ERR syntax error")
+		}
+	}
+	if (nx && xx) || (keepTTL && ttl != 0) {
+		return Errorf("ERR syntax error")
+	}
+
+	// A failed condition aborts the update, leaving the key as it was.
+	checkCondition := func(old []byte) error {
+		if (nx && old != nil) || (xx && old == nil) {
+			return errNotSet
+		}
+		return nil
+	}
+
+	update := func(old []byte, expires time.Time) ([]byte, time.Time, error) {
+		if err := checkCondition(old); err != nil {
+			return nil, expires, err
+		}
+		switch {
+		case keepTTL:
+		case ttl > 0:
+			expires = time.Now().Add(ttl)
+		default:
+			expires = time.Time{}
+		}
+		return value, expires, nil
+	}
+
+	var err error
+	if is, ok := l.Store.(db.ItemStore); ok {
+		// SET also resets the flags of memcached clients.
+		err = is.ModifyItem(bucketName, key, func(item *db.Item) (*db.Item, error) {
+			var old db.Item
+			if item != nil {
+				old = *item
+			}
+			value, expires, err := update(old.Value, old.Expires)
+			if err != nil {
+				return nil, err
+			}
+			return &db.Item{Value: value, Expires: expires}, nil
+		})
+	} else if e, ok := l.Store.(db.Expirer); ok {
+		err = e.ModifyTTL(bucketName, key, update)
+	} else if ttl > 0 {
+		return Errorf("ERR the storage engine does not support expiry")
+	} else if nx || xx {
+		err = l.Store.Modify(bucketName, key, func(old []byte) ([]byte, error) {
+			return value, checkCondition(old)
+		})
+	} else {
+		err = l.Store.SetKey(key, bucketName, value)
+	}
+
+	switch {
+	case errors.Is(err, errNotSet):
+		return Null()
+	case err != nil:
+		return errorValue(err)
+	}
+	return OK()
+}
+
+func (l Local) incr(bucketName string, cmd [][]byte) Value {
+	name := strings.ToUpper(string(cmd[0]))
+	by := int64(1)
+	if strings.HasSuffix(name, "BY") {
+		if len(cmd) != 3 {
+			return wrongArgs(cmd)
+		}
+		n, err := strconv.ParseInt(string(cmd[2]), 10, 64)
+		if err != nil {
+			return Errorf("ERR value is not an integer or out of range")
+		}
+		by = n
+	} else if len(cmd) != 2 {
+		return wrongArgs(cmd)
+	}
+
+	if strings.HasPrefix(name, "DECR") {
+		if by == math.MinInt64 {
+			return Errorf("ERR decrement would overflow")
+		}
+		by = -by
+	}
+
+	n, err := db.Add(l.Store, bucketName, string(cmd[1]), by, db.IntOptions{})
+	if err != nil {
+		return errorValue(err)
+	}
+	return Int(n)
+}
+
+// keys returns the owned keys of the bucket that match the pattern.
+func (l Local) keys(bucketName, pattern string) ([]string, error) {
+	all, err := l.Store.ListKeys(bucketName)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := []string{}
+	for _, key := range all {
+		if l.Owns != nil && !l.Owns(bucketName, key) {
+			continue
+		}
+		if Match(pattern, key) {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+// scanOptions are the options of SCAN.
+type scanOptions struct {
+	cursor  string
+	pattern string
+	count   int
+}
+
+func parseScan(cmd [][]byte) (scanOptions, error) {
+	opts := scanOptions{pattern: "*", count: 10}
+	if len(cmd) < 2 || len(cmd)%2 != 0 {
+		return opts, errSyntax
+	}
+
+	var err error
+	opts.cursor = string(cmd[1])
+	for i := 2; i < len(cmd); i += 2 {
+		switch strings.ToUpper(string(cmd[i])) {
+		case "MATCH":
+			opts.pattern = string(cmd[i+1])
+		case "COUNT":
+			if opts.count, err = strconv.Atoi(string(cmd[i+1])); err != nil || opts.count < 1 {
+				return opts, errSyntax
+			}
+		default:
+			return opts, errSyntax
+		}
+	}
+	return opts, nil
+}
+
+// scan handles SCAN cursor [MATCH pattern] [COUNT count] on the shard.
+// The cursor is "0" to start and then the hex encoded last key visited,
+// so the scan goes on after it whatever was added or deleted meanwhile.
+// COUNT is the number of keys visited, of which fewer may match.
+func (l Local) scan(bucketName string, cmd [][]byte) Value {
+	opts, err := parseScan(cmd)
+	if err != nil {
+		return errorValue(err)
+	}
+
+	var last string
+	if opts.cursor != "0" {
+		b, err := hex.DecodeString(opts.cursor)
+		if err != nil || len(b) == 0 {
+			return Errorf("ERR invalid cursor")
+		}
+		last = string(b)
+	}
+
+	// Keys sort after their prefixes, so the scan starts right after the
+	// last key with the key followed by a zero byte.
+	start := last
+	if last != "" {
+		start += "\x00"
+	}
+	all, err := l.Store.ScanKeys(bucketName, start, "")
+	if err != nil {
+		return errorValue(err)
+	}
+
+	next := "0"
+	if len(all) > opts.count {
+		all = all[:opts.count]
+		next = hex.EncodeToString([]byte(all[len(all)-1]))
+	}
+
+	keys := []string{}
+	for _, key := range all {
+		if l.Owns != nil && !l.Owns(bucketName, key) {
+			continue
+		}
+		if Match(opts.pattern, key) {
+			keys = append(keys, key)
+		}
+	}
+
+	return Value{Type: Array, Array: []Value{
+		Bulk([]byte(next)),
+		Strings(keys),
+	}}
+}
+
+// Match reports whether the key matches the glob-style pattern of KEYS
+// and SCAN: * matches any sequence, ? any character, [abc], [^abc] and
+// [a-z] a character of the set and \ escapes the next character.
+func Match(pattern, key string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 0 && pattern[0] == '*' {
+				pattern = pattern[1:]
+			}
+			if pattern == "" {
+				return true
+			}
+			for i := 0; i <= len(key); i++ {
+				if Match(pattern, key[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if key == "" {
+				return false
+			}
+			pattern, key = pattern[1:], key[1:]
+		case '[':
+			if key == "" {
+				return false
+			}
+			end := strings.IndexByte(pattern[1:], ']')
+			if end < 0 {
+				return pattern == key
+			}
+			if !matchSet(pattern[1:end+1], key[0]) {
+				return false
+			}
+			pattern, key = pattern[end+2:], key[1:]
+		case '\\':
+			if len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if key == "" || pattern[0] != key[0] {
+				return false
+			}
+			pattern, key = pattern[1:], key[1:]
+		}
+	}
+	return key == ""
+}
+
+func matchSet(set string, c byte) bool {
+	negate := strings.HasPrefix(set, "^")
+	if negate {
+		set = set[1:]
+	}
+
+	found := false
+	for i := 0; i < len(set); i++ {
+		if i+2 < len(set) && set[i+1] == '-' {
+			lo, hi := set[i], set[i+2]
+			if lo > hi {
+				lo, hi = hi, lo
+			}
+			found = found || (c >= lo && c <= hi)
+			i += 2
+			continue
+		}
+		found = found || set[i] == c
+	}
+	return found != negate
+}
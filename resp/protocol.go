@@ -0,0 +1,253 @@
+// Package resp serves the keys of a shard over the Redis protocol (RESP),
+// so that redis-cli and the Redis client libraries work against go-kvdb.
+package resp
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// Types of values.
+const (
+	SimpleString = '+'
+	Error        = '-'
+	Integer      = ':'
+	BulkString   = '$'
+	Array        = '*'
+)
+
+// Limits of the values read, like the defaults of Redis.
+const (
+	maxBulkLen  = 512 << 20
+	maxArrayLen = 1 << 20
+	maxLineLen  = 64 << 10
+)
+
+// ErrProtocol is returned for malformed input.
+var ErrProtocol = errors.New("protocol error")
+
+// Value is a RESP value. Str holds simple strings and errors, Int
+// integers, Bulk bulk strings and Array arrays. A nil Bulk or Array
+// is the null value of the type.
+type Value struct {
+	Type  byte
+	Str   string
+	Int   int64
+	Bulk  []byte
+	Array []Value
+}
+
+// OK returns the "OK" simple string.
+func OK() Value {
+	return Value{Type: SimpleString, Str: "OK"}
+}
+
+// Errorf returns an error value. The message should start with an error
+// code such as ERR or WRONGTYPE.
+func Errorf(format string, args ...any) Value {
+	return Value{Type: Error, Str: fmt.Sprintf(format, args...)}
+}
+
+// Int returns an integer value.
+func Int(n int64) Value {
+	return Value{Type: Integer, Int: n}
+}
+
+// Bulk returns a bulk string, which is null if b is nil.
+func Bulk(b []byte) Value {
+	return Value{Type: BulkString, Bulk: b}
+}
+
+// Null returns the null bulk string.
+func Null() Value {
+	return Value{Type: BulkString}
+}
+
+// Strings returns an array of bulk strings.
+func Strings(ss []string) Value {
+	v := Value{Type: Array, Array: make([]Value, len(ss))}
+	for i, s := range ss {
+		v.Array[i] = Bulk([]byte(s))
+	}
+	return v
+}
+
+// IsError reports whether the value is an error.
+func (v Value) IsError() bool {
+	return v.Type == Error
+}
+
+// Write encodes the value.
+func Write(w *bufio.Writer, v Value) error {
+	switch v.Type {
+	case SimpleString, Error:
+		w.WriteByte(v.Type)
+		w.WriteString(v.Str)
+	case Integer:
+		w.WriteByte(Integer)
+		w.WriteString(strconv.FormatInt(v.Int, 10))
+	case BulkString:
+		if v.Bulk == nil {
+			w.WriteString("$-1")
+			break
+		}
+		w.WriteByte(BulkString)
+		w.WriteString(strconv.Itoa(len(v.Bulk)))
+		w.WriteString("\r\n")
+		w.Write(v.Bulk)
+	case Array:
+		if v.Array == nil {
+			w.WriteString("*-1")
+			break
+		}
+		w.WriteByte(Array)
+		w.WriteString(strconv.Itoa(len(v.Array)))
+		w.WriteString("\r\n")
+		for _, e := range v.Array {
+			if err := Write(w, e); err != nil {
+				return err
+			}
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown value type %q", v.Type)
+	}
+	_, err := w.WriteString("\r\n")
+	return err
+}
+
+// WriteCommand encodes the command as an array of bulk strings.
+func WriteCommand(w *bufio.Writer, cmd [][]byte) error {
+	v := Value{Type: Array, Array: make([]Value, len(cmd))}
+	for i, arg := range cmd {
+		v.Array[i] = Bulk(arg)
+	}
+	return Write(w, v)
+}
+
+func readLine(r *bufio.Reader) ([]byte, error) {
+	line, err := r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull || len(line) > maxLineLen {
+		return nil, fmt.Errorf("%w: line too long", ErrProtocol)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("%w: line not terminated by CRLF", ErrProtocol)
+	}
+	return line[:len(line)-2], nil
+}
+
+func parseLen(b []byte, limit int) (int, error) {
+	n, err := strconv.Atoi(string(b))
+	if err != nil || n < -1 || n > limit {
+		return 0, fmt.Errorf("%w: invalid length %q", ErrProtocol, b)
+	}
+	return n, nil
+}
+
+// Read decodes a value.
+func Read(r *bufio.Reader) (Value, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return Value{}, err
+	}
+	if len(line) == 0 {
+		return Value{}, fmt.Errorf("%w: empty line", ErrProtocol)
+	}
+
+	v := Value{Type: line[0]}
+	switch v.Type {
+	case SimpleString, Error:
+		v.Str = string(line[1:])
+	case Integer:
+		if v.Int, err = strconv.ParseInt(string(line[1:]), 10, 64); err != nil {
+			return Value{}, fmt.Errorf("%w: invalid integer %q", ErrProtocol, line[1:])
+		}
+	case BulkString:
+		n, err := parseLen(line[1:], maxBulkLen)
+		if err != nil || n < 0 {
+			return v, err
+		}
+		v.Bulk = make([]byte, n+2)
+		if _, err := io.ReadFull(r, v.Bulk); err != nil {
+			return Value{}, err
+		}
+		if !bytes.HasSuffix(v.Bulk, []byte("\r\n")) {
+			return Value{}, fmt.Errorf("%w: bulk string not terminated by CRLF", ErrProtocol)
+		}
+		v.Bulk = v.Bulk[:n]
+	case Array:
+		n, err := parseLen(line[1:], maxArrayLen)
+		if err != nil || n < 0 {
+			return v, err
+		}
+		v.Array = make([]Value, n)
+		for i := range v.Array {
+			if v.Array[i], err = Read(r); err != nil {
+				return Value{}, err
+			}
+		}
+	default:
+		return Value{}, fmt.Errorf("%w: unknown value type %q", ErrProtocol, v.Type)
+	}
+	return v, nil
+}
+
+// ReadCommand reads a command sent as an array of bulk strings or as
+// an inline command, which is a line of space-separated arguments.
+// Empty inline commands are skipped.
+func ReadCommand(r *bufio.Reader) ([][]byte, error) {
+	for {
+		b, err := r.Peek(1)
+		if err != nil {
+			return nil, err
+		}
+
+		if b[0] != Array {
+			line, err := readInlineLine(r)
+			if err != nil {
+				return nil, err
+			}
+			if fields := bytes.Fields(line); len(fields) > 0 {
+				return fields, nil
+			}
+			continue
+		}
+
+		v, err := Read(r)
+		if err != nil {
+			return nil, err
+		}
+		if len(v.Array) == 0 {
+			continue
+		}
+
+		cmd := make([][]byte, len(v.Array))
+		for i, arg := range v.Array {
+			if arg.Type != BulkString || arg.Bulk == nil {
+				return nil, fmt.Errorf("%w: expected bulk strings", ErrProtocol)
+			}
+			cmd[i] = arg.Bulk
+		}
+		return cmd, nil
+	}
+}
+
+// readInlineLine reads a line terminated by LF, like Redis does for
+// inline commands typed in a terminal.
+func readInlineLine(r *bufio.Reader) ([]byte, error) {
+	line, err := r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull || len(line) > maxLineLen {
+		return nil, fmt.Errorf("%w: line too long", ErrProtocol)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{}, bytes.TrimRight(line, "\r\n")...), nil
+}
@@ -0,0 +1,85 @@
+package resp_test
+
+import (
+	"bufio"
+	"bytes"
+	"go-kvdb/resp"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadWrite(t *testing.T) {
+	values := []resp.Value{
+		resp.OK(),
+		resp.Errorf("ERR %s", "boom"),
+		resp.Int(-42),
+		resp.Bulk([]byte("hello\r\nworld")),
+		resp.Bulk([]byte{}),
+		resp.Null(),
+		resp.Strings([]string{"a", "b"}),
+		{Type: resp.Array, Array: []resp.Value{resp.Int(1), resp.Null()}},
+	}
+
+	var buf bytes.Buffer
+	w := bufio.NewWriter(&buf)
+	for _, v := range values {
+		if err := resp.Write(w, v); err != nil {
+			t.Fatalf("Could not write %v: %v", v, err)
+		}
+	}
+	w.Flush()
+
+	r := bufio.NewReader(&buf)
+	for _, want := range values {
+		got, err := resp.Read(r)
+		if err != nil {
+			t.Fatalf("Could not read %v: %v", want, err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("Unexpected value: got %#v, want %#v", got, want)
+		}
+	}
+}
+
+func TestReadCommand(t *testing.T) {
+	r := bufio.NewReader(strings.NewReader("*2\r\n$3\r\nGET\r\n$1\r\nk\r\n\r\nSET  k v\nPING\r\n*1\r\n:1\r\n"))
+
+	for _, want := range []string{"GET k", "SET k v", "PING"} {
+		cmd, err := resp.ReadCommand(r)
+		if err != nil {
+			t.Fatalf("Could not read command %q: %v", want, err)
+		}
+		if got := string(bytes.Join(cmd, []byte(" "))); got != want {
+			t.Errorf("Unexpected command: got %q, want %q", got, want)
+		}
+	}
+
+	if _, err := resp.ReadCommand(r); err == nil {
+		t.Errorf("Expected an error for a command that is not made of bulk strings")
+	}
+}
+
+func TestMatch(t *testing.T) {
+	cases := []struct {
+		pattern, key string
+		want         bool
+	}{
+		{"*", "anything", true},
+		{"user:*", "user:1", true},
+		{"user:*", "users", false},
+		{"h?llo", "hello", true},
+		{"h?llo", "hllo", false},
+		{"h[ae]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-c]llo", "hbllo", true},
+		{"a\\*b", "a*b", true},
+		{"a\\*b", "axb", false},
+		{"*/*", "hook/1", true},
+	}
+	for _, c := range cases {
+		if got := resp.Match(c.pattern, c.key); got != c.want {
+			t.Errorf("Unexpected match of %q against %q: got %v, want %v", c.key, c.pattern, got, c.want)
+		}
+	}
+}
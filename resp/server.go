@@ -0,0 +1,353 @@
+package resp
+
+import (
+	"bufio"
+	"errors"
+	"go-kvdb/config"
+	"go-kvdb/db"
+	"io"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Cluster routes the keys to the shards of the cluster.
+type Cluster interface {
+	// Shards returns the current topology.
+	Shards() *config.Shards
+	// Owner returns the shard that owns the key of the bucket.
+	Owner(bucketName, key string) (int, error)
+	// Owns reports whether the current shard owns the key of the bucket.
+	Owns(bucketName, key string) bool
+	// ForwardRESP runs the command on another shard, which must own all
+	// the keys of the command.
+	ForwardRESP(shard int, bucketName string, cmd [][]byte) (Value, error)
+}
+
+// Server serves the keys of the cluster over RESP. Single-key commands
+// run on the shard that owns the key, DEL, EXISTS, MGET and MSET are split
+// by shard, and KEYS and SCAN visit every shard. MSET is only atomic
+// within a shard. SELECT switches to the bucket with the given name,
+// where database 0 is the default bucket.
+type Server struct {
+	cluster Cluster
+
+	// mu guards the local runner, whose limits may change.
+	mu    sync.Mutex
+	local Local
+}
+
+// NewServer returns a server of the store. Without a cluster all keys
+// are served from the store.
+func NewServer(store db.Store, cluster Cluster) *Server {
+	s := &Server{local: Local{Store: store}, cluster: cluster}
+	if cluster != nil {
+		s.local.Owns = cluster.Owns
+	}
+	return s
+}
+
+// SetLimits restricts the size of keys and values written by SET and MSET.
+func (s *Server) SetLimits(l config.Limits) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.local.Limits = l
+}
+
+// runner returns the runner of the commands on the current shard.
+func (s *Server) runner() Local {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.local
+}
+
+// ListenAndServe listens on the TCP address and serves the connections.
+func (s *Server) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve serves the connections accepted by the listener until it is closed.
+func (s *Server) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go s.serveConn(conn)
+	}
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	defer conn.Close()
+
+	r := bufio.NewReaderSize(conn, maxLineLen)
+	w := bufio.NewWriter(conn)
+	bucketName := "default"
+
+	for {
+		cmd, err := ReadCommand(r)
+		if err != nil {
+			if errors.Is(err, ErrProtocol) {
+				Write(w, Errorf("ERR %v", err))
+				w.Flush()
+			} else if err != io.EOF {
+				log.Printf("Error reading RESP command from %s: %v", conn.RemoteAddr(), err)
+			}
+			return
+		}
+
+		var reply Value
+		quit := false
+		switch strings.ToUpper(string(cmd[0])) {
+		case "PING":
+			reply = Value{Type: SimpleString, Str: "PONG"}
+			if len(cmd) > 1 {
+				reply = Bulk(cmd[1])
+			}
+		case "ECHO":
+			reply = wrongArgs(cmd)
+			if len(cmd) == 2 {
+				reply = Bulk(cmd[1])
+			}
+		case "QUIT":
+			reply, quit = OK(), true
+		case "COMMAND":
+			// Clients ask for the command table, which is not provided.
+			reply = Value{Type: Array, Array: []Value{}}
+		case "SELECT":
+			reply = wrongArgs(cmd)
+			if len(cmd) == 2 {
+				reply = s.selectBucket(string(cmd[1]), &bucketName)
+			}
+		default:
+			reply = s.Exec(bucketName, cmd)
+		}
+
+		if err := Write(w, reply); err != nil {
+			return
+		}
+		// Pipelined commands are answered together.
+		if r.Buffered() == 0 || quit {
+			if err := w.Flush(); err != nil || quit {
+				return
+			}
+		}
+	}
+}
+
+// selectBucket switches to the bucket, which must exist and must not be
+// one of the system buckets.
+func (s *Server) selectBucket(name string, bucketName *string) Value {
+	if name == "0" {
+		name = "default"
+	}
+	if db.IsSystemBucket(name) {
+		return Errorf("ERR bucket names starting with %q are reserved", db.SystemPrefix)
+	}
+
+	buckets, err := s.runner().Store.Buckets()
+	if err != nil {
+		return errorValue(err)
+	}
+	for _, b := range buckets {
+		if b == name {
+			*bucketName = name
+			return OK()
+		}
+	}
+	return Errorf("ERR bucket %s not found", name)
+}
+
+// Exec runs the key command on the shards that own the keys.
+func (s *Server) Exec(bucketName string, cmd [][]byte) Value {
+	if s.cluster == nil {
+		return s.runner().Exec(bucketName, cmd)
+	}
+
+	name := strings.ToUpper(string(cmd[0]))
+	switch name {
+	case "KEYS":
+		if len(cmd) != 2 {
+			return wrongArgs(cmd)
+		}
+		return s.keys(bucketName, cmd)
+	case "SCAN":
+		return s.scan(bucketName, cmd)
+	case "DEL", "EXISTS":
+		if len(cmd) < 2 {
+			return wrongArgs(cmd)
+		}
+		return s.split(bucketName, cmd, 1)
+	case "MGET":
+		if len(cmd) < 2 {
+			return wrongArgs(cmd)
+		}
+		return s.split(bucketName, cmd, 1)
+	case "MSET":
+		if len(cmd) < 3 || len(cmd)%2 == 0 {
+			return wrongArgs(cmd)
+		}
+		return s.split(bucketName, cmd, 2)
+	}
+
+	keys := Keys(cmd)
+	if len(keys) == 0 {
+		return s.runner().Exec(bucketName, cmd)
+	}
+	shard, err := s.cluster.Owner(bucketName, keys[0])
+	if err != nil {
+		return errorValue(err)
+	}
+	return s.run(shard, bucketName, cmd)
+}
+
+// run runs the command on the shard.
+func (s *Server) run(shard int, bucketName string, cmd [][]byte) Value {
+	if shard == s.cluster.Shards().CurIdx {
+		return s.runner().Exec(bucketName, cmd)
+	}
+
+	v, err := s.cluster.ForwardRESP(shard, bucketName, cmd)
+	if err != nil {
+		return Errorf("ERR forwarding to shard %d: %v", shard, err)
+	}
+	return v
+}
+
+// split runs the command with its keys, each followed by step-1 more
+// arguments, grouped by shard and merges the replies: the integers are
+// added up, the arrays are put back in the order of the keys and errors
+// are returned as is.
+func (s *Server) split(bucketName string, cmd [][]byte, step int) Value {
+	type group struct {
+		cmd  [][]byte
+		idxs []int
+	}
+
+	groups := make(map[int]*group)
+	var shards []int
+	for i := 1; i < len(cmd); i += step {
+		shard, err := s.cluster.Owner(bucketName, string(cmd[i]))
+		if err != nil {
+			return errorValue(err)
+		}
+		g := groups[shard]
+		if g == nil {
+			g = &group{cmd: [][]byte{cmd[0]}}
+			groups[shard] = g
+			shards = append(shards, shard)
+		}
+		g.cmd = append(g.cmd, cmd[i:i+step]...)
+		g.idxs = append(g.idxs, (i-1)/step)
+	}
+
+	replies := make([]Value, len(shards))
+	var wg sync.WaitGroup
+	for i, shard := range shards {
+		wg.Add(1)
+		go func(i, shard int) {
+			defer wg.Done()
+			replies[i] = s.run(shard, bucketName, groups[shard].cmd)
+		}(i, shard)
+	}
+	wg.Wait()
+
+	merged := Value{Type: replies[0].Type}
+	if merged.Type == Array {
+		merged.Array = make([]Value, (len(cmd)-1)/step)
+	}
+	for i, reply := range replies {
+		switch {
+		case reply.IsError():
+			return reply
+		case reply.Type != merged.Type:
+			return Errorf("ERR unexpected reply from shard %d", shards[i])
+		case reply.Type == Integer:
+			merged.Int += reply.Int
+		case reply.Type == Array:
+			g := groups[shards[i]]
+			if len(reply.Array) != len(g.idxs) {
+				return Errorf("ERR unexpected reply from shard %d", shards[i])
+			}
+			for j, idx := range g.idxs {
+				merged.Array[idx] = reply.Array[j]
+			}
+		default:
+			merged = reply
+		}
+	}
+	return merged
+}
+
+// keys gathers the matching keys from every shard.
+func (s *Server) keys(bucketName string, cmd [][]byte) Value {
+	count := s.cluster.Shards().Count
+	replies := make([]Value, count)
+
+	var wg sync.WaitGroup
+	for shard := 0; shard < count; shard++ {
+		wg.Add(1)
+		go func(shard int) {
+			defer wg.Done()
+			replies[shard] = s.run(shard, bucketName, cmd)
+		}(shard)
+	}
+	wg.Wait()
+
+	keys := []string{}
+	for _, reply := range replies {
+		if reply.IsError() {
+			return reply
+		}
+		for _, k := range reply.Array {
+			keys = append(keys, string(k.Bulk))
+		}
+	}
+	sort.Strings(keys)
+	return Strings(keys)
+}
+
+// scan scans the shards one after the other. The cursor is "0" to start
+// and then the index of the shard, a colon and the cursor of the shard.
+func (s *Server) scan(bucketName string, cmd [][]byte) Value {
+	opts, err := parseScan(cmd)
+	if err != nil {
+		return errorValue(err)
+	}
+
+	shard, local := 0, "0"
+	if opts.cursor != "0" {
+		idx, cursor, ok := strings.Cut(opts.cursor, ":")
+		if shard, err = strconv.Atoi(idx); !ok || err != nil || shard < 0 || shard >= s.cluster.Shards().Count {
+			return Errorf("ERR invalid cursor")
+		}
+		local = cursor
+	}
+
+	reply := s.run(shard, bucketName, append([][]byte{cmd[0], []byte(local)}, cmd[2:]...))
+	if reply.IsError() {
+		return reply
+	}
+	if len(reply.Array) != 2 {
+		return Errorf("ERR unexpected reply from shard %d", shard)
+	}
+
+	next := string(reply.Array[0].Bulk)
+	switch {
+	case next != "0":
+		next = strconv.Itoa(shard) + ":" + next
+	case shard+1 < s.cluster.Shards().Count:
+		// Continue with the next shard, or finish after the last one.
+		next = strconv.Itoa(shard+1) + ":0"
+	}
+
+	reply.Array[0] = Bulk([]byte(next))
+	return reply
+}
@@ -0,0 +1,189 @@
+package resp_test
+
+import (
+	"bufio"
+	"go-kvdb/config"
+	"go-kvdb/db"
+	"go-kvdb/resp"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// client is a minimal RESP client.
+type client struct {
+	conn net.Conn
+	r    *bufio.Reader
+	w    *bufio.Writer
+}
+
+func dial(t *testing.T, addr string) *client {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Could not connect to %s: %v", addr, err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &client{conn: conn, r: bufio.NewReader(conn), w: bufio.NewWriter(conn)}
+}
+
+func (c *client) do(t *testing.T, args ...string) resp.Value {
+	t.Helper()
+	cmd := make([][]byte, len(args))
+	for i, a := range args {
+		cmd[i] = []byte(a)
+	}
+	if err := resp.WriteCommand(c.w, cmd); err != nil {
+		t.Fatalf("Could not send %v: %v", args, err)
+	}
+	c.w.Flush()
+
+	v, err := resp.Read(c.r)
+	if err != nil {
+		t.Fatalf("Could not read the reply to %v: %v", args, err)
+	}
+	return v
+}
+
+// format returns a short form of the value for comparisons.
+func format(v resp.Value) string {
+	switch v.Type {
+	case resp.SimpleString:
+		return v.Str
+	case resp.Error:
+		return "-" + strings.SplitN(v.Str, " ", 2)[0]
+	case resp.Integer:
+		return ":" + strconv.FormatInt(v.Int, 10)
+	case resp.BulkString:
+		if v.Bulk == nil {
+			return "(nil)"
+		}
+		return string(v.Bulk)
+	default:
+		parts := make([]string, len(v.Array))
+		for i, e := range v.Array {
+			parts[i] = format(e)
+		}
+		return "[" + strings.Join(parts, " ") + "]"
+	}
+}
+
+func startServer(t *testing.T, store db.Store) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not listen: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go resp.NewServer(store, nil).Serve(l)
+	return l.Addr().String()
+}
+
+func TestServer(t *testing.T) {
+	d, closeFunc, err := db.NewDatabase(filepath.Join(t.TempDir(), "shard.db"))
+	if err != nil {
+		t.Fatalf("Could not create a new database: %v", err)
+	}
+	defer closeFunc()
+	if err := d.CreateBucketIfNotExists("users"); err != nil {
+		t.Fatalf("Could not create bucket: %v", err)
+	}
+
+	c := dial(t, startServer(t, d))
+	cases := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"PING"}, "PONG"},
+		{[]string{"SET", "a", "1"}, "OK"},
+		{[]string{"SET", "a", "2", "NX"}, "(nil)"},
+		{[]string{"SET", "b", "2", "XX"}, "(nil)"},
+		{[]string{"set", "b", "2", "nx"}, "OK"},
+		{[]string{"GET", "a"}, "1"},
+		{[]string{"INCR", "a"}, ":2"},
+		{[]string{"DECRBY", "a", "2"}, ":0"},
+		{[]string{"MSET", "c", "3", "d", "4"}, "OK"},
+		{[]string{"MGET", "a", "missing", "d"}, "[0 (nil) 4]"},
+		{[]string{"EXISTS", "a", "b", "missing"}, ":2"},
+		{[]string{"DEL", "b", "missing"}, ":1"},
+		{[]string{"KEYS", "*"}, "[a c d]"},
+		{[]string{"SCAN", "0", "COUNT", "2"}, "[63 [a c]]"},
+		{[]string{"SCAN", "63", "COUNT", "2"}, "[0 [d]]"},
+		{[]string{"SCAN", "0", "MATCH", "[cd]", "COUNT", "2"}, "[63 [c]]"},
+		{[]string{"SCAN", "zz", "COUNT", "2"}, "-ERR"},
+		{[]string{"SET", "t", "v", "PX", "1"}, "OK"},
+		{[]string{"SET", "t", "v", "EX", "0"}, "-ERR"},
+		{[]string{"INCR", "c", "extra"}, "-ERR"},
+		{[]string{"NOPE"}, "-ERR"},
+		{[]string{"SELECT", "users"}, "OK"},
+		{[]string{"GET", "a"}, "(nil)"},
+		{[]string{"SELECT", "missing"}, "-ERR"},
+		{[]string{"SELECT", "__flags"}, "-ERR"},
+		{[]string{"SELECT", "0"}, "OK"},
+		{[]string{"GET", "c"}, "3"},
+	}
+	for _, tc := range cases {
+		if got := format(c.do(t, tc.args...)); got != tc.want {
+			t.Errorf("Unexpected reply to %v: got %q, want %q", tc.args, got, tc.want)
+		}
+	}
+
+	time.Sleep(5 * time.Millisecond)
+	if got := format(c.do(t, "GET", "t")); got != "(nil)" {
+		t.Errorf("Unexpected value of an expired key: got %q, want (nil)", got)
+	}
+
+	// Inline commands work as well.
+	c.w.WriteString("GET c\r\n")
+	c.w.Flush()
+	if v, err := resp.Read(c.r); err != nil || format(v) != "3" {
+		t.Errorf("Unexpected reply to an inline command: got %q, %v", format(v), err)
+	}
+
+	// Writes of keys locked by a transaction may be retried.
+	txn := db.PreparedTxn{ID: "t1", Bucket: "default", Prepared: time.Now(), Ops: []db.TxnOp{{Op: db.Op{Key: "c", Value: []byte("4")}}}}
+	if err := d.Prepare(txn); err != nil {
+		t.Fatalf("Could not prepare: %v", err)
+	}
+	if got := format(c.do(t, "SET", "c", "5")); got != "-TRYAGAIN" {
+		t.Errorf("Unexpected reply to a write of a locked key: got %q, want -TRYAGAIN", got)
+	}
+}
+
+func TestLimits(t *testing.T) {
+	d, closeFunc, err := db.NewDatabase(filepath.Join(t.TempDir(), "shard.db"))
+	if err != nil {
+		t.Fatalf("Could not create a new database: %v", err)
+	}
+	defer closeFunc()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not listen: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	s := resp.NewServer(d, nil)
+	s.SetLimits(config.Limits{MaxKeySize: 4, MaxValueSize: 4})
+	go s.Serve(l)
+
+	c := dial(t, l.Addr().String())
+	cases := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"SET", "a", "1234"}, "OK"},
+		{[]string{"SET", "a", "12345"}, "-ERR"},
+		{[]string{"SET", "abcde", "1"}, "-ERR"},
+		{[]string{"MSET", "b", "1", "c", "12345"}, "-ERR"},
+		{[]string{"MGET", "a", "b"}, "[1234 (nil)]"},
+	}
+	for _, tc := range cases {
+		if got := format(c.do(t, tc.args...)); got != tc.want {
+			t.Errorf("Unexpected reply to %v: got %q, want %q", tc.args, got, tc.want)
+		}
+	}
+}
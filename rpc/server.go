@@ -0,0 +1,601 @@
+// Package rpc serves the keys of the cluster over gRPC with the KV service
+// defined in kv.proto. Calls for keys of other shards are forwarded to
+// their owners over gRPC as well, so every shard of the cluster needs a
+// gRPC address in the config.
+package rpc
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative kv.proto
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"go-kvdb/config"
+	"go-kvdb/db"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// Metadata of the forwarded calls, like the headers of the HTTP API.
+const (
+	epochKey = "x-kvdb-epoch"
+	hopsKey  = "x-kvdb-hops"
+
+	// maxHops is the maximum number of forwards a call can go through.
+	maxHops = 2
+)
+
+var (
+	errKeyNotFound     = errors.New("key not found")
+	errConditionFailed = errors.New("condition failed")
+)
+
+// Cluster routes the keys to the shards of the cluster.
+type Cluster interface {
+	// Shards returns the current topology.
+	Shards() *config.Shards
+	// Owner returns the shard that owns the key of the bucket.
+	Owner(bucketName, key string) (int, error)
+	// Owns reports whether the current shard owns the key of the bucket.
+	Owns(bucketName, key string) bool
+	// ScanShards returns the shards that may hold keys of the bucket in
+	// [start, end).
+	ScanShards(bucketName, start, end string) ([]int, error)
+}
+
+// Server implements the KV service on a shard.
+type Server struct {
+	UnimplementedKVServer
+
+	store   db.Store
+	cluster Cluster
+
+	// mu guards the limits, the credentials and the connections.
+	mu     sync.Mutex
+	limits config.Limits
+	creds  credentials.TransportCredentials
+	conns  map[string]*grpc.ClientConn
+}
+
+// NewServer returns a server of the store.
+func NewServer(store db.Store, cluster Cluster) *Server {
+	return &Server{store: store, cluster: cluster, conns: make(map[string]*grpc.ClientConn)}
+}
+
+// SetLimits restricts the size of keys and values accepted by the server.
+func (s *Server) SetLimits(l config.Limits) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.limits = l
+}
+
+// SetCredentials sets the credentials of the calls forwarded to the other
+// shards, which are insecure by default. It must be called before the
+// first call is served.
+func (s *Server) SetCredentials(creds credentials.TransportCredentials) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.creds = creds
+}
+
+// Credentials returns the transport credentials of a node with the TLS
+// config: the server presents the certificate and the client, which
+// forwards calls to the other shards, trusts the certificates described
+// in config.TLSConfig. Without TLS both are insecure.
+func Credentials(t config.TLSConfig) (server, client credentials.TransportCredentials, err error) {
+	if !t.Enabled() {
+		return insecure.NewCredentials(), insecure.NewCredentials(), nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	clientConfig, err := t.ClientConfig()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	server = credentials.NewServerTLSFromCert(&cert)
+	client = credentials.NewTLS(clientConfig)
+	return server, client, nil
+}
+
+// Close closes the connections to the other shards.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var errs []error
+	for addr, conn := range s.conns {
+		errs = append(errs, conn.Close())
+		delete(s.conns, addr)
+	}
+	return errors.Join(errs...)
+}
+
+// requestBucket returns the bucket of a request, which must not be one
+// of the system buckets.
+func requestBucket(bucketName string) (string, error) {
+	if bucketName == "" {
+		return "default", nil
+	}
+	if db.IsSystemBucket(bucketName) {
+		return "", status.Errorf(codes.InvalidArgument, "Bucket names starting with %q are reserved", db.SystemPrefix)
+	}
+	return bucketName, nil
+}
+
+func (s *Server) checkLimits(key string, value []byte) error {
+	s.mu.Lock()
+	limits := s.limits
+	s.mu.Unlock()
+
+	if limits.MaxKeySize > 0 && len(key) > limits.MaxKeySize {
+		return status.Errorf(codes.InvalidArgument, "Key is too large: %d bytes, the limit is %d", len(key), limits.MaxKeySize)
+	}
+	if limits.MaxValueSize > 0 && len(value) > limits.MaxValueSize {
+		return status.Errorf(codes.InvalidArgument, "Value is too large: %d bytes, the limit is %d", len(value), limits.MaxValueSize)
+	}
+	return nil
+}
+
+// storeError converts an error of the store to a status. Writes of keys
+// locked by a distributed transaction are aborted and may be retried once
+// it is resolved.
+func storeError(msg string, err error) error {
+	switch {
+	case errors.Is(err, db.ErrWrongType):
+		return status.Errorf(codes.FailedPrecondition, "%s: %v", msg, err)
+	case errors.Is(err, db.ErrLocked):
+		return status.Errorf(codes.Aborted, "%s: %v", msg, err)
+	}
+	return status.Errorf(codes.Internal, "%s: %v", msg, err)
+}
+
+// incoming returns the epoch and the hops of a forwarded call.
+func incoming(ctx context.Context) (epoch int64, forwarded bool, hops int) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	if v := md.Get(epochKey); len(v) > 0 {
+		if e, err := strconv.ParseInt(v[0], 10, 64); err == nil {
+			epoch, forwarded = e, true
+		}
+	}
+	if v := md.Get(hopsKey); len(v) > 0 {
+		hops, _ = strconv.Atoi(v[0])
+	}
+	return epoch, forwarded, hops
+}
+
+// checkEpoch rejects the calls that were routed using a newer topology
+// than ours, since we can no longer be sure that the keys belong to us.
+func checkEpoch(ctx context.Context, shards *config.Shards) error {
+	if epoch, ok, _ := incoming(ctx); ok && epoch > shards.Epoch {
+		return status.Errorf(codes.Unavailable, "Stale topology: request epoch %d, local epoch %d", epoch, shards.Epoch)
+	}
+	return nil
+}
+
+// conn returns the connection to the address, which is kept for later calls.
+func (s *Server) conn(addr string) (*grpc.ClientConn, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if conn, ok := s.conns[addr]; ok {
+		return conn, nil
+	}
+	creds := s.creds
+	if creds == nil {
+		creds = insecure.NewCredentials()
+	}
+	conn, err := grpc.NewClient(addr, grpc.WithTransportCredentials(creds))
+	if err != nil {
+		return nil, err
+	}
+	s.conns[addr] = conn
+	return conn, nil
+}
+
+// forward returns the client of the shard and the context to call it with.
+func (s *Server) forward(ctx context.Context, shards *config.Shards, shard int) (KVClient, context.Context, error) {
+	_, _, hops := incoming(ctx)
+	if hops >= maxHops {
+		return nil, nil, status.Errorf(codes.FailedPrecondition, "Forwarding hop limit of %d exceeded", maxHops)
+	}
+
+	addr, ok := shards.GRPCAddrs[shard]
+	if !ok {
+		return nil, nil, status.Errorf(codes.Unavailable, "Shard %d has no gRPC address", shard)
+	}
+	conn, err := s.conn(addr)
+	if err != nil {
+		return nil, nil, status.Errorf(codes.Unavailable, "Error connecting to shard %d: %v", shard, err)
+	}
+
+	md := metadata.Pairs(epochKey, strconv.FormatInt(shards.Epoch, 10), hopsKey, strconv.Itoa(hops+1))
+	return NewKVClient(conn), metadata.NewOutgoingContext(ctx, md), nil
+}
+
+// route returns the client of the shard that owns the key and the context
+// to call it with, or a nil client if the current shard owns the key.
+func (s *Server) route(ctx context.Context, bucketName, key string) (KVClient, context.Context, error) {
+	if key == "" {
+		return nil, nil, status.Error(codes.InvalidArgument, "key is required")
+	}
+
+	shards := s.cluster.Shards()
+	if err := checkEpoch(ctx, shards); err != nil {
+		return nil, nil, err
+	}
+
+	// If the sender's epoch is older than ours the call is simply
+	// re-routed using our own view of the topology.
+	shard, err := s.cluster.Owner(bucketName, key)
+	if err != nil {
+		return nil, nil, status.Errorf(codes.Internal, "Error getting bucket policy: %v", err)
+	}
+	if shard == shards.CurIdx {
+		return nil, ctx, nil
+	}
+	return s.forward(ctx, shards, shard)
+}
+
+// Get returns the value of the key.
+func (s *Server) Get(ctx context.Context, req *GetRequest) (*GetResponse, error) {
+	bucketName, err := requestBucket(req.Bucket)
+	if err != nil {
+		return nil, err
+	}
+	c, ctx, err := s.route(ctx, bucketName, req.Key)
+	if err != nil {
+		return nil, err
+	}
+	if c != nil {
+		return c.Get(ctx, req)
+	}
+
+	value, err := s.store.GetKey(req.Key, bucketName)
+	if err != nil {
+		return nil, storeError("Error getting key", err)
+	}
+	if value == nil {
+		return nil, status.Error(codes.NotFound, "Key not found")
+	}
+	return &GetResponse{Value: value}, nil
+}
+
+// Set stores the value of the key.
+func (s *Server) Set(ctx context.Context, req *SetRequest) (*SetResponse, error) {
+	if len(req.Value) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "value is required")
+	}
+	if err := s.checkLimits(req.Key, req.Value); err != nil {
+		return nil, err
+	}
+
+	bucketName, err := requestBucket(req.Bucket)
+	if err != nil {
+		return nil, err
+	}
+	c, ctx, err := s.route(ctx, bucketName, req.Key)
+	if err != nil {
+		return nil, err
+	}
+	if c != nil {
+		return c.Set(ctx, req)
+	}
+
+	if err := s.store.SetKey(req.Key, bucketName, req.Value); err != nil {
+		return nil, storeError("Error setting key", err)
+	}
+	return &SetResponse{}, nil
+}
+
+// Delete deletes the key, if it has the expected value.
+func (s *Server) Delete(ctx context.Context, req *DeleteRequest) (*DeleteResponse, error) {
+	bucketName, err := requestBucket(req.Bucket)
+	if err != nil {
+		return nil, err
+	}
+	c, ctx, err := s.route(ctx, bucketName, req.Key)
+	if err != nil {
+		return nil, err
+	}
+	if c != nil {
+		return c.Delete(ctx, req)
+	}
+
+	err = s.store.Modify(bucketName, req.Key, func(value []byte) ([]byte, error) {
+		if value == nil {
+			return nil, errKeyNotFound
+		}
+		if req.IfValue != nil && string(value) != string(req.IfValue) {
+			return nil, errConditionFailed
+		}
+		return nil, nil
+	})
+	if errors.Is(err, db.ErrWrongType) {
+		// Typed values never match the if_value condition.
+		if req.IfValue != nil {
+			err = errConditionFailed
+		} else {
+			err = s.store.DelKey(bucketName, req.Key)
+		}
+	}
+
+	switch {
+	case errors.Is(err, errKeyNotFound):
+		return nil, status.Error(codes.NotFound, "Key not found")
+	case errors.Is(err, errConditionFailed):
+		return nil, status.Error(codes.FailedPrecondition, "Key has a different value")
+	case err != nil:
+		return nil, storeError("Error deleting key", err)
+	}
+	return &DeleteResponse{}, nil
+}
+
+// Batch applies the operations of each shard atomically, the shards
+// concurrently.
+func (s *Server) Batch(ctx context.Context, req *BatchRequest) (*BatchResponse, error) {
+	bucketName, err := requestBucket(req.Bucket)
+	if err != nil {
+		return nil, err
+	}
+	shards := s.cluster.Shards()
+	if err := checkEpoch(ctx, shards); err != nil {
+		return nil, err
+	}
+
+	groups := make(map[int][]*Op)
+	var idxs []int
+	for _, op := range req.Ops {
+		if op.Key == "" {
+			return nil, status.Error(codes.InvalidArgument, "key is required")
+		}
+		if !op.Delete {
+			if err := s.checkLimits(op.Key, op.Value); err != nil {
+				return nil, err
+			}
+		}
+
+		shard, err := s.cluster.Owner(bucketName, op.Key)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "Error getting bucket policy: %v", err)
+		}
+		if _, ok := groups[shard]; !ok {
+			idxs = append(idxs, shard)
+		}
+		groups[shard] = append(groups[shard], op)
+	}
+
+	errs := make([]error, len(idxs))
+	var wg sync.WaitGroup
+	for i, shard := range idxs {
+		wg.Add(1)
+		go func(i, shard int) {
+			defer wg.Done()
+			errs[i] = s.batch(ctx, shards, shard, bucketName, groups[shard])
+		}(i, shard)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &BatchResponse{}, nil
+}
+
+// batch applies the operations on the shard.
+func (s *Server) batch(ctx context.Context, shards *config.Shards, shard int, bucketName string, ops []*Op) error {
+	if shard != shards.CurIdx {
+		c, ctx, err := s.forward(ctx, shards, shard)
+		if err != nil {
+			return err
+		}
+		_, err = c.Batch(ctx, &BatchRequest{Bucket: bucketName, Ops: ops})
+		return err
+	}
+
+	dbOps := make([]db.Op, len(ops))
+	for i, op := range ops {
+		dbOps[i] = db.Op{Key: op.Key, Value: op.Value, Delete: op.Delete}
+	}
+	if err := s.store.Batch(bucketName, dbOps); err != nil {
+		return storeError("Error applying batch", err)
+	}
+	return nil
+}
+
+// scanSource returns the keys of a shard in order, nil after the last one.
+type scanSource func() (*KeyValue, error)
+
+// Scan streams the keys of the range from the shards that may hold them,
+// merged in order. Forwarded scans only return the keys of the shard.
+// Keys deleted during the scan and typed values are skipped.
+func (s *Server) Scan(req *ScanRequest, stream grpc.ServerStreamingServer[KeyValue]) error {
+	ctx, cancel := context.WithCancel(stream.Context())
+	defer cancel()
+
+	bucketName, err := requestBucket(req.Bucket)
+	if err != nil {
+		return err
+	}
+	start, end := req.Start, req.End
+	if req.Prefix != "" {
+		start, end = config.PrefixRange(req.Prefix)
+	}
+
+	shards := s.cluster.Shards()
+	if err := checkEpoch(ctx, shards); err != nil {
+		return err
+	}
+
+	idxs := []int{shards.CurIdx}
+	if _, forwarded, _ := incoming(ctx); !forwarded {
+		var err error
+		if idxs, err = s.cluster.ScanShards(bucketName, start, end); err != nil {
+			return status.Errorf(codes.Internal, "Error getting bucket policy: %v", err)
+		}
+	}
+
+	sources := make([]scanSource, len(idxs))
+	for i, shard := range idxs {
+		if shard == shards.CurIdx {
+			keys, err := s.store.ScanKeys(bucketName, start, end)
+			if err != nil {
+				return storeError("Error scanning keys", err)
+			}
+			sources[i] = s.localSource(bucketName, keys)
+			continue
+		}
+
+		c, fctx, err := s.forward(ctx, shards, shard)
+		if err != nil {
+			return err
+		}
+		remote, err := c.Scan(fctx, &ScanRequest{Bucket: bucketName, Start: start, End: end, Limit: req.Limit})
+		if err != nil {
+			return err
+		}
+		sources[i] = func() (*KeyValue, error) {
+			kv, err := remote.Recv()
+			if err == io.EOF {
+				return nil, nil
+			}
+			return kv, err
+		}
+	}
+
+	heads := make([]*KeyValue, len(sources))
+	for i, next := range sources {
+		var err error
+		if heads[i], err = next(); err != nil {
+			return err
+		}
+	}
+
+	for sent := uint32(0); req.Limit == 0 || sent < req.Limit; sent++ {
+		first := -1
+		for i, kv := range heads {
+			if kv != nil && (first < 0 || kv.Key < heads[first].Key) {
+				first = i
+			}
+		}
+		if first < 0 {
+			return nil
+		}
+
+		if err := stream.Send(heads[first]); err != nil {
+			return err
+		}
+		var err error
+		if heads[first], err = sources[first](); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// localSource returns the keys of the current shard with their values.
+func (s *Server) localSource(bucketName string, keys []string) scanSource {
+	return func() (*KeyValue, error) {
+		for len(keys) > 0 {
+			key := keys[0]
+			keys = keys[1:]
+
+			value, err := s.store.GetKey(key, bucketName)
+			if err != nil {
+				return nil, storeError("Error getting key", err)
+			}
+			if value != nil {
+				return &KeyValue{Key: key, Value: value}, nil
+			}
+		}
+		return nil, nil
+	}
+}
+
+// Watch streams the changes of the bucket on the current shard. Only the
+// changes of the keys owned by the shard are sent.
+func (s *Server) Watch(req *WatchRequest, stream grpc.ServerStreamingServer[Change]) error {
+	watcher, ok := s.store.(db.Watcher)
+	if !ok {
+		return status.Error(codes.Unimplemented, "The storage engine does not support watching")
+	}
+
+	last, err := watcher.LastSeq()
+	if errors.Is(err, db.ErrNoChangeLog) {
+		return status.Error(codes.FailedPrecondition, "The change log is disabled")
+	} else if err != nil {
+		return status.Errorf(codes.Internal, "Error reading the change log: %v", err)
+	}
+
+	since := last
+	if req.Since != nil {
+		if since = *req.Since; since > last {
+			return status.Errorf(codes.OutOfRange, "Sequence number %d is ahead of the change log at %d", since, last)
+		}
+	}
+
+	bucketName, err := requestBucket(req.Bucket)
+	if err != nil {
+		return err
+	}
+	ctx := stream.Context()
+	err = watcher.Watch(ctx, since, func(rec db.LogRecord) error {
+		if !s.watched(rec, bucketName, req.Prefix) {
+			return nil
+		}
+		return stream.Send(newChange(rec))
+	})
+	if ctx.Err() != nil {
+		return status.FromContextError(ctx.Err()).Err()
+	}
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+	return status.Errorf(codes.Internal, "Error watching the change log: %v", err)
+}
+
+// watched reports whether the change must be sent to the watcher.
+func (s *Server) watched(rec db.LogRecord, bucketName, prefix string) bool {
+	if rec.Bucket != bucketName {
+		return false
+	}
+
+	switch rec.Op {
+	case db.ChangeCreateBucket, db.ChangeDeleteBucket:
+		return true
+	}
+
+	// Keys left behind by a resharding are purged by the old shard,
+	// which must not look like a deletion to the watchers.
+	return strings.HasPrefix(rec.Key, prefix) && s.cluster.Owns(bucketName, rec.Key)
+}
+
+func newChange(rec db.LogRecord) *Change {
+	c := &Change{Seq: rec.Seq, Time: timestamppb.New(rec.Time), Op: rec.Op, Bucket: rec.Bucket, Key: rec.Key}
+	switch rec.Op {
+	case db.ChangeSet:
+		c.Value = rec.Value
+	case db.ChangeTyped:
+		var cmd db.Cmd
+		if json.Unmarshal(rec.Value, &cmd) == nil {
+			c.Command = cmd.Name
+		}
+	}
+	return c
+}
@@ -0,0 +1,282 @@
+package rpc_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"go-kvdb/config"
+	"go-kvdb/db"
+	"go-kvdb/rpc"
+	"go-kvdb/web"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+type testShard struct {
+	db     *db.Database
+	addr   string
+	client rpc.KVClient
+}
+
+// startShards starts the gRPC servers of a cluster that splits the keys at "m".
+func startShards(t *testing.T, n int) []testShard {
+	t.Helper()
+	return startTLSShards(t, n, config.TLSConfig{})
+}
+
+// startTLSShards is like startShards with the TLS config of every shard.
+func startTLSShards(t *testing.T, n int, tlsConfig config.TLSConfig) []testShard {
+	t.Helper()
+
+	serverCreds, clientCreds, err := rpc.Credentials(tlsConfig)
+	if err != nil {
+		t.Fatalf("Could not load the credentials: %v", err)
+	}
+
+	listeners := make([]net.Listener, n)
+	grpcAddrs := make(map[int]string)
+	for i := range listeners {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Could not listen: %v", err)
+		}
+		listeners[i] = l
+		grpcAddrs[i] = l.Addr().String()
+	}
+
+	res := make([]testShard, n)
+	for i, l := range listeners {
+		d, closeFunc, err := db.OpenDatabase(filepath.Join(t.TempDir(), "shard.db"), db.Options{ChangeLog: true})
+		if err != nil {
+			t.Fatalf("Could not create a new database: %v", err)
+		}
+		t.Cleanup(func() { closeFunc() })
+
+		// The HTTP addresses are not used.
+		shards := &config.Shards{Addrs: map[int]string{}, Count: n, CurIdx: i, Splits: []string{"m"}, GRPCAddrs: grpcAddrs}
+		rs := rpc.NewServer(d, web.NewServer(d, shards))
+		rs.SetCredentials(clientCreds)
+		t.Cleanup(func() { rs.Close() })
+
+		gs := grpc.NewServer(grpc.Creds(serverCreds))
+		rpc.RegisterKVServer(gs, rs)
+		go gs.Serve(l)
+		t.Cleanup(gs.Stop)
+
+		conn, err := grpc.NewClient(grpcAddrs[i], grpc.WithTransportCredentials(clientCreds))
+		if err != nil {
+			t.Fatalf("Could not connect to shard %d: %v", i, err)
+		}
+		t.Cleanup(func() { conn.Close() })
+
+		res[i] = testShard{db: d, addr: grpcAddrs[i], client: rpc.NewKVClient(conn)}
+	}
+	return res
+}
+
+// writeCert writes a self-signed certificate for 127.0.0.1 and its key.
+func writeCert(t *testing.T) config.TLSConfig {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Could not generate a key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "kvdb"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Could not create the certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Could not encode the key: %v", err)
+	}
+
+	dir := t.TempDir()
+	c := config.TLSConfig{CertFile: filepath.Join(dir, "cert.pem"), KeyFile: filepath.Join(dir, "key.pem")}
+	if err := os.WriteFile(c.CertFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatalf("Could not write the certificate: %v", err)
+	}
+	if err := os.WriteFile(c.KeyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatalf("Could not write the key: %v", err)
+	}
+	return c
+}
+
+func getLocal(t *testing.T, d *db.Database, key string) string {
+	t.Helper()
+	value, err := d.GetKey(key, "default")
+	if err != nil {
+		t.Fatalf("Could not get key %q: %v", key, err)
+	}
+	return string(value)
+}
+
+func scan(t *testing.T, c rpc.KVClient, req *rpc.ScanRequest) string {
+	t.Helper()
+	stream, err := c.Scan(context.Background(), req)
+	if err != nil {
+		t.Fatalf("Could not scan: %v", err)
+	}
+
+	var kvs []string
+	for {
+		kv, err := stream.Recv()
+		if err == io.EOF {
+			return strings.Join(kvs, ",")
+		}
+		if err != nil {
+			t.Fatalf("Could not scan: %v", err)
+		}
+		kvs = append(kvs, kv.Key+"="+string(kv.Value))
+	}
+}
+
+func TestForwarding(t *testing.T) {
+	cluster := startShards(t, 2)
+	c := cluster[0].client
+	ctx := context.Background()
+
+	if _, err := c.Set(ctx, &rpc.SetRequest{Key: "zebra", Value: []byte("stripes")}); err != nil {
+		t.Fatalf("Could not set key: %v", err)
+	}
+	if got := getLocal(t, cluster[1].db, "zebra"); got != "stripes" {
+		t.Errorf("Key zebra was not stored on the second shard: got %q", got)
+	}
+	if res, err := c.Get(ctx, &rpc.GetRequest{Key: "zebra"}); err != nil || string(res.Value) != "stripes" {
+		t.Errorf("Unexpected value of zebra: got %v, %v", res, err)
+	}
+	if _, err := c.Get(ctx, &rpc.GetRequest{Key: "missing"}); status.Code(err) != codes.NotFound {
+		t.Errorf("Unexpected error for a missing key: got %v, want NotFound", err)
+	}
+	if _, err := c.Get(ctx, &rpc.GetRequest{Bucket: "__flags", Key: "zebra"}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Unexpected error for a system bucket: got %v, want InvalidArgument", err)
+	}
+	if _, err := c.Set(ctx, &rpc.SetRequest{Bucket: "__txnlocks", Key: "a", Value: []byte("b")}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Unexpected error for a system bucket: got %v, want InvalidArgument", err)
+	}
+
+	_, err := c.Batch(ctx, &rpc.BatchRequest{Ops: []*rpc.Op{
+		{Key: "apple", Value: []byte("1")},
+		{Key: "zoo", Value: []byte("2")},
+		{Key: "banana", Value: []byte("3")},
+		{Key: "zebra", Delete: true},
+	}})
+	if err != nil {
+		t.Fatalf("Could not apply the batch: %v", err)
+	}
+	if got := getLocal(t, cluster[1].db, "zoo"); got != "2" {
+		t.Errorf("Key zoo was not stored on the second shard: got %q", got)
+	}
+	if got := getLocal(t, cluster[0].db, "apple"); got != "1" {
+		t.Errorf("Key apple was not stored on the first shard: got %q", got)
+	}
+
+	if got := scan(t, c, &rpc.ScanRequest{}); got != "apple=1,banana=3,zoo=2" {
+		t.Errorf("Unexpected scan: got %q", got)
+	}
+	if got := scan(t, cluster[1].client, &rpc.ScanRequest{Start: "b", Limit: 2}); got != "banana=3,zoo=2" {
+		t.Errorf("Unexpected scan with a limit: got %q", got)
+	}
+	if got := scan(t, c, &rpc.ScanRequest{Prefix: "z"}); got != "zoo=2" {
+		t.Errorf("Unexpected scan with a prefix: got %q", got)
+	}
+
+	_, err = c.Delete(ctx, &rpc.DeleteRequest{Key: "zoo", IfValue: []byte("3")})
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("Unexpected error for a failed condition: got %v, want FailedPrecondition", err)
+	}
+	if _, err := c.Delete(ctx, &rpc.DeleteRequest{Key: "zoo", IfValue: []byte("2")}); err != nil {
+		t.Errorf("Could not delete key: %v", err)
+	}
+	if _, err := c.Delete(ctx, &rpc.DeleteRequest{Key: "zoo"}); status.Code(err) != codes.NotFound {
+		t.Errorf("Unexpected error for a missing key: got %v, want NotFound", err)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	cluster := startShards(t, 2)
+	c := cluster[1].client
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	for _, key := range []string{"zebra", "apple", "zoo", "yak"} {
+		if _, err := c.Set(ctx, &rpc.SetRequest{Key: key, Value: []byte("v")}); err != nil {
+			t.Fatalf("Could not set key %q: %v", key, err)
+		}
+	}
+
+	// Only the bucket changes and the keys of the shard with the prefix
+	// are sent, from the start of the change log.
+	stream, err := c.Watch(ctx, &rpc.WatchRequest{Prefix: "z", Since: proto.Uint64(0)})
+	if err != nil {
+		t.Fatalf("Could not watch: %v", err)
+	}
+	for _, want := range []string{"createBucket ", "set zebra", "set zoo"} {
+		change, err := stream.Recv()
+		if err != nil {
+			t.Fatalf("Could not receive a change: %v", err)
+		}
+		if got := change.Op + " " + change.Key; got != want {
+			t.Errorf("Unexpected change: got %q, want %q", got, want)
+		}
+	}
+
+	stream, err = c.Watch(ctx, &rpc.WatchRequest{Since: proto.Uint64(1000)})
+	if err == nil {
+		_, err = stream.Recv()
+	}
+	if status.Code(err) != codes.OutOfRange {
+		t.Errorf("Unexpected error for a sequence number ahead of the log: got %v, want OutOfRange", err)
+	}
+}
+
+func TestTLS(t *testing.T) {
+	shards := startTLSShards(t, 2, writeCert(t))
+
+	// The key of the second shard is forwarded over TLS.
+	ctx := context.Background()
+	if _, err := shards[0].client.Set(ctx, &rpc.SetRequest{Key: "zebra", Value: []byte("stripes")}); err != nil {
+		t.Fatalf("Could not set key: %v", err)
+	}
+	if got := getLocal(t, shards[1].db, "zebra"); got != "stripes" {
+		t.Errorf("Unexpected value on the second shard: got %q, want %q", got, "stripes")
+	}
+
+	// Plaintext clients are rejected.
+	conn, err := grpc.NewClient(shards[0].addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("Could not create the client: %v", err)
+	}
+	defer conn.Close()
+	if _, err := rpc.NewKVClient(conn).Get(ctx, &rpc.GetRequest{Key: "zebra"}); status.Code(err) != codes.Unavailable {
+		t.Errorf("Unexpected error of a plaintext call: got %v, want Unavailable", err)
+	}
+}
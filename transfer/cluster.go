@@ -0,0 +1,275 @@
+package transfer
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"go-kvdb/config"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// Conflict policies decide what happens when an imported key already exists.
+const (
+	ConflictSkip      = "skip"
+	ConflictOverwrite = "overwrite"
+	ConflictFail      = "fail"
+)
+
+// CheckConflict returns an error for unknown conflict policies.
+func CheckConflict(conflict string) error {
+	switch conflict {
+	case ConflictSkip, ConflictOverwrite, ConflictFail:
+		return nil
+	default:
+		return fmt.Errorf("unknown conflict policy %q, want %q, %q or %q", conflict, ConflictSkip, ConflictOverwrite, ConflictFail)
+	}
+}
+
+// Result counts the imported records.
+type Result struct {
+	Imported int `json:"imported"`
+	Skipped  int `json:"skipped"`
+}
+
+// Add adds the counts of the other result.
+func (r *Result) Add(o Result) {
+	r.Imported += o.Imported
+	r.Skipped += o.Skipped
+}
+
+// StatusError is returned for the import requests rejected by a shard.
+type StatusError struct {
+	Status  int
+	Message string
+}
+
+func (e *StatusError) Error() string { return e.Message }
+
+// BatchSize is the number of records sent to a shard in one request.
+const BatchSize = 500
+
+// sortedShards returns the shards of the config in index order.
+func sortedShards(c config.Config) []config.Shard {
+	shards := append([]config.Shard{}, c.Shards...)
+	sort.Slice(shards, func(i, j int) bool { return shards[i].Idx < shards[j].Idx })
+	return shards
+}
+
+// Export writes the keys of the buckets, or of all buckets if none are
+// given, from every shard to w. The shards are read one after another and
+// every shard streams only the keys it owns. progress, if not nil, is
+// called with the number of records written so far after every batch.
+func Export(ctx context.Context, c config.Config, buckets []string, w *Writer, progress func(int)) (int, error) {
+	client, err := config.NewClient(c.Node.TLS)
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for _, s := range sortedShards(c) {
+		q := url.Values{"bucket": buckets}
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, client.URL(s.Address, "/admin/export?"+q.Encode()), nil)
+		if err != nil {
+			return n, err
+		}
+
+		err = func() error {
+			resp, err := client.Do(req)
+			if err != nil {
+				return err
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode != http.StatusOK {
+				body, _ := io.ReadAll(resp.Body)
+				return fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(body))
+			}
+
+			r, err := NewReader(resp.Body, FormatNDJSON)
+			if err != nil {
+				return err
+			}
+			for {
+				rec, err := r.Read()
+				if err == io.EOF {
+					return nil
+				} else if err != nil {
+					return err
+				}
+
+				if err := w.Write(rec); err != nil {
+					return err
+				}
+				n++
+				if progress != nil && n%BatchSize == 0 {
+					progress(n)
+				}
+			}
+		}()
+		if err != nil {
+			return n, fmt.Errorf("exporting shard %q: %w", s.Name, err)
+		}
+	}
+
+	if progress != nil {
+		progress(n)
+	}
+	return n, w.Flush()
+}
+
+// Import reads the records and sends them to the shards that own them
+// according to Shards.Index, in batches of BatchSize records. Buckets
+// that are not known yet are created on every shard first. The shards
+// re-route the keys of buckets with a different sharding policy.
+//
+// With the "fail" conflict policy the import stops at the first key that
+// already exists; the records sent before it remain imported. progress,
+// if not nil, is called with the running totals after every batch.
+func Import(ctx context.Context, c config.Config, r *Reader, conflict string, progress func(Result)) (Result, error) {
+	var total Result
+
+	if err := CheckConflict(conflict); err != nil {
+		return total, err
+	}
+
+	shardList := sortedShards(c)
+	if len(shardList) == 0 {
+		return total, fmt.Errorf("no shards in the config")
+	}
+	shards, err := config.NewShards(c, shardList[0].Name)
+	if err != nil {
+		return total, err
+	}
+	client, err := config.NewClient(c.Node.TLS)
+	if err != nil {
+		return total, err
+	}
+
+	batches := make(map[int][]Record)
+	flush := func(idx int) error {
+		if len(batches[idx]) == 0 {
+			return nil
+		}
+
+		res, err := SendBatch(ctx, client, shards.Addrs[idx], batches[idx], conflict, nil)
+		total.Add(res)
+		batches[idx] = batches[idx][:0]
+		if err != nil {
+			return fmt.Errorf("importing to shard %d: %w", idx, err)
+		}
+
+		if progress != nil {
+			progress(total)
+		}
+		return nil
+	}
+
+	created := make(map[string]bool)
+	for {
+		rec, err := r.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return total, err
+		}
+
+		if !created[rec.Bucket] {
+			if err := createBucket(ctx, client, shards.Addrs[shards.CurIdx], rec.Bucket); err != nil {
+				return total, fmt.Errorf("creating bucket %q: %w", rec.Bucket, err)
+			}
+			created[rec.Bucket] = true
+		}
+
+		idx := shards.Index(rec.Key)
+		batches[idx] = append(batches[idx], rec)
+		if len(batches[idx]) >= BatchSize {
+			if err := flush(idx); err != nil {
+				return total, err
+			}
+		}
+	}
+
+	for idx := 0; idx < shards.Count; idx++ {
+		if err := flush(idx); err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+// createBucket creates the bucket on every shard through the given one.
+// An existing bucket keeps its sharding policy.
+func createBucket(ctx context.Context, client *config.Client, addr, bucketName string) error {
+	form := url.Values{"bucketName": {bucketName}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, client.URL(addr, "/createBucket"), strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(body))
+	}
+	return nil
+}
+
+// SendBatch posts the records to the import endpoint of the shard with
+// the client. The header, if not nil, is added to the request.
+func SendBatch(ctx context.Context, client *config.Client, addr string, recs []Record, conflict string, header http.Header) (Result, error) {
+	var res Result
+
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, FormatNDJSON)
+	if err != nil {
+		return res, err
+	}
+	for _, rec := range recs {
+		if err := w.Write(rec); err != nil {
+			return res, err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return res, err
+	}
+
+	u := client.URL(addr, "/admin/import?"+url.Values{"conflict": {conflict}}.Encode())
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, &buf)
+	if err != nil {
+		return res, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return res, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return res, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return res, &StatusError{Status: resp.StatusCode, Message: fmt.Sprintf("%s: %s", resp.Status, bytes.TrimSpace(body))}
+	}
+
+	if err := json.Unmarshal(body, &res); err != nil {
+		return res, fmt.Errorf("decoding import result: %w", err)
+	}
+	return res, nil
+}
@@ -0,0 +1,124 @@
+package transfer_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"go-kvdb/config"
+	"go-kvdb/db"
+	"go-kvdb/transfer"
+	"go-kvdb/web"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// startCluster starts the shards of a cluster with in-memory stores.
+func startCluster(t *testing.T, n int) (config.Config, []*db.MemStore) {
+	t.Helper()
+
+	c := config.Config{Epoch: 1}
+	muxes := make([]*http.ServeMux, n)
+	for i := 0; i < n; i++ {
+		i := i
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			muxes[i].ServeHTTP(w, r)
+		}))
+		t.Cleanup(ts.Close)
+
+		c.Shards = append(c.Shards, config.Shard{
+			Name:    fmt.Sprintf("sh-%d", i),
+			Idx:     i,
+			Address: strings.TrimPrefix(ts.URL, "http://"),
+		})
+	}
+
+	stores := make([]*db.MemStore, n)
+	for i := 0; i < n; i++ {
+		shards, err := config.NewShards(c, c.Shards[i].Name)
+		if err != nil {
+			t.Fatalf("Could not parse the shards: %v", err)
+		}
+
+		stores[i] = db.NewMemStore()
+		srv := web.NewServer(stores[i], shards)
+
+		mux := http.NewServeMux()
+		mux.HandleFunc("/createBucket", srv.CreateBucket)
+		mux.HandleFunc("/admin/export", srv.ExportHandler)
+		mux.HandleFunc("/admin/import", srv.ImportHandler)
+		muxes[i] = mux
+	}
+
+	return c, stores
+}
+
+func importNDJSON(t *testing.T, c config.Config, input, conflict string) (transfer.Result, error) {
+	t.Helper()
+
+	r, err := transfer.NewReader(strings.NewReader(input), transfer.FormatNDJSON)
+	if err != nil {
+		t.Fatalf("Could not create the reader: %v", err)
+	}
+	return transfer.Import(context.Background(), c, r, conflict, nil)
+}
+
+func TestImportExport(t *testing.T) {
+	c, stores := startCluster(t, 2)
+
+	var input strings.Builder
+	for i := 0; i < 1200; i++ {
+		fmt.Fprintf(&input, "{\"bucket\":\"users\",\"key\":\"user-%d\",\"value\":\"v%d\"}\n", i, i)
+	}
+
+	res, err := importNDJSON(t, c, input.String(), transfer.ConflictFail)
+	if err != nil {
+		t.Fatalf("Could not import: %v", err)
+	}
+	if res != (transfer.Result{Imported: 1200}) {
+		t.Errorf("Unexpected import result: %+v", res)
+	}
+
+	// Every key must be stored on the shard that owns it.
+	shards, _ := config.NewShards(c, "sh-0")
+	for i := 0; i < 1200; i++ {
+		key := fmt.Sprintf("user-%d", i)
+		v, err := stores[shards.Index(key)].GetKey(key, "users")
+		if err != nil || string(v) != fmt.Sprintf("v%d", i) {
+			t.Fatalf("Key %q is not on shard %d: got %q, %v", key, shards.Index(key), v, err)
+		}
+	}
+
+	input.Reset()
+	input.WriteString("{\"bucket\":\"users\",\"key\":\"user-1\",\"value\":\"new\"}\n")
+	input.WriteString("{\"bucket\":\"users\",\"key\":\"extra\",\"value\":\"x\"}\n")
+
+	if res, err := importNDJSON(t, c, input.String(), transfer.ConflictSkip); err != nil || res != (transfer.Result{Imported: 1, Skipped: 1}) {
+		t.Errorf("Unexpected result of the import with skip: %+v, %v", res, err)
+	}
+	if _, err := importNDJSON(t, c, input.String(), transfer.ConflictFail); err == nil || !strings.Contains(err.Error(), "409") {
+		t.Errorf("Expected a conflict error, got %v", err)
+	}
+	if res, err := importNDJSON(t, c, input.String(), transfer.ConflictOverwrite); err != nil || res.Imported != 2 {
+		t.Errorf("Unexpected result of the import with overwrite: %+v, %v", res, err)
+	}
+
+	var buf bytes.Buffer
+	w, _ := transfer.NewWriter(&buf, transfer.FormatCSV)
+	n, err := transfer.Export(context.Background(), c, []string{"users"}, w, nil)
+	if err != nil {
+		t.Fatalf("Could not export: %v", err)
+	}
+	if n != 1201 {
+		t.Errorf("Unexpected number of exported records: got %d, want %d", n, 1201)
+	}
+	if !strings.Contains(buf.String(), "users,user-1,new,,,\n") {
+		t.Errorf("Overwritten value is missing from the export")
+	}
+
+	w, _ = transfer.NewWriter(&buf, transfer.FormatCSV)
+	if _, err := transfer.Export(context.Background(), c, []string{"missing"}, w, nil); err == nil {
+		t.Errorf("Expected error when exporting a missing bucket")
+	}
+}
@@ -0,0 +1,342 @@
+// Package transfer exports the cluster data to portable formats
+// and imports it back.
+package transfer
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"go-kvdb/db"
+	"io"
+	"strconv"
+	"time"
+	"unicode/utf8"
+)
+
+// Supported formats.
+const (
+	FormatNDJSON = "ndjson"
+	FormatCSV    = "csv"
+)
+
+// Record is a single key of a bucket. Typed values, such as hashes and
+// lists, have no Value but the Commands that rebuild them. Plain values
+// keep their expiry time and flags, which are zero if they have none.
+type Record struct {
+	Bucket   string
+	Key      string
+	Value    []byte
+	Commands []db.Cmd
+	Expires  time.Time
+	Flags    uint32
+}
+
+// jsonRecord is the NDJSON encoding of a record. Values that are valid
+// UTF-8 are written as text, the others are base64 encoded.
+type jsonRecord struct {
+	Bucket      string     `json:"bucket"`
+	Key         string     `json:"key"`
+	Value       *string    `json:"value,omitempty"`
+	ValueBase64 *string    `json:"value_base64,omitempty"`
+	Commands    []db.Cmd   `json:"commands,omitempty"`
+	Expires     *time.Time `json:"expires,omitempty"`
+	Flags       uint32     `json:"flags,omitempty"`
+}
+
+// csvHeader is the first line of CSV files. The encoding column
+// is "base64" for binary values, "commands" for typed values written
+// as the JSON encoded commands and empty for text ones. The expires
+// column holds the RFC 3339 expiry time and is empty for keys that do
+// not expire, the flags column is empty for zero flags. Files written
+// before these two columns were added are read as well.
+var csvHeader = []string{"bucket", "key", "value", "encoding", "expires", "flags"}
+
+// csvBaseColumns is the number of columns of the files without the
+// expires and flags columns.
+const csvBaseColumns = 4
+
+const (
+	encodingBase64   = "base64"
+	encodingCommands = "commands"
+)
+
+// encodeValue returns the value as text and whether it is base64 encoded.
+func encodeValue(v []byte) (string, bool) {
+	if utf8.Valid(v) {
+		return string(v), false
+	}
+	return base64.StdEncoding.EncodeToString(v), true
+}
+
+func checkFormat(format string) error {
+	switch format {
+	case FormatNDJSON, FormatCSV:
+		return nil
+	default:
+		return fmt.Errorf("unknown format %q, want %q or %q", format, FormatNDJSON, FormatCSV)
+	}
+}
+
+// Writer writes records in one of the formats.
+type Writer struct {
+	format string
+	bw     *bufio.Writer
+	csv    *csv.Writer
+	header bool
+}
+
+// NewWriter returns a writer of the format. Flush must be called
+// after the last record.
+func NewWriter(w io.Writer, format string) (*Writer, error) {
+	if err := checkFormat(format); err != nil {
+		return nil, err
+	}
+
+	wr := &Writer{format: format, bw: bufio.NewWriter(w)}
+	if format == FormatCSV {
+		wr.csv = csv.NewWriter(wr.bw)
+	}
+	return wr, nil
+}
+
+// Write writes the record.
+func (w *Writer) Write(rec Record) error {
+	text, b64 := encodeValue(rec.Value)
+
+	if w.format == FormatCSV {
+		if !w.header {
+			w.header = true
+			if err := w.csv.Write(csvHeader); err != nil {
+				return err
+			}
+		}
+
+		if rec.Commands != nil {
+			data, err := json.Marshal(rec.Commands)
+			if err != nil {
+				return err
+			}
+			return w.csv.Write([]string{rec.Bucket, rec.Key, string(data), encodingCommands, "", ""})
+		}
+
+		// The CSV reader turns \r\n into \n, even in quoted fields.
+		if !b64 && bytes.IndexByte(rec.Value, '\r') >= 0 {
+			text, b64 = base64.StdEncoding.EncodeToString(rec.Value), true
+		}
+
+		encoding, expires, flags := "", "", ""
+		if b64 {
+			encoding = encodingBase64
+		}
+		if !rec.Expires.IsZero() {
+			expires = rec.Expires.UTC().Format(time.RFC3339Nano)
+		}
+		if rec.Flags != 0 {
+			flags = strconv.FormatUint(uint64(rec.Flags), 10)
+		}
+		return w.csv.Write([]string{rec.Bucket, rec.Key, text, encoding, expires, flags})
+	}
+
+	jr := jsonRecord{Bucket: rec.Bucket, Key: rec.Key, Commands: rec.Commands, Flags: rec.Flags}
+	if !rec.Expires.IsZero() {
+		expires := rec.Expires.UTC()
+		jr.Expires = &expires
+	}
+	switch {
+	case rec.Commands != nil:
+	case b64:
+		jr.ValueBase64 = &text
+	default:
+		jr.Value = &text
+	}
+
+	data, err := json.Marshal(jr)
+	if err != nil {
+		return err
+	}
+	w.bw.Write(data)
+	return w.bw.WriteByte('\n')
+}
+
+// Flush writes the buffered records.
+func (w *Writer) Flush() error {
+	if w.csv != nil {
+		w.csv.Flush()
+		if err := w.csv.Error(); err != nil {
+			return err
+		}
+	}
+	return w.bw.Flush()
+}
+
+// Reader reads records in one of the formats.
+type Reader struct {
+	format string
+	br     *bufio.Reader
+	csv    *csv.Reader
+	line   int
+}
+
+// NewReader returns a reader of the format.
+func NewReader(r io.Reader, format string) (*Reader, error) {
+	if err := checkFormat(format); err != nil {
+		return nil, err
+	}
+
+	rd := &Reader{format: format, br: bufio.NewReader(r)}
+	if format == FormatCSV {
+		rd.csv = csv.NewReader(rd.br)
+		// The header sets the number of fields of all lines.
+		rd.csv.FieldsPerRecord = 0
+		rd.csv.ReuseRecord = true
+	}
+	return rd, nil
+}
+
+// Read returns the next record or io.EOF at the end of the input.
+func (r *Reader) Read() (Record, error) {
+	if r.format == FormatCSV {
+		return r.readCSV()
+	}
+
+	for {
+		line, err := r.br.ReadBytes('\n')
+		if err == io.EOF && len(line) > 0 {
+			err = nil
+		}
+		if err != nil {
+			return Record{}, err
+		}
+		r.line++
+
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+
+		var jr jsonRecord
+		if err := json.Unmarshal(line, &jr); err != nil {
+			return Record{}, fmt.Errorf("line %d: %w", r.line, err)
+		}
+		rec, err := r.record(jr.Bucket, jr.Key, jr.Value, jr.ValueBase64)
+		if err != nil {
+			return Record{}, err
+		}
+		if jr.Expires != nil {
+			rec.Expires = *jr.Expires
+		}
+		rec.Flags = jr.Flags
+		if len(jr.Commands) == 0 {
+			return rec, nil
+		}
+		if jr.Value != nil || jr.ValueBase64 != nil {
+			return Record{}, fmt.Errorf("line %d: both value and commands are set", r.line)
+		}
+		return r.typed(rec, jr.Commands)
+	}
+}
+
+func (r *Reader) readCSV() (Record, error) {
+	if r.line == 0 {
+		header, err := r.csv.Read()
+		if err != nil {
+			return Record{}, err
+		}
+		r.line++
+		if len(header) != len(csvHeader) && len(header) != csvBaseColumns {
+			return Record{}, fmt.Errorf("line 1: unexpected number of columns %d, want %d", len(header), len(csvHeader))
+		}
+		for i, name := range header {
+			if csvHeader[i] != name {
+				return Record{}, fmt.Errorf("line 1: unexpected column %q, want %q", name, csvHeader[i])
+			}
+		}
+	}
+
+	fields, err := r.csv.Read()
+	if err != nil {
+		return Record{}, err
+	}
+	r.line, _ = r.csv.FieldPos(0)
+
+	var rec Record
+	value := fields[2]
+	switch fields[3] {
+	case "":
+		rec, err = r.record(fields[0], fields[1], &value, nil)
+	case encodingBase64:
+		rec, err = r.record(fields[0], fields[1], nil, &value)
+	case encodingCommands:
+		rec, err = r.record(fields[0], fields[1], nil, nil)
+	default:
+		return Record{}, fmt.Errorf("line %d: unknown encoding %q", r.line, fields[3])
+	}
+	if err != nil {
+		return Record{}, err
+	}
+
+	if len(fields) > csvBaseColumns {
+		if fields[4] != "" {
+			if rec.Expires, err = time.Parse(time.RFC3339Nano, fields[4]); err != nil {
+				return Record{}, fmt.Errorf("line %d: decoding expiry time: %w", r.line, err)
+			}
+		}
+		if fields[5] != "" {
+			flags, err := strconv.ParseUint(fields[5], 10, 32)
+			if err != nil {
+				return Record{}, fmt.Errorf("line %d: decoding flags: %w", r.line, err)
+			}
+			rec.Flags = uint32(flags)
+		}
+	}
+
+	if fields[3] != encodingCommands {
+		return rec, nil
+	}
+	var cmds []db.Cmd
+	if err := json.Unmarshal([]byte(value), &cmds); err != nil {
+		return Record{}, fmt.Errorf("line %d: decoding commands: %w", r.line, err)
+	}
+	return r.typed(rec, cmds)
+}
+
+// typed turns the record into the one of a typed value.
+func (r *Reader) typed(rec Record, cmds []db.Cmd) (Record, error) {
+	if len(cmds) == 0 {
+		return Record{}, fmt.Errorf("line %d: commands are empty", r.line)
+	}
+	if !rec.Expires.IsZero() || rec.Flags != 0 {
+		return Record{}, fmt.Errorf("line %d: typed values have no expiry time or flags", r.line)
+	}
+	rec.Value, rec.Commands = nil, cmds
+	return rec, nil
+}
+
+func (r *Reader) record(bucket, key string, value, valueBase64 *string) (Record, error) {
+	rec := Record{Bucket: bucket, Key: key}
+	if rec.Bucket == "" {
+		rec.Bucket = "default"
+	}
+	if rec.Key == "" {
+		return Record{}, fmt.Errorf("line %d: key is empty", r.line)
+	}
+
+	switch {
+	case value != nil && valueBase64 != nil:
+		return Record{}, fmt.Errorf("line %d: both value and value_base64 are set", r.line)
+	case valueBase64 != nil:
+		v, err := base64.StdEncoding.DecodeString(*valueBase64)
+		if err != nil {
+			return Record{}, fmt.Errorf("line %d: decoding value: %w", r.line, err)
+		}
+		rec.Value = v
+	case value != nil:
+		rec.Value = []byte(*value)
+	default:
+		rec.Value = []byte{}
+	}
+	return rec, nil
+}
@@ -0,0 +1,91 @@
+package transfer_test
+
+import (
+	"bytes"
+	"go-kvdb/db"
+	"go-kvdb/transfer"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFormatRoundTrip(t *testing.T) {
+	records := []transfer.Record{
+		{Bucket: "default", Key: "text", Value: []byte("Great")},
+		{Bucket: "users", Key: "binary", Value: []byte{0xff, 0x00, 0xfe}},
+		{Bucket: "users", Key: "lines", Value: []byte("a,\"b\"\r\nc")},
+		{Bucket: "default", Key: "empty", Value: []byte{}},
+		{Bucket: "default", Key: "session", Value: []byte("s"), Expires: time.Date(2030, 1, 2, 3, 4, 5, 6, time.UTC), Flags: 42},
+		{Bucket: "users", Key: "hash", Commands: []db.Cmd{db.NewCmd("hset", "name", "alice"), db.NewCmd("hset", "bin", "\xff")}},
+	}
+
+	for _, format := range []string{transfer.FormatNDJSON, transfer.FormatCSV} {
+		t.Run(format, func(t *testing.T) {
+			var buf bytes.Buffer
+			w, err := transfer.NewWriter(&buf, format)
+			if err != nil {
+				t.Fatalf("Could not create the writer: %v", err)
+			}
+			for _, rec := range records {
+				if err := w.Write(rec); err != nil {
+					t.Fatalf("Could not write %q: %v", rec.Key, err)
+				}
+			}
+			if err := w.Flush(); err != nil {
+				t.Fatalf("Could not flush the writer: %v", err)
+			}
+
+			r, err := transfer.NewReader(&buf, format)
+			if err != nil {
+				t.Fatalf("Could not create the reader: %v", err)
+			}
+
+			var got []transfer.Record
+			for {
+				rec, err := r.Read()
+				if err == io.EOF {
+					break
+				} else if err != nil {
+					t.Fatalf("Could not read a record: %v", err)
+				}
+				got = append(got, rec)
+			}
+
+			if !reflect.DeepEqual(got, records) {
+				t.Errorf("Unexpected records: got %q, want %q", got, records)
+			}
+		})
+	}
+}
+
+func TestReadErrors(t *testing.T) {
+	for _, tc := range []struct {
+		format, input, want string
+	}{
+		{transfer.FormatNDJSON, "{\"key\":\"a\"}\n\n{\"key\":\n", "line 3"},
+		{transfer.FormatNDJSON, `{"key":"a","value":"x","value_base64":"eA=="}`, "both value and value_base64"},
+		{transfer.FormatNDJSON, `{"key":"a","value_base64":"!"}`, "decoding value"},
+		{transfer.FormatCSV, "bucket,name,value,encoding\n", `unexpected column "name"`},
+		{transfer.FormatCSV, "bucket,key,value,encoding\ndefault,a,b,hex\n", `line 2: unknown encoding "hex"`},
+		{transfer.FormatCSV, "bucket,key,value,encoding\ndefault,,b,\n", "line 2: key is empty"},
+		{transfer.FormatNDJSON, `{"key":"a","value":"x","commands":[{"name":"sadd"}]}`, "both value and commands"},
+		{transfer.FormatCSV, "bucket,key,value,encoding\ndefault,a,[,commands\n", "line 2: decoding commands"},
+		{transfer.FormatCSV, "bucket,key,value,encoding,expires,flags\ndefault,a,b,,soon,\n", "line 2: decoding expiry time"},
+		{transfer.FormatCSV, "bucket,key,value,encoding,expires,flags\ndefault,a,b,,,-1\n", "line 2: decoding flags"},
+		{transfer.FormatNDJSON, `{"key":"a","flags":1,"commands":[{"name":"sadd"}]}`, "typed values have no expiry time or flags"},
+	} {
+		r, err := transfer.NewReader(strings.NewReader(tc.input), tc.format)
+		if err != nil {
+			t.Fatalf("Could not create the reader: %v", err)
+		}
+
+		for err == nil {
+			_, err = r.Read()
+		}
+		if err == io.EOF || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("Unexpected error for %q: got %v, want %q", tc.input, err, tc.want)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"go-kvdb/config"
+	"go-kvdb/transfer"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// formatOf returns the transfer format given with the flag
+// or detected by the file extension.
+func formatOf(format, file string) string {
+	if format != "" {
+		return format
+	}
+	if strings.EqualFold(filepath.Ext(file), ".csv") {
+		return transfer.FormatCSV
+	}
+	return transfer.FormatNDJSON
+}
+
+// runExportCommand implements "go-kvdb export" and returns the process exit code.
+func runExportCommand(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	file := fs.String("config-file", "sharding.toml", "Config file with the shards to export")
+	configFormat := fs.String("config-format", "", "Format of the config file: toml, json or yaml (detected by the extension by default)")
+	buckets := fs.String("buckets", "", "Comma-separated buckets to export, all buckets if empty")
+	out := fs.String("out", "-", "File to write the records to, - for the standard output")
+	format := fs.String("format", "", "Format of the records: ndjson or csv (detected by the extension by default)")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	c, err := config.ParseFileFormat(*file, *configFormat)
+	if err != nil {
+		fmt.Fprintf(stderr, "Error parsing config %q: %v\n", *file, err)
+		return 1
+	}
+
+	dst := stdout
+	if *out != "-" {
+		f, err := os.Create(*out)
+		if err != nil {
+			fmt.Fprintf(stderr, "Error creating %q: %v\n", *out, err)
+			return 1
+		}
+		defer f.Close()
+		dst = f
+	}
+
+	w, err := transfer.NewWriter(dst, formatOf(*format, *out))
+	if err != nil {
+		fmt.Fprintf(stderr, "Error: %v\n", err)
+		return 2
+	}
+
+	var names []string
+	if *buckets != "" {
+		names = strings.Split(*buckets, ",")
+	}
+
+	n, err := transfer.Export(context.Background(), c, names, w, func(n int) {
+		fmt.Fprintf(stderr, "\rExported %d records", n)
+	})
+	fmt.Fprintln(stderr)
+	if err != nil {
+		fmt.Fprintf(stderr, "Error exporting: %v\n", err)
+		return 1
+	}
+
+	fmt.Fprintf(stderr, "Exported %d records from %d shards\n", n, len(c.Shards))
+	return 0
+}
+
+// runImportCommand implements "go-kvdb import" and returns the process exit code.
+func runImportCommand(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	file := fs.String("config-file", "sharding.toml", "Config file with the shards to import to")
+	configFormat := fs.String("config-format", "", "Format of the config file: toml, json or yaml (detected by the extension by default)")
+	in := fs.String("in", "-", "File to read the records from, - for the standard input")
+	format := fs.String("format", "", "Format of the records: ndjson or csv (detected by the extension by default)")
+	conflict := fs.String("conflict", transfer.ConflictSkip, "What to do with existing keys: skip, overwrite or fail")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	if err := transfer.CheckConflict(*conflict); err != nil {
+		fmt.Fprintf(stderr, "Error: %v\n", err)
+		return 2
+	}
+
+	c, err := config.ParseFileFormat(*file, *configFormat)
+	if err != nil {
+		fmt.Fprintf(stderr, "Error parsing config %q: %v\n", *file, err)
+		return 1
+	}
+
+	var src io.Reader = os.Stdin
+	if *in != "-" {
+		f, err := os.Open(*in)
+		if err != nil {
+			fmt.Fprintf(stderr, "Error opening %q: %v\n", *in, err)
+			return 1
+		}
+		defer f.Close()
+		src = f
+	}
+
+	r, err := transfer.NewReader(src, formatOf(*format, *in))
+	if err != nil {
+		fmt.Fprintf(stderr, "Error: %v\n", err)
+		return 2
+	}
+
+	res, err := transfer.Import(context.Background(), c, r, *conflict, func(res transfer.Result) {
+		fmt.Fprintf(stderr, "\rImported %d records, skipped %d", res.Imported, res.Skipped)
+	})
+	fmt.Fprintln(stderr)
+	if err != nil {
+		fmt.Fprintf(stderr, "Error importing after %d imported and %d skipped records: %v\n", res.Imported, res.Skipped, err)
+		return 1
+	}
+
+	fmt.Fprintf(stdout, "Imported %d records, skipped %d existing keys\n", res.Imported, res.Skipped)
+	return 0
+}
@@ -0,0 +1,39 @@
+package web
+
+import (
+	"fmt"
+	"go-kvdb/db"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// ShardHeader carries the index of the shard that produced a backup.
+const ShardHeader = "X-Kvdb-Shard"
+
+// BackupHandler streams a consistent snapshot of the shard database.
+// Writes are not blocked while the backup is taken.
+func (s *Server) BackupHandler(w http.ResponseWriter, r *http.Request) {
+	b, ok := s.db.(db.Backuper)
+	if !ok {
+		http.Error(w, "The storage engine does not support backups", http.StatusNotImplemented)
+		return
+	}
+
+	shards := s.Shards()
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=shard-%d.db", shards.CurIdx))
+	w.Header().Set(ShardHeader, strconv.Itoa(shards.CurIdx))
+	w.Header().Set(EpochHeader, strconv.FormatInt(shards.Epoch, 10))
+
+	// Backups of large shards outlive the write timeout of the server.
+	http.NewResponseController(w).SetWriteDeadline(time.Time{})
+
+	if _, err := b.Backup(w); err != nil {
+		// The status has already been sent, so the only way to tell
+		// the client that the backup is incomplete is to break the connection.
+		log.Printf("Error streaming backup: %v", err)
+		panic(http.ErrAbortHandler)
+	}
+}
@@ -0,0 +1,165 @@
+package web
+
+import (
+	"errors"
+	"fmt"
+	"go-kvdb/db"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// IncrHandler atomically adds the by parameter, 1 if not given, to the
+// numeric value of the key and responds with the new value. A missing key
+// starts from the initial parameter or zero, and the optional min and max
+// parameters bound the result: updates that would leave the bounds or
+// overflow fail with 409 Conflict and change nothing.
+//
+// Integer values are updated with int64 arithmetic. If any parameter is
+// not an integer, the float parameter is "true" or the stored value is a
+// float, the update uses float64 arithmetic instead. Integers beyond the
+// int64 range are not floats: they fail with 409 Conflict as overflows.
+func (s *Server) IncrHandler(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Error parsing form", http.StatusBadRequest)
+		return
+	}
+
+	key := r.Form.Get("key")
+	if key == "" {
+		http.Error(w, "key parameter is required", http.StatusBadRequest)
+		return
+	}
+
+	bucketName := r.Form.Get("bucketName")
+	if bucketName == "" {
+		bucketName = "default"
+	}
+	if !checkBucket(w, bucketName) {
+		return
+	}
+
+	if !s.checkLimits(w, key, nil) {
+		return
+	}
+
+	if !s.route(bucketName, key, w, r) {
+		return
+	}
+
+	if r.Form.Get("by") == "" {
+		r.Form.Set("by", "1")
+	}
+
+	var value string
+	err := errNotInt
+	if r.Form.Get("float") != "true" {
+		value, err = incrInt(s.db, bucketName, key, r.Form)
+	}
+	if errors.Is(err, errNotInt) || errors.Is(err, db.ErrNotInteger) {
+		value, err = incrFloat(s.db, bucketName, key, r.Form)
+	}
+
+	var pe *paramError
+	switch {
+	case errors.As(err, &pe):
+		http.Error(w, pe.Error(), http.StatusBadRequest)
+		return
+	case errors.Is(err, db.ErrNotNumber), errors.Is(err, db.ErrOverflow), errors.Is(err, db.ErrOutOfBounds), errors.Is(err, db.ErrWrongType):
+		http.Error(w, fmt.Sprintf("Error incrementing key: %v", err), http.StatusConflict)
+		return
+	case err != nil:
+		http.Error(w, fmt.Sprintf("Error incrementing key: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	fmt.Fprintln(w, value)
+}
+
+// errNotInt is returned by incrInt when a parameter is not an integer.
+var errNotInt = errors.New("parameter is not an integer")
+
+// paramError is an invalid numeric parameter.
+type paramError struct {
+	name, value string
+}
+
+func (e *paramError) Error() string {
+	return fmt.Sprintf("Invalid %s parameter %q", e.name, e.value)
+}
+
+func incrInt(s db.Store, bucketName, key string, form url.Values) (string, error) {
+	var by int64
+	var opts db.IntOptions
+	params := []struct {
+		name string
+		dst  *int64
+		ptr  **int64
+	}{
+		{"by", &by, nil},
+		{"initial", &opts.Initial, nil},
+		{"min", nil, &opts.Min},
+		{"max", nil, &opts.Max},
+	}
+
+	for _, p := range params {
+		v := form.Get(p.name)
+		if v == "" {
+			continue
+		}
+		n, err := strconv.ParseInt(v, 10, 64)
+		if errors.Is(err, strconv.ErrRange) {
+			return "", fmt.Errorf("%w: %s parameter %q", db.ErrOverflow, p.name, v)
+		} else if err != nil {
+			return "", errNotInt
+		}
+		if p.ptr != nil {
+			*p.ptr = &n
+		} else {
+			*p.dst = n
+		}
+	}
+
+	n, err := db.Add(s, bucketName, key, by, opts)
+	if err != nil {
+		return "", err
+	}
+	return strconv.FormatInt(n, 10), nil
+}
+
+func incrFloat(s db.Store, bucketName, key string, form url.Values) (string, error) {
+	var by float64
+	var opts db.FloatOptions
+	params := []struct {
+		name string
+		dst  *float64
+		ptr  **float64
+	}{
+		{"by", &by, nil},
+		{"initial", &opts.Initial, nil},
+		{"min", nil, &opts.Min},
+		{"max", nil, &opts.Max},
+	}
+
+	for _, p := range params {
+		v := form.Get(p.name)
+		if v == "" {
+			continue
+		}
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return "", &paramError{p.name, v}
+		}
+		if p.ptr != nil {
+			*p.ptr = &f
+		} else {
+			*p.dst = f
+		}
+	}
+
+	f, err := db.AddFloat(s, bucketName, key, by, opts)
+	if err != nil {
+		return "", err
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64), nil
+}
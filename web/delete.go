@@ -0,0 +1,247 @@
+package web
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"go-kvdb/config"
+	"go-kvdb/db"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// deletePrefixChunk is the number of keys deleted per batch
+// by a delete by prefix.
+const deletePrefixChunk = 1000
+
+var (
+	errKeyNotFound     = errors.New("key not found")
+	errConditionFailed = errors.New("condition failed")
+)
+
+// DeleteHandler deletes the key given with the key parameter. With the
+// ifValue parameter the key is only deleted if it has that value, which
+// fails with 412 Precondition Failed otherwise. Missing keys are reported
+// with 404 Not Found.
+//
+// With the prefix parameter instead of the key, all keys with the prefix
+// are deleted from every shard that may hold them. Each shard deletes its
+// keys in batches, so a failure may leave some of the keys in place.
+//
+// Deletes are recorded in the change log like any other change, which is
+// how watchers, webhooks and incremental backups learn about them.
+//
+// Keys are removed right away, without tombstones: replication is not
+// supported (node.replicas must be 1), so there are no replicas that
+// could bring a deleted key back.
+func (s *Server) DeleteHandler(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Error parsing form", http.StatusBadRequest)
+		return
+	}
+
+	bucketName := r.Form.Get("bucketName")
+	if bucketName == "" {
+		bucketName = "default"
+	}
+	if !checkBucket(w, bucketName) {
+		return
+	}
+
+	if r.Form.Has("prefix") {
+		if r.Form.Has("key") {
+			http.Error(w, "Only one of key and prefix may be given", http.StatusBadRequest)
+			return
+		}
+		s.deletePrefix(w, r, bucketName, r.Form.Get("prefix"))
+		return
+	}
+
+	key := r.Form.Get("key")
+	if key == "" {
+		http.Error(w, "key parameter is required", http.StatusBadRequest)
+		return
+	}
+	s.deleteKey(w, r, bucketName, key)
+}
+
+// DeleteKeyHandler serves DELETE /v1/kv/{bucket}/{key} like DeleteHandler,
+// including the ifValue query parameter.
+func (s *Server) DeleteKeyHandler(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Error parsing form", http.StatusBadRequest)
+		return
+	}
+
+	key := r.PathValue("key")
+	if key == "" {
+		http.Error(w, "key is required", http.StatusBadRequest)
+		return
+	}
+	if !checkBucket(w, r.PathValue("bucket")) {
+		return
+	}
+	s.deleteKey(w, r, r.PathValue("bucket"), key)
+}
+
+func (s *Server) deleteKey(w http.ResponseWriter, r *http.Request, bucketName, key string) {
+	if !s.route(bucketName, key, w, r) {
+		return
+	}
+
+	ifValue, conditional := r.Form.Get("ifValue"), r.Form.Has("ifValue")
+	err := s.db.Modify(bucketName, key, func(value []byte) ([]byte, error) {
+		if value == nil {
+			return nil, errKeyNotFound
+		}
+		if conditional && string(value) != ifValue {
+			return nil, errConditionFailed
+		}
+		return nil, nil
+	})
+	if errors.Is(err, db.ErrWrongType) {
+		// Typed values never match the ifValue condition.
+		if conditional {
+			err = errConditionFailed
+		} else {
+			err = s.db.DelKey(bucketName, key)
+		}
+	}
+
+	switch {
+	case errors.Is(err, errKeyNotFound):
+		http.Error(w, "Key not found", http.StatusNotFound)
+		return
+	case errors.Is(err, errConditionFailed):
+		http.Error(w, "Key has a different value", http.StatusPreconditionFailed)
+		return
+	case errors.Is(err, db.ErrLocked):
+		http.Error(w, fmt.Sprintf("Error deleting key: %v", err), http.StatusConflict)
+		return
+	case err != nil:
+		http.Error(w, fmt.Sprintf("Error deleting key: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	fmt.Fprintf(w, "Successfully deleted key in shard %d", s.Shards().CurIdx)
+}
+
+func (s *Server) deletePrefix(w http.ResponseWriter, r *http.Request, bucketName, prefix string) {
+	if prefix == "" {
+		http.Error(w, "prefix must not be empty", http.StatusBadRequest)
+		return
+	}
+	start, end := config.PrefixRange(prefix)
+
+	// Requests from other shards only delete the local keys.
+	if r.Form.Get("local") == "true" {
+		if epoch, ok := requestEpoch(r); ok && epoch > s.Shards().Epoch {
+			http.Error(w, fmt.Sprintf("Stale topology: request epoch %d, local epoch %d", epoch, s.Shards().Epoch), http.StatusMisdirectedRequest)
+			return
+		}
+		n, err := s.deleteRange(bucketName, start, end)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error deleting keys after %d deleted: %v", n, err), http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprintln(w, n)
+		return
+	}
+
+	policy, err := s.bucketPolicy(bucketName)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error getting bucket policy: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	shards := s.Shards()
+	idxs := shards.BucketOverlapping(policy, start, end)
+
+	counts := make([]int, len(idxs))
+	errs := make([]error, len(idxs))
+
+	var wg sync.WaitGroup
+	for i, idx := range idxs {
+		wg.Add(1)
+		go func(i, idx int) {
+			defer wg.Done()
+			if idx == shards.CurIdx {
+				counts[i], errs[i] = s.deleteRange(bucketName, start, end)
+			} else {
+				counts[i], errs[i] = s.deleteShardPrefix(shards, idx, bucketName, prefix)
+			}
+		}(i, idx)
+	}
+	wg.Wait()
+
+	total := 0
+	for _, n := range counts {
+		total += n
+	}
+	for i, err := range errs {
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error deleting keys on shard %d after %d deleted: %v", idxs[i], total, err), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	fmt.Fprintf(w, "Deleted %d keys with prefix %q in bucket %s (shards %v)", total, prefix, bucketName, idxs)
+}
+
+// deleteRange deletes the local keys in [start, end) and returns their number.
+func (s *Server) deleteRange(bucketName, start, end string) (int, error) {
+	keys, err := s.db.ScanKeys(bucketName, start, end)
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for len(keys) > 0 {
+		chunk := keys[:min(len(keys), deletePrefixChunk)]
+		keys = keys[len(chunk):]
+
+		ops := make([]db.Op, len(chunk))
+		for i, key := range chunk {
+			ops[i] = db.Op{Key: key, Delete: true}
+		}
+		if err := s.db.Batch(bucketName, ops); err != nil {
+			return n, err
+		}
+		n += len(chunk)
+	}
+	return n, nil
+}
+
+func (s *Server) deleteShardPrefix(shards *config.Shards, idx int, bucketName, prefix string) (int, error) {
+	form := url.Values{
+		"bucketName": {bucketName},
+		"prefix":     {prefix},
+		"local":      {"true"},
+	}
+
+	req, err := http.NewRequest(http.MethodPost, s.Client().URL(shards.Addrs[idx], "/delete"), strings.NewReader(form.Encode()))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set(EpochHeader, strconv.FormatInt(shards.Epoch, 10))
+
+	resp, err := s.Client().Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return 0, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("target shard returned %s: %s", resp.Status, bytes.TrimSpace(body))
+	}
+	return strconv.Atoi(string(bytes.TrimSpace(body)))
+}
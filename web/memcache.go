@@ -0,0 +1,85 @@
+package web
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"go-kvdb/db"
+	"go-kvdb/memcache"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+// MemcacheHandler runs a memcached command forwarded by the memcached
+// listener of another shard. The body holds the command and the response
+// its reply. All keys of the command must belong to the current shard,
+// which rejects the command with 421 Misdirected Request otherwise.
+func (s *Server) MemcacheHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	items, ok := s.db.(db.ItemStore)
+	if !ok {
+		http.Error(w, "The storage engine does not support memcached items", http.StatusNotImplemented)
+		return
+	}
+
+	shards := s.Shards()
+	if epoch, ok := requestEpoch(r); ok && epoch > shards.Epoch {
+		http.Error(w, fmt.Sprintf("Stale topology: request epoch %d, local epoch %d", epoch, shards.Epoch), http.StatusMisdirectedRequest)
+		return
+	}
+
+	req, err := memcache.ReadRequest(bufio.NewReader(r.Body))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error reading command: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	for _, key := range req.Keys {
+		if !s.Owns(memcache.Bucket, key) {
+			http.Error(w, fmt.Sprintf("Key %q does not belong to shard %d", key, shards.CurIdx), http.StatusMisdirectedRequest)
+			return
+		}
+	}
+
+	s.mu.RLock()
+	limits := s.limits
+	s.mu.RUnlock()
+
+	res := memcache.Local{Store: items, Limits: limits}.Exec(req)
+	res.Write(bufio.NewWriter(w))
+}
+
+// ForwardMemcache runs the memcached command on the shard through its
+// MemcacheHandler.
+func (s *Server) ForwardMemcache(shard int, req *memcache.Request) (memcache.Response, error) {
+	shards := s.Shards()
+
+	var body bytes.Buffer
+	if err := req.Write(bufio.NewWriter(&body)); err != nil {
+		return memcache.Response{}, err
+	}
+
+	httpReq, err := http.NewRequest(http.MethodPost, s.Client().URL(shards.Addrs[shard], "/memcache"), &body)
+	if err != nil {
+		return memcache.Response{}, err
+	}
+	httpReq.Header.Set(EpochHeader, strconv.FormatInt(shards.Epoch, 10))
+	httpReq.Header.Set(HopsHeader, "1")
+
+	res, err := s.Client().Do(httpReq)
+	if err != nil {
+		return memcache.Response{}, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(res.Body)
+		return memcache.Response{}, fmt.Errorf("%s: %s", res.Status, bytes.TrimSpace(msg))
+	}
+	return memcache.ReadResponse(bufio.NewReader(res.Body))
+}
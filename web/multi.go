@@ -0,0 +1,282 @@
+package web
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"go-kvdb/config"
+	"go-kvdb/db"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// Statuses of the keys of /mget and /mset.
+const (
+	keyOK       = "ok"
+	keyNotFound = "not_found"
+	keyFailed   = "error"
+)
+
+// keyResult is the outcome for one key of /mget or /mset. Values that
+// are not UTF-8 are base64 encoded, like in the webhook events.
+type keyResult struct {
+	Key         string  `json:"key"`
+	Status      string  `json:"status"`
+	Value       *string `json:"value,omitempty"`
+	ValueBase64 *string `json:"value_base64,omitempty"`
+	Error       string  `json:"error,omitempty"`
+}
+
+// multiResponse is the response of /mget and /mset.
+type multiResponse struct {
+	Results []keyResult `json:"results"`
+	// Failed is the number of keys with the error status.
+	Failed int `json:"failed"`
+}
+
+func valueResult(key string, value []byte) keyResult {
+	res := keyResult{Key: key, Status: keyOK}
+	if utf8.Valid(value) {
+		v := string(value)
+		res.Value = &v
+	} else {
+		v := base64.StdEncoding.EncodeToString(value)
+		res.ValueBase64 = &v
+	}
+	return res
+}
+
+// MGetHandler gets the values of the repeated key parameters, e.g.
+//
+//	/mget?key=a&key=b&bucketName=users
+//
+// The keys are grouped by shard and each shard is asked once, all of them
+// concurrently. The response is a JSON object whose results hold the
+// status of every key in the order of the request: "ok" with the value,
+// "not_found" or "error" with the reason, e.g. when its shard could not
+// be reached. The status is 200 OK if no key failed and 207 Multi-Status
+// otherwise.
+func (s *Server) MGetHandler(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Error parsing form", http.StatusBadRequest)
+		return
+	}
+
+	keys := r.Form["key"]
+	if len(keys) == 0 {
+		http.Error(w, "key parameter is required", http.StatusBadRequest)
+		return
+	}
+	for _, key := range keys {
+		if key == "" {
+			http.Error(w, "Keys must not be empty", http.StatusBadRequest)
+			return
+		}
+	}
+
+	s.multi(w, r, "/mget", keys, nil)
+}
+
+// MSetHandler sets the values of the keys given as repeated key and value
+// parameters, the n-th value belonging to the n-th key. The keys are
+// grouped by shard like with /mget and the keys of each shard are set
+// atomically, but the shards independently, so a failure may leave the
+// keys of the other shards set. The response is like the one of /mget,
+// without the values.
+func (s *Server) MSetHandler(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Error parsing form", http.StatusBadRequest)
+		return
+	}
+
+	keys, values := r.Form["key"], r.Form["value"]
+	if len(keys) == 0 {
+		http.Error(w, "key parameter is required", http.StatusBadRequest)
+		return
+	}
+	if len(keys) != len(values) {
+		http.Error(w, fmt.Sprintf("Every key needs a value: got %d keys and %d values", len(keys), len(values)), http.StatusBadRequest)
+		return
+	}
+	for i, key := range keys {
+		if key == "" || values[i] == "" {
+			http.Error(w, "Keys and values must not be empty", http.StatusBadRequest)
+			return
+		}
+		if !s.checkLimits(w, key, []byte(values[i])) {
+			return
+		}
+	}
+
+	s.multi(w, r, "/mset", keys, values)
+}
+
+// multi runs /mget, or /mset if values are given, for the keys on the
+// shards that own them.
+func (s *Server) multi(w http.ResponseWriter, r *http.Request, path string, keys, values []string) {
+	bucketName := r.Form.Get("bucketName")
+	if bucketName == "" {
+		bucketName = "default"
+	}
+	if !checkBucket(w, bucketName) {
+		return
+	}
+	shards := s.Shards()
+
+	// Requests from other shards only hold keys of the current shard.
+	if r.Form.Get("local") == "true" {
+		if epoch, ok := requestEpoch(r); ok && epoch > shards.Epoch {
+			http.Error(w, fmt.Sprintf("Stale topology: request epoch %d, local epoch %d", epoch, shards.Epoch), http.StatusMisdirectedRequest)
+			return
+		}
+		for _, key := range keys {
+			if !s.Owns(bucketName, key) {
+				http.Error(w, fmt.Sprintf("Key %q does not belong to shard %d", key, shards.CurIdx), http.StatusMisdirectedRequest)
+				return
+			}
+		}
+		writeJSON(w, multiResponse{Results: s.multiLocal(bucketName, keys, values)})
+		return
+	}
+
+	groups := make(map[int][]int)
+	var idxs []int
+	for i, key := range keys {
+		shard, err := s.Owner(bucketName, key)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error getting bucket policy: %v", err), http.StatusInternalServerError)
+			return
+		}
+		if _, ok := groups[shard]; !ok {
+			idxs = append(idxs, shard)
+		}
+		groups[shard] = append(groups[shard], i)
+	}
+
+	res := multiResponse{Results: make([]keyResult, len(keys))}
+	var wg sync.WaitGroup
+	for _, idx := range idxs {
+		wg.Add(1)
+		go func(idx int) {
+			defer wg.Done()
+
+			group := groups[idx]
+			groupKeys := make([]string, len(group))
+			var groupValues []string
+			for i, k := range group {
+				groupKeys[i] = keys[k]
+				if values != nil {
+					groupValues = append(groupValues, values[k])
+				}
+			}
+
+			var results []keyResult
+			var err error
+			if idx == shards.CurIdx {
+				results = s.multiLocal(bucketName, groupKeys, groupValues)
+			} else {
+				results, err = s.multiShard(shards, idx, path, bucketName, groupKeys, groupValues)
+			}
+
+			for i, k := range group {
+				if err != nil {
+					res.Results[k] = keyResult{Key: keys[k], Status: keyFailed, Error: fmt.Sprintf("shard %d: %v", idx, err)}
+				} else {
+					res.Results[k] = results[i]
+				}
+			}
+		}(idx)
+	}
+	wg.Wait()
+
+	for _, kr := range res.Results {
+		if kr.Status == keyFailed {
+			res.Failed++
+		}
+	}
+	if res.Failed > 0 {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusMultiStatus)
+		json.NewEncoder(w).Encode(res)
+		return
+	}
+	writeJSON(w, res)
+}
+
+// multiLocal gets the keys of the current shard, or sets them in one
+// batch if values are given.
+func (s *Server) multiLocal(bucketName string, keys, values []string) []keyResult {
+	results := make([]keyResult, len(keys))
+
+	if values == nil {
+		for i, key := range keys {
+			value, err := s.db.GetKey(key, bucketName)
+			switch {
+			case err != nil:
+				results[i] = keyResult{Key: key, Status: keyFailed, Error: err.Error()}
+			case value == nil:
+				results[i] = keyResult{Key: key, Status: keyNotFound}
+			default:
+				results[i] = valueResult(key, value)
+			}
+		}
+		return results
+	}
+
+	ops := make([]db.Op, len(keys))
+	for i, key := range keys {
+		ops[i] = db.Op{Key: key, Value: []byte(values[i])}
+	}
+	err := s.db.Batch(bucketName, ops)
+	for i, key := range keys {
+		results[i] = keyResult{Key: key, Status: keyOK}
+		if err != nil {
+			results[i] = keyResult{Key: key, Status: keyFailed, Error: err.Error()}
+		}
+	}
+	return results
+}
+
+func (s *Server) multiShard(shards *config.Shards, idx int, path, bucketName string, keys, values []string) ([]keyResult, error) {
+	form := url.Values{
+		"bucketName": {bucketName},
+		"key":        keys,
+		"local":      {"true"},
+	}
+	if values != nil {
+		form["value"] = values
+	}
+
+	req, err := http.NewRequest(http.MethodPost, s.Client().URL(shards.Addrs[idx], path), strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set(EpochHeader, strconv.FormatInt(shards.Epoch, 10))
+
+	resp, err := s.Client().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("target shard returned %s: %s", resp.Status, bytes.TrimSpace(body))
+	}
+
+	var res multiResponse
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return nil, err
+	}
+	if len(res.Results) != len(keys) {
+		return nil, fmt.Errorf("target shard returned %d results for %d keys", len(res.Results), len(keys))
+	}
+	return res.Results, nil
+}
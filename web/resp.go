@@ -0,0 +1,92 @@
+package web
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"go-kvdb/resp"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// RESPHandler runs a RESP command forwarded by the RESP listener of
+// another shard. The body holds the command and the response its reply.
+// All keys of the command must belong to the current shard, which rejects
+// the command with 421 Misdirected Request otherwise.
+func (s *Server) RESPHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	bucketName := r.URL.Query().Get("bucket")
+	if bucketName == "" {
+		bucketName = "default"
+	}
+	if !checkBucket(w, bucketName) {
+		return
+	}
+
+	shards := s.Shards()
+	if epoch, ok := requestEpoch(r); ok && epoch > shards.Epoch {
+		http.Error(w, fmt.Sprintf("Stale topology: request epoch %d, local epoch %d", epoch, shards.Epoch), http.StatusMisdirectedRequest)
+		return
+	}
+
+	cmd, err := resp.ReadCommand(bufio.NewReader(r.Body))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error reading command: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	for _, key := range resp.Keys(cmd) {
+		if !s.Owns(bucketName, key) {
+			http.Error(w, fmt.Sprintf("Key %q does not belong to shard %d", key, shards.CurIdx), http.StatusMisdirectedRequest)
+			return
+		}
+	}
+
+	s.mu.RLock()
+	limits := s.limits
+	s.mu.RUnlock()
+
+	reply := resp.Local{Store: s.db, Owns: s.Owns, Limits: limits}.Exec(bucketName, cmd)
+
+	bw := bufio.NewWriter(w)
+	resp.Write(bw, reply)
+	bw.Flush()
+}
+
+// ForwardRESP runs the RESP command on the shard through its RESPHandler.
+func (s *Server) ForwardRESP(shard int, bucketName string, cmd [][]byte) (resp.Value, error) {
+	shards := s.Shards()
+
+	var body bytes.Buffer
+	bw := bufio.NewWriter(&body)
+	if err := resp.WriteCommand(bw, cmd); err != nil {
+		return resp.Value{}, err
+	}
+	bw.Flush()
+
+	u := s.Client().URL(shards.Addrs[shard], "/resp?bucket="+url.QueryEscape(bucketName))
+	req, err := http.NewRequest(http.MethodPost, u, &body)
+	if err != nil {
+		return resp.Value{}, err
+	}
+	req.Header.Set(EpochHeader, strconv.FormatInt(shards.Epoch, 10))
+	req.Header.Set(HopsHeader, "1")
+
+	res, err := s.Client().Do(req)
+	if err != nil {
+		return resp.Value{}, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(res.Body)
+		return resp.Value{}, fmt.Errorf("%s: %s", res.Status, bytes.TrimSpace(msg))
+	}
+	return resp.Read(bufio.NewReader(res.Body))
+}
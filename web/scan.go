@@ -0,0 +1,128 @@
+package web
+
+import (
+	"bufio"
+	"fmt"
+	"go-kvdb/config"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// ScanHandler lists the keys in a key range across the cluster.
+// The range is given either as a prefix or as start and end parameters.
+// Only the shards whose ranges overlap with the requested one are queried.
+func (s *Server) ScanHandler(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Error parsing form", http.StatusBadRequest)
+		return
+	}
+
+	bucketName := r.Form.Get("bucketName")
+	if bucketName == "" {
+		bucketName = "default"
+	}
+	if !checkBucket(w, bucketName) {
+		return
+	}
+
+	start, end := r.Form.Get("start"), r.Form.Get("end")
+	if prefix := r.Form.Get("prefix"); prefix != "" {
+		start, end = config.PrefixRange(prefix)
+	}
+
+	// Requests from other shards only ask for the local keys.
+	if r.Form.Get("local") == "true" {
+		keys, err := s.db.ScanKeys(bucketName, start, end)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error scanning keys: %v", err), http.StatusInternalServerError)
+			return
+		}
+		for _, key := range keys {
+			fmt.Fprintln(w, key)
+		}
+		return
+	}
+
+	shards := s.Shards()
+	idxs, err := s.ScanShards(bucketName, start, end)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error getting bucket policy: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	results := make([][]string, len(idxs))
+	errs := make([]error, len(idxs))
+
+	var wg sync.WaitGroup
+	for i, idx := range idxs {
+		wg.Add(1)
+		go func(i, idx int) {
+			defer wg.Done()
+			if idx == shards.CurIdx {
+				results[i], errs[i] = s.db.ScanKeys(bucketName, start, end)
+			} else {
+				results[i], errs[i] = s.scanShard(shards, idx, bucketName, start, end)
+			}
+		}(i, idx)
+	}
+	wg.Wait()
+
+	var keys []string
+	for i, err := range errs {
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error scanning shard %d: %v", idxs[i], err), http.StatusInternalServerError)
+			return
+		}
+		keys = append(keys, results[i]...)
+	}
+	sort.Strings(keys)
+
+	fmt.Fprintf(w, "Keys in bucket %s (shards %v):\n", bucketName, idxs)
+	for _, key := range keys {
+		fmt.Fprintf(w, "- %s\n", key)
+	}
+}
+
+// ScanShards returns the shards that may hold keys of the bucket in [start, end).
+func (s *Server) ScanShards(bucketName, start, end string) ([]int, error) {
+	policy, err := s.bucketPolicy(bucketName)
+	if err != nil {
+		return nil, err
+	}
+	return s.Shards().BucketOverlapping(policy, start, end), nil
+}
+
+func (s *Server) scanShard(shards *config.Shards, idx int, bucketName, start, end string) ([]string, error) {
+	q := url.Values{
+		"bucketName": {bucketName},
+		"start":      {start},
+		"end":        {end},
+		"local":      {"true"},
+	}
+
+	req, err := http.NewRequest(http.MethodGet, s.Client().URL(shards.Addrs[idx], "/scan?"+q.Encode()), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(EpochHeader, strconv.FormatInt(shards.Epoch, 10))
+
+	resp, err := s.Client().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("target shard returned %s", resp.Status)
+	}
+
+	var keys []string
+	sc := bufio.NewScanner(resp.Body)
+	for sc.Scan() {
+		keys = append(keys, sc.Text())
+	}
+	return keys, sc.Err()
+}
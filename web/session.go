@@ -0,0 +1,273 @@
+package web
+
+import (
+	"errors"
+	"fmt"
+	"go-kvdb/db"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// SessionTimeout is how long a session may stay idle before it is rolled
+// back. Sessions hold a snapshot of the database open, which keeps the
+// space freed by other writes from being reused, so they must not linger.
+const SessionTimeout = 10 * time.Second
+
+// MaxSessions is the number of sessions that may be open at once. Every
+// session holds a snapshot open, see SessionTimeout.
+const MaxSessions = 64
+
+// session is an interactive transaction opened with /session/begin.
+type session struct {
+	mu    sync.Mutex
+	txn   *db.Txn
+	timer *time.Timer
+}
+
+// SessionBeginHandler starts an interactive transaction and returns its
+// ID as a JSON object, e.g. {"id": "..."}. The ID is passed with the id
+// parameter to the other session endpoints:
+//
+//	/session/get?id=...&key=a
+//	/session/set?id=...&key=b&value=2
+//	/session/delete?id=...&key=c
+//	/session/commit?id=...
+//	/session/rollback?id=...
+//
+// Reads see the database as it was when the session began, along with the
+// writes of the session, which are applied when it commits. The commit
+// fails with 409 Conflict if another client wrote one of the written keys
+// in the meantime. Sessions are limited to the keys of the shard that
+// began them and are rolled back after SessionTimeout without requests.
+// Beyond MaxSessions open sessions, begin fails with 503 Service Unavailable.
+func (s *Server) SessionBeginHandler(w http.ResponseWriter, r *http.Request) {
+	ss, ok := s.db.(db.Snapshotter)
+	if !ok {
+		http.Error(w, "Sessions are not supported by the storage engine", http.StatusNotImplemented)
+		return
+	}
+
+	id, err := newTxnID()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error beginning session: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	// The ID is reserved before the snapshot is taken, so that the limit
+	// holds for concurrent requests; the session is not found until then.
+	s.sessionMu.Lock()
+	if len(s.sessions) >= MaxSessions {
+		s.sessionMu.Unlock()
+		http.Error(w, fmt.Sprintf("Too many open sessions, at most %d are allowed", MaxSessions), http.StatusServiceUnavailable)
+		return
+	}
+	if s.sessions == nil {
+		s.sessions = make(map[string]*session)
+	}
+	s.sessions[id] = nil
+	s.sessionMu.Unlock()
+
+	txn, err := ss.Begin()
+	if err != nil {
+		s.takeSession(id)
+		http.Error(w, fmt.Sprintf("Error beginning session: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	sess := &session{txn: txn}
+	sess.timer = time.AfterFunc(SessionTimeout, func() {
+		if s.takeSession(id) != nil {
+			sess.mu.Lock()
+			defer sess.mu.Unlock()
+			sess.txn.Rollback()
+		}
+	})
+
+	s.sessionMu.Lock()
+	s.sessions[id] = sess
+	s.sessionMu.Unlock()
+
+	writeJSON(w, txnResponse{ID: id})
+}
+
+// takeSession removes the session, nil if it does not exist.
+func (s *Server) takeSession(id string) *session {
+	s.sessionMu.Lock()
+	defer s.sessionMu.Unlock()
+	sess := s.sessions[id]
+	delete(s.sessions, id)
+	return sess
+}
+
+// session returns the session given with the id parameter, locked, and
+// reports an error to the client if there is none. With take the session
+// is removed, otherwise its timeout starts again.
+func (s *Server) session(w http.ResponseWriter, r *http.Request, take bool) (*session, bool) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Error parsing form", http.StatusBadRequest)
+		return nil, false
+	}
+	id := r.Form.Get("id")
+	if id == "" {
+		http.Error(w, "id parameter is required", http.StatusBadRequest)
+		return nil, false
+	}
+
+	var sess *session
+	if take {
+		sess = s.takeSession(id)
+	} else {
+		s.sessionMu.Lock()
+		sess = s.sessions[id]
+		s.sessionMu.Unlock()
+	}
+	if sess == nil {
+		http.Error(w, fmt.Sprintf("Session %s not found", id), http.StatusNotFound)
+		return nil, false
+	}
+
+	if take {
+		sess.timer.Stop()
+	} else {
+		sess.timer.Reset(SessionTimeout)
+	}
+	sess.mu.Lock()
+	return sess, true
+}
+
+// sessionKey returns the bucket and the key of a session request and
+// reports an error to the client if the key belongs to another shard.
+func (s *Server) sessionKey(w http.ResponseWriter, r *http.Request) (string, string, bool) {
+	key := r.Form.Get("key")
+	if key == "" {
+		http.Error(w, "key parameter is required", http.StatusBadRequest)
+		return "", "", false
+	}
+	bucketName := r.Form.Get("bucketName")
+	if bucketName == "" {
+		bucketName = "default"
+	}
+	if !checkBucket(w, bucketName) {
+		return "", "", false
+	}
+
+	if !s.Owns(bucketName, key) {
+		http.Error(w, fmt.Sprintf("Key %q does not belong to shard %d, sessions are limited to the keys of one shard", key, s.Shards().CurIdx), http.StatusMisdirectedRequest)
+		return "", "", false
+	}
+	return bucketName, key, true
+}
+
+// sessionError reports the error of a session operation to the client.
+func sessionError(w http.ResponseWriter, action string, err error) {
+	code := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, db.ErrTxnDone):
+		code = http.StatusNotFound
+	case errors.Is(err, db.ErrTxnConflict), errors.Is(err, db.ErrLocked), errors.Is(err, db.ErrWrongType):
+		code = http.StatusConflict
+	}
+	http.Error(w, fmt.Sprintf("Error %s: %v", action, err), code)
+}
+
+// SessionGetHandler reads the key in the session.
+func (s *Server) SessionGetHandler(w http.ResponseWriter, r *http.Request) {
+	sess, ok := s.session(w, r, false)
+	if !ok {
+		return
+	}
+	defer sess.mu.Unlock()
+
+	bucketName, key, ok := s.sessionKey(w, r)
+	if !ok {
+		return
+	}
+	value, err := sess.txn.Get(bucketName, key)
+	if err != nil {
+		sessionError(w, "getting key", err)
+		return
+	}
+	if value == nil {
+		http.Error(w, "Key not found", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, valueResult(key, value))
+}
+
+// SessionSetHandler writes the key in the session.
+func (s *Server) SessionSetHandler(w http.ResponseWriter, r *http.Request) {
+	sess, ok := s.session(w, r, false)
+	if !ok {
+		return
+	}
+	defer sess.mu.Unlock()
+
+	bucketName, key, ok := s.sessionKey(w, r)
+	if !ok {
+		return
+	}
+	value := r.Form.Get("value")
+	if value == "" {
+		http.Error(w, "value parameter is required", http.StatusBadRequest)
+		return
+	}
+	if !s.checkLimits(w, key, []byte(value)) {
+		return
+	}
+
+	if err := sess.txn.Set(bucketName, key, []byte(value)); err != nil {
+		sessionError(w, "setting key", err)
+		return
+	}
+	fmt.Fprintf(w, "Set key in session %s", r.Form.Get("id"))
+}
+
+// SessionDeleteHandler deletes the key in the session.
+func (s *Server) SessionDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	sess, ok := s.session(w, r, false)
+	if !ok {
+		return
+	}
+	defer sess.mu.Unlock()
+
+	bucketName, key, ok := s.sessionKey(w, r)
+	if !ok {
+		return
+	}
+	if err := sess.txn.Delete(bucketName, key); err != nil {
+		sessionError(w, "deleting key", err)
+		return
+	}
+	fmt.Fprintf(w, "Deleted key in session %s", r.Form.Get("id"))
+}
+
+// SessionCommitHandler applies the writes of the session and ends it.
+func (s *Server) SessionCommitHandler(w http.ResponseWriter, r *http.Request) {
+	sess, ok := s.session(w, r, true)
+	if !ok {
+		return
+	}
+	defer sess.mu.Unlock()
+
+	if err := sess.txn.Commit(); err != nil {
+		sessionError(w, "committing session", err)
+		return
+	}
+	fmt.Fprintf(w, "Committed session %s in shard %d", r.Form.Get("id"), s.Shards().CurIdx)
+}
+
+// SessionRollbackHandler discards the writes of the session and ends it.
+func (s *Server) SessionRollbackHandler(w http.ResponseWriter, r *http.Request) {
+	sess, ok := s.session(w, r, true)
+	if !ok {
+		return
+	}
+	defer sess.mu.Unlock()
+
+	if err := sess.txn.Rollback(); err != nil {
+		sessionError(w, "rolling back session", err)
+		return
+	}
+	fmt.Fprintf(w, "Rolled back session %s", r.Form.Get("id"))
+}
@@ -0,0 +1,394 @@
+package web
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go-kvdb/config"
+	"go-kvdb/db"
+	"go-kvdb/transfer"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// ExportHandler streams the keys of the buckets given with the bucket
+// parameters, or of all buckets, as NDJSON. Only the keys owned by the
+// current shard are exported, so that keys left behind by a resharding
+// are not exported twice. Plain values keep their expiry time and flags,
+// typed values are exported as the commands that rebuild them.
+func (s *Server) ExportHandler(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Error parsing form", http.StatusBadRequest)
+		return
+	}
+
+	all, err := s.db.Buckets()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error listing buckets: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	buckets := r.Form["bucket"]
+	if len(buckets) == 0 {
+		buckets = all
+	}
+	for _, bucketName := range buckets {
+		if !slices.Contains(all, bucketName) {
+			http.Error(w, fmt.Sprintf("Bucket %s not found", bucketName), http.StatusNotFound)
+			return
+		}
+	}
+
+	shards := s.Shards()
+	enc, err := transfer.NewWriter(w, transfer.FormatNDJSON)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error exporting: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	// Exports of large shards outlive the timeouts of the server.
+	rc := http.NewResponseController(w)
+	rc.SetReadDeadline(time.Time{})
+	rc.SetWriteDeadline(time.Time{})
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set(ShardHeader, strconv.Itoa(shards.CurIdx))
+
+	for _, bucketName := range buckets {
+		policy, err := s.bucketPolicy(bucketName)
+		if err == nil {
+			err = db.WalkEntries(s.db, bucketName, func(e db.Entry) error {
+				if shards.BucketIndex(policy, e.Key) != shards.CurIdx {
+					return nil
+				}
+				return enc.Write(entryRecord(bucketName, e))
+			})
+		}
+		if err == nil {
+			err = enc.Flush()
+		}
+
+		if err != nil {
+			// The status has already been sent, so the only way to tell
+			// the client that the export is incomplete is to break the connection.
+			log.Printf("Error exporting bucket %s: %v", bucketName, err)
+			panic(http.ErrAbortHandler)
+		}
+	}
+}
+
+// ImportHandler imports the NDJSON records of the request body. The
+// conflict parameter selects what happens to the keys that already
+// exist: "skip" (the default), "overwrite" or "fail". Records owned by
+// other shards are forwarded to them in batches. Records that have
+// already expired are skipped. The response holds
+// the JSON encoded transfer.Result.
+//
+// With the "fail" policy the import stops with 409 Conflict at the
+// first existing key; the batches applied before it remain imported.
+func (s *Server) ImportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	conflict := r.URL.Query().Get("conflict")
+	if conflict == "" {
+		conflict = transfer.ConflictSkip
+	}
+	if err := transfer.CheckConflict(conflict); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	shards := s.Shards()
+	if epoch, ok := requestEpoch(r); ok && epoch > shards.Epoch {
+		http.Error(w, fmt.Sprintf("Stale topology: request epoch %d, local epoch %d", epoch, shards.Epoch), http.StatusMisdirectedRequest)
+		return
+	}
+
+	// Large imports outlive the timeouts of the server.
+	rc := http.NewResponseController(w)
+	rc.SetReadDeadline(time.Time{})
+	rc.SetWriteDeadline(time.Time{})
+
+	rd, err := transfer.NewReader(r.Body, transfer.FormatNDJSON)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var res transfer.Result
+	local := make(map[string][]db.Op)
+	foreign := make(map[int][]transfer.Record)
+	localCount := 0
+
+	flushLocal := func() error {
+		for bucketName, ops := range local {
+			n, err := s.importOps(bucketName, ops, conflict)
+			res.Imported += n
+			if err != nil {
+				return err
+			}
+			res.Skipped += len(ops) - n
+		}
+		clear(local)
+		localCount = 0
+		return nil
+	}
+
+	flushForeign := func(idx int) error {
+		if len(foreign[idx]) == 0 {
+			return nil
+		}
+
+		hops := requestHops(r)
+		if hops >= MaxHops {
+			return errHopLimit
+		}
+
+		h := http.Header{}
+		h.Set(EpochHeader, strconv.FormatInt(shards.Epoch, 10))
+		h.Set(HopsHeader, strconv.Itoa(hops+1))
+
+		fr, err := transfer.SendBatch(r.Context(), s.Client(), shards.Addrs[idx], foreign[idx], conflict, h)
+		res.Add(fr)
+		foreign[idx] = foreign[idx][:0]
+		if err != nil {
+			return fmt.Errorf("forwarding to shard %d: %w", idx, err)
+		}
+		return nil
+	}
+
+	policies := make(map[string]config.BucketPolicy)
+	err = func() error {
+		for {
+			rec, err := rd.Read()
+			if err == io.EOF {
+				return nil
+			} else if err != nil {
+				return &importError{http.StatusBadRequest, err}
+			}
+
+			if !s.checkImportLimits(rec) {
+				return &importError{http.StatusRequestEntityTooLarge, fmt.Errorf("key %q in bucket %s exceeds the size limits", rec.Key, rec.Bucket)}
+			}
+			if !rec.Expires.IsZero() && !time.Now().Before(rec.Expires) {
+				res.Skipped++
+				continue
+			}
+
+			policy, ok := policies[rec.Bucket]
+			if !ok {
+				if db.IsSystemBucket(rec.Bucket) {
+					return &importError{http.StatusBadRequest, fmt.Errorf("bucket names starting with %q are reserved", db.SystemPrefix)}
+				}
+				if err := s.db.CreateBucketIfNotExists(rec.Bucket); err != nil {
+					return err
+				}
+				if policy, err = s.bucketPolicy(rec.Bucket); err != nil {
+					return err
+				}
+				policies[rec.Bucket] = policy
+			}
+
+			idx := shards.BucketIndex(policy, rec.Key)
+			if idx != shards.CurIdx {
+				foreign[idx] = append(foreign[idx], rec)
+				if len(foreign[idx]) >= transfer.BatchSize {
+					if err := flushForeign(idx); err != nil {
+						return err
+					}
+				}
+				continue
+			}
+
+			if rec.Commands != nil {
+				// Typed values are rebuilt command by command.
+				n, err := s.importTyped(rec, conflict)
+				if err != nil {
+					return err
+				}
+				res.Imported += n
+				res.Skipped += 1 - n
+				continue
+			}
+			if !rec.Expires.IsZero() || rec.Flags != 0 {
+				n, err := s.importItem(rec, conflict)
+				if err != nil {
+					return err
+				}
+				res.Imported += n
+				res.Skipped += 1 - n
+				continue
+			}
+
+			local[rec.Bucket] = append(local[rec.Bucket], db.Op{Key: rec.Key, Value: rec.Value})
+			localCount++
+			if localCount >= transfer.BatchSize {
+				if err := flushLocal(); err != nil {
+					return err
+				}
+			}
+		}
+	}()
+	if err == nil {
+		err = flushLocal()
+	}
+	for idx := 0; idx < shards.Count && err == nil; idx++ {
+		err = flushForeign(idx)
+	}
+
+	if err != nil {
+		status := http.StatusInternalServerError
+		var ie *importError
+		var se *transfer.StatusError
+		switch {
+		case errors.As(err, &ie):
+			status = ie.status
+		case errors.As(err, &se):
+			status = se.Status
+		case errors.Is(err, errHopLimit):
+			status = http.StatusLoopDetected
+		}
+		http.Error(w, fmt.Sprintf("Error importing after %d imported and %d skipped keys: %v", res.Imported, res.Skipped, err), status)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+// entryRecord returns the record of the key of the bucket.
+func entryRecord(bucketName string, e db.Entry) transfer.Record {
+	return transfer.Record{Bucket: bucketName, Key: e.Key, Value: e.Value, Commands: e.Commands, Expires: e.Expires, Flags: e.Flags}
+}
+
+var errHopLimit = fmt.Errorf("forwarding hop limit of %d exceeded", MaxHops)
+
+// importError is an import error with its HTTP status.
+type importError struct {
+	status int
+	err    error
+}
+
+func (e *importError) Error() string { return e.err.Error() }
+func (e *importError) Unwrap() error { return e.err }
+
+// checkImportLimits reports whether the record fits the size limits.
+func (s *Server) checkImportLimits(rec transfer.Record) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.limits.MaxKeySize > 0 && len(rec.Key) > s.limits.MaxKeySize {
+		return false
+	}
+	if s.limits.MaxValueSize <= 0 {
+		return true
+	}
+	for _, cmd := range rec.Commands {
+		for _, arg := range cmd.Args {
+			if len(arg) > s.limits.MaxValueSize {
+				return false
+			}
+		}
+	}
+	return len(rec.Value) <= s.limits.MaxValueSize
+}
+
+// importItem writes the value of the record along with its expiry time
+// and flags according to the conflict policy and returns the number of
+// keys written. The key is checked in the transaction that writes it.
+func (s *Server) importItem(rec transfer.Record, conflict string) (int, error) {
+	is, ok := s.db.(db.ItemStore)
+	if !ok {
+		return 0, &importError{http.StatusNotImplemented, fmt.Errorf("key %q in bucket %s: the storage engine does not support expiry times and flags", rec.Key, rec.Bucket)}
+	}
+
+	write := func() error {
+		return is.ModifyItem(rec.Bucket, rec.Key, func(item *db.Item) (*db.Item, error) {
+			if item != nil && conflict != transfer.ConflictOverwrite {
+				return nil, db.ErrKeyExists
+			}
+			return &db.Item{Value: rec.Value, Expires: rec.Expires, Flags: rec.Flags}, nil
+		})
+	}
+	err := write()
+	if errors.Is(err, db.ErrWrongType) {
+		// Typed values cannot be modified as items.
+		err = db.ErrKeyExists
+		if conflict == transfer.ConflictOverwrite {
+			if err = s.db.DelKey(rec.Bucket, rec.Key); err == nil {
+				err = write()
+			}
+		}
+	}
+	return importResult(rec.Bucket, rec.Key, conflict, err)
+}
+
+// importTyped rebuilds the typed value of the record in a single
+// transaction according to the conflict policy and returns the number of
+// keys written.
+func (s *Server) importTyped(rec transfer.Record, conflict string) (int, error) {
+	ts, ok := s.db.(db.TypedStore)
+	if !ok {
+		return 0, &importError{http.StatusNotImplemented, fmt.Errorf("key %q in bucket %s: the storage engine does not support typed values", rec.Key, rec.Bucket)}
+	}
+
+	err := ts.Build(rec.Bucket, rec.Key, rec.Commands, conflict == transfer.ConflictOverwrite)
+	if errors.Is(err, db.ErrUnknownCommand) || errors.Is(err, db.ErrSyntax) || errors.Is(err, db.ErrWrongType) {
+		return 0, &importError{http.StatusBadRequest, fmt.Errorf("key %q in bucket %s: %w", rec.Key, rec.Bucket, err)}
+	}
+	return importResult(rec.Bucket, rec.Key, conflict, err)
+}
+
+// importResult returns the number of keys written by the import of the
+// key, which failed with db.ErrKeyExists if the key was kept.
+func importResult(bucketName, key, conflict string, err error) (int, error) {
+	switch {
+	case err == nil:
+		return 1, nil
+	case !errors.Is(err, db.ErrKeyExists):
+		return 0, err
+	case conflict == transfer.ConflictFail:
+		return 0, &importError{http.StatusConflict, fmt.Errorf("key %q already exists in bucket %s", key, bucketName)}
+	default:
+		return 0, nil
+	}
+}
+
+// importOps applies the sets according to the conflict policy and returns
+// the number of keys written. Unless they are overwritten, the keys are
+// written one by one, each checked in the transaction that writes it.
+func (s *Server) importOps(bucketName string, ops []db.Op, conflict string) (int, error) {
+	if conflict == transfer.ConflictOverwrite {
+		if err := s.db.Batch(bucketName, ops); err != nil {
+			return 0, err
+		}
+		return len(ops), nil
+	}
+
+	n := 0
+	for _, op := range ops {
+		err := s.db.Modify(bucketName, op.Key, func(value []byte) ([]byte, error) {
+			if value != nil {
+				return nil, db.ErrKeyExists
+			}
+			// A nil value would delete the key.
+			return append([]byte{}, op.Value...), nil
+		})
+		if errors.Is(err, db.ErrWrongType) {
+			err = db.ErrKeyExists
+		}
+		written, err := importResult(bucketName, op.Key, conflict, err)
+		n += written
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,586 @@
+package web
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go-kvdb/config"
+	"go-kvdb/db"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Operations of a transaction.
+const (
+	txnSet    = "set"
+	txnDelete = "delete"
+	txnCheck  = "check"
+)
+
+// Outcomes of a transaction, as reported by /txn and /txn/status.
+const (
+	txnCommitted = "committed"
+	txnAborted   = "aborted"
+	txnPending   = "pending"
+)
+
+// TxnTimeout is how long the coordinator of a transaction waits for a
+// participant to prepare, commit or abort it, and a participant in doubt
+// for the status from the coordinator. A participant that does not
+// prepare in time aborts the transaction.
+var TxnTimeout = 10 * time.Second
+
+// txnOp is an operation of /txn. The operation only happens if the key
+// has the value given with if_value, or does not exist with if_missing.
+type txnOp struct {
+	Op        string  `json:"op"`
+	Key       string  `json:"key"`
+	Value     string  `json:"value,omitempty"`
+	IfValue   *string `json:"if_value,omitempty"`
+	IfMissing bool    `json:"if_missing,omitempty"`
+}
+
+type txnRequest struct {
+	Bucket string  `json:"bucket"`
+	Ops    []txnOp `json:"ops"`
+}
+
+type txnResponse struct {
+	ID     string `json:"id"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+	// Pending are the shards that did not confirm the commit yet. The
+	// transaction is committed nonetheless and they will apply it once
+	// they are recovered.
+	Pending []int `json:"pending,omitempty"`
+}
+
+// txnStore returns the store as a participant of transactions and
+// reports an error to the client if it is not one.
+func (s *Server) txnStore(w http.ResponseWriter) (db.TxnStore, bool) {
+	ts, ok := s.db.(db.TxnStore)
+	if !ok {
+		http.Error(w, "Transactions are not supported by the storage engine", http.StatusNotImplemented)
+	}
+	return ts, ok
+}
+
+// TxnHandler runs the transaction given as a JSON object in the body, e.g.
+//
+//	{"bucket": "default", "ops": [
+//		{"op": "check", "key": "a", "if_value": "1"},
+//		{"op": "set", "key": "b", "value": "2", "if_missing": true},
+//		{"op": "delete", "key": "c"}
+//	]}
+//
+// Either all operations happen or none does, even if the keys belong to
+// different shards. The shard that receives the request coordinates a
+// two-phase commit: every shard owning some of the keys checks their
+// conditions and locks them, and only if all of them succeed the commit
+// is recorded and the writes applied. Writes of locked keys fail with 409
+// Conflict until then.
+//
+// The response is a JSON object with the transaction ID and its status.
+// A failed condition aborts the transaction with 412 Precondition Failed,
+// a key locked by another transaction with 409 Conflict.
+func (s *Server) TxnHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ts, ok := s.txnStore(w)
+	if !ok {
+		return
+	}
+
+	var req txnRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("Error parsing transaction: %v", err), http.StatusBadRequest)
+		return
+	}
+	if req.Bucket == "" {
+		req.Bucket = "default"
+	}
+	if !checkBucket(w, req.Bucket) {
+		return
+	}
+	if len(req.Ops) == 0 {
+		http.Error(w, "Transaction has no operations", http.StatusBadRequest)
+		return
+	}
+
+	ops := make([]db.TxnOp, len(req.Ops))
+	for i, op := range req.Ops {
+		if op.Key == "" {
+			http.Error(w, "Keys must not be empty", http.StatusBadRequest)
+			return
+		}
+		if op.IfValue != nil && (*op.IfValue == "" || op.IfMissing) {
+			http.Error(w, fmt.Sprintf("Key %q: if_value must not be empty nor combined with if_missing", op.Key), http.StatusBadRequest)
+			return
+		}
+
+		ops[i] = db.TxnOp{Op: db.Op{Key: op.Key}, IfMissing: op.IfMissing}
+		if op.IfValue != nil {
+			ops[i].IfValue = []byte(*op.IfValue)
+		}
+		switch op.Op {
+		case txnSet:
+			if op.Value == "" {
+				http.Error(w, fmt.Sprintf("Key %q: values must not be empty", op.Key), http.StatusBadRequest)
+				return
+			}
+			if !s.checkLimits(w, op.Key, []byte(op.Value)) {
+				return
+			}
+			ops[i].Value = []byte(op.Value)
+		case txnDelete:
+			ops[i].Delete = true
+		case txnCheck:
+			if op.IfValue == nil && !op.IfMissing {
+				http.Error(w, fmt.Sprintf("Key %q: check needs a condition", op.Key), http.StatusBadRequest)
+				return
+			}
+			ops[i].Check = true
+		default:
+			http.Error(w, fmt.Sprintf("Key %q: unknown operation %q", op.Key, op.Op), http.StatusBadRequest)
+			return
+		}
+	}
+
+	res, err := s.runTxn(ts, req.Bucket, ops)
+	if err == nil {
+		writeJSON(w, res)
+		return
+	}
+	if res.ID == "" {
+		http.Error(w, fmt.Sprintf("Error running transaction: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	code := http.StatusInternalServerError
+	if errors.Is(err, db.ErrConditionFailed) {
+		code = http.StatusPreconditionFailed
+	} else if errors.Is(err, db.ErrLocked) {
+		code = http.StatusConflict
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(res)
+}
+
+func newTxnID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// runTxn coordinates the two-phase commit of the operations. Until it
+// returns, the transaction is active and in-doubt participants are told
+// to wait for its outcome; afterwards it is committed if and only if the
+// decision was recorded.
+//
+// The participants are recorded by their addresses, since the indexes of
+// the shards change with the topology.
+func (s *Server) runTxn(ts db.TxnStore, bucketName string, ops []db.TxnOp) (txnResponse, error) {
+	shards := s.Shards()
+
+	groups := make(map[string][]db.TxnOp)
+	var idxs []int
+	var addrs []string
+	for _, op := range ops {
+		shard, err := s.Owner(bucketName, op.Key)
+		if err != nil {
+			return txnResponse{}, fmt.Errorf("getting bucket policy: %w", err)
+		}
+		addr := shards.Addrs[shard]
+		if _, ok := groups[addr]; !ok {
+			idxs = append(idxs, shard)
+			addrs = append(addrs, addr)
+		}
+		groups[addr] = append(groups[addr], op)
+	}
+
+	id, err := newTxnID()
+	if err != nil {
+		return txnResponse{}, err
+	}
+	s.beginTxn(id)
+	defer s.endTxn(id)
+
+	now := time.Now().UTC()
+	errs := make([]error, len(addrs))
+	s.onTxnShards(addrs, errs, func(addr string) error {
+		txn := db.PreparedTxn{ID: id, Coordinator: shards.Addrs[shards.CurIdx], Bucket: bucketName, Ops: groups[addr], Prepared: now}
+		if addr == txn.Coordinator {
+			return ts.Prepare(txn)
+		}
+		return s.prepareShard(shards, addr, txn)
+	})
+
+	if err := firstError(addrs, errs); err != nil {
+		// The participants that did not answer, e.g. because they did not
+		// prepare in time, learn about the abort when they recover the
+		// transaction.
+		s.onTxnShards(addrs, make([]error, len(addrs)), func(addr string) error {
+			return s.finishTxn(ts, shards, addr, id, "/txn/abort")
+		})
+		return txnResponse{ID: id, Status: txnAborted, Error: err.Error()}, err
+	}
+
+	if err := ts.LogDecision(id, addrs); err != nil {
+		s.onTxnShards(addrs, make([]error, len(addrs)), func(addr string) error {
+			return s.finishTxn(ts, shards, addr, id, "/txn/abort")
+		})
+		err = fmt.Errorf("recording commit: %w", err)
+		return txnResponse{ID: id, Status: txnAborted, Error: err.Error()}, err
+	}
+
+	s.onTxnShards(addrs, errs, func(addr string) error {
+		return s.finishTxn(ts, shards, addr, id, "/txn/commit")
+	})
+	res := txnResponse{ID: id, Status: txnCommitted}
+	for i, err := range errs {
+		if err != nil {
+			res.Pending = append(res.Pending, idxs[i])
+		}
+	}
+	if len(res.Pending) == 0 {
+		// A decision that could not be removed is removed by the
+		// recovery, which commits again on every participant.
+		ts.ForgetDecision(id)
+	}
+	return res, nil
+}
+
+func (s *Server) beginTxn(id string) {
+	s.txnMu.Lock()
+	defer s.txnMu.Unlock()
+	if s.activeTxns == nil {
+		s.activeTxns = make(map[string]bool)
+	}
+	s.activeTxns[id] = true
+}
+
+func (s *Server) endTxn(id string) {
+	s.txnMu.Lock()
+	defer s.txnMu.Unlock()
+	delete(s.activeTxns, id)
+}
+
+func (s *Server) txnActive(id string) bool {
+	s.txnMu.Lock()
+	defer s.txnMu.Unlock()
+	return s.activeTxns[id]
+}
+
+// txnStatus returns the outcome of a transaction coordinated by this shard.
+// Transactions that are neither active nor committed were aborted, which
+// includes those interrupted by a crash before their commit was recorded.
+func (s *Server) txnStatus(ts db.TxnStore, id string) (string, error) {
+	// The decision is recorded before the transaction ends, so it must
+	// be looked up after checking that the transaction is not active.
+	if s.txnActive(id) {
+		return txnPending, nil
+	}
+	_, committed, err := ts.Decision(id)
+	if err != nil {
+		return "", err
+	}
+	if committed {
+		return txnCommitted, nil
+	}
+	return txnAborted, nil
+}
+
+// onTxnShards runs fn for the shards at the addresses concurrently and
+// stores their errors.
+func (s *Server) onTxnShards(addrs []string, errs []error, fn func(addr string) error) {
+	var wg sync.WaitGroup
+	for i, addr := range addrs {
+		wg.Add(1)
+		go func(i int, addr string) {
+			defer wg.Done()
+			errs[i] = fn(addr)
+		}(i, addr)
+	}
+	wg.Wait()
+}
+
+// firstError returns the first error, preferring failed conditions and
+// locked keys, which are reported to the client as such.
+func firstError(addrs []string, errs []error) error {
+	var first error
+	for i, err := range errs {
+		if err == nil {
+			continue
+		}
+		if errors.Is(err, db.ErrConditionFailed) || errors.Is(err, db.ErrLocked) {
+			return err
+		}
+		if first == nil {
+			first = fmt.Errorf("shard %s: %w", addrs[i], err)
+		}
+	}
+	return first
+}
+
+// finishTxn commits or aborts the prepared transaction on the shard at
+// the address.
+func (s *Server) finishTxn(ts db.TxnStore, shards *config.Shards, addr, id, path string) error {
+	if addr == shards.Addrs[shards.CurIdx] {
+		if path == "/txn/commit" {
+			return ts.CommitPrepared(id)
+		}
+		return ts.AbortPrepared(id)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), TxnTimeout)
+	defer cancel()
+	return s.postFormContext(ctx, shards, addr, path, url.Values{"id": {id}})
+}
+
+// prepareShard sends the part of the transaction to the shard at the
+// address, which owns its keys. Failed conditions and locked keys are
+// returned as the errors of the store.
+func (s *Server) prepareShard(shards *config.Shards, addr string, txn db.PreparedTxn) error {
+	data, err := json.Marshal(txn)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), TxnTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.Client().URL(addr, "/txn/prepare"), bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(EpochHeader, strconv.FormatInt(shards.Epoch, 10))
+
+	resp, err := s.Client().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	body = bytes.TrimSpace(body)
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusPreconditionFailed:
+		return fmt.Errorf("%w: %s", db.ErrConditionFailed, body)
+	case http.StatusConflict:
+		return fmt.Errorf("%w: %s", db.ErrLocked, body)
+	default:
+		return fmt.Errorf("target shard returned %s: %s", resp.Status, body)
+	}
+}
+
+// TxnPrepareHandler prepares the part of a transaction that belongs to
+// the current shard. It is called by the coordinator of the transaction.
+func (s *Server) TxnPrepareHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ts, ok := s.txnStore(w)
+	if !ok {
+		return
+	}
+
+	var txn db.PreparedTxn
+	if err := json.NewDecoder(r.Body).Decode(&txn); err != nil {
+		http.Error(w, fmt.Sprintf("Error parsing transaction: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	if !checkBucket(w, txn.Bucket) {
+		return
+	}
+
+	shards := s.Shards()
+	if epoch, ok := requestEpoch(r); ok && epoch > shards.Epoch {
+		http.Error(w, fmt.Sprintf("Stale topology: request epoch %d, local epoch %d", epoch, shards.Epoch), http.StatusMisdirectedRequest)
+		return
+	}
+	for _, op := range txn.Ops {
+		if !s.Owns(txn.Bucket, op.Key) {
+			http.Error(w, fmt.Sprintf("Key %q does not belong to shard %d", op.Key, shards.CurIdx), http.StatusMisdirectedRequest)
+			return
+		}
+	}
+
+	err := ts.Prepare(txn)
+	switch {
+	case errors.Is(err, db.ErrConditionFailed):
+		http.Error(w, err.Error(), http.StatusPreconditionFailed)
+	case errors.Is(err, db.ErrLocked):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case err != nil:
+		http.Error(w, fmt.Sprintf("Error preparing transaction: %v", err), http.StatusInternalServerError)
+	default:
+		fmt.Fprintf(w, "Prepared transaction %s in shard %d", txn.ID, shards.CurIdx)
+	}
+}
+
+// TxnCommitHandler commits the prepared transaction given with the id parameter.
+func (s *Server) TxnCommitHandler(w http.ResponseWriter, r *http.Request) {
+	s.finishTxnHandler(w, r, "committing", db.TxnStore.CommitPrepared)
+}
+
+// TxnAbortHandler aborts the prepared transaction given with the id parameter.
+func (s *Server) TxnAbortHandler(w http.ResponseWriter, r *http.Request) {
+	s.finishTxnHandler(w, r, "aborting", db.TxnStore.AbortPrepared)
+}
+
+func (s *Server) finishTxnHandler(w http.ResponseWriter, r *http.Request, action string, fn func(db.TxnStore, string) error) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ts, ok := s.txnStore(w)
+	if !ok {
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Error parsing form", http.StatusBadRequest)
+		return
+	}
+
+	id := r.Form.Get("id")
+	if id == "" {
+		http.Error(w, "id parameter is required", http.StatusBadRequest)
+		return
+	}
+	if err := fn(ts, id); err != nil {
+		http.Error(w, fmt.Sprintf("Error %s transaction: %v", action, err), http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprintf(w, "Finished transaction %s in shard %d", id, s.Shards().CurIdx)
+}
+
+// TxnStatusHandler returns the status of the transaction given with the
+// id parameter that the current shard coordinates: "pending" while it
+// runs, then "committed" or "aborted".
+func (s *Server) TxnStatusHandler(w http.ResponseWriter, r *http.Request) {
+	ts, ok := s.txnStore(w)
+	if !ok {
+		return
+	}
+	id := r.FormValue("id")
+	if id == "" {
+		http.Error(w, "id parameter is required", http.StatusBadRequest)
+		return
+	}
+
+	status, err := s.txnStatus(ts, id)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error getting transaction status: %v", err), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, txnResponse{ID: id, Status: status})
+}
+
+// remoteTxnStatus asks the coordinator of the transaction at the address
+// for its status.
+func (s *Server) remoteTxnStatus(addr, id string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), TxnTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.Client().URL(addr, "/txn/status?id="+url.QueryEscape(id)), nil)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := s.Client().Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return "", fmt.Errorf("coordinator returned %s: %s", resp.Status, bytes.TrimSpace(body))
+	}
+	var res txnResponse
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return "", err
+	}
+	return res.Status, nil
+}
+
+// ResolveTxns finishes the transactions left in doubt, e.g. by a crash of
+// their coordinator or of this shard. Transactions prepared on this shard
+// for longer than minAge are committed or aborted as their coordinator
+// decided, and the commits this shard coordinated are sent again to the
+// participants that did not confirm them. It should run at startup and
+// then periodically.
+func (s *Server) ResolveTxns(minAge time.Duration) error {
+	ts, ok := s.db.(db.TxnStore)
+	if !ok {
+		return nil
+	}
+	shards := s.Shards()
+	var errs []error
+
+	decisions, err := ts.Decisions()
+	if err != nil {
+		return fmt.Errorf("listing commit decisions: %w", err)
+	}
+	for id, addrs := range decisions {
+		if s.txnActive(id) {
+			continue
+		}
+		commitErrs := make([]error, len(addrs))
+		s.onTxnShards(addrs, commitErrs, func(addr string) error {
+			return s.finishTxn(ts, shards, addr, id, "/txn/commit")
+		})
+		if err := errors.Join(commitErrs...); err != nil {
+			errs = append(errs, fmt.Errorf("committing transaction %s: %w", id, err))
+			continue
+		}
+		if err := ts.ForgetDecision(id); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	txns, err := ts.PreparedTxns()
+	if err != nil {
+		return errors.Join(append(errs, fmt.Errorf("listing prepared transactions: %w", err))...)
+	}
+	for _, txn := range txns {
+		if time.Since(txn.Prepared) < minAge {
+			continue
+		}
+
+		var status string
+		if txn.Coordinator == shards.Addrs[shards.CurIdx] {
+			status, err = s.txnStatus(ts, txn.ID)
+		} else {
+			status, err = s.remoteTxnStatus(txn.Coordinator, txn.ID)
+		}
+		switch {
+		case err != nil:
+			err = fmt.Errorf("getting status of transaction %s: %w", txn.ID, err)
+		case status == txnCommitted:
+			err = ts.CommitPrepared(txn.ID)
+		case status == txnAborted:
+			err = ts.AbortPrepared(txn.ID)
+		}
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,165 @@
+package web
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"go-kvdb/db"
+	"net/http"
+	"unicode/utf8"
+)
+
+// TypeHandler responds with the type of the value of the key: "string",
+// "hash", "list", "set", "zset" or "none" if the key does not exist.
+func (s *Server) TypeHandler(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Error parsing form", http.StatusBadRequest)
+		return
+	}
+
+	key := r.Form.Get("key")
+	if key == "" {
+		http.Error(w, "key parameter is required", http.StatusBadRequest)
+		return
+	}
+
+	bucketName := r.Form.Get("bucketName")
+	if bucketName == "" {
+		bucketName = "default"
+	}
+	if !checkBucket(w, bucketName) {
+		return
+	}
+
+	ts, ok := s.db.(db.TypedStore)
+	if !ok {
+		http.Error(w, "The storage engine does not support typed values", http.StatusNotImplemented)
+		return
+	}
+
+	if !s.route(bucketName, key, w, r) {
+		return
+	}
+
+	typ, err := ts.Type(bucketName, key)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error getting type: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if typ == "" {
+		typ = "none"
+	}
+	fmt.Fprintln(w, typ)
+}
+
+// cmdReply is the JSON form of db.Reply. Empty fields are omitted and
+// all values are base64 encoded if any of them is not UTF-8.
+type cmdReply struct {
+	N        int64     `json:"n"`
+	Value    *string   `json:"value,omitempty"`
+	Values   []string  `json:"values,omitempty"`
+	Scores   []float64 `json:"scores,omitempty"`
+	Encoding string    `json:"encoding,omitempty"`
+}
+
+func newCmdReply(reply db.Reply) cmdReply {
+	encode := func(v []byte) string { return string(v) }
+	valid := reply.Value == nil || utf8.Valid(reply.Value)
+	for _, v := range reply.Values {
+		valid = valid && utf8.Valid(v)
+	}
+
+	cr := cmdReply{N: reply.N, Scores: reply.Scores}
+	if !valid {
+		encode = base64.StdEncoding.EncodeToString
+		cr.Encoding = "base64"
+	}
+
+	if reply.Value != nil {
+		v := encode(reply.Value)
+		cr.Value = &v
+	}
+	for _, v := range reply.Values {
+		cr.Values = append(cr.Values, encode(v))
+	}
+	return cr
+}
+
+// CmdHandler runs a command on the hash, list, set or sorted set stored
+// under the key and responds with the JSON encoded reply. The cmd
+// parameter names the command like its Redis counterpart (see db.Cmd)
+// and the repeated arg parameters are its arguments, e.g.
+//
+//	/cmd?key=user:1&cmd=hset&arg=name&arg=alice
+//
+// Like plain keys, typed values live on the shard that owns their key.
+// Commands on a key of another type fail with 409 Conflict. With the
+// replace parameter set to "true" the current value of the key is
+// deleted first.
+func (s *Server) CmdHandler(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Error parsing form", http.StatusBadRequest)
+		return
+	}
+
+	key := r.Form.Get("key")
+	if key == "" {
+		http.Error(w, "key parameter is required", http.StatusBadRequest)
+		return
+	}
+
+	name := r.Form.Get("cmd")
+	if name == "" {
+		http.Error(w, "cmd parameter is required", http.StatusBadRequest)
+		return
+	}
+
+	bucketName := r.Form.Get("bucketName")
+	if bucketName == "" {
+		bucketName = "default"
+	}
+	if !checkBucket(w, bucketName) {
+		return
+	}
+
+	ts, ok := s.db.(db.TypedStore)
+	if !ok {
+		http.Error(w, "The storage engine does not support typed values", http.StatusNotImplemented)
+		return
+	}
+
+	if !s.checkLimits(w, key, nil) {
+		return
+	}
+	for _, arg := range r.Form["arg"] {
+		if !s.checkLimits(w, key, []byte(arg)) {
+			return
+		}
+	}
+
+	if !s.route(bucketName, key, w, r) {
+		return
+	}
+
+	if r.Form.Get("replace") == "true" {
+		if err := s.db.DelKey(bucketName, key); err != nil {
+			http.Error(w, fmt.Sprintf("Error deleting key: %v", err), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	reply, err := ts.Do(bucketName, key, db.NewCmd(name, r.Form["arg"]...))
+	switch {
+	case errors.Is(err, db.ErrUnknownCommand), errors.Is(err, db.ErrSyntax):
+		http.Error(w, fmt.Sprintf("Error running command: %v", err), http.StatusBadRequest)
+		return
+	case errors.Is(err, db.ErrWrongType):
+		http.Error(w, fmt.Sprintf("Error running command: %v", err), http.StatusConflict)
+		return
+	case err != nil:
+		http.Error(w, fmt.Sprintf("Error running command: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, newCmdReply(reply))
+}
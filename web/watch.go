@@ -0,0 +1,192 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go-kvdb/config"
+	"go-kvdb/db"
+	"go-kvdb/webhook"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// WatchKeepAlive is how often an idle watch stream sends a comment,
+// so that proxies do not close it.
+var WatchKeepAlive = 15 * time.Second
+
+// WatchHandler streams the changes of a bucket as Server-Sent Events. The
+// bucket parameter selects the bucket ("default" if empty) and the prefix
+// parameter restricts the key changes to the keys with the prefix; the
+// creation and deletion of the bucket itself are always sent.
+//
+// Every event has the sequence number of the change as its id and the
+// operation as its type. The stream starts after the sequence number given
+// with the since parameter or the Last-Event-ID header, so that reconnecting
+// clients resume where they stopped, or with the next change otherwise.
+//
+// The sequence numbers belong to the change log of the shard and only the
+// changes of the keys owned by the shard are sent, so watching a bucket
+// across the cluster takes one stream per shard. The change log must be
+// enabled.
+func (s *Server) WatchHandler(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Error parsing form", http.StatusBadRequest)
+		return
+	}
+
+	watcher, ok := s.db.(db.Watcher)
+	if !ok {
+		http.Error(w, "The storage engine does not support watching", http.StatusNotImplemented)
+		return
+	}
+	rc := http.NewResponseController(w)
+
+	bucketName := r.Form.Get("bucket")
+	if bucketName == "" {
+		bucketName = "default"
+	}
+	if !checkBucket(w, bucketName) {
+		return
+	}
+	prefix := r.Form.Get("prefix")
+
+	last, err := watcher.LastSeq()
+	if errors.Is(err, db.ErrNoChangeLog) {
+		http.Error(w, "The change log is disabled", http.StatusNotImplemented)
+		return
+	} else if err != nil {
+		http.Error(w, fmt.Sprintf("Error reading the change log: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	since := last
+	if v := r.Form.Get("since"); v != "" || r.Header.Get("Last-Event-ID") != "" {
+		if v == "" {
+			v = r.Header.Get("Last-Event-ID")
+		}
+		if since, err = strconv.ParseUint(v, 10, 64); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid sequence number %q", v), http.StatusBadRequest)
+			return
+		}
+		if since > last {
+			http.Error(w, fmt.Sprintf("Sequence number %d is ahead of the change log at %d", since, last), http.StatusGone)
+			return
+		}
+	}
+
+	policy, err := s.bucketPolicy(bucketName)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error getting bucket policy: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	recs := make(chan db.LogRecord)
+	errc := make(chan error, 1)
+	go func() {
+		errc <- watcher.Watch(ctx, since, func(rec db.LogRecord) error {
+			select {
+			case recs <- rec:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		})
+	}()
+
+	// The stream outlives the write timeout of the server.
+	rc.SetWriteDeadline(time.Time{})
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set(ShardHeader, strconv.Itoa(s.Shards().CurIdx))
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	ticker := time.NewTicker(WatchKeepAlive)
+	defer ticker.Stop()
+
+	// The sequence number of the last change seen, sent or not.
+	seen, sent := since, since
+	for {
+		select {
+		case rec := <-recs:
+			seen = rec.Seq
+			if name, ok := rec.MetaBucket(); ok && name == bucketName {
+				if policy, err = s.bucketPolicy(bucketName); err != nil {
+					writeWatchError(rc, w, err)
+					return
+				}
+			}
+			if !s.watched(rec, bucketName, prefix, policy) {
+				continue
+			}
+			if err := writeWatchEvent(w, rec); err != nil {
+				return
+			}
+			sent = rec.Seq
+			rc.Flush()
+
+		case <-ticker.C:
+			// An id without data moves the resume point of the client
+			// past the changes it was not interested in.
+			fmt.Fprint(w, ": keepalive\n")
+			if seen != sent {
+				fmt.Fprintf(w, "id: %d\n", seen)
+				sent = seen
+			}
+			fmt.Fprint(w, "\n")
+			rc.Flush()
+
+		case err := <-errc:
+			if ctx.Err() == nil {
+				writeWatchError(rc, w, err)
+			}
+			return
+		}
+	}
+}
+
+// watched reports whether the change must be sent to the watcher.
+func (s *Server) watched(rec db.LogRecord, bucketName, prefix string, policy config.BucketPolicy) bool {
+	if rec.Bucket != bucketName {
+		return false
+	}
+
+	switch rec.Op {
+	case db.ChangeCreateBucket, db.ChangeDeleteBucket:
+		return true
+	}
+
+	if !strings.HasPrefix(rec.Key, prefix) {
+		return false
+	}
+	// Keys left behind by a resharding are purged by the old shard,
+	// which must not look like a deletion to the watchers.
+	shards := s.Shards()
+	return shards.BucketIndex(policy, rec.Key) == shards.CurIdx
+}
+
+func writeWatchEvent(w http.ResponseWriter, rec db.LogRecord) error {
+	data, err := json.Marshal(webhook.NewEvent(rec))
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", rec.Seq, rec.Op, data)
+	return err
+}
+
+// writeWatchError ends the stream with an error event, since the status
+// has already been sent.
+func writeWatchError(rc *http.ResponseController, w http.ResponseWriter, err error) {
+	fmt.Fprintf(w, "event: error\ndata: %s\n\n", strings.ReplaceAll(err.Error(), "\n", " "))
+	rc.Flush()
+}
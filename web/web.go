@@ -1,32 +1,243 @@
 package web
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"go-kvdb/config"
 	"go-kvdb/db"
+	"go-kvdb/transfer"
+	"go-kvdb/webhook"
 	"io"
 	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
 )
 
 // Server contains HTTP method handlers to be used for the database.
 type Server struct {
-	db     *db.Database
+	db db.Store
+
+	mu     sync.RWMutex
 	shards *config.Shards
+
+	limits config.Limits
+	hooks  *webhook.Manager
+	client *config.Client
+
+	// txnMu guards the transactions this shard is coordinating.
+	txnMu      sync.Mutex
+	activeTxns map[string]bool
+
+	// sessionMu guards the interactive transactions of the shard.
+	sessionMu sync.Mutex
+	sessions  map[string]*session
 }
 
 // NewServer creates a new instance with HTTP handlers to be used to get and set values.
-func NewServer(db *db.Database, s *config.Shards) *Server {
+func NewServer(db db.Store, s *config.Shards) *Server {
 	return &Server{
 		db:     db,
 		shards: s,
+		client: config.DefaultClient,
+	}
+}
+
+// SetClient sets the client of the requests to the other shards, which
+// must be made with TLS if the shards serve it. It must be called before
+// the first request is served.
+func (s *Server) SetClient(c *config.Client) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.client = c
+}
+
+// Client returns the client of the requests to the other shards.
+func (s *Server) Client() *config.Client {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.client
+}
+
+// SetLimits restricts the size of keys and values accepted by the server.
+func (s *Server) SetLimits(l config.Limits) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.limits = l
+}
+
+// checkLimits verifies the key and value sizes and reports
+// an error to the client if they are too large.
+func (s *Server) checkLimits(w http.ResponseWriter, key string, value []byte) bool {
+	s.mu.RLock()
+	limits := s.limits
+	s.mu.RUnlock()
+
+	if limits.MaxKeySize > 0 && len(key) > limits.MaxKeySize {
+		http.Error(w, fmt.Sprintf("Key is too large: %d bytes, the limit is %d", len(key), limits.MaxKeySize), http.StatusBadRequest)
+		return false
+	}
+	if limits.MaxValueSize > 0 && len(value) > limits.MaxValueSize {
+		http.Error(w, fmt.Sprintf("Value is too large: %d bytes, the limit is %d", len(value), limits.MaxValueSize), http.StatusRequestEntityTooLarge)
+		return false
+	}
+	return true
+}
+
+// checkBucket reports an error to the client if the bucket is one of the
+// system buckets, which only the server itself reads and writes.
+func checkBucket(w http.ResponseWriter, bucketName string) bool {
+	if db.IsSystemBucket(bucketName) {
+		http.Error(w, fmt.Sprintf("Bucket names starting with %q are reserved", db.SystemPrefix), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// Shards returns the topology the server currently routes requests with.
+func (s *Server) Shards() *config.Shards {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.shards
+}
+
+// SetShards replaces the topology, e.g. after the coordinator announced a new epoch.
+// Topologies with an epoch older than the current one are ignored.
+func (s *Server) SetShards(shards *config.Shards) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if shards.Epoch < s.shards.Epoch {
+		return
+	}
+	s.shards = shards
+}
+
+const (
+	// EpochHeader carries the topology epoch of the node that forwarded the request.
+	EpochHeader = "X-Kvdb-Epoch"
+	// HopsHeader carries the number of times the request has already been forwarded.
+	HopsHeader = "X-Kvdb-Hops"
+
+	// MaxHops is the maximum number of forwards a request can go through
+	// before it is rejected. With a consistent topology one hop is always enough.
+	MaxHops = 2
+)
+
+// bucketPolicy returns the sharding policy stored in the bucket metadata.
+func (s *Server) bucketPolicy(bucketName string) (config.BucketPolicy, error) {
+	var p config.BucketPolicy
+
+	meta, err := s.db.BucketMeta(bucketName)
+	if err != nil || meta == nil {
+		return p, err
+	}
+
+	if err := json.Unmarshal(meta, &p); err != nil {
+		return p, fmt.Errorf("decoding bucket %s policy: %w", bucketName, err)
+	}
+	return p, nil
+}
+
+// Owner returns the shard that owns the key of the bucket.
+func (s *Server) Owner(bucketName, key string) (int, error) {
+	policy, err := s.bucketPolicy(bucketName)
+	if err != nil {
+		return 0, err
+	}
+	return s.Shards().BucketIndex(policy, key), nil
+}
+
+// Owns reports whether the key of the bucket belongs to the current shard.
+func (s *Server) Owns(bucketName, key string) bool {
+	shard, err := s.Owner(bucketName, key)
+	return err == nil && shard == s.Shards().CurIdx
+}
+
+// route checks whether the key must be served by the current shard
+// according to the bucket policy. Requests for other shards are forwarded
+// and requests that were routed using a newer topology than ours are
+// rejected. The caller must only proceed with the request if route
+// returns true.
+func (s *Server) route(bucketName, key string, w http.ResponseWriter, r *http.Request) bool {
+	shards := s.Shards()
+
+	if epoch, ok := requestEpoch(r); ok && epoch > shards.Epoch {
+		// The sender knows a newer topology than we do, so we can no
+		// longer be sure that the key belongs to us.
+		http.Error(w, fmt.Sprintf("Stale topology: request epoch %d, local epoch %d", epoch, shards.Epoch), http.StatusMisdirectedRequest)
+		return false
+	}
+
+	policy, err := s.bucketPolicy(bucketName)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error getting bucket policy: %v", err), http.StatusInternalServerError)
+		return false
+	}
+
+	// If the sender's epoch is older than ours the request is simply
+	// re-routed using our own view of the topology.
+	shard := shards.BucketIndex(policy, key)
+	if shard != shards.CurIdx {
+		s.redirect(shards, shard, w, r)
+		return false
+	}
+	return true
+}
+
+func requestEpoch(r *http.Request) (int64, bool) {
+	v := r.Header.Get(EpochHeader)
+	if v == "" {
+		return 0, false
+	}
+	epoch, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return epoch, true
+}
+
+func requestHops(r *http.Request) int {
+	hops, err := strconv.Atoi(r.Header.Get(HopsHeader))
+	if err != nil {
+		return 0
 	}
+	return hops
 }
 
-func (s *Server) redirect(shard int, w http.ResponseWriter, r *http.Request) {
-	url := "http://" + s.shards.Addrs[shard] + r.RequestURI
-	fmt.Fprintf(w, "redirecting from shard %d to shard %d (%q)\n", s.shards.CurIdx, shard, url)
+func (s *Server) redirect(shards *config.Shards, shard int, w http.ResponseWriter, r *http.Request) {
+	hops := requestHops(r)
+	if hops >= MaxHops {
+		http.Error(w, fmt.Sprintf("Forwarding hop limit of %d exceeded", MaxHops), http.StatusLoopDetected)
+		return
+	}
+
+	client := s.Client()
+	url := client.URL(shards.Addrs[shard], r.RequestURI)
+
+	// The form has already been parsed, so the body must be re-encoded.
+	var body io.Reader
+	if r.Method == http.MethodPost {
+		body = strings.NewReader(r.PostForm.Encode())
+	}
+
+	req, err := http.NewRequest(r.Method, url, body)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error redirecting the request: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	req.Header.Set(EpochHeader, strconv.FormatInt(shards.Epoch, 10))
+	req.Header.Set(HopsHeader, strconv.Itoa(hops+1))
 
-	resp, err := http.Get(url)
+	resp, err := client.Do(req)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Error redirecting the request: %v", err), http.StatusInternalServerError)
 		return
@@ -34,10 +245,12 @@ func (s *Server) redirect(shard int, w http.ResponseWriter, r *http.Request) {
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		http.Error(w, fmt.Sprintf("Error from target shard: %s", resp.Status), resp.StatusCode)
+		body, _ := io.ReadAll(resp.Body)
+		http.Error(w, fmt.Sprintf("Error from target shard: %s: %s", resp.Status, bytes.TrimSpace(body)), resp.StatusCode)
 		return
 	}
 
+	fmt.Fprintf(w, "redirecting from shard %d to shard %d (%q)\n", shards.CurIdx, shard, url)
 	io.Copy(w, resp.Body)
 }
 
@@ -57,12 +270,15 @@ func (s *Server) GetHandler(w http.ResponseWriter, r *http.Request) {
 	if bucketName == "" {
 		bucketName = "default"
 	}
+	if !checkBucket(w, bucketName) {
+		return
+	}
 
-	shard := s.shards.Index(key)
-	if shard != s.shards.CurIdx {
-		s.redirect(shard, w, r)
+	if !s.route(bucketName, key, w, r) {
 		return
 	}
+	shards := s.Shards()
+	shard := shards.CurIdx
 
 	value, err := s.db.GetKey(key, bucketName)
 	if err != nil {
@@ -76,7 +292,7 @@ func (s *Server) GetHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	fmt.Fprintf(w, "Shard = %d, current shard = %d, addr = %q, Value = %q",
-		shard, s.shards.CurIdx, s.shards.Addrs[shard], value)
+		shard, shards.CurIdx, shards.Addrs[shard], value)
 }
 
 func (s *Server) SetHandler(w http.ResponseWriter, r *http.Request) {
@@ -101,14 +317,25 @@ func (s *Server) SetHandler(w http.ResponseWriter, r *http.Request) {
 	if bucketName == "" {
 		bucketName = "default"
 	}
+	if !checkBucket(w, bucketName) {
+		return
+	}
 
-	shard := s.shards.Index(key)
-	if shard != s.shards.CurIdx {
-		s.redirect(shard, w, r)
+	if !s.checkLimits(w, key, []byte(value)) {
 		return
 	}
 
+	if !s.route(bucketName, key, w, r) {
+		return
+	}
+	shards := s.Shards()
+	shard := shards.CurIdx
+
 	err := s.db.SetKey(key, bucketName, []byte(value))
+	if errors.Is(err, db.ErrLocked) {
+		http.Error(w, fmt.Sprintf("Error setting key: %v", err), http.StatusConflict)
+		return
+	}
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Error setting key: %v", err), http.StatusInternalServerError)
 		return
@@ -117,7 +344,16 @@ func (s *Server) SetHandler(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "Successfully set key in shard %d", shard)
 }
 
-// Function to create a new bucket
+// CreateBucket creates a new bucket on every shard.
+//
+// The optional policy parameter selects how the bucket keys are spread
+// over shards ("default", "pinned" or "subset") and the shards parameter
+// lists the comma-separated shard indexes used by the policy. Names
+// starting with db.SystemPrefix are reserved for the system buckets.
+//
+// An existing bucket keeps its policy: a request without a policy
+// succeeds, one with a different policy is rejected, since its keys would
+// be looked up on shards that don't hold them.
 func (s *Server) CreateBucket(w http.ResponseWriter, r *http.Request) {
 	if err := r.ParseForm(); err != nil {
 		http.Error(w, "Error parsing form", http.StatusBadRequest)
@@ -129,13 +365,84 @@ func (s *Server) CreateBucket(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "bucketName parameter is required", http.StatusBadRequest)
 		return
 	}
+	if !checkBucket(w, bucketName) {
+		return
+	}
+
+	policy := config.BucketPolicy{Strategy: r.Form.Get("policy")}
+	if list := r.Form.Get("shards"); list != "" {
+		for _, v := range strings.Split(list, ",") {
+			idx, err := strconv.Atoi(strings.TrimSpace(v))
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Invalid shard index %q", v), http.StatusBadRequest)
+				return
+			}
+			policy.Shards = append(policy.Shards, idx)
+		}
+	}
+
+	shards := s.Shards()
+	if err := policy.Validate(shards); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid bucket policy: %v", err), http.StatusBadRequest)
+		return
+	}
 
-	err := s.db.CreateBucketIfNotExists(bucketName)
+	buckets, err := s.db.Buckets()
 	if err != nil {
+		http.Error(w, fmt.Sprintf("Error listing buckets: %v", err), http.StatusInternalServerError)
+		return
+	}
+	exists := slices.Contains(buckets, bucketName)
+	if exists && policy.Strategy != "" {
+		current, err := s.bucketPolicy(bucketName)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error getting bucket policy: %v", err), http.StatusInternalServerError)
+			return
+		}
+		if !current.Equal(policy) {
+			http.Error(w, fmt.Sprintf("Bucket %s already exists with a different policy", bucketName), http.StatusConflict)
+			return
+		}
+	}
+
+	if err := s.db.CreateBucketIfNotExists(bucketName); err != nil {
 		http.Error(w, fmt.Sprintf("Error creating bucket: %v", err), http.StatusInternalServerError)
 		return
 	}
 
+	if !exists && policy.Strategy != "" {
+		meta, err := json.Marshal(policy)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error encoding bucket policy: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		if err := s.db.SetBucketMeta(bucketName, meta); err != nil {
+			http.Error(w, fmt.Sprintf("Error storing bucket policy: %v", err), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// Every shard needs the bucket and its policy to route the keys.
+	if r.Form.Get("local") != "true" {
+		for idx, addr := range shards.Addrs {
+			if idx == shards.CurIdx {
+				continue
+			}
+
+			form := url.Values{}
+			for k, v := range r.Form {
+				form[k] = v
+			}
+			form.Set("local", "true")
+
+			if err := s.postForm(shards, addr, "/createBucket", form); err != nil {
+				http.Error(w, fmt.Sprintf("Error creating bucket on shard %d: %v", idx, err), http.StatusInternalServerError)
+				return
+			}
+		}
+	}
+
 	fmt.Fprintf(w, "Successfully created bucket %s", bucketName)
 }
 
@@ -150,19 +457,178 @@ func (s *Server) DeleteExtraKeysHandler(w http.ResponseWriter, r *http.Request)
 	if bucketName == "" {
 		bucketName = "default"
 	}
+	if !checkBucket(w, bucketName) {
+		return
+	}
 
-	err := s.db.DeleteExtraKeys(func(key string) bool {
-		return s.shards.Index(key) != s.shards.CurIdx
+	policy, err := s.bucketPolicy(bucketName)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error getting bucket policy: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	shards := s.Shards()
+	err = s.db.DeleteExtraKeys(func(key string) bool {
+		return shards.BucketIndex(policy, key) != shards.CurIdx
 	}, bucketName)
 
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Error deleting extra keys: %v", err), http.StatusInternalServerError)
+		code := http.StatusInternalServerError
+		if errors.Is(err, db.ErrLocked) {
+			code = http.StatusConflict
+		}
+		http.Error(w, fmt.Sprintf("Error deleting extra keys: %v", err), code)
 		return
 	}
 
 	fmt.Fprintf(w, "Successfully deleted extra keys from bucket %s", bucketName)
 }
 
+// MigrateHandler moves the keys that don't belong to the current shard
+// to their owners, e.g. after a range was split or merged. Keys are only
+// deleted locally once the owning shard has stored them. Plain values keep
+// their expiry times and flags, typed values are rebuilt by their commands.
+//
+// With all=true the keys of every bucket are moved instead of the ones of
+// bucketName. Requests made with a newer topology epoch than the one of
+// the shard are rejected, so that the keys are not moved before the shard
+// knows their new owners.
+func (s *Server) MigrateHandler(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Error parsing form", http.StatusBadRequest)
+		return
+	}
+
+	shards := s.Shards()
+	if epoch, ok := requestEpoch(r); ok && epoch > shards.Epoch {
+		http.Error(w, fmt.Sprintf("Stale topology: request epoch %d, local epoch %d", epoch, shards.Epoch), http.StatusMisdirectedRequest)
+		return
+	}
+
+	var buckets []string
+	if r.Form.Get("all") == "true" {
+		var err error
+		if buckets, err = s.db.Buckets(); err != nil {
+			http.Error(w, fmt.Sprintf("Error listing buckets: %v", err), http.StatusInternalServerError)
+			return
+		}
+	} else {
+		bucketName := r.Form.Get("bucketName")
+		if bucketName == "" {
+			bucketName = "default"
+		}
+		if !checkBucket(w, bucketName) {
+			return
+		}
+		buckets = []string{bucketName}
+	}
+
+	total := 0
+	for _, bucketName := range buckets {
+		n, err := s.migrateBucket(r.Context(), shards, bucketName)
+		total += n
+		if err != nil {
+			code := http.StatusInternalServerError
+			if errors.Is(err, db.ErrLocked) {
+				code = http.StatusConflict
+			}
+			http.Error(w, fmt.Sprintf("Error moving keys of bucket %s: %v", bucketName, err), code)
+			return
+		}
+	}
+
+	if len(buckets) == 1 {
+		fmt.Fprintf(w, "Successfully moved %d keys from bucket %s", total, buckets[0])
+		return
+	}
+	fmt.Fprintf(w, "Successfully moved %d keys from %d buckets", total, len(buckets))
+}
+
+// migrateBucket moves the keys of the bucket that don't belong to the
+// current shard and returns how many were moved.
+func (s *Server) migrateBucket(ctx context.Context, shards *config.Shards, bucketName string) (int, error) {
+	policy, err := s.bucketPolicy(bucketName)
+	if err != nil {
+		return 0, fmt.Errorf("getting bucket policy: %w", err)
+	}
+
+	moved := make(map[string]bool)
+	batches := make(map[int][]transfer.Record)
+
+	// The keys are sent through the import of the owners, which keeps
+	// their expiry times and flags.
+	send := func(shard int) error {
+		recs := batches[shard]
+		if len(recs) == 0 {
+			return nil
+		}
+
+		h := http.Header{}
+		h.Set(EpochHeader, strconv.FormatInt(shards.Epoch, 10))
+		h.Set(HopsHeader, "1")
+		if _, err := transfer.SendBatch(ctx, s.Client(), shards.Addrs[shard], recs, transfer.ConflictOverwrite, h); err != nil {
+			return fmt.Errorf("moving keys to shard %d: %w", shard, err)
+		}
+
+		for _, rec := range recs {
+			moved[rec.Key] = true
+		}
+		batches[shard] = recs[:0]
+		return nil
+	}
+
+	err = db.WalkEntries(s.db, bucketName, func(e db.Entry) error {
+		shard := shards.BucketIndex(policy, e.Key)
+		if shard == shards.CurIdx {
+			return nil
+		}
+		batches[shard] = append(batches[shard], entryRecord(bucketName, e))
+		if len(batches[shard]) >= transfer.BatchSize {
+			return send(shard)
+		}
+		return nil
+	})
+	for shard := 0; shard < shards.Count && err == nil; shard++ {
+		err = send(shard)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	if err := s.db.DeleteExtraKeys(func(key string) bool { return moved[key] }, bucketName); err != nil {
+		return 0, fmt.Errorf("deleting moved keys: %w", err)
+	}
+	return len(moved), nil
+}
+
+// postForm sends the form to another shard on behalf of the current one.
+func (s *Server) postForm(shards *config.Shards, addr, path string, form url.Values) error {
+	return s.postFormContext(context.Background(), shards, addr, path, form)
+}
+
+// postFormContext is postForm with a context.
+func (s *Server) postFormContext(ctx context.Context, shards *config.Shards, addr, path string, form url.Values) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.Client().URL(addr, path), strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set(EpochHeader, strconv.FormatInt(shards.Epoch, 10))
+	req.Header.Set(HopsHeader, "1")
+
+	resp, err := s.Client().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(body))
+	}
+	return nil
+}
+
 // DeleteBucketHandler handles the deletion of a bucket.
 func (s *Server) DeleteBucketHandler(w http.ResponseWriter, r *http.Request) {
 	if err := r.ParseForm(); err != nil {
@@ -181,10 +647,18 @@ func (s *Server) DeleteBucketHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Cannot delete the default bucket", http.StatusBadRequest)
 		return
 	}
+	if db.IsSystemBucket(bucketName) {
+		http.Error(w, "Cannot delete a system bucket", http.StatusBadRequest)
+		return
+	}
 
 	err := s.db.DeleteBucket(bucketName)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Error deleting bucket: %v", err), http.StatusInternalServerError)
+		code := http.StatusInternalServerError
+		if errors.Is(err, db.ErrLocked) {
+			code = http.StatusConflict
+		}
+		http.Error(w, fmt.Sprintf("Error deleting bucket: %v", err), code)
 		return
 	}
 
@@ -202,6 +676,9 @@ func (s *Server) ListKeysHandler(w http.ResponseWriter, r *http.Request) {
 	if bucketName == "" {
 		bucketName = "default"
 	}
+	if !checkBucket(w, bucketName) {
+		return
+	}
 
 	keys, err := s.db.ListKeys(bucketName)
 	if err != nil {
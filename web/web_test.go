@@ -1,18 +1,41 @@
 package web_test
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
 	"fmt"
 	"go-kvdb/config"
 	"go-kvdb/db"
+	"go-kvdb/memcache"
+	"go-kvdb/resp"
+	"go-kvdb/transfer"
 	"go-kvdb/web"
+	"go-kvdb/webhook"
+	"io"
 	"io/ioutil"
 	"log"
+	"math/big"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
+	"path/filepath"
+	"reflect"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func createShardDb(t *testing.T, idx int) *db.Database {
@@ -139,3 +162,1581 @@ func TestWebServer(t *testing.T) {
 		t.Errorf("Unexpected value of Soviet key: got %q, want %q", value2, want2)
 	}
 }
+
+func TestStaleEpoch(t *testing.T) {
+	_, srv := createShardServer(t, 0, map[int]string{0: "localhost:0"})
+
+	cases := []struct {
+		url     string
+		handler http.HandlerFunc
+	}{
+		{"/get?key=USA", srv.GetHandler},
+		{"/delete?prefix=US&local=true", srv.DeleteHandler},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest(http.MethodGet, c.url, nil)
+		req.Header.Set(web.EpochHeader, "1")
+
+		w := httptest.NewRecorder()
+		c.handler(w, req)
+
+		if w.Code != http.StatusMisdirectedRequest {
+			t.Errorf("Unexpected status for %q with a newer epoch: got %d, want %d", c.url, w.Code, http.StatusMisdirectedRequest)
+		}
+	}
+}
+
+func TestHopLimit(t *testing.T) {
+	addrs := map[int]string{
+		0: "localhost:0",
+		1: "localhost:0",
+	}
+	_, srv := createShardServer(t, 0, addrs)
+
+	// "Soviet" belongs to shard 1, so the request has to be forwarded.
+	req := httptest.NewRequest(http.MethodGet, "/get?key=Soviet", nil)
+	req.Header.Set(web.HopsHeader, fmt.Sprint(web.MaxHops))
+
+	w := httptest.NewRecorder()
+	srv.GetHandler(w, req)
+
+	if w.Code != http.StatusLoopDetected {
+		t.Errorf("Unexpected status for a request over the hop limit: got %d, want %d", w.Code, http.StatusLoopDetected)
+	}
+}
+
+type testShard struct {
+	db  *db.Database
+	srv *web.Server
+	url string
+}
+
+// startShards starts n shard servers with all handlers registered.
+// The topology for every shard is built by the shards function.
+func startShards(t *testing.T, n int, shards func(addrs map[int]string, idx int) *config.Shards) []testShard {
+	t.Helper()
+
+	res := make([]testShard, n)
+	muxes := make([]*http.ServeMux, n)
+	addrs := make(map[int]string)
+
+	for i := 0; i < n; i++ {
+		i := i
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			muxes[i].ServeHTTP(w, r)
+		}))
+		t.Cleanup(ts.Close)
+
+		res[i].url = ts.URL
+		addrs[i] = strings.TrimPrefix(ts.URL, "http://")
+	}
+
+	for i := 0; i < n; i++ {
+		res[i].db = createShardDb(t, i)
+		res[i].srv = web.NewServer(res[i].db, shards(addrs, i))
+
+		mux := http.NewServeMux()
+		mux.HandleFunc("/get", res[i].srv.GetHandler)
+		mux.HandleFunc("/set", res[i].srv.SetHandler)
+		mux.HandleFunc("/mget", res[i].srv.MGetHandler)
+		mux.HandleFunc("/mset", res[i].srv.MSetHandler)
+		mux.HandleFunc("/delete", res[i].srv.DeleteHandler)
+		mux.HandleFunc("/txn", res[i].srv.TxnHandler)
+		mux.HandleFunc("/txn/prepare", res[i].srv.TxnPrepareHandler)
+		mux.HandleFunc("/txn/commit", res[i].srv.TxnCommitHandler)
+		mux.HandleFunc("/txn/abort", res[i].srv.TxnAbortHandler)
+		mux.HandleFunc("/txn/status", res[i].srv.TxnStatusHandler)
+		mux.HandleFunc("/session/begin", res[i].srv.SessionBeginHandler)
+		mux.HandleFunc("/session/get", res[i].srv.SessionGetHandler)
+		mux.HandleFunc("/session/set", res[i].srv.SessionSetHandler)
+		mux.HandleFunc("/session/delete", res[i].srv.SessionDeleteHandler)
+		mux.HandleFunc("/session/commit", res[i].srv.SessionCommitHandler)
+		mux.HandleFunc("/session/rollback", res[i].srv.SessionRollbackHandler)
+		mux.HandleFunc("/incr", res[i].srv.IncrHandler)
+		mux.HandleFunc("/type", res[i].srv.TypeHandler)
+		mux.HandleFunc("/cmd", res[i].srv.CmdHandler)
+		mux.HandleFunc("/resp", res[i].srv.RESPHandler)
+		mux.HandleFunc("/memcache", res[i].srv.MemcacheHandler)
+		mux.HandleFunc("DELETE /v1/kv/{bucket}/{key...}", res[i].srv.DeleteKeyHandler)
+		mux.HandleFunc("/listKeys", res[i].srv.ListKeysHandler)
+		mux.HandleFunc("/scan", res[i].srv.ScanHandler)
+		mux.HandleFunc("/migrate", res[i].srv.MigrateHandler)
+		mux.HandleFunc("/createBucket", res[i].srv.CreateBucket)
+		mux.HandleFunc("/admin/export", res[i].srv.ExportHandler)
+		mux.HandleFunc("/admin/import", res[i].srv.ImportHandler)
+		muxes[i] = mux
+	}
+
+	return res
+}
+
+func httpGet(t *testing.T, url string) (int, string) {
+	t.Helper()
+
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("GET %q failed: %v", url, err)
+	}
+	defer resp.Body.Close()
+
+	contents, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("Could not read the response of %q: %v", url, err)
+	}
+	return resp.StatusCode, string(contents)
+}
+
+func TestRangeScanAndMigrate(t *testing.T) {
+	splits := []string{"m"}
+	cluster := startShards(t, 2, func(addrs map[int]string, idx int) *config.Shards {
+		return &config.Shards{Addrs: addrs, Count: len(addrs), CurIdx: idx, Splits: splits}
+	})
+
+	for _, key := range []string{"apple", "avocado", "banana", "mango", "melon"} {
+		if code, body := httpGet(t, cluster[0].url+"/set?key="+key+"&value=v-"+key); code != http.StatusOK {
+			t.Fatalf("Could not set %q: %d %s", key, code, body)
+		}
+	}
+
+	if code, body := httpGet(t, cluster[1].url+"/scan?prefix=a"); code != http.StatusOK || body != "Keys in bucket default (shards [0]):\n- apple\n- avocado\n" {
+		t.Errorf("Unexpected scan result: %d %q", code, body)
+	}
+
+	if code, body := httpGet(t, cluster[0].url+"/scan?start=b&end=n"); code != http.StatusOK || body != "Keys in bucket default (shards [0 1]):\n- banana\n- mango\n- melon\n" {
+		t.Errorf("Unexpected scan result: %d %q", code, body)
+	}
+
+	// Move "banana" to the second shard.
+	for _, c := range cluster {
+		c.srv.SetShards(&config.Shards{Addrs: c.srv.Shards().Addrs, Count: 2, CurIdx: c.srv.Shards().CurIdx, Splits: []string{"b"}, Epoch: 1})
+	}
+
+	if code, body := httpGet(t, cluster[0].url+"/migrate"); code != http.StatusOK {
+		t.Fatalf("Could not migrate keys: %d %s", code, body)
+	}
+
+	if got := getLocal(t, cluster[0].db, "banana"); got != "" {
+		t.Errorf("Key banana was not removed from the first shard: got %q", got)
+	}
+	if got := getLocal(t, cluster[1].db, "banana"); got != "v-banana" {
+		t.Errorf("Key banana was not moved to the second shard: got %q", got)
+	}
+	if got := getLocal(t, cluster[0].db, "apple"); got != "v-apple" {
+		t.Errorf("Key apple must stay on the first shard: got %q", got)
+	}
+}
+
+func getLocal(t *testing.T, d *db.Database, key string) string {
+	t.Helper()
+
+	value, err := d.GetKey(key, "default")
+	if err != nil {
+		t.Fatalf("GetKey(%q) failed: %v", key, err)
+	}
+	return string(value)
+}
+
+func TestPinnedBucket(t *testing.T) {
+	cluster := startShards(t, 3, func(addrs map[int]string, idx int) *config.Shards {
+		return &config.Shards{Addrs: addrs, Count: len(addrs), CurIdx: idx}
+	})
+
+	if code, body := httpGet(t, cluster[0].url+"/createBucket?bucketName=settings&policy=pinned&shards=2"); code != http.StatusOK {
+		t.Fatalf("Could not create bucket: %d %s", code, body)
+	}
+
+	if code, body := httpGet(t, cluster[0].url+"/createBucket?bucketName=broken&policy=pinned&shards=5"); code != http.StatusBadRequest {
+		t.Errorf("Unexpected response for an invalid policy: %d %s", code, body)
+	}
+
+	keys := []string{"USA", "Soviet", "timeout", "retries"}
+	for i, key := range keys {
+		url := cluster[i%3].url + "/set?bucketName=settings&key=" + key + "&value=v-" + key
+		if code, body := httpGet(t, url); code != http.StatusOK {
+			t.Fatalf("Could not set %q: %d %s", key, code, body)
+		}
+	}
+
+	for _, key := range keys {
+		value, err := cluster[2].db.GetKey(key, "settings")
+		if err != nil {
+			t.Fatalf("GetKey(%q) failed: %v", key, err)
+		}
+		if want := "v-" + key; string(value) != want {
+			t.Errorf("Unexpected value of %q on the pinned shard: got %q, want %q", key, value, want)
+		}
+	}
+
+	code, body := httpGet(t, cluster[0].url+"/scan?bucketName=settings")
+	if want := "Keys in bucket settings (shards [2]):\n- Soviet\n- USA\n- retries\n- timeout\n"; code != http.StatusOK || body != want {
+		t.Errorf("Unexpected scan result: %d %q, want %q", code, body, want)
+	}
+
+	// The policy of an existing bucket cannot be changed.
+	for _, tc := range []struct {
+		query string
+		want  int
+	}{
+		{"bucketName=settings&policy=pinned&shards=1", http.StatusConflict},
+		{"bucketName=settings&policy=default", http.StatusConflict},
+		{"bucketName=settings&policy=pinned&shards=2", http.StatusOK},
+		{"bucketName=settings", http.StatusOK},
+	} {
+		if code, body := httpGet(t, cluster[1].url+"/createBucket?"+tc.query); code != tc.want {
+			t.Errorf("Unexpected response for %q: %d %s, want %d", tc.query, code, body, tc.want)
+		}
+	}
+	if value, err := cluster[2].db.GetKey("USA", "settings"); err != nil || string(value) != "v-USA" {
+		t.Errorf("Unexpected value after re-creating the bucket: %q, %v", value, err)
+	}
+	code, body = httpGet(t, cluster[0].url+"/get?bucketName=settings&key=USA")
+	if code != http.StatusOK || !strings.Contains(body, "v-USA") {
+		t.Errorf("Unexpected get after re-creating the bucket: %d %s", code, body)
+	}
+}
+
+func TestLimits(t *testing.T) {
+	_, srv := createShardServer(t, 0, map[int]string{0: "localhost:0"})
+	srv.SetLimits(config.Limits{MaxKeySize: 4, MaxValueSize: 8})
+
+	cases := []struct {
+		url  string
+		want int
+	}{
+		{"/set?key=abcd&value=12345678", http.StatusOK},
+		{"/set?key=abcde&value=1", http.StatusBadRequest},
+		{"/set?key=abc&value=123456789", http.StatusRequestEntityTooLarge},
+	}
+
+	for _, c := range cases {
+		w := httptest.NewRecorder()
+		srv.SetHandler(w, httptest.NewRequest(http.MethodGet, c.url, nil))
+
+		if w.Code != c.want {
+			t.Errorf("Unexpected status for %q: got %d, want %d", c.url, w.Code, c.want)
+		}
+	}
+}
+
+func TestBackupNotSupported(t *testing.T) {
+	srv := web.NewServer(db.NewMemStore(), &config.Shards{Count: 1, Addrs: map[int]string{0: "localhost:0"}})
+
+	w := httptest.NewRecorder()
+	srv.BackupHandler(w, httptest.NewRequest(http.MethodGet, "/admin/backup", nil))
+
+	if w.Code != http.StatusNotImplemented {
+		t.Errorf("Unexpected status: got %d, want %d", w.Code, http.StatusNotImplemented)
+	}
+}
+
+// slowBackup streams its backup in two halves with a pause in between.
+type slowBackup struct {
+	*db.Database
+	pause time.Duration
+}
+
+func (s slowBackup) Backup(w io.Writer) (int64, error) {
+	var buf bytes.Buffer
+	if _, err := s.Database.Backup(&buf); err != nil {
+		return 0, err
+	}
+	half := buf.Len() / 2
+	n, err := w.Write(buf.Next(half))
+	if err != nil {
+		return int64(n), err
+	}
+	time.Sleep(s.pause)
+	m, err := w.Write(buf.Bytes())
+	return int64(n + m), err
+}
+
+func TestBackupPastWriteTimeout(t *testing.T) {
+	d := createShardDb(t, 0)
+	if err := d.SetKey("a", "default", bytes.Repeat([]byte("x"), 64<<10)); err != nil {
+		t.Fatalf("Could not set key: %v", err)
+	}
+	var want bytes.Buffer
+	if _, err := d.Backup(&want); err != nil {
+		t.Fatalf("Could not back up: %v", err)
+	}
+
+	srv := web.NewServer(slowBackup{d, 200 * time.Millisecond}, &config.Shards{Count: 1, Addrs: map[int]string{0: "localhost:0"}})
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(srv.BackupHandler))
+	ts.Config.WriteTimeout = 50 * time.Millisecond
+	ts.Start()
+	defer ts.Close()
+
+	res, err := http.Get(ts.URL + "/admin/backup")
+	if err != nil {
+		t.Fatalf("Could not request a backup: %v", err)
+	}
+	defer res.Body.Close()
+	got, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatalf("Could not read the backup: %v", err)
+	}
+	if len(got) != want.Len() {
+		t.Errorf("Unexpected backup size: got %d, want %d", len(got), want.Len())
+	}
+}
+
+// slowWalk pauses before walking a bucket.
+type slowWalk struct {
+	*db.Database
+	pause time.Duration
+}
+
+func (s slowWalk) WalkEntries(bucketName string, fn func(e db.Entry) error) error {
+	time.Sleep(s.pause)
+	return s.Database.WalkEntries(bucketName, fn)
+}
+
+func TestTransferPastTimeouts(t *testing.T) {
+	d := createShardDb(t, 0)
+	if err := d.SetKey("a", "default", []byte("1")); err != nil {
+		t.Fatalf("Could not set key: %v", err)
+	}
+
+	srv := web.NewServer(slowWalk{d, 200 * time.Millisecond}, &config.Shards{Count: 1, Addrs: map[int]string{0: "localhost:0"}})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/admin/export", srv.ExportHandler)
+	mux.HandleFunc("/admin/import", srv.ImportHandler)
+	ts := httptest.NewUnstartedServer(mux)
+	ts.Config.ReadTimeout = 50 * time.Millisecond
+	ts.Config.WriteTimeout = 50 * time.Millisecond
+	ts.Start()
+	defer ts.Close()
+
+	code, body := httpGet(t, ts.URL+"/admin/export?bucket=default")
+	if want := "{\"bucket\":\"default\",\"key\":\"a\",\"value\":\"1\"}\n"; code != http.StatusOK || body != want {
+		t.Errorf("Unexpected export: %d %q, want %q", code, body, want)
+	}
+
+	// The body arrives in two parts with a pause in between.
+	pr, pw := io.Pipe()
+	go func() {
+		pw.Write([]byte("{\"bucket\":\"default\",\"key\":\"b\",\"value\":\"2\"}\n"))
+		time.Sleep(200 * time.Millisecond)
+		pw.Write([]byte("{\"bucket\":\"default\",\"key\":\"c\",\"value\":\"3\"}\n"))
+		pw.Close()
+	}()
+	res, err := http.Post(ts.URL+"/admin/import", "application/x-ndjson", pr)
+	if err != nil {
+		t.Fatalf("Could not import: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("Unexpected import status: got %d, want %d", res.StatusCode, http.StatusOK)
+	}
+	if v, err := d.GetKey("c", "default"); err != nil || string(v) != "3" {
+		t.Errorf("Unexpected value of c: got %q, %v", v, err)
+	}
+
+	res, err = http.Post(ts.URL+"/admin/import", "application/x-ndjson", strings.NewReader("{\"bucket\":\"__webhooks\",\"key\":\"a\",\"value\":\"1\"}\n"))
+	if err != nil {
+		t.Fatalf("Could not import: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("Unexpected status for a system bucket: got %d, want %d", res.StatusCode, http.StatusBadRequest)
+	}
+}
+
+// slowGet pauses before reading a key.
+type slowGet struct {
+	*db.Database
+	pause time.Duration
+}
+
+func (s slowGet) GetKey(key, bucketName string) ([]byte, error) {
+	time.Sleep(s.pause)
+	return s.Database.GetKey(key, bucketName)
+}
+
+func TestImportConcurrentConflicts(t *testing.T) {
+	d := createShardDb(t, 0)
+	srv := web.NewServer(slowGet{d, 50 * time.Millisecond}, &config.Shards{Count: 1, Addrs: map[int]string{0: "localhost:0"}})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/admin/import", srv.ImportHandler)
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+	addr := strings.TrimPrefix(ts.URL, "http://")
+
+	// Of the concurrent imports of a missing key that must not replace it,
+	// exactly one writes it.
+	for _, rec := range []transfer.Record{
+		{Bucket: "default", Key: "plain", Value: []byte("1")},
+		{Bucket: "default", Key: "item", Value: []byte("1"), Flags: 3},
+		{Bucket: "default", Key: "typed", Commands: []db.Cmd{db.NewCmd("sadd", "a")}},
+	} {
+		for _, conflict := range []string{transfer.ConflictFail, transfer.ConflictSkip} {
+			if err := d.DelKey("default", rec.Key); err != nil {
+				t.Fatalf("Could not delete key: %v", err)
+			}
+
+			var mu sync.Mutex
+			var wg sync.WaitGroup
+			imported := 0
+			for i := 0; i < 10; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					res, err := transfer.SendBatch(context.Background(), config.DefaultClient, addr, []transfer.Record{rec}, conflict, nil)
+					var se *transfer.StatusError
+					if err != nil && (!errors.As(err, &se) || se.Status != http.StatusConflict) {
+						t.Errorf("Unexpected error importing %q with %s: %v", rec.Key, conflict, err)
+					}
+					mu.Lock()
+					defer mu.Unlock()
+					imported += res.Imported
+				}()
+			}
+			wg.Wait()
+			if imported != 1 {
+				t.Errorf("Unexpected number of imports of %q with %s: got %d, want 1", rec.Key, conflict, imported)
+			}
+		}
+	}
+}
+
+func TestImportPinnedBucket(t *testing.T) {
+	cluster := startShards(t, 2, func(addrs map[int]string, idx int) *config.Shards {
+		return &config.Shards{Addrs: addrs, Count: len(addrs), CurIdx: idx}
+	})
+
+	if code, body := httpGet(t, cluster[0].url+"/createBucket?bucketName=settings&policy=pinned&shards=1"); code != http.StatusOK {
+		t.Fatalf("Could not create bucket: %d %s", code, body)
+	}
+
+	recs := []transfer.Record{
+		{Bucket: "settings", Key: "timeout", Value: []byte("10s")},
+		{Bucket: "settings", Key: "retries", Value: []byte("3")},
+	}
+	addr := strings.TrimPrefix(cluster[0].url, "http://")
+
+	res, err := transfer.SendBatch(context.Background(), config.DefaultClient, addr, recs, transfer.ConflictFail, nil)
+	if err != nil {
+		t.Fatalf("Could not import: %v", err)
+	}
+	if res.Imported != 2 {
+		t.Errorf("Unexpected import result: %+v", res)
+	}
+
+	for _, rec := range recs {
+		if v, err := cluster[1].db.GetKey(rec.Key, "settings"); err != nil || string(v) != string(rec.Value) {
+			t.Errorf("Key %q was not forwarded to the pinned shard: got %q, %v", rec.Key, v, err)
+		}
+	}
+
+	_, err = transfer.SendBatch(context.Background(), config.DefaultClient, addr, recs, transfer.ConflictFail, nil)
+	var se *transfer.StatusError
+	if !errors.As(err, &se) || se.Status != http.StatusConflict {
+		t.Errorf("Expected a forwarded conflict error, got %v", err)
+	}
+
+	code, body := httpGet(t, cluster[0].url+"/admin/export?bucket=settings")
+	if code != http.StatusOK || body != "" {
+		t.Errorf("Unexpected export of the shard that does not own the bucket: %d %q", code, body)
+	}
+	code, body = httpGet(t, cluster[1].url+"/admin/export?bucket=settings")
+	if want := "{\"bucket\":\"settings\",\"key\":\"retries\",\"value\":\"3\"}\n"; code != http.StatusOK || !strings.HasPrefix(body, want) {
+		t.Errorf("Unexpected export: %d %q, want prefix %q", code, body, want)
+	}
+}
+
+func TestTransferTypedValues(t *testing.T) {
+	cluster := startShards(t, 1, func(addrs map[int]string, idx int) *config.Shards {
+		return &config.Shards{Addrs: addrs, Count: len(addrs), CurIdx: idx}
+	})
+	u := cluster[0].url
+	addr := strings.TrimPrefix(u, "http://")
+
+	if code, body := httpGet(t, u+"/cmd?key=user&cmd=hset&arg=name&arg=alice"); code != http.StatusOK {
+		t.Fatalf("Could not set the hash: %d %s", code, body)
+	}
+
+	code, body := httpGet(t, u+"/admin/export?bucket=default")
+	want := `{"bucket":"default","key":"user","commands":[{"name":"hset","args":["bmFtZQ==","YWxpY2U="]}]}` + "\n"
+	if code != http.StatusOK || body != want {
+		t.Errorf("Unexpected export: %d %q, want %q", code, body, want)
+	}
+
+	// The hash is not overwritten with the skip policy.
+	res, err := transfer.SendBatch(context.Background(), config.DefaultClient, addr, []transfer.Record{{Bucket: "default", Key: "user", Value: []byte("plain")}}, transfer.ConflictSkip, nil)
+	if err != nil || res != (transfer.Result{Skipped: 1}) {
+		t.Errorf("Unexpected result of the import with skip: %+v, %v", res, err)
+	}
+	if typ, err := cluster[0].db.Type("default", "user"); err != nil || typ != db.TypeHash {
+		t.Errorf("Unexpected type after the import with skip: got %q, %v, want %q", typ, err, db.TypeHash)
+	}
+
+	recs := []transfer.Record{
+		{Bucket: "default", Key: "user", Commands: []db.Cmd{db.NewCmd("hset", "name", "bob")}},
+		{Bucket: "default", Key: "queue", Commands: []db.Cmd{db.NewCmd("rpush", "a"), db.NewCmd("rpush", "b")}},
+	}
+	_, err = transfer.SendBatch(context.Background(), config.DefaultClient, addr, recs, transfer.ConflictFail, nil)
+	var se *transfer.StatusError
+	if !errors.As(err, &se) || se.Status != http.StatusConflict {
+		t.Errorf("Expected a conflict error, got %v", err)
+	}
+	res, err = transfer.SendBatch(context.Background(), config.DefaultClient, addr, recs, transfer.ConflictOverwrite, nil)
+	if err != nil || res != (transfer.Result{Imported: 2}) {
+		t.Errorf("Unexpected result of the import with overwrite: %+v, %v", res, err)
+	}
+	if code, body := httpGet(t, u+"/cmd?key=user&cmd=hgetall"); code != http.StatusOK || !strings.HasSuffix(body, `{"n":0,"values":["name","bob"]}`+"\n") {
+		t.Errorf("Unexpected hash after the import: %d %q", code, body)
+	}
+	if code, body := httpGet(t, u+"/cmd?key=queue&cmd=lrange&arg=0&arg=-1"); code != http.StatusOK || !strings.HasSuffix(body, `{"n":0,"values":["a","b"]}`+"\n") {
+		t.Errorf("Unexpected list after the import: %d %q", code, body)
+	}
+}
+
+func TestTransferItems(t *testing.T) {
+	cluster := startShards(t, 2, func(addrs map[int]string, idx int) *config.Shards {
+		return &config.Shards{Addrs: addrs, Count: len(addrs), CurIdx: idx, Splits: []string{"m"}}
+	})
+
+	expires := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	items := map[string]*db.Item{
+		"session": {Value: []byte("s"), Expires: expires, Flags: 7},
+		"gone":    {Value: []byte("g"), Expires: time.Now().Add(time.Millisecond)},
+	}
+	for key, item := range items {
+		err := cluster[1].db.ModifyItem("default", key, func(*db.Item) (*db.Item, error) { return item, nil })
+		if err != nil {
+			t.Fatalf("Could not set key %q: %v", key, err)
+		}
+	}
+	time.Sleep(5 * time.Millisecond)
+
+	code, body := httpGet(t, cluster[1].url+"/admin/export?bucket=default")
+	want := fmt.Sprintf(`{"bucket":"default","key":"session","value":"s","expires":%q,"flags":7}`+"\n", expires.Format(time.RFC3339Nano))
+	if code != http.StatusOK || body != want {
+		t.Errorf("Unexpected export: %d %q, want %q", code, body, want)
+	}
+
+	// Move the keys to the first shard.
+	for _, c := range cluster {
+		c.srv.SetShards(&config.Shards{Addrs: c.srv.Shards().Addrs, Count: 2, CurIdx: c.srv.Shards().CurIdx, Splits: []string{"t"}, Epoch: 1})
+	}
+	if code, body := httpGet(t, cluster[1].url+"/migrate"); code != http.StatusOK {
+		t.Fatalf("Could not migrate keys: %d %s", code, body)
+	}
+
+	item, err := cluster[0].db.GetItem("default", "session")
+	if err != nil || item == nil || string(item.Value) != "s" || !item.Expires.Equal(expires) || item.Flags != 7 {
+		t.Errorf("Unexpected item after the migration: got %+v, %v", item, err)
+	}
+	if item, _ := cluster[0].db.GetItem("default", "gone"); item != nil {
+		t.Errorf("An expired key was migrated: got %+v", item)
+	}
+}
+
+// readEvent reads the next event of a Server-Sent Events stream.
+func readEvent(t *testing.T, r *bufio.Reader) map[string]string {
+	t.Helper()
+
+	ev := make(map[string]string)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Could not read the event stream: %v", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			if len(ev) > 0 {
+				return ev
+			}
+			continue
+		}
+		if name, value, ok := strings.Cut(line, ": "); ok && name != "" {
+			ev[name] = value
+		}
+	}
+}
+
+func TestWatch(t *testing.T) {
+	d, closeFunc, err := db.OpenDatabase(filepath.Join(t.TempDir(), "shard.db"), db.Options{ChangeLog: true})
+	if err != nil {
+		t.Fatalf("Could not create a new database: %v", err)
+	}
+	defer closeFunc()
+
+	srv := web.NewServer(d, &config.Shards{Count: 1, Addrs: map[int]string{0: "localhost:0"}})
+	ts := httptest.NewServer(http.HandlerFunc(srv.WatchHandler))
+	defer ts.Close()
+
+	watch := func(query string) (*bufio.Reader, func()) {
+		t.Helper()
+
+		resp, err := http.Get(ts.URL + "/watch?" + query)
+		if err != nil {
+			t.Fatalf("Could not watch %q: %v", query, err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("Unexpected status watching %q: %s", query, resp.Status)
+		}
+		return bufio.NewReader(resp.Body), func() { resp.Body.Close() }
+	}
+
+	r, stop := watch("bucket=default&prefix=config/")
+	setKey := func(key, value string) {
+		t.Helper()
+		if err := d.SetKey(key, "default", []byte(value)); err != nil {
+			t.Fatalf("Could not write key %q: %v", key, err)
+		}
+	}
+	setKey("other", "ignored")
+	setKey("config/timeout", "10s")
+	if err := d.DelKey("default", "config/timeout"); err != nil {
+		t.Fatalf("Could not delete key: %v", err)
+	}
+
+	set := readEvent(t, r)
+	if set["event"] != db.ChangeSet || !strings.Contains(set["data"], `"key":"config/timeout","value":"10s"`) {
+		t.Errorf("Unexpected set event: %v", set)
+	}
+	del := readEvent(t, r)
+	if del["event"] != db.ChangeDelete || !strings.Contains(del["data"], `"key":"config/timeout"`) {
+		t.Errorf("Unexpected delete event: %v", del)
+	}
+	stop()
+
+	// Resuming after the set only replays the delete.
+	r, stop = watch("prefix=config/&since=" + set["id"])
+	defer stop()
+	if ev := readEvent(t, r); ev["id"] != del["id"] {
+		t.Errorf("Unexpected event after resuming: got %v, want id %s", ev, del["id"])
+	}
+
+	resp, err := http.Get(ts.URL + "/watch?since=1000")
+	if err != nil {
+		t.Fatalf("Could not watch: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusGone {
+		t.Errorf("Unexpected status for a future sequence number: got %d, want %d", resp.StatusCode, http.StatusGone)
+	}
+}
+
+func TestWatchWithoutChangeLog(t *testing.T) {
+	srv := web.NewServer(createShardDb(t, 0), &config.Shards{Count: 1, Addrs: map[int]string{0: "localhost:0"}})
+
+	w := httptest.NewRecorder()
+	srv.WatchHandler(w, httptest.NewRequest(http.MethodGet, "/watch", nil))
+
+	if w.Code != http.StatusNotImplemented {
+		t.Errorf("Unexpected status: got %d, want %d", w.Code, http.StatusNotImplemented)
+	}
+}
+
+func TestSystemBucketsReserved(t *testing.T) {
+	srv := web.NewServer(db.NewMemStore(), &config.Shards{Count: 1, Addrs: map[int]string{0: "localhost:0"}})
+
+	for _, url := range []string{"/createBucket?bucketName=__webhooks", "/deleteBucket?bucketName=__changelog"} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, url, nil)
+		if strings.HasPrefix(url, "/createBucket") {
+			srv.CreateBucket(w, r)
+		} else {
+			srv.DeleteBucketHandler(w, r)
+		}
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Unexpected status for %q: got %d, want %d", url, w.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestDelete(t *testing.T) {
+	cluster := startShards(t, 2, func(addrs map[int]string, idx int) *config.Shards {
+		return &config.Shards{Addrs: addrs, Count: len(addrs), CurIdx: idx, Splits: []string{"m"}}
+	})
+
+	for _, key := range []string{"apple", "avocado", "banana", "mango", "melon", "mint"} {
+		if code, body := httpGet(t, cluster[0].url+"/set?key="+key+"&value=v-"+key); code != http.StatusOK {
+			t.Fatalf("Could not set %q: %d %s", key, code, body)
+		}
+	}
+
+	cases := []struct {
+		url  string
+		want int
+	}{
+		{"/delete?key=mango&ifValue=other", http.StatusPreconditionFailed},
+		{"/delete?key=mango&ifValue=v-mango", http.StatusOK},
+		{"/delete?key=mango", http.StatusNotFound},
+		{"/delete?key=a&prefix=a", http.StatusBadRequest},
+		{"/delete?prefix=", http.StatusBadRequest},
+	}
+	for _, c := range cases {
+		if code, body := httpGet(t, cluster[0].url+c.url); code != c.want {
+			t.Errorf("Unexpected status for %q: got %d, want %d: %s", c.url, code, c.want, body)
+		}
+	}
+
+	req, err := http.NewRequest(http.MethodDelete, cluster[1].url+"/v1/kv/default/apple", nil)
+	if err != nil {
+		t.Fatalf("Could not create request: %v", err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("DELETE failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Unexpected status of DELETE: got %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	if got := getLocal(t, cluster[0].db, "apple"); got != "" {
+		t.Errorf("Key apple was not deleted: got %q", got)
+	}
+
+	code, body := httpGet(t, cluster[0].url+"/delete?prefix=m")
+	if want := `Deleted 2 keys with prefix "m" in bucket default (shards [1])`; code != http.StatusOK || body != want {
+		t.Errorf("Unexpected delete by prefix: %d %q, want %q", code, body, want)
+	}
+	if got := getLocal(t, cluster[1].db, "mint"); got != "" {
+		t.Errorf("Key mint was not deleted: got %q", got)
+	}
+	if got := getLocal(t, cluster[0].db, "avocado"); got != "v-avocado" {
+		t.Errorf("Key avocado must not be deleted: got %q", got)
+	}
+}
+
+func TestIncr(t *testing.T) {
+	cluster := startShards(t, 2, func(addrs map[int]string, idx int) *config.Shards {
+		return &config.Shards{Addrs: addrs, Count: len(addrs), CurIdx: idx, Splits: []string{"m"}}
+	})
+
+	cases := []struct {
+		url      string
+		wantCode int
+		want     string
+	}{
+		// The counter lives on the second shard.
+		{"/incr?key=visits", http.StatusOK, "1"},
+		{"/incr?key=visits&by=41", http.StatusOK, "42"},
+		{"/incr?key=visits&by=-50&min=0", http.StatusConflict, ""},
+		{"/incr?key=stock&initial=10&by=-1", http.StatusOK, "9"},
+		{"/incr?key=ratio&by=0.25", http.StatusOK, "0.25"},
+		{"/incr?key=ratio", http.StatusOK, "1.25"},
+		{"/incr?key=visits&by=abc", http.StatusBadRequest, ""},
+		{"/incr?key=visits&by=9223372036854775807", http.StatusConflict, ""},
+		{"/incr?key=visits&by=9223372036854775808", http.StatusConflict, ""},
+		{"/incr?key=visits&min=-9223372036854775809", http.StatusConflict, ""},
+		{"/set?key=huge&value=9223372036854775808", http.StatusOK, ""},
+		{"/incr?key=huge", http.StatusConflict, ""},
+	}
+	for _, c := range cases {
+		code, body := httpGet(t, cluster[0].url+c.url)
+		if code != c.wantCode || (c.want != "" && !strings.HasSuffix(body, c.want+"\n")) {
+			t.Errorf("Unexpected response for %q: got %d %q, want %d %q", c.url, code, body, c.wantCode, c.want)
+		}
+	}
+
+	if got := getLocal(t, cluster[1].db, "visits"); got != "42" {
+		t.Errorf("Unexpected counter on the owning shard: got %q, want %q", got, "42")
+	}
+}
+
+func TestTypedValues(t *testing.T) {
+	cluster := startShards(t, 2, func(addrs map[int]string, idx int) *config.Shards {
+		return &config.Shards{Addrs: addrs, Count: len(addrs), CurIdx: idx, Splits: []string{"m"}}
+	})
+
+	cases := []struct {
+		url      string
+		wantCode int
+		want     string
+	}{
+		// The values live on the second shard.
+		{"/cmd?key=user&cmd=hset&arg=name&arg=alice", http.StatusOK, `{"n":1}` + "\n"},
+		{"/cmd?key=user&cmd=hgetall", http.StatusOK, `{"n":0,"values":["name","alice"]}` + "\n"},
+		{"/cmd?key=user&cmd=hget&arg=name", http.StatusOK, `{"n":0,"value":"alice"}` + "\n"},
+		{"/cmd?key=queue&cmd=rpush&arg=a&arg=b", http.StatusOK, `{"n":2}` + "\n"},
+		{"/cmd?key=queue&cmd=lrange&arg=0&arg=-1", http.StatusOK, `{"n":0,"values":["a","b"]}` + "\n"},
+		{"/cmd?key=scores&cmd=zadd&arg=2&arg=bob&arg=1.5&arg=alice", http.StatusOK, `{"n":2}` + "\n"},
+		{"/cmd?key=scores&cmd=zrangebyscore&arg=-inf&arg=inf", http.StatusOK, `{"n":0,"values":["alice","bob"],"scores":[1.5,2]}` + "\n"},
+		{"/cmd?key=user&cmd=sadd&arg=x", http.StatusConflict, ""},
+		{"/cmd?key=user&cmd=nope", http.StatusBadRequest, ""},
+		{"/cmd?key=queue&cmd=lrange&arg=0", http.StatusBadRequest, ""},
+		{"/type?key=scores", http.StatusOK, "zset\n"},
+		{"/type?key=missing", http.StatusOK, "none\n"},
+	}
+	for _, c := range cases {
+		code, body := httpGet(t, cluster[0].url+c.url)
+		if code != c.wantCode || (c.want != "" && !strings.HasSuffix(body, c.want)) {
+			t.Errorf("Unexpected response for %q: got %d %q, want %d %q", c.url, code, body, c.wantCode, c.want)
+		}
+	}
+
+	if typ, err := cluster[1].db.Type("default", "queue"); err != nil || typ != db.TypeList {
+		t.Errorf("Unexpected type on the owning shard: got %q, %v, want %q", typ, err, db.TypeList)
+	}
+
+	// Move the list to the first shard.
+	for _, c := range cluster {
+		c.srv.SetShards(&config.Shards{Addrs: c.srv.Shards().Addrs, Count: 2, CurIdx: c.srv.Shards().CurIdx, Splits: []string{"r"}, Epoch: 1})
+	}
+	if code, body := httpGet(t, cluster[1].url+"/migrate"); code != http.StatusOK {
+		t.Fatalf("Could not migrate keys: %d %s", code, body)
+	}
+
+	if typ, _ := cluster[1].db.Type("default", "queue"); typ != "" {
+		t.Errorf("The list was not removed from the second shard: got type %q", typ)
+	}
+	if code, body := httpGet(t, cluster[1].url+"/cmd?key=queue&cmd=lrange&arg=0&arg=-1"); code != http.StatusOK || !strings.HasSuffix(body, `{"n":0,"values":["a","b"]}`+"\n") {
+		t.Errorf("Unexpected list after the migration: %d %q", code, body)
+	}
+}
+
+func respDo(t *testing.T, rw *bufio.ReadWriter, args ...string) resp.Value {
+	t.Helper()
+	cmd := make([][]byte, len(args))
+	for i, a := range args {
+		cmd[i] = []byte(a)
+	}
+	if err := resp.WriteCommand(rw.Writer, cmd); err != nil {
+		t.Fatalf("Could not send %v: %v", args, err)
+	}
+	rw.Flush()
+
+	v, err := resp.Read(rw.Reader)
+	if err != nil {
+		t.Fatalf("Could not read the reply to %v: %v", args, err)
+	}
+	if v.IsError() {
+		t.Fatalf("Unexpected error reply to %v: %s", args, v.Str)
+	}
+	return v
+}
+
+func TestRESPForwarding(t *testing.T) {
+	cluster := startShards(t, 2, func(addrs map[int]string, idx int) *config.Shards {
+		return &config.Shards{Addrs: addrs, Count: len(addrs), CurIdx: idx, Splits: []string{"m"}}
+	})
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not listen: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go resp.NewServer(cluster[0].db, cluster[0].srv).Serve(l)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("Could not connect: %v", err)
+	}
+	defer conn.Close()
+	rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+
+	respDo(t, rw, "SET", "zebra", "stripes", "NX")
+	respDo(t, rw, "MSET", "apple", "1", "zoo", "2", "banana", "3")
+	if got := getLocal(t, cluster[1].db, "zebra"); got != "stripes" {
+		t.Errorf("Key zebra was not stored on the second shard: got %q", got)
+	}
+	if got := getLocal(t, cluster[1].db, "zoo"); got != "2" {
+		t.Errorf("Key zoo was not stored on the second shard: got %q", got)
+	}
+	if got := getLocal(t, cluster[0].db, "apple"); got != "1" {
+		t.Errorf("Key apple was not stored on the first shard: got %q", got)
+	}
+
+	if v := respDo(t, rw, "INCR", "zoo"); v.Int != 3 {
+		t.Errorf("Unexpected INCR reply: got %d, want 3", v.Int)
+	}
+
+	v := respDo(t, rw, "MGET", "zoo", "apple", "missing", "zebra")
+	var got []string
+	for _, e := range v.Array {
+		got = append(got, string(e.Bulk))
+	}
+	if strings.Join(got, ",") != "3,1,,stripes" {
+		t.Errorf("Unexpected MGET reply: got %q", got)
+	}
+
+	v = respDo(t, rw, "KEYS", "*")
+	got = nil
+	for _, e := range v.Array {
+		got = append(got, string(e.Bulk))
+	}
+	if strings.Join(got, ",") != "apple,banana,zebra,zoo" {
+		t.Errorf("Unexpected KEYS reply: got %q", got)
+	}
+
+	var scanned []string
+	cursor := "0"
+	for i := 0; i < 10; i++ {
+		v := respDo(t, rw, "SCAN", cursor, "COUNT", "1")
+		for _, e := range v.Array[1].Array {
+			scanned = append(scanned, string(e.Bulk))
+		}
+		if cursor = string(v.Array[0].Bulk); cursor == "0" {
+			break
+		}
+	}
+	if strings.Join(scanned, ",") != "apple,banana,zebra,zoo" {
+		t.Errorf("Unexpected SCAN result: got %q (cursor %s)", scanned, cursor)
+	}
+
+	if v := respDo(t, rw, "DEL", "zebra", "apple", "missing"); v.Int != 2 {
+		t.Errorf("Unexpected DEL reply: got %d, want 2", v.Int)
+	}
+	if v := respDo(t, rw, "EXISTS", "zebra", "zoo"); v.Int != 1 {
+		t.Errorf("Unexpected EXISTS reply: got %d, want 1", v.Int)
+	}
+}
+
+func TestMemcacheForwarding(t *testing.T) {
+	cluster := startShards(t, 2, func(addrs map[int]string, idx int) *config.Shards {
+		return &config.Shards{Addrs: addrs, Count: len(addrs), CurIdx: idx, Splits: []string{"m"}}
+	})
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not listen: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go memcache.NewServer(cluster[0].db, cluster[0].srv).Serve(l)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("Could not connect: %v", err)
+	}
+	defer conn.Close()
+	rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+
+	do := func(request string) memcache.Response {
+		t.Helper()
+		rw.WriteString(request)
+		rw.Flush()
+		res, err := memcache.ReadResponse(rw.Reader)
+		if err != nil {
+			t.Fatalf("Could not read the response to %q: %v", request, err)
+		}
+		return res
+	}
+
+	for _, key := range []string{"zebra", "apple"} {
+		if res := do("set " + key + " 9 0 1\r\nv\r\n"); res.Status != "STORED" {
+			t.Errorf("Unexpected response to set %s: got %q, want STORED", key, res.Status)
+		}
+	}
+	if got := getLocal(t, cluster[1].db, "zebra"); got != "v" {
+		t.Errorf("Key zebra was not stored on the second shard: got %q", got)
+	}
+	if got := getLocal(t, cluster[0].db, "apple"); got != "v" {
+		t.Errorf("Key apple was not stored on the first shard: got %q", got)
+	}
+
+	res := do("gets zebra missing apple\r\n")
+	if len(res.Hits) != 2 || res.Hits[0].Key != "zebra" || res.Hits[1].Key != "apple" || res.Hits[0].Flags != 9 || res.Hits[0].Cas == 0 {
+		t.Fatalf("Unexpected response to gets: got %+v", res)
+	}
+	if res := do(fmt.Sprintf("cas zebra 0 0 1 %d\r\nw\r\n", res.Hits[0].Cas)); res.Status != "STORED" {
+		t.Errorf("Unexpected response to a forwarded cas: got %q, want STORED", res.Status)
+	}
+	if res := do("delete zebra\r\n"); res.Status != "DELETED" {
+		t.Errorf("Unexpected response to a forwarded delete: got %q, want DELETED", res.Status)
+	}
+}
+
+// multiResult is the response of /mget and /mset in a short form:
+// key=value, key:status or key!error for every key, joined by spaces.
+func multiResult(t *testing.T, u string, form url.Values) (int, string) {
+	t.Helper()
+
+	resp, err := http.PostForm(u, form)
+	if err != nil {
+		t.Fatalf("POST %q failed: %v", u, err)
+	}
+	defer resp.Body.Close()
+
+	var res struct {
+		Results []struct {
+			Key, Status, Error string
+			Value              *string
+		}
+		Failed int
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		t.Fatalf("Could not decode the response of %q: %v", u, err)
+	}
+
+	var parts []string
+	failed := 0
+	for _, r := range res.Results {
+		switch {
+		case r.Value != nil:
+			parts = append(parts, r.Key+"="+*r.Value)
+		case r.Error != "":
+			parts = append(parts, r.Key+"!error")
+			failed++
+		default:
+			parts = append(parts, r.Key+":"+r.Status)
+		}
+	}
+	if failed != res.Failed {
+		t.Errorf("Unexpected number of failed keys: got %d, want %d", res.Failed, failed)
+	}
+	return resp.StatusCode, strings.Join(parts, " ")
+}
+
+func TestMultiGetSet(t *testing.T) {
+	cluster := startShards(t, 2, func(addrs map[int]string, idx int) *config.Shards {
+		return &config.Shards{Addrs: addrs, Count: len(addrs), CurIdx: idx, Splits: []string{"m"}}
+	})
+
+	status, got := multiResult(t, cluster[0].url+"/mset", url.Values{
+		"key":   {"zebra", "apple", "zoo"},
+		"value": {"1", "2", "3"},
+	})
+	if status != http.StatusOK || got != "zebra:ok apple:ok zoo:ok" {
+		t.Errorf("Unexpected /mset response: got %d %q", status, got)
+	}
+	if got := getLocal(t, cluster[1].db, "zoo"); got != "3" {
+		t.Errorf("Key zoo was not stored on the second shard: got %q", got)
+	}
+
+	status, got = multiResult(t, cluster[1].url+"/mget", url.Values{"key": {"zoo", "missing", "apple", "zebra"}})
+	if status != http.StatusOK || got != "zoo=3 missing:not_found apple=2 zebra=1" {
+		t.Errorf("Unexpected /mget response: got %d %q", status, got)
+	}
+
+	if status, _ := httpGet(t, cluster[0].url+"/mset?key=a&key=b&value=1"); status != http.StatusBadRequest {
+		t.Errorf("Unexpected status for keys without values: got %d, want %d", status, http.StatusBadRequest)
+	}
+}
+
+func TestMultiGetPartialFailure(t *testing.T) {
+	cluster := startShards(t, 2, func(addrs map[int]string, idx int) *config.Shards {
+		// The first shard cannot reach the second one.
+		view := map[int]string{0: addrs[0], 1: "127.0.0.1:1"}
+		if idx == 1 {
+			view = addrs
+		}
+		return &config.Shards{Addrs: view, Count: len(addrs), CurIdx: idx, Splits: []string{"m"}}
+	})
+	if err := cluster[0].db.SetKey("apple", "default", []byte("1")); err != nil {
+		t.Fatalf("Could not set key: %v", err)
+	}
+
+	status, got := multiResult(t, cluster[0].url+"/mget", url.Values{"key": {"zebra", "apple", "zoo"}})
+	if status != http.StatusMultiStatus || got != "zebra!error apple=1 zoo!error" {
+		t.Errorf("Unexpected /mget response: got %d %q", status, got)
+	}
+}
+
+// runTxn posts the transaction and returns the status code and the
+// status of the transaction.
+func runTxn(t *testing.T, u, body string) (int, string) {
+	t.Helper()
+
+	resp, err := http.Post(u+"/txn", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("POST %q failed: %v", u, err)
+	}
+	defer resp.Body.Close()
+
+	var res struct{ Status string }
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		t.Fatalf("Could not decode the response of %q: %v", u, err)
+	}
+	return resp.StatusCode, res.Status
+}
+
+func TestTxn(t *testing.T) {
+	cluster := startShards(t, 2, func(addrs map[int]string, idx int) *config.Shards {
+		return &config.Shards{Addrs: addrs, Count: len(addrs), CurIdx: idx, Splits: []string{"m"}}
+	})
+	if err := cluster[1].db.SetKey("zoo", "default", []byte("1")); err != nil {
+		t.Fatalf("Could not set key: %v", err)
+	}
+
+	status, got := runTxn(t, cluster[0].url, `{"ops": [
+		{"op": "check", "key": "zoo", "if_value": "1"},
+		{"op": "set", "key": "apple", "value": "2", "if_missing": true},
+		{"op": "set", "key": "zebra", "value": "3"}
+	]}`)
+	if status != http.StatusOK || got != "committed" {
+		t.Errorf("Unexpected /txn response: got %d %q", status, got)
+	}
+	if got := getLocal(t, cluster[0].db, "apple"); got != "2" {
+		t.Errorf("Unexpected value of apple: got %q, want %q", got, "2")
+	}
+	if got := getLocal(t, cluster[1].db, "zebra"); got != "3" {
+		t.Errorf("Unexpected value of zebra: got %q, want %q", got, "3")
+	}
+
+	// A failed condition on one shard aborts the writes on the other.
+	status, got = runTxn(t, cluster[1].url, `{"ops": [
+		{"op": "delete", "key": "apple"},
+		{"op": "set", "key": "zoo", "value": "4", "if_value": "2"}
+	]}`)
+	if status != http.StatusPreconditionFailed || got != "aborted" {
+		t.Errorf("Unexpected /txn response for a failed condition: got %d %q", status, got)
+	}
+	if got := getLocal(t, cluster[0].db, "apple"); got != "2" {
+		t.Errorf("Unexpected value of apple after the abort: got %q, want %q", got, "2")
+	}
+	if status, body := httpGet(t, cluster[0].url+"/set?key=apple&value=5"); status != http.StatusOK {
+		t.Errorf("Could not set a key of an aborted transaction: got %d %q", status, body)
+	}
+
+	if status, _ := httpGet(t, cluster[0].url+"/txn"); status != http.StatusMethodNotAllowed {
+		t.Errorf("Unexpected status for GET /txn: got %d, want %d", status, http.StatusMethodNotAllowed)
+	}
+}
+
+func TestTxnRecovery(t *testing.T) {
+	cluster := startShards(t, 2, func(addrs map[int]string, idx int) *config.Shards {
+		return &config.Shards{Addrs: addrs, Count: len(addrs), CurIdx: idx, Splits: []string{"m"}}
+	})
+
+	addrs := []string{strings.TrimPrefix(cluster[0].url, "http://"), strings.TrimPrefix(cluster[1].url, "http://")}
+
+	// The first shard crashed while coordinating two transactions: the
+	// commit of one of them was recorded, the other one was left
+	// prepared without a decision.
+	for _, txn := range []db.PreparedTxn{
+		{ID: "committed", Coordinator: addrs[0], Bucket: "default", Ops: []db.TxnOp{{Op: db.Op{Key: "zebra", Value: []byte("1")}}}},
+		{ID: "aborted", Coordinator: addrs[0], Bucket: "default", Ops: []db.TxnOp{{Op: db.Op{Key: "zoo", Value: []byte("2")}}}},
+	} {
+		if err := cluster[1].db.Prepare(txn); err != nil {
+			t.Fatalf("Could not prepare %s: %v", txn.ID, err)
+		}
+	}
+	if err := cluster[0].db.LogDecision("committed", []string{addrs[1]}); err != nil {
+		t.Fatalf("Could not record the decision: %v", err)
+	}
+
+	if status, _ := httpGet(t, cluster[1].url+"/set?key=zoo&value=3"); status != http.StatusConflict {
+		t.Errorf("Unexpected status for a locked key: got %d, want %d", status, http.StatusConflict)
+	}
+
+	// A shard added in front renumbers the others before the recovery.
+	for i, c := range cluster {
+		c.srv.SetShards(&config.Shards{
+			Addrs:  map[int]string{0: "127.0.0.1:1", 1: addrs[0], 2: addrs[1]},
+			Count:  3,
+			CurIdx: i + 1,
+			Epoch:  1,
+			Splits: []string{"a", "m"},
+		})
+	}
+
+	if err := cluster[1].srv.ResolveTxns(0); err != nil {
+		t.Fatalf("Could not resolve the transactions: %v", err)
+	}
+	if got := getLocal(t, cluster[1].db, "zebra"); got != "1" {
+		t.Errorf("Unexpected value of zebra: got %q, want %q", got, "1")
+	}
+	if got := getLocal(t, cluster[1].db, "zoo"); got != "" {
+		t.Errorf("Unexpected value of zoo: got %q, want none", got)
+	}
+	if txns, err := cluster[1].db.PreparedTxns(); err != nil || len(txns) != 0 {
+		t.Errorf("Unexpected prepared transactions: got %+v, %v", txns, err)
+	}
+
+	// The coordinator forgets the decision once the participants committed.
+	if err := cluster[0].srv.ResolveTxns(0); err != nil {
+		t.Fatalf("Could not resolve the transactions: %v", err)
+	}
+	if decisions, err := cluster[0].db.Decisions(); err != nil || len(decisions) != 0 {
+		t.Errorf("Unexpected decisions: got %v, %v", decisions, err)
+	}
+}
+
+func TestTxnTimeout(t *testing.T) {
+	defer func(d time.Duration) { web.TxnTimeout = d }(web.TxnTimeout)
+	web.TxnTimeout = 100 * time.Millisecond
+
+	// The second shard never answers the prepare.
+	release := make(chan struct{})
+	hung := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	t.Cleanup(func() {
+		close(release)
+		hung.Close()
+	})
+	cluster := startShards(t, 1, func(addrs map[int]string, idx int) *config.Shards {
+		addrs[1] = strings.TrimPrefix(hung.URL, "http://")
+		return &config.Shards{Addrs: addrs, Count: len(addrs), CurIdx: idx, Splits: []string{"m"}}
+	})
+
+	start := time.Now()
+	status, got := runTxn(t, cluster[0].url, `{"ops": [
+		{"op": "set", "key": "apple", "value": "1"},
+		{"op": "set", "key": "zebra", "value": "2"}
+	]}`)
+	if status != http.StatusInternalServerError || got != "aborted" {
+		t.Errorf("Unexpected /txn response for a hung participant: got %d %q", status, got)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("The transaction took %v", elapsed)
+	}
+	if status, body := httpGet(t, cluster[0].url+"/set?key=apple&value=3"); status != http.StatusOK {
+		t.Errorf("Could not set a key of the aborted transaction: got %d %q", status, body)
+	}
+}
+
+func beginSession(t *testing.T, u string) string {
+	t.Helper()
+
+	resp, err := http.Post(u+"/session/begin", "", nil)
+	if err != nil {
+		t.Fatalf("POST %q failed: %v", u, err)
+	}
+	defer resp.Body.Close()
+
+	var res struct{ ID string }
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil || res.ID == "" {
+		t.Fatalf("Could not begin a session: %v", err)
+	}
+	return res.ID
+}
+
+func TestSessions(t *testing.T) {
+	cluster := startShards(t, 2, func(addrs map[int]string, idx int) *config.Shards {
+		return &config.Shards{Addrs: addrs, Count: len(addrs), CurIdx: idx, Splits: []string{"m"}}
+	})
+	u := cluster[0].url
+	if err := cluster[0].db.SetKey("apple", "default", []byte("1")); err != nil {
+		t.Fatalf("Could not set key: %v", err)
+	}
+
+	first := beginSession(t, u)
+	second := beginSession(t, u)
+
+	cases := []struct {
+		url    string
+		status int
+		body   string
+	}{
+		{"/session/set?id=" + first + "&key=banana&value=2", http.StatusOK, ""},
+		{"/session/get?id=" + first + "&key=banana", http.StatusOK, `"value":"2"`},
+		{"/session/get?id=" + second + "&key=banana", http.StatusNotFound, ""},
+		{"/get?key=banana", http.StatusNotFound, ""},
+		// The snapshot does not see the writes made after it.
+		{"/set?key=apple&value=3", http.StatusOK, ""},
+		{"/session/get?id=" + first + "&key=apple", http.StatusOK, `"value":"1"`},
+		{"/session/set?id=" + second + "&key=banana&value=4", http.StatusOK, ""},
+		{"/session/set?id=" + first + "&key=zebra&value=5", http.StatusMisdirectedRequest, ""},
+		{"/session/commit?id=" + first, http.StatusOK, ""},
+		{"/get?key=banana", http.StatusOK, `"2"`},
+		// The second session wrote the key committed by the first one.
+		{"/session/commit?id=" + second, http.StatusConflict, ""},
+		{"/session/get?id=" + second + "&key=banana", http.StatusNotFound, ""},
+		{"/session/get?id=unknown&key=banana", http.StatusNotFound, ""},
+	}
+	for _, c := range cases {
+		status, body := httpGet(t, u+c.url)
+		if status != c.status || !strings.Contains(body, c.body) {
+			t.Errorf("Unexpected response to %q: got %d %q, want %d %q", c.url, status, body, c.status, c.body)
+		}
+	}
+
+	third := beginSession(t, u)
+	if status, body := httpGet(t, u+"/session/delete?id="+third+"&key=apple"); status != http.StatusOK {
+		t.Fatalf("Could not delete in the session: got %d %q", status, body)
+	}
+	if status, body := httpGet(t, u+"/session/rollback?id="+third); status != http.StatusOK {
+		t.Fatalf("Could not roll back the session: got %d %q", status, body)
+	}
+	if got := getLocal(t, cluster[0].db, "apple"); got != "3" {
+		t.Errorf("Unexpected value of apple after the rollback: got %q, want %q", got, "3")
+	}
+}
+
+func TestMaxSessions(t *testing.T) {
+	cluster := startShards(t, 1, func(addrs map[int]string, idx int) *config.Shards {
+		return &config.Shards{Addrs: addrs, Count: len(addrs), CurIdx: idx}
+	})
+	u := cluster[0].url
+
+	var ids []string
+	for i := 0; i < web.MaxSessions; i++ {
+		ids = append(ids, beginSession(t, u))
+	}
+	if status, body := httpGet(t, u+"/session/begin"); status != http.StatusServiceUnavailable {
+		t.Errorf("Unexpected status beyond the session limit: got %d, want %d: %s", status, http.StatusServiceUnavailable, body)
+	}
+
+	httpGet(t, u+"/session/rollback?id="+ids[0])
+	for _, id := range append(ids[1:], beginSession(t, u)) {
+		httpGet(t, u+"/session/rollback?id="+id)
+	}
+}
+
+func TestSystemBuckets(t *testing.T) {
+	cluster := startShards(t, 1, func(addrs map[int]string, idx int) *config.Shards {
+		return &config.Shards{Addrs: addrs, Count: len(addrs), CurIdx: idx}
+	})
+	u := cluster[0].url
+	id := beginSession(t, u)
+	defer httpGet(t, u+"/session/rollback?id="+id)
+
+	for _, path := range []string{
+		"/get?bucketName=__flags&key=a",
+		"/set?bucketName=__txnlocks&key=a&value=b",
+		"/listKeys?bucketName=__expires",
+		"/scan?bucketName=__versions",
+		"/delete?bucketName=__txns&key=a",
+		"/delete?bucketName=__txns&prefix=a",
+		"/incr?bucketName=__flags&key=a",
+		"/type?bucketName=__flags&key=a",
+		"/cmd?bucketName=__flags&key=a&cmd=hget&arg=f",
+		"/mget?bucketName=__flags&key=a",
+		"/mset?bucketName=__flags&key=a&value=b",
+		"/session/get?id=" + id + "&bucketName=__flags&key=a",
+		"/session/set?id=" + id + "&bucketName=__flags&key=a&value=b",
+	} {
+		if status, body := httpGet(t, u+path); status != http.StatusBadRequest {
+			t.Errorf("Unexpected status for %q: got %d, want %d: %s", path, status, http.StatusBadRequest, body)
+		}
+	}
+
+	req, err := http.NewRequest(http.MethodDelete, u+"/v1/kv/__flags/a", nil)
+	if err != nil {
+		t.Fatalf("Could not create request: %v", err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("DELETE failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Unexpected status of DELETE: got %d, want %d", resp.StatusCode, http.StatusBadRequest)
+	}
+
+	for path, body := range map[string]string{
+		"/txn":                 "{\"bucket\": \"__txnlocks\", \"ops\": [{\"op\": \"set\", \"key\": \"a\", \"value\": \"b\"}]}",
+		"/resp?bucket=__flags": "*2\r\n$3\r\nGET\r\n$1\r\na\r\n",
+	} {
+		resp, err := http.Post(u+path, "", strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("POST %q failed: %v", path, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("Unexpected status for %q: got %d, want %d", path, resp.StatusCode, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestWebhookSecret(t *testing.T) {
+	d, closeFunc, err := db.OpenDatabase(filepath.Join(t.TempDir(), "shard.db"), db.Options{ChangeLog: true})
+	if err != nil {
+		t.Fatalf("Could not create a new database: %v", err)
+	}
+	defer closeFunc()
+
+	srv := web.NewServer(d, &config.Shards{Count: 1, Addrs: map[int]string{0: "localhost:0"}})
+	m, err := webhook.NewManager(d, 0, srv.Owns)
+	if err != nil {
+		t.Fatalf("Could not create the webhook manager: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go m.Run(ctx)
+	srv.SetWebhooks(m)
+
+	register := func(form url.Values) webhook.Hook {
+		t.Helper()
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, "/webhooks", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		srv.WebhooksHandler(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Could not register a webhook: %d %s", w.Code, w.Body)
+		}
+		var h webhook.Hook
+		if err := json.Unmarshal(w.Body.Bytes(), &h); err != nil {
+			t.Fatalf("Could not decode the webhook: %v", err)
+		}
+		return h
+	}
+
+	// A generated secret is returned once, a given one never.
+	generated := register(url.Values{"url": {"http://localhost:1/hook"}})
+	if len(generated.Secret) != 64 {
+		t.Errorf("Unexpected generated secret: got %q", generated.Secret)
+	}
+	if given := register(url.Values{"url": {"http://localhost:1/hook"}, "secret": {"s3cret"}}); given.Secret != "" {
+		t.Errorf("Unexpected secret in the response: got %q", given.Secret)
+	}
+
+	hooks, err := m.Hooks()
+	if err != nil {
+		t.Fatalf("Could not list the webhooks: %v", err)
+	}
+	for _, h := range hooks {
+		if h.ID == generated.ID && h.Secret != generated.Secret {
+			t.Errorf("Unexpected stored secret: got %q, want %q", h.Secret, generated.Secret)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	srv.WebhooksHandler(w, httptest.NewRequest(http.MethodGet, "/webhooks", nil))
+	if strings.Contains(w.Body.String(), generated.Secret) || strings.Contains(w.Body.String(), "s3cret") {
+		t.Errorf("Secrets listed: %s", w.Body)
+	}
+}
+
+func TestWebhookRollback(t *testing.T) {
+	d, closeFunc, err := db.OpenDatabase(filepath.Join(t.TempDir(), "shard.db"), db.Options{ChangeLog: true})
+	if err != nil {
+		t.Fatalf("Could not create a new database: %v", err)
+	}
+	defer closeFunc()
+
+	// Shard 1 accepts everything and shard 2 fails.
+	var mu sync.Mutex
+	var paths []string
+	ok := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		paths = append(paths, r.URL.Path)
+		mu.Unlock()
+	}))
+	defer ok.Close()
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer failing.Close()
+
+	srv := web.NewServer(d, &config.Shards{Count: 3, Addrs: map[int]string{
+		0: "localhost:0",
+		1: strings.TrimPrefix(ok.URL, "http://"),
+		2: strings.TrimPrefix(failing.URL, "http://"),
+	}})
+	m, err := webhook.NewManager(d, 0, srv.Owns)
+	if err != nil {
+		t.Fatalf("Could not create the webhook manager: %v", err)
+	}
+	srv.SetWebhooks(m)
+
+	form := url.Values{"url": {"http://localhost:1/hook"}}
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/webhooks", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	srv.WebhooksHandler(w, r)
+	if w.Code != http.StatusInternalServerError || !strings.Contains(w.Body.String(), "shard 2") {
+		t.Fatalf("Unexpected response: %d %s", w.Code, w.Body)
+	}
+
+	hooks, err := m.Hooks()
+	if err != nil {
+		t.Fatalf("Could not list the webhooks: %v", err)
+	}
+	if len(hooks) != 0 {
+		t.Errorf("Unexpected webhooks after the rollback: %+v", hooks)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if want := []string{"/webhooks", "/webhooks/delete"}; !reflect.DeepEqual(paths, want) {
+		t.Errorf("Unexpected requests to shard 1: got %v, want %v", paths, want)
+	}
+}
+
+// writeCert writes a self-signed certificate for 127.0.0.1.
+func writeCert(t *testing.T) config.TLSConfig {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Could not generate a key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "kvdb"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Could not create the certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Could not encode the key: %v", err)
+	}
+
+	dir := t.TempDir()
+	c := config.TLSConfig{CertFile: filepath.Join(dir, "cert.pem"), KeyFile: filepath.Join(dir, "key.pem")}
+	if err := os.WriteFile(c.CertFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatalf("Could not write the certificate: %v", err)
+	}
+	if err := os.WriteFile(c.KeyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatalf("Could not write the key: %v", err)
+	}
+	return c
+}
+
+func TestTLSForwarding(t *testing.T) {
+	tlsConfig := writeCert(t)
+	cert, err := tls.LoadX509KeyPair(tlsConfig.CertFile, tlsConfig.KeyFile)
+	if err != nil {
+		t.Fatalf("Could not load the certificate: %v", err)
+	}
+	client, err := config.NewClient(tlsConfig)
+	if err != nil {
+		t.Fatalf("Could not create the client: %v", err)
+	}
+
+	servers := make([]*web.Server, 2)
+	addrs := make(map[int]string)
+	urls := make([]string, 2)
+	for i := range servers {
+		i := i
+		ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/get":
+				servers[i].GetHandler(w, r)
+			case "/set":
+				servers[i].SetHandler(w, r)
+			default:
+				http.NotFound(w, r)
+			}
+		}))
+		ts.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+		ts.StartTLS()
+		t.Cleanup(ts.Close)
+
+		urls[i] = ts.URL
+		addrs[i] = strings.TrimPrefix(ts.URL, "https://")
+	}
+
+	dbs := make([]*db.Database, 2)
+	for i := range servers {
+		dbs[i] = createShardDb(t, i)
+		servers[i] = web.NewServer(dbs[i], &config.Shards{Addrs: addrs, Count: 2, CurIdx: i})
+		servers[i].SetClient(client)
+	}
+
+	// "Soviet" belongs to shard 1, so shard 0 forwards both requests.
+	get := func(u string) (int, string) {
+		t.Helper()
+		resp, err := client.Get(u)
+		if err != nil {
+			t.Fatalf("GET %q failed: %v", u, err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+	if code, body := get(urls[0] + "/set?key=Soviet&value=Moscow"); code != http.StatusOK {
+		t.Fatalf("Could not set the key through shard 0: %d %s", code, body)
+	}
+	if got := getLocal(t, dbs[1], "Soviet"); got != "Moscow" {
+		t.Errorf("Unexpected value on shard 1: got %q, want %q", got, "Moscow")
+	}
+	if code, body := get(urls[0] + "/get?key=Soviet"); code != http.StatusOK || !strings.Contains(body, "Moscow") {
+		t.Errorf("Unexpected forwarded get: %d %s", code, body)
+	}
+}
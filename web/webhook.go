@@ -0,0 +1,216 @@
+package web
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go-kvdb/webhook"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// SetWebhooks enables the webhook endpoints with the manager of the shard.
+func (s *Server) SetWebhooks(m *webhook.Manager) {
+	s.hooks = m
+}
+
+// WebhooksHandler lists the registered webhooks on GET and registers
+// a new one on POST. A hook is registered with the bucket, prefix, url
+// and secret parameters on every shard, each of which delivers the
+// changes of its own keys. Without a secret a random one is generated and
+// returned in the registration response, which is the only time a secret
+// is ever returned.
+// If a shard fails to register the hook, it is removed from the others
+// again and the response names the shards it could not be removed from.
+func (s *Server) WebhooksHandler(w http.ResponseWriter, r *http.Request) {
+	if s.hooks == nil {
+		http.Error(w, "Webhooks require the change log", http.StatusNotImplemented)
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		hooks, err := s.hooks.Hooks()
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error listing webhooks: %v", err), http.StatusInternalServerError)
+			return
+		}
+		for i := range hooks {
+			hooks[i].Secret = ""
+		}
+		writeJSON(w, hooks)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Error parsing form", http.StatusBadRequest)
+		return
+	}
+
+	h := webhook.Hook{
+		ID:      r.Form.Get("id"),
+		Bucket:  r.Form.Get("bucket"),
+		Prefix:  r.Form.Get("prefix"),
+		URL:     r.Form.Get("url"),
+		Secret:  r.Form.Get("secret"),
+		Created: time.Now().UTC(),
+	}
+	if h.Bucket == "" {
+		h.Bucket = "default"
+	}
+
+	local := r.Form.Get("local") == "true"
+	if !local {
+		id, err := webhook.NewID()
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error registering webhook: %v", err), http.StatusInternalServerError)
+			return
+		}
+		h.ID = id
+	}
+	generated := false
+	if !local && h.Secret == "" {
+		secret, err := webhook.NewSecret()
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error registering webhook: %v", err), http.StatusInternalServerError)
+			return
+		}
+		h.Secret = secret
+		generated = true
+	}
+
+	if err := h.Validate(); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid webhook: %v", err), http.StatusBadRequest)
+		return
+	}
+	if err := s.hooks.Register(h); err != nil {
+		http.Error(w, fmt.Sprintf("Error registering webhook: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	if !local {
+		form := url.Values{}
+		for k, v := range r.Form {
+			form[k] = v
+		}
+		form.Set("id", h.ID)
+		form.Set("secret", h.Secret)
+		form.Set("local", "true")
+
+		if done, err := s.onOtherShards("/webhooks", form); err != nil {
+			// Roll back, so that the hook is not left on some shards only.
+			msg := fmt.Sprintf("Error registering webhook %s: %v", h.ID, err)
+			undo := url.Values{"id": {h.ID}, "local": {"true"}}
+			shards := s.Shards()
+			var failed []int
+			if err := s.hooks.Remove(h.ID); err != nil {
+				failed = append(failed, shards.CurIdx)
+			}
+			for _, idx := range done {
+				if err := s.postForm(shards, shards.Addrs[idx], "/webhooks/delete", undo); err != nil {
+					failed = append(failed, idx)
+				}
+			}
+			if len(failed) > 0 {
+				msg += fmt.Sprintf("; it could not be removed again from shards %v", failed)
+			}
+			http.Error(w, msg, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if !generated {
+		h.Secret = ""
+	}
+	writeJSON(w, h)
+}
+
+// DeleteWebhookHandler removes the webhook with the id parameter from
+// every shard. Its dead letters are kept.
+func (s *Server) DeleteWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	if s.hooks == nil {
+		http.Error(w, "Webhooks require the change log", http.StatusNotImplemented)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Error parsing form", http.StatusBadRequest)
+		return
+	}
+
+	id := r.Form.Get("id")
+	if id == "" {
+		http.Error(w, "id parameter is required", http.StatusBadRequest)
+		return
+	}
+
+	local := r.Form.Get("local") == "true"
+	err := s.hooks.Remove(id)
+	switch {
+	case errors.Is(err, webhook.ErrUnknownHook) && !local:
+		http.Error(w, fmt.Sprintf("Webhook %s not found", id), http.StatusNotFound)
+		return
+	case err != nil && !errors.Is(err, webhook.ErrUnknownHook):
+		http.Error(w, fmt.Sprintf("Error deleting webhook: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	if !local {
+		form := url.Values{"id": {id}, "local": {"true"}}
+		if done, err := s.onOtherShards("/webhooks/delete", form); err != nil {
+			done = append([]int{s.Shards().CurIdx}, done...)
+			http.Error(w, fmt.Sprintf("Error deleting webhook %s: %v; it was deleted from shards %v", id, err, done), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	fmt.Fprintf(w, "Successfully deleted webhook %s", id)
+}
+
+// DeadLettersHandler lists the changes of the current shard
+// that could not be delivered to their webhooks.
+func (s *Server) DeadLettersHandler(w http.ResponseWriter, r *http.Request) {
+	if s.hooks == nil {
+		http.Error(w, "Webhooks require the change log", http.StatusNotImplemented)
+		return
+	}
+
+	letters, err := s.hooks.DeadLetters()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error listing dead letters: %v", err), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, letters)
+}
+
+// onOtherShards posts the form to the path on every other shard, even
+// after a failure. It returns the indexes of the shards that accepted the
+// form and an error naming the ones that did not.
+func (s *Server) onOtherShards(path string, form url.Values) ([]int, error) {
+	shards := s.Shards()
+	var done []int
+	var errs []error
+	for idx, addr := range shards.Addrs {
+		if idx == shards.CurIdx {
+			continue
+		}
+		if err := s.postForm(shards, addr, path, form); err != nil {
+			errs = append(errs, fmt.Errorf("shard %d: %w", idx, err))
+			continue
+		}
+		done = append(done, idx)
+	}
+	return done, errors.Join(errs...)
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
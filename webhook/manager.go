@@ -0,0 +1,375 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go-kvdb/config"
+	"go-kvdb/db"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Delivery defaults.
+const (
+	DefaultAttempts   = 5
+	DefaultMinBackoff = time.Second
+	DefaultMaxBackoff = time.Minute
+	DefaultTimeout    = 10 * time.Second
+)
+
+// ErrUnknownHook is returned when removing a hook that is not registered.
+var ErrUnknownHook = errors.New("unknown webhook")
+
+// Manager delivers the changes of a shard to the registered hooks.
+//
+// Every hook has its own worker that follows the change log from the
+// cursor of the hook, so a slow or failing endpoint only delays its own
+// deliveries. The changes are delivered in order and at least once: the
+// cursor is stored after the delivery, so a change may be sent again after
+// a restart. A change that still fails after all attempts is stored in the
+// dead letters and the worker moves on.
+type Manager struct {
+	store   db.Store
+	watcher db.Watcher
+	shard   int
+	owns    func(bucketName, key string) bool
+
+	// Client sends the deliveries.
+	Client *http.Client
+	// Attempts is the number of tries before a change goes to the dead
+	// letters. The delay between them doubles from MinBackoff up to MaxBackoff.
+	Attempts   int
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	mu      sync.Mutex
+	ctx     context.Context
+	workers map[string]context.CancelFunc
+	wg      sync.WaitGroup
+}
+
+// NewManager returns the manager of the hooks stored in the store, which
+// must have the change log enabled. owns reports whether the key belongs
+// to the shard, so that the keys purged by the shard after a resharding
+// are not reported as deleted.
+func NewManager(store db.Store, shard int, owns func(bucketName, key string) bool) (*Manager, error) {
+	watcher, ok := store.(db.Watcher)
+	if !ok {
+		return nil, fmt.Errorf("the storage engine does not support watching")
+	}
+	if _, err := watcher.LastSeq(); err != nil {
+		return nil, err
+	}
+
+	for _, bucketName := range []string{Bucket, DeadLetterBucket} {
+		if err := store.CreateBucketIfNotExists(bucketName); err != nil {
+			return nil, fmt.Errorf("creating bucket %s: %w", bucketName, err)
+		}
+	}
+
+	return &Manager{
+		store:      store,
+		watcher:    watcher,
+		shard:      shard,
+		owns:       owns,
+		Client:     &http.Client{Timeout: DefaultTimeout},
+		Attempts:   DefaultAttempts,
+		MinBackoff: DefaultMinBackoff,
+		MaxBackoff: DefaultMaxBackoff,
+		workers:    make(map[string]context.CancelFunc),
+	}, nil
+}
+
+// Run delivers the changes to the registered hooks until ctx is done
+// and waits for the workers to stop.
+func (m *Manager) Run(ctx context.Context) error {
+	m.mu.Lock()
+	m.ctx = ctx
+	m.mu.Unlock()
+
+	if err := m.sync(); err != nil {
+		return err
+	}
+
+	<-ctx.Done()
+	m.wg.Wait()
+	return nil
+}
+
+// sync starts the workers of the new hooks and stops those of the
+// removed ones. It does nothing before Run.
+func (m *Manager) sync() error {
+	hooks, err := m.Hooks()
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.ctx == nil || m.ctx.Err() != nil {
+		return nil
+	}
+
+	registered := make(map[string]bool)
+	for _, h := range hooks {
+		registered[h.ID] = true
+		if _, ok := m.workers[h.ID]; ok {
+			continue
+		}
+
+		ctx, cancel := context.WithCancel(m.ctx)
+		m.workers[h.ID] = cancel
+		m.wg.Add(1)
+		go func(h Hook) {
+			defer m.wg.Done()
+			m.work(ctx, h)
+		}(h)
+	}
+
+	for id, cancel := range m.workers {
+		if !registered[id] {
+			cancel()
+			delete(m.workers, id)
+		}
+	}
+	return nil
+}
+
+// Register stores the hook and starts delivering the changes
+// committed from now on to it.
+func (m *Manager) Register(h Hook) error {
+	if err := h.Validate(); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(h)
+	if err != nil {
+		return err
+	}
+	last, err := m.watcher.LastSeq()
+	if err != nil {
+		return err
+	}
+
+	// The cursor goes first, so that a hook never starts without one.
+	if err := m.setCursor(h.ID, last); err != nil {
+		return err
+	}
+	if err := m.store.SetKey(hookPrefix+h.ID, Bucket, data); err != nil {
+		return err
+	}
+	return m.sync()
+}
+
+// Remove stops the deliveries to the hook and removes it.
+// Its dead letters are kept.
+func (m *Manager) Remove(id string) error {
+	v, err := m.store.GetKey(hookPrefix+id, Bucket)
+	if err != nil {
+		return err
+	}
+	if v == nil {
+		return ErrUnknownHook
+	}
+
+	err = m.store.Batch(Bucket, []db.Op{
+		{Key: hookPrefix + id, Delete: true},
+		{Key: cursorPrefix + id, Delete: true},
+	})
+	if err != nil {
+		return err
+	}
+	if err := m.watcher.DeleteCursor(cursorPrefix + id); err != nil {
+		return err
+	}
+	return m.sync()
+}
+
+// Hooks returns the registered hooks ordered by ID.
+func (m *Manager) Hooks() ([]Hook, error) {
+	start, end := config.PrefixRange(hookPrefix)
+	keys, err := m.store.ScanKeys(Bucket, start, end)
+	if err != nil {
+		return nil, err
+	}
+
+	var hooks []Hook
+	for _, k := range keys {
+		v, err := m.store.GetKey(k, Bucket)
+		if err != nil {
+			return nil, err
+		}
+		if v == nil {
+			continue
+		}
+
+		var h Hook
+		if err := json.Unmarshal(v, &h); err != nil {
+			return nil, fmt.Errorf("decoding hook %s: %w", k, err)
+		}
+		hooks = append(hooks, h)
+	}
+	return hooks, nil
+}
+
+// DeadLetters returns the changes that could not be delivered,
+// ordered by hook and sequence number.
+func (m *Manager) DeadLetters() ([]DeadLetter, error) {
+	var letters []DeadLetter
+	err := db.Walk(m.store, DeadLetterBucket, func(key string, value []byte) error {
+		var l DeadLetter
+		if err := json.Unmarshal(value, &l); err != nil {
+			return fmt.Errorf("decoding dead letter %s: %w", key, err)
+		}
+		letters = append(letters, l)
+		return nil
+	})
+	return letters, err
+}
+
+// cursor returns the sequence number of the last change handled for the
+// hook. Cursors used to be stored in Bucket, which is still read for the
+// hooks registered before.
+func (m *Manager) cursor(id string) (uint64, error) {
+	seq, ok, err := m.watcher.Cursor(cursorPrefix + id)
+	if err != nil || ok {
+		return seq, err
+	}
+
+	v, err := m.store.GetKey(cursorPrefix+id, Bucket)
+	if err != nil {
+		return 0, err
+	}
+	if v == nil {
+		return m.watcher.LastSeq()
+	}
+	return strconv.ParseUint(string(v), 10, 64)
+}
+
+// setCursor stores the cursor of the hook outside of the change log, so
+// that it does not wake up the workers of the other hooks.
+func (m *Manager) setCursor(id string, seq uint64) error {
+	return m.watcher.SetCursor(cursorPrefix+id, seq)
+}
+
+// work delivers the changes to the hook until ctx is done. Only the
+// delivered changes move the stored cursor, which costs a write each.
+func (m *Manager) work(ctx context.Context, h Hook) {
+	for {
+		cursor, err := m.cursor(h.ID)
+		if err == nil {
+			err = m.watcher.Watch(ctx, cursor, func(rec db.LogRecord) error {
+				if !h.matches(rec) || !m.owns(rec.Bucket, rec.Key) {
+					return nil
+				}
+				if err := m.deliver(ctx, h, rec); err != nil {
+					return err
+				}
+				// A removed hook must not leave its cursor behind.
+				if err := ctx.Err(); err != nil {
+					return err
+				}
+				return m.setCursor(h.ID, rec.Seq)
+			})
+		}
+		if ctx.Err() != nil {
+			return
+		}
+
+		if errors.Is(err, db.ErrUnknownSeq) {
+			var last uint64
+			if last, err = m.watcher.LastSeq(); err == nil {
+				log.Printf("Webhook %s: changes after %d are no longer in the change log, skipping to %d", h.ID, cursor, last)
+				if err = m.setCursor(h.ID, last); err == nil {
+					continue
+				}
+			}
+		}
+
+		log.Printf("Webhook %s: %v", h.ID, err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(m.MaxBackoff):
+		}
+	}
+}
+
+// deliver posts the change to the hook, retrying with exponential backoff,
+// and stores it in the dead letters if all attempts fail. It only returns
+// an error if ctx is done or the dead letter cannot be stored.
+func (m *Manager) deliver(ctx context.Context, h Hook, rec db.LogRecord) error {
+	ev := NewEvent(rec)
+	body, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+
+	backoff := m.MinBackoff
+	attempt := 1
+	for ; ; attempt++ {
+		if err = m.post(ctx, h, rec, body); err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if attempt >= m.Attempts {
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff = min(2*backoff, m.MaxBackoff)
+	}
+
+	log.Printf("Webhook %s: giving up on change %d after %d attempts: %v", h.ID, rec.Seq, attempt, err)
+	data, err := json.Marshal(DeadLetter{
+		Hook:     h.ID,
+		URL:      h.URL,
+		Event:    ev,
+		Attempts: attempt,
+		Error:    err.Error(),
+		Time:     time.Now().UTC(),
+	})
+	if err != nil {
+		return err
+	}
+	return m.store.SetKey(deadLetterKey(h.ID, rec.Seq), DeadLetterBucket, data)
+}
+
+func (m *Manager) post(ctx context.Context, h Hook, rec db.LogRecord, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(EventHeader, rec.Op)
+	req.Header.Set(DeliveryHeader, fmt.Sprintf("%d.%d", m.shard, rec.Seq))
+	if h.Secret != "" {
+		req.Header.Set(SignatureHeader, Sign(h.Secret, body))
+	}
+
+	resp, err := m.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s", resp.Status)
+	}
+	return nil
+}
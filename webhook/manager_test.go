@@ -0,0 +1,167 @@
+package webhook_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"go-kvdb/db"
+	"go-kvdb/webhook"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type delivery struct {
+	header http.Header
+	body   []byte
+}
+
+func startManager(t *testing.T) (*db.Database, *webhook.Manager) {
+	t.Helper()
+
+	d, closeFunc, err := db.OpenDatabase(filepath.Join(t.TempDir(), "shard.db"), db.Options{ChangeLog: true})
+	if err != nil {
+		t.Fatalf("Could not create a new database: %v", err)
+	}
+	t.Cleanup(func() { closeFunc() })
+
+	m, err := webhook.NewManager(d, 0, func(string, string) bool { return true })
+	if err != nil {
+		t.Fatalf("Could not create the webhook manager: %v", err)
+	}
+	m.Attempts = 3
+	m.MinBackoff = time.Millisecond
+	m.MaxBackoff = 5 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		m.Run(ctx)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return d, m
+}
+
+func TestDelivery(t *testing.T) {
+	d, m := startManager(t)
+
+	var calls atomic.Int32
+	deliveries := make(chan delivery, 10)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The first attempt fails and has to be retried.
+		if calls.Add(1) == 1 {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		deliveries <- delivery{r.Header, body}
+	}))
+	defer ts.Close()
+
+	hook := webhook.Hook{ID: "h1", Bucket: "default", Prefix: "config/", URL: ts.URL, Secret: "s3cret"}
+	if err := m.Register(hook); err != nil {
+		t.Fatalf("Could not register the webhook: %v", err)
+	}
+
+	if err := d.SetKey("other", "default", []byte("ignored")); err != nil {
+		t.Fatalf("Could not set key: %v", err)
+	}
+	if err := d.SetKey("config/timeout", "default", []byte("10s")); err != nil {
+		t.Fatalf("Could not set key: %v", err)
+	}
+
+	var got delivery
+	select {
+	case got = <-deliveries:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("The change was not delivered")
+	}
+
+	if !webhook.Verify(hook.Secret, got.body, got.header.Get(webhook.SignatureHeader)) {
+		t.Errorf("Invalid signature %q", got.header.Get(webhook.SignatureHeader))
+	}
+	if ev := got.header.Get(webhook.EventHeader); ev != db.ChangeSet {
+		t.Errorf("Unexpected event header: got %q, want %q", ev, db.ChangeSet)
+	}
+
+	var ev webhook.Event
+	if err := json.Unmarshal(got.body, &ev); err != nil {
+		t.Fatalf("Could not decode the event: %v", err)
+	}
+	if ev.Key != "config/timeout" || ev.Value == nil || *ev.Value != "10s" {
+		t.Errorf("Unexpected event: %+v", ev)
+	}
+	if n := calls.Load(); n != 2 {
+		t.Errorf("Unexpected number of attempts: got %d, want 2", n)
+	}
+
+	// Moving the cursor past the delivered change does not log a change,
+	// so the last sequence number stays that of the delivered one.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		seq, ok, err := d.Cursor("cursor/" + hook.ID)
+		if err != nil {
+			t.Fatalf("Could not get the cursor: %v", err)
+		}
+		if ok && seq == ev.Seq {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("The cursor did not move to %d: got %d", ev.Seq, seq)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if last, err := d.LastSeq(); err != nil || last != ev.Seq {
+		t.Errorf("Unexpected last sequence number: got %d, %v, want %d", last, err, ev.Seq)
+	}
+
+	if err := m.Remove(hook.ID); err != nil {
+		t.Fatalf("Could not remove the webhook: %v", err)
+	}
+	if err := m.Remove(hook.ID); !errors.Is(err, webhook.ErrUnknownHook) {
+		t.Errorf("Unexpected error removing the webhook twice: got %v, want %v", err, webhook.ErrUnknownHook)
+	}
+}
+
+func TestDeadLetter(t *testing.T) {
+	d, m := startManager(t)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "broken", http.StatusInternalServerError)
+	}))
+	defer ts.Close()
+
+	if err := m.Register(webhook.Hook{ID: "h1", Bucket: "default", URL: ts.URL}); err != nil {
+		t.Fatalf("Could not register the webhook: %v", err)
+	}
+	if err := d.DelKey("default", "gone"); err != nil {
+		t.Fatalf("Could not delete key: %v", err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		letters, err := m.DeadLetters()
+		if err != nil {
+			t.Fatalf("Could not list the dead letters: %v", err)
+		}
+		if len(letters) > 0 {
+			l := letters[0]
+			if l.Hook != "h1" || l.Attempts != 3 || l.Event.Op != db.ChangeDelete || l.Event.Key != "gone" {
+				t.Errorf("Unexpected dead letter: %+v", l)
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("The failed delivery did not reach the dead letters")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
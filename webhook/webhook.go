@@ -0,0 +1,169 @@
+// Package webhook posts the key changes of a shard to the registered
+// HTTP endpoints.
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"go-kvdb/db"
+	"net/url"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// System buckets of the webhooks. Every shard keeps a copy of the
+// registered hooks and its own delivery cursors and dead letters.
+const (
+	Bucket           = db.SystemPrefix + "webhooks"
+	DeadLetterBucket = db.SystemPrefix + "deadletters"
+)
+
+// Keys of the hooks in Bucket. The cursors are stored with the
+// db.Watcher under the cursor prefix and the ID of the hook, and
+// in Bucket by older versions.
+const (
+	hookPrefix   = "hook/"
+	cursorPrefix = "cursor/"
+)
+
+// Headers of the deliveries.
+const (
+	// SignatureHeader holds "sha256=" and the hex encoded HMAC-SHA256
+	// of the body keyed with the secret of the hook.
+	SignatureHeader = "X-Kvdb-Signature"
+	// EventHeader holds the operation of the change.
+	EventHeader = "X-Kvdb-Event"
+	// DeliveryHeader identifies the change as "<shard>.<seq>", which is
+	// the same for all the attempts to deliver it.
+	DeliveryHeader = "X-Kvdb-Delivery"
+)
+
+// Hook is a registered webhook. It receives the sets and deletes of the
+// keys with the prefix in the bucket.
+type Hook struct {
+	ID      string    `json:"id"`
+	Bucket  string    `json:"bucket"`
+	Prefix  string    `json:"prefix,omitempty"`
+	URL     string    `json:"url"`
+	Secret  string    `json:"secret,omitempty"`
+	Created time.Time `json:"created"`
+}
+
+// Validate checks the hook before it is registered.
+func (h Hook) Validate() error {
+	if h.ID == "" {
+		return fmt.Errorf("id must be set")
+	}
+	if h.Bucket == "" {
+		return fmt.Errorf("bucket must be set")
+	}
+	if db.IsSystemBucket(h.Bucket) {
+		return fmt.Errorf("cannot watch the system bucket %s", h.Bucket)
+	}
+
+	u, err := url.Parse(h.URL)
+	if err != nil {
+		return fmt.Errorf("invalid url %q: %v", h.URL, err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("url %q must be an http or https URL", h.URL)
+	}
+	return nil
+}
+
+// matches reports whether the change must be delivered to the hook.
+func (h Hook) matches(rec db.LogRecord) bool {
+	if rec.Bucket != h.Bucket {
+		return false
+	}
+	if rec.Op != db.ChangeSet && rec.Op != db.ChangeDelete {
+		return false
+	}
+	return strings.HasPrefix(rec.Key, h.Prefix)
+}
+
+// NewID returns a random hook ID.
+func NewID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// NewSecret returns a random secret to sign the deliveries with.
+func NewSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Event is a change as sent to the watchers and webhooks. The sequence
+// number is the version of the change in the change log of the shard;
+// values are base64 encoded if they are not UTF-8. Changes of typed
+// values only carry the name of the command.
+type Event struct {
+	Seq         uint64    `json:"seq"`
+	Time        time.Time `json:"time"`
+	Op          string    `json:"op"`
+	Bucket      string    `json:"bucket"`
+	Key         string    `json:"key,omitempty"`
+	Value       *string   `json:"value,omitempty"`
+	ValueBase64 *string   `json:"value_base64,omitempty"`
+	Command     string    `json:"command,omitempty"`
+}
+
+// NewEvent returns the event of the change log record.
+func NewEvent(rec db.LogRecord) Event {
+	ev := Event{Seq: rec.Seq, Time: rec.Time, Op: rec.Op, Bucket: rec.Bucket, Key: rec.Key}
+	if rec.Op == db.ChangeSet {
+		if utf8.Valid(rec.Value) {
+			v := string(rec.Value)
+			ev.Value = &v
+		} else {
+			v := base64.StdEncoding.EncodeToString(rec.Value)
+			ev.ValueBase64 = &v
+		}
+	}
+	if rec.Op == db.ChangeTyped {
+		var cmd db.Cmd
+		if json.Unmarshal(rec.Value, &cmd) == nil {
+			ev.Command = cmd.Name
+		}
+	}
+	return ev
+}
+
+// Sign returns the signature header value of the body.
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify reports whether the signature header value matches the body.
+func Verify(secret string, body []byte, signature string) bool {
+	return hmac.Equal([]byte(Sign(secret, body)), []byte(signature))
+}
+
+// DeadLetter is a change that could not be delivered to a hook.
+type DeadLetter struct {
+	Hook     string    `json:"hook"`
+	URL      string    `json:"url"`
+	Event    Event     `json:"event"`
+	Attempts int       `json:"attempts"`
+	Error    string    `json:"error"`
+	Time     time.Time `json:"time"`
+}
+
+func deadLetterKey(hookID string, seq uint64) string {
+	return fmt.Sprintf("%s/%020d", hookID, seq)
+}
@@ -0,0 +1,41 @@
+package webhook_test
+
+import (
+	"go-kvdb/db"
+	"go-kvdb/webhook"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	cases := []struct {
+		hook  webhook.Hook
+		valid bool
+	}{
+		{webhook.Hook{ID: "a", Bucket: "default", URL: "https://example.com/hook"}, true},
+		{webhook.Hook{ID: "a", Bucket: "default", URL: "ftp://example.com/hook"}, false},
+		{webhook.Hook{ID: "a", Bucket: "default", URL: "/relative"}, false},
+		{webhook.Hook{ID: "a", Bucket: db.SystemPrefix + "webhooks", URL: "http://example.com"}, false},
+		{webhook.Hook{Bucket: "default", URL: "http://example.com"}, false},
+	}
+
+	for _, c := range cases {
+		if err := c.hook.Validate(); (err == nil) != c.valid {
+			t.Errorf("Unexpected validation of %+v: got %v, want valid %v", c.hook, err, c.valid)
+		}
+	}
+}
+
+func TestSign(t *testing.T) {
+	body := []byte(`{"seq":1}`)
+	sig := webhook.Sign("secret", body)
+
+	if !webhook.Verify("secret", body, sig) {
+		t.Errorf("Signature %q does not verify", sig)
+	}
+	if webhook.Verify("other", body, sig) {
+		t.Errorf("Signature %q verifies with the wrong secret", sig)
+	}
+	if webhook.Verify("secret", []byte(`{"seq":2}`), sig) {
+		t.Errorf("Signature %q verifies a different body", sig)
+	}
+}